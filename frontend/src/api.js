@@ -0,0 +1,19 @@
+// Anything that changes something on the server has to be a POST, with the CSRF token the server leaves in a cookie.
+export function send(url, options = {}) {
+	let token = ""
+	for (let c of document.cookie.split(";")) {
+		let [name, value] = c.trim().split("=")
+		if (name == "rsn2-csrf") {
+			token = decodeURIComponent(value)
+		}
+	}
+
+	return fetch(url, {
+		...options,
+		method: options.method || "POST",
+		headers: {
+			...options.headers,
+			"X-CSRF-Token": token
+		}
+	})
+}
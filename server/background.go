@@ -22,11 +22,17 @@ misrepresented as being the original software.
 
 package main
 
+import "sync"
 import "time"
+import "sync/atomic"
 
 import "github.com/mmcdole/gofeed"
 
-var fp = gofeed.NewParser()
+// When the last update cycle finished, as a unix time. Use sync/atomic to access.
+var LastRefresh int64
+
+// Pushed content can arrive while the background process is working on the same feed.
+var ingestLock sync.Mutex
 
 func Background() {
 	l := ml
@@ -36,58 +42,99 @@ func Background() {
 	for {
 		l.I.Println("Starting update cycle.")
 
-		updated := map[string]bool{}
+		updated := map[string][]string{}
 
 		// For every single feed in the DB
 		feeds := GetAllFeeds(l)
 		if feeds == nil {
 			continue
 		}
+		pushed := WebSubPollSkip(l)
 		for _, data := range feeds {
 			// Check if there are new items
 			url, feed := data[0], data[1]
-
-			f, err := fp.ParseURL(url)
-			if err != nil {
-				l.E.Printf("Error loading feed %v (%v), error: %v\n", feed, url, err)
-				if f != nil {
-					l.I.Printf("%#v\n", f)
-				}
+			if pushed[feed] {
 				continue
 			}
-			for _, item := range f.Items {
-				// Check if we know of the item
-
-				exists, ok := ArticleExists(l, item.Link)
-				if !ok || exists {
-					continue
-				}
-
-				t := item.PublishedParsed
-				if t == nil {
-					t = item.UpdatedParsed
-					if t == nil {
-						t2 := time.Now()
-						t = &t2
-					}
-				}
-
-				ArticleAdd(l, feed, item.Title, item.Link, *t)
-
-				users := FeedListSubs(l, feed)
-				if users == nil {
-					continue
-				}
-				for _, user := range users {
-					updated[user] = true
-				}
-			}
+			FeedUpdate(l, feed, url, updated)
 		}
 
+		atomic.StoreInt64(&LastRefresh, time.Now().Unix())
+
 		if len(updated) > 0 {
-			Feeds.BroadcastLatest(l, updated)
+			Feeds.SendAdded(l, updated)
 		}
 
 		time.Sleep(1 * time.Minute)
 	}
 }
+
+// FeedUpdate fetches a feed and adds anything new, recording the new articles for each user in updated.
+func FeedUpdate(l *SessionLogger, feed, url string, updated map[string][]string) {
+	fetched := time.Now().Unix()
+
+	f, res, err := FeedFetch(url)
+	if err != nil {
+		l.W.Printf("Error loading feed %v (%v), error: %v\n", feed, url, err)
+		FeedFetchFailed(l, feed, fetched, err)
+		return
+	}
+	FeedFetchOK(l, feed, fetched)
+	FeedUpdateInfo(l, feed, f)
+
+	FeedIngest(l, feed, f, fetched, updated)
+
+	// Anything pruned that has since dropped out of the feed can be forgotten.
+	PrunedTrim(l, feed, fetched)
+
+	WebSubCheck(l, feed, url, res)
+}
+
+// FeedIngest adds any new items in a feed, and records them in updated for each user subscribed to it.
+func FeedIngest(l *SessionLogger, feed string, f *gofeed.Feed, fetched int64, updated map[string][]string) {
+	ingestLock.Lock()
+	defer ingestLock.Unlock()
+
+	for _, item := range f.Items {
+		// Articles are keyed on their link, so there is nothing we can do with an item that doesn't have one.
+		if item.Link == "" {
+			continue
+		}
+
+		// Check if we know of the item
+		exists, ok := ArticleExists(l, item.Link)
+		if !ok || exists {
+			continue
+		}
+		pruned, ok := ArticlePruned(l, item.Link, fetched)
+		if !ok || pruned {
+			continue
+		}
+
+		t := item.PublishedParsed
+		if t == nil {
+			t = item.UpdatedParsed
+			if t == nil {
+				t2 := time.Now()
+				t = &t2
+			}
+		}
+
+		article := ArticleAdd(l, feed, item.Title, item.Link, *t)
+		if article == "" {
+			continue
+		}
+		fa := NewFilterArticle(feed, article, item, *t)
+		ArticleContentAdd(l, fa)
+		FilterArticleAdded(l, fa)
+		WebhookArticleAdded(l, feed, article, item.Title, item.Link, *t)
+
+		users := FeedListSubs(l, feed)
+		if users == nil {
+			continue
+		}
+		for _, user := range users {
+			updated[user] = append(updated[user], article)
+		}
+	}
+}
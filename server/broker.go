@@ -0,0 +1,322 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "os"
+import "net"
+import "sync"
+import "time"
+import "bufio"
+import "strings"
+import "encoding/json"
+
+// When more than one process shares a database, events have to get from the process that made them to whichever
+// processes the user is connected to. The broker is a very simple relay for this: every process connects to it, and
+// every line one of them sends is sent on to all of them, including the sender. One process runs the broker as well,
+// or a process of its own does with RSN2_ROLE=broker.
+//
+// RSN2_EVENTS_BROKER is the address of the broker, either "host:port" or "unix:/path/to/socket".
+// RSN2_EVENTS_LISTEN makes this process run the broker, on an address in the same format.
+//
+// There is no authentication, the broker must only be reachable by RSN2 processes. Each process numbers events on its
+// own, so a client that reconnects to a different process gets a hello instead of resuming.
+
+var EventBrokerAddr = os.Getenv("RSN2_EVENTS_BROKER")
+var EventBrokerListen = os.Getenv("RSN2_EVENTS_LISTEN")
+
+// How long to wait before trying to reconnect to the broker.
+const EventBrokerRetry = 5 * time.Second
+
+// Messages waiting to go to or from the broker. If the broker can't keep up with this events are delivered locally
+// instead, or (for the broker itself) the process that isn't keeping up is dropped.
+const EventBrokerQueueSize = 1024
+
+// The largest message the broker relays. The biggest events are a few hundred articles, nowhere near this.
+const EventBrokerMaxMessage = 4 << 20
+
+func init() {
+	if EventBrokerAddr != "" {
+		Feeds.Dispatcher = &brokerDispatcher{
+			dispatcher: localEvents,
+			out:        make(chan []byte, EventBrokerQueueSize),
+		}
+	}
+}
+
+// EventBus runs the broker and/or the connection to it, as configured.
+func EventBus() {
+	l := newSessionLogger("events")
+
+	if EventBrokerListen != "" {
+		go eventBrokerServe(l, EventBrokerListen)
+	}
+	if b, ok := Feeds.Dispatcher.(*brokerDispatcher); ok {
+		b.run(l, EventBrokerAddr)
+	}
+}
+
+type brokerMessage struct {
+	User string
+	Type string
+	Data json.RawMessage
+}
+
+// eventDecode turns event data back into the type it was sent as, so it can be filtered like a local event.
+func eventDecode(typ string, raw json.RawMessage) (interface{}, error) {
+	var data interface{}
+	switch typ {
+	case "hello":
+		data = &UnreadPage{}
+	case "article.added", "article.unread":
+		data = &ArticlesEvent{}
+	case "article.read", "article.starred", "article.unstarred":
+		data = &ArticleIDsEvent{}
+	case "feed.read":
+		data = &FeedReadEvent{}
+	case "feed.paused", "feed.unpaused", "feed.removed":
+		data = &FeedEvent{}
+	case "feed.error":
+		data = &FeedErrorEvent{}
+	case "feed.moved":
+		data = &FeedFolderEvent{}
+	default:
+		// Probably from a newer process, send it on as is.
+		return raw, nil
+	}
+
+	err := json.Unmarshal(raw, data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func brokerAddr(addr string) (string, string) {
+	if strings.HasPrefix(addr, "unix:") {
+		return "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	return "tcp", addr
+}
+
+// brokerDispatcher sends events through the broker. Connections are still local, the broker sends every event back
+// and it is delivered from there.
+type brokerDispatcher struct {
+	*dispatcher
+
+	out chan []byte
+
+	// Not embedded, the dispatcher has its own lock.
+	lock      sync.Mutex
+	connected bool
+}
+
+// Connected can only see this process's connections. While the broker is up the user may be connected to another
+// process, so it is always true and every event is built. While it is down events only go to this process anyway.
+func (b *brokerDispatcher) Connected(user string) bool {
+	b.lock.Lock()
+	connected := b.connected
+	b.lock.Unlock()
+
+	return connected || b.dispatcher.Connected(user)
+}
+
+func (b *brokerDispatcher) Send(l *SessionLogger, user, typ string, data interface{}) {
+	raw, err := json.Marshal(data)
+	if err == nil {
+		raw, err = json.Marshal(&brokerMessage{User: user, Type: typ, Data: raw})
+	}
+	if err != nil {
+		l.E.Printf("Error encoding %v event for the broker, error: %v\n", typ, err)
+		return
+	}
+
+	b.lock.Lock()
+	connected := b.connected
+	b.lock.Unlock()
+
+	// Better that users of this process get the event than nobody does.
+	if !connected {
+		l.W.Printf("Not connected to the event broker, sending %v to user %v locally.\n", typ, user)
+		b.dispatcher.Send(l, user, typ, data)
+		return
+	}
+
+	select {
+	case b.out <- append(raw, '\n'):
+	default:
+		l.W.Printf("Event broker queue is full, sending %v to user %v locally.\n", typ, user)
+		b.dispatcher.Send(l, user, typ, data)
+	}
+}
+
+func (b *brokerDispatcher) setConnected(connected bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.connected = connected
+}
+
+// run keeps a connection to the broker open, delivering everything that comes from it.
+func (b *brokerDispatcher) run(l *SessionLogger, addr string) {
+	network, address := brokerAddr(addr)
+
+	for {
+		conn, err := net.Dial(network, address)
+		if err != nil {
+			l.W.Printf("Cannot connect to event broker at %v, error: %v\n", addr, err)
+			time.Sleep(EventBrokerRetry)
+			continue
+		}
+		l.I.Printf("Connected to event broker at %v.\n", addr)
+		b.setConnected(true)
+
+		done := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case msg := <-b.out:
+					conn.SetWriteDeadline(time.Now().Add(ConnWriteTimeout))
+					_, err := conn.Write(msg)
+					if err != nil {
+						l.W.Printf("Error sending to event broker, error: %v\n", err)
+						conn.Close()
+						return
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+
+		scanner := bufio.NewScanner(conn)
+		scanner.Buffer(nil, EventBrokerMaxMessage)
+		for scanner.Scan() {
+			msg := &brokerMessage{}
+			err := json.Unmarshal(scanner.Bytes(), msg)
+			if err != nil {
+				l.W.Printf("Invalid message from event broker, error: %v\n", err)
+				continue
+			}
+			data, err := eventDecode(msg.Type, msg.Data)
+			if err != nil {
+				l.W.Printf("Invalid %v event from event broker, error: %v\n", msg.Type, err)
+				continue
+			}
+			b.dispatcher.Send(l, msg.User, msg.Type, data)
+		}
+		l.W.Printf("Lost connection to event broker, error: %v\n", scanner.Err())
+
+		b.setConnected(false)
+		close(done)
+		conn.Close()
+		time.Sleep(EventBrokerRetry)
+	}
+}
+
+// eventBrokerServe runs the broker.
+func eventBrokerServe(l *SessionLogger, addr string) {
+	network, address := brokerAddr(addr)
+	if network == "unix" {
+		// Left over from last time.
+		os.Remove(address)
+	}
+
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		l.E.Printf("Cannot start event broker on %v, error: %v\n", addr, err)
+		return
+	}
+	l.I.Printf("Event broker listening on %v.\n", addr)
+
+	b := &eventBroker{conns: map[net.Conn]chan []byte{}}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			l.E.Printf("Event broker cannot accept connections, error: %v\n", err)
+			return
+		}
+		go b.serve(l, conn)
+	}
+}
+
+type eventBroker struct {
+	sync.Mutex
+
+	conns map[net.Conn]chan []byte
+}
+
+func (b *eventBroker) serve(l *SessionLogger, conn net.Conn) {
+	l.I.Printf("Event broker connection from %v.\n", conn.RemoteAddr())
+
+	out := make(chan []byte, EventBrokerQueueSize)
+	b.Lock()
+	b.conns[conn] = out
+	b.Unlock()
+
+	go func() {
+		for msg := range out {
+			conn.SetWriteDeadline(time.Now().Add(ConnWriteTimeout))
+			_, err := conn.Write(msg)
+			if err != nil {
+				l.W.Printf("Error relaying to %v, error: %v\n", conn.RemoteAddr(), err)
+				conn.Close()
+				for range out {
+				}
+				return
+			}
+		}
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(nil, EventBrokerMaxMessage)
+	for scanner.Scan() {
+		msg := append(append([]byte(nil), scanner.Bytes()...), '\n')
+		b.relay(l, msg)
+	}
+	l.I.Printf("Event broker connection from %v closed, error: %v\n", conn.RemoteAddr(), scanner.Err())
+
+	conn.Close()
+	b.Lock()
+	if _, ok := b.conns[conn]; ok {
+		delete(b.conns, conn)
+		close(out)
+	}
+	b.Unlock()
+}
+
+// relay sends a message to every process. One that isn't keeping up is disconnected, it will reconnect.
+func (b *eventBroker) relay(l *SessionLogger, msg []byte) {
+	b.Lock()
+	defer b.Unlock()
+
+	for conn, out := range b.conns {
+		select {
+		case out <- msg:
+		default:
+			l.W.Printf("Event broker connection from %v is not keeping up, closing it.\n", conn.RemoteAddr())
+			conn.Close()
+			delete(b.conns, conn)
+			close(out)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "os"
+import "time"
+import "strings"
+import "testing"
+import "path/filepath"
+
+func TestEventBroker(t *testing.T) {
+	testDB(t, func(t *testing.T) {
+		testUser(t, "u1", "one@example.com")
+
+		sock := filepath.Join(t.TempDir(), "events.sock")
+		addr := "unix:" + sock
+		go eventBrokerServe(ml, addr)
+
+		// Otherwise the first connection attempts fail, and the retries are slow.
+		for i := 0; ; i++ {
+			if _, err := os.Stat(sock); err == nil {
+				break
+			}
+			if i == 100 {
+				t.Fatalf("Broker did not start")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// Two processes, the user is connected to the second.
+		procs := []*brokerDispatcher{}
+		for i := 0; i < 2; i++ {
+			b := &brokerDispatcher{
+				dispatcher: &dispatcher{clients: map[string]*client{}},
+				out:        make(chan []byte, EventBrokerQueueSize),
+			}
+			go b.run(ml, addr)
+			procs = append(procs, b)
+		}
+		for _, b := range procs {
+			for i := 0; ; i++ {
+				b.lock.Lock()
+				connected := b.connected
+				b.lock.Unlock()
+				if connected {
+					break
+				}
+				if i == 100 {
+					t.Fatalf("Not connected to the broker")
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+		}
+
+		s := testStreamOpen(t, procs[1].dispatcher, "")
+		s.next(t, "hello")
+
+		procs[0].Send(ml, "u1", "article.read", &ArticleIDsEvent{Articles: []string{"a1"}})
+		procs[0].Send(ml, "u1", "feed.error", &FeedErrorEvent{Feed: "f1", Error: "Timed out"})
+		if _, data := s.next(t, "article.read"); !strings.Contains(data, `"Articles":["a1"]`) {
+			t.Fatalf("Unexpected event data: %v", data)
+		}
+		if _, data := s.next(t, "feed.error"); !strings.Contains(data, `"Data":{"Feed":"f1","Error":"Timed out"}`) {
+			t.Fatalf("Unexpected event data: %v", data)
+		}
+
+		// Events come back decoded, so they can be filtered like local ones.
+		procs[1].RLock()
+		c := procs[1].clients["u1"]
+		procs[1].RUnlock()
+		c.RLock()
+		_, ok := c.log[len(c.log)-1].Data.(*FeedErrorEvent)
+		c.RUnlock()
+		if !ok {
+			t.Fatalf("Relayed event was not decoded")
+		}
+	})
+}
+
+func TestBrokerConnected(t *testing.T) {
+	b := &brokerDispatcher{dispatcher: &dispatcher{clients: map[string]*client{}}}
+	if b.Connected("u1") {
+		t.Fatalf("Connected with no broker and no local client")
+	}
+
+	// Anyone may be connected through the broker.
+	b.setConnected(true)
+	if !b.Connected("u1") {
+		t.Fatalf("Not connected with the broker up")
+	}
+
+	// Without it only the local clients count.
+	b.setConnected(false)
+	c := newClient()
+	c.left = time.Now()
+	b.clients["u1"] = c
+	if !b.Connected("u1") {
+		t.Fatalf("Not connected with a local client")
+	}
+}
@@ -28,7 +28,6 @@ import "os"
 import "time"
 import "net/http"
 import "encoding/hex"
-import "database/sql"
 
 import "gopkg.in/gomail.v2"
 
@@ -36,6 +35,8 @@ import "github.com/teris-io/shortid"
 
 import "github.com/gorilla/sessions"
 
+import "github.com/mmcdole/gofeed"
+
 const PasswordCost = 15
 
 // Sessions
@@ -54,7 +55,8 @@ func init() {
 	SessionStore = sessions.NewCookieStore(key)
 }
 
-// GetSession returns the user id for the current user and 200, or an empty string and a HTTP error code.
+// GetSession returns the user id for the current user and 200, or an empty string and a HTTP error code. Requests that
+// may change something must also have the session's CSRF token.
 func GetSession(l *SessionLogger, w http.ResponseWriter, r *http.Request) (string, int) {
 	session, _ := SessionStore.Get(r, "rsn2-session")
 	if auth, ok := session.Values["auth"].(bool); !ok || !auth {
@@ -67,11 +69,23 @@ func GetSession(l *SessionLogger, w http.ResponseWriter, r *http.Request) (strin
 		return "", http.StatusBadRequest
 	}
 
-	err := session.Save(r, w)
+	token, created, err := CSRFToken(w, r, session)
 	if err != nil {
-		l.W.Printf("Error saving session for user %v, error: %v\n", user, err)
+		l.E.Printf("Error creating CSRF token for user %v, error: %v\n", user, err)
 		return "", http.StatusInternalServerError
 	}
+	if !csrfCheck(l, r, token) {
+		return "", http.StatusForbidden
+	}
+
+	// Sessions from before CSRF tokens need theirs stored, otherwise the session hasn't changed.
+	if created {
+		err = session.Save(r, w)
+		if err != nil {
+			l.W.Printf("Error saving session for user %v, error: %v\n", user, err)
+			return "", http.StatusInternalServerError
+		}
+	}
 	return user, http.StatusOK
 }
 
@@ -79,29 +93,16 @@ func GetSession(l *SessionLogger, w http.ResponseWriter, r *http.Request) (strin
 // =====================================================================================================================
 
 func GetAllFeeds(l *SessionLogger) [][2]string {
-	rows, err := Queries["GetAllFeeds"].Preped.Query()
+	feeds, err := Data.FeedURLs()
 	if err != nil {
 		l.E.Printf("Feed list failed for background update, error: %v\n", err)
 		return nil
 	}
-	defer rows.Close()
-
-	feeds := [][2]string{}
-	for rows.Next() {
-		f, id := "", ""
-		err := rows.Scan(&f, &id)
-		if err != nil {
-			l.E.Printf("Feed list failed for background update, error: %v\n", err)
-			return nil
-		}
-		feeds = append(feeds, [2]string{f, id})
-	}
 	return feeds
 }
 
 func ArticleExists(l *SessionLogger, url string) (exists, ok bool) {
-	article := ""
-	err := Queries["ArticleExistsByURL"].Preped.QueryRow(url).Scan(&article)
+	article, err := Data.ArticleByURL(url)
 	if err != nil {
 		l.E.Printf("DB existence check failed for new article %v, error: %v\n", url, err)
 		return false, false
@@ -109,6 +110,71 @@ func ArticleExists(l *SessionLogger, url string) (exists, ok bool) {
 	return article != "", true
 }
 
+// FeedUpdateInfo stores what the feed says about itself.
+func FeedUpdateInfo(l *SessionLogger, feed string, f *gofeed.Feed) {
+	image := ""
+	if f.Image != nil {
+		image = f.Image.URL
+	}
+	err := Data.FeedSetInfo(feed, f.Title, f.Link, f.Description, image, f.Language)
+	if err != nil {
+		l.E.Printf("Cannot update info for feed %v, error: %v\n", feed, err)
+	}
+}
+
+// FeedFetchOK records a successful fetch.
+func FeedFetchOK(l *SessionLogger, feed string, fetched int64) {
+	last := feedFetchError(l, feed)
+	err := Data.FeedFetchOK(feed, fetched)
+	if err != nil {
+		l.E.Printf("Cannot update fetch status for feed %v, error: %v\n", feed, err)
+		return
+	}
+	if last != "" {
+		Feeds.SendFeed(l, feed, "feed.error", &FeedErrorEvent{Feed: feed})
+	}
+}
+
+// FeedFetchFailed records why a fetch failed.
+func FeedFetchFailed(l *SessionLogger, feed string, fetched int64, ferr error) {
+	last := feedFetchError(l, feed)
+	err := Data.FeedFetchFailed(feed, fetched, ferr.Error())
+	if err != nil {
+		l.E.Printf("Cannot update fetch status for feed %v, error: %v\n", feed, err)
+		return
+	}
+	if last != ferr.Error() {
+		Feeds.SendFeed(l, feed, "feed.error", &FeedErrorEvent{Feed: feed, Error: ferr.Error()})
+	}
+}
+
+// feedFetchError returns the error from the last fetch of a feed, so users are only told when it changes.
+func feedFetchError(l *SessionLogger, feed string) string {
+	last, err := Data.FeedFetchError(feed)
+	if err != nil {
+		l.E.Printf("Cannot read fetch status for feed %v, error: %v\n", feed, err)
+	}
+	return last
+}
+
+// ArticlePruned checks for a tombstone left by the retention job, marking it as seen so it is kept around.
+func ArticlePruned(l *SessionLogger, url string, seen int64) (pruned, ok bool) {
+	pruned, err := Data.ArticlePrunedSeen(url, seen)
+	if err != nil {
+		l.E.Printf("DB tombstone check failed for new article %v, error: %v\n", url, err)
+		return false, false
+	}
+	return pruned, true
+}
+
+// PrunedTrim drops the tombstones for a feed that were not seen in the fetch that started at the given time.
+func PrunedTrim(l *SessionLogger, feed string, before int64) {
+	err := Data.PrunedTrim(feed, before)
+	if err != nil {
+		l.E.Printf("Cannot trim tombstones for feed %v, error: %v\n", feed, err)
+	}
+}
+
 var articleIDService <-chan string
 
 func init() {
@@ -124,32 +190,23 @@ func init() {
 	}()
 }
 
-func ArticleAdd(l *SessionLogger, feed, title, url string, published time.Time) {
+// ArticleAdd returns the new article's ID, or an empty string if it could not be added.
+func ArticleAdd(l *SessionLogger, feed, title, url string, published time.Time) string {
 	article := <-articleIDService
-	_, err := Queries["ArticleAdd"].Preped.Exec(article, feed, title, url, published.Unix())
+	err := Data.ArticleAdd(article, feed, title, url, published.Unix())
 	if err != nil {
 		l.E.Printf("Cannot insert article %v into db, error: %v\n", url, err)
+		return ""
 	}
+	return article
 }
 
 func FeedListSubs(l *SessionLogger, feed string) []string {
-	rows, err := Queries["FeedListSubs"].Preped.Query(feed)
+	users, err := Data.Subscribers(feed)
 	if err != nil {
 		l.E.Printf("Feed subscribed user list failed for background update, error: %v\n", err)
 		return nil
 	}
-	defer rows.Close()
-
-	users := []string{}
-	for rows.Next() {
-		user := ""
-		err := rows.Scan(&user)
-		if err != nil {
-			l.E.Printf("Feed subscribed user list failed for background update, error: %v\n", err)
-			return nil
-		}
-		users = append(users, user)
-	}
 	return users
 }
 
@@ -183,9 +240,8 @@ func EmailConfirm(l *SessionLogger, confirmation string) int {
 	}
 
 	// Now to get the user's email from the DB.
-	email := ""
-	err = Queries["GetEmail"].Preped.QueryRow(id).Scan(&email)
-	if err == sql.ErrNoRows {
+	email, err := Data.UserEmail(id)
+	if err == ErrNotFound {
 		l.E.Printf("User %v does not exist.\n", id)
 		return http.StatusBadRequest
 	}
@@ -205,7 +261,7 @@ func EmailConfirm(l *SessionLogger, confirmation string) int {
 	}
 
 	// And finally mark the email confirmed.
-	_, err = Queries["ConfirmEmail"].Preped.Exec(id)
+	err = Data.UserConfirm(id)
 	if err != nil {
 		l.E.Printf("Error confirming email for %v (%v), error: %v\n", email, id, err)
 		return http.StatusInternalServerError
@@ -216,7 +272,7 @@ func EmailConfirm(l *SessionLogger, confirmation string) int {
 
 // EmailForceConfirm forcably confirms an email for the given user.
 func EmailForceConfirm(l *SessionLogger, id string) int {
-	_, err := Queries["ConfirmEmail"].Preped.Exec(id)
+	err := Data.UserConfirm(id)
 	if err != nil {
 		l.E.Printf("Error force-confirming email for %v, error: %v\n", id, err)
 		return http.StatusInternalServerError
@@ -251,9 +307,8 @@ func EmailDelete(l *SessionLogger, confirmation string) int {
 	}
 
 	// Now to get the user's email from the DB.
-	email := ""
-	err = Queries["GetEmail"].Preped.QueryRow(id).Scan(&email)
-	if err == sql.ErrNoRows {
+	email, err := Data.UserEmail(id)
+	if err == ErrNotFound {
 		l.E.Printf("User %v does not exist.\n", id)
 		return http.StatusBadRequest
 	}
@@ -273,7 +328,7 @@ func EmailDelete(l *SessionLogger, confirmation string) int {
 	}
 
 	// And finally remove the user from the DB.
-	_, err = Queries["DeleteEmail"].Preped.Exec(id)
+	err = Data.UserDeleteUnconfirmed(id)
 	if err != nil {
 		l.E.Printf("Error deleting email for %v (%v), error: %v\n", email, id, err)
 		return http.StatusInternalServerError
@@ -293,8 +348,7 @@ type UserLoginData struct {
 // UserLogin returns false for valid if the username or password is wrong, and false for canlogin if the
 // email is not confirmed.
 func UserLogin(l *SessionLogger, email, password string) (code int, id string, canlogin bool) {
-	dbpass := ""
-	err := Queries["UserLogin"].Preped.QueryRow(email).Scan(&id, &dbpass, &canlogin)
+	id, dbpass, canlogin, err := Data.UserLogin(email)
 	if err != nil {
 		l.W.Printf("Cannot find user %v in db, error: %v\n", email, err)
 		return http.StatusBadRequest, "", false
@@ -336,13 +390,12 @@ func UserNew(l *SessionLogger, email, password string) int {
 	id := <-userIDService
 
 	// Make sure the user doesn't exist.
-	ok := 0
-	err := Queries["UserEmailExists"].Preped.QueryRow(email).Scan(&ok)
+	exists, err := Data.UserEmailExists(email)
 	if err != nil {
 		l.E.Printf("DB existence check failed for new user %v, error: %v\n", email, err)
 		return http.StatusInternalServerError
 	}
-	if ok == 1 {
+	if exists {
 		l.W.Printf("User %v already exists.\n", email)
 		return http.StatusBadRequest
 	}
@@ -354,7 +407,7 @@ func UserNew(l *SessionLogger, email, password string) int {
 		return http.StatusInternalServerError
 	}
 
-	_, err = Queries["UserNew"].Preped.Exec(id, email, string(hashed))
+	err = Data.UserAdd(id, email, string(hashed))
 	if err != nil {
 		l.E.Printf("Cannot insert user %v (%v) into db, error: %v\n", email, id, err)
 		return http.StatusInternalServerError
@@ -404,8 +457,7 @@ func UserNewPass(l *SessionLogger, user, oldpassword, newpassword string) int {
 		return http.StatusInternalServerError
 	}
 
-	dbpass := ""
-	err = Queries["UserGetPass"].Preped.QueryRow(user).Scan(&dbpass)
+	dbpass, err := Data.UserPassword(user)
 	if err != nil {
 		l.W.Printf("Cannot find user %v in db, error: %v\n", user, err)
 		return http.StatusBadRequest
@@ -417,29 +469,40 @@ func UserNewPass(l *SessionLogger, user, oldpassword, newpassword string) int {
 		return http.StatusBadRequest
 	}
 
-	_, err = Queries["UserNewPass"].Preped.Exec(user, string(hashed))
+	err = Data.UserSetPassword(user, string(hashed))
 	if err != nil {
 		l.E.Printf("Cannot update user %v with new password, error: %v\n", user, err)
 		return http.StatusInternalServerError
 	}
-	return http.StatusOK
+
+	// Google Reader clients have to log in again.
+	err = Data.ApiKeyDelete(user, "greader")
+	if err != nil {
+		l.E.Printf("Cannot delete Google Reader tokens for user %v, error: %v\n", user, err)
+		return http.StatusInternalServerError
+	}
+
+	email, err := Data.UserEmail(user)
+	if err != nil {
+		l.E.Printf("Error fetching email for %v from DB, error: %v\n", user, err)
+		return http.StatusInternalServerError
+	}
+	return feverKeyUpdate(l, user, email, newpassword)
 }
 
 func UserNewName(l *SessionLogger, user, password, email string) int {
 	// Make sure the user doesn't exist.
-	ok := 0
-	err := Queries["UserEmailExists"].Preped.QueryRow(email).Scan(&ok)
+	exists, err := Data.UserEmailExists(email)
 	if err != nil {
 		l.E.Printf("DB existence check failed for user email change %v, error: %v\n", email, err)
 		return http.StatusInternalServerError
 	}
-	if ok == 1 {
+	if exists {
 		l.W.Printf("User with email %v already exists.\n", email)
 		return http.StatusBadRequest
 	}
 
-	dbpass := ""
-	err = Queries["UserGetPass"].Preped.QueryRow(user).Scan(&dbpass)
+	dbpass, err := Data.UserPassword(user)
 	if err != nil {
 		l.W.Printf("Cannot find user %v in db, error: %v\n", user, err)
 		return http.StatusBadRequest
@@ -451,11 +514,14 @@ func UserNewName(l *SessionLogger, user, password, email string) int {
 		return http.StatusBadRequest
 	}
 
-	_, err = Queries["UserNewName"].Preped.Exec(user, email)
+	err = Data.UserSetEmail(user, email)
 	if err != nil {
 		l.E.Printf("Cannot update user %v (%v) email in db, error: %v\n", email, user, err)
 		return http.StatusInternalServerError
 	}
+	if status := feverKeyUpdate(l, user, email, password); status != http.StatusOK {
+		return status
+	}
 
 	// Generate confirmation token.
 	src := md5.Sum([]byte(email))
@@ -486,6 +552,77 @@ func UserNewName(l *SessionLogger, user, password, email string) int {
 	return http.StatusOK
 }
 
+// /api/user/fever
+// =====================================================================================================================
+
+// The Fever API key is the MD5 of "email:password", so it has to be recalculated any time either changes.
+func feverKey(email, password string) string {
+	sum := md5.Sum([]byte(email + ":" + password))
+	return hex.EncodeToString(sum[:])
+}
+
+func feverKeyUpdate(l *SessionLogger, user, email, password string) int {
+	err := Data.ApiKeyUpdate(user, "fever", feverKey(email, password))
+	if err != nil {
+		l.E.Printf("Cannot update Fever API key for user %v, error: %v\n", user, err)
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
+
+// FeverEnable turns on Fever API access for the user, this requires the password since the key is derived from it.
+func FeverEnable(l *SessionLogger, user, password string) int {
+	dbpass, err := Data.UserPassword(user)
+	if err != nil {
+		l.W.Printf("Cannot find user %v in db, error: %v\n", user, err)
+		return http.StatusBadRequest
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(dbpass), []byte(password))
+	if err != nil {
+		l.W.Printf("Password check failed for user %v, error: %v\n", user, err)
+		return http.StatusBadRequest
+	}
+
+	email, err := Data.UserEmail(user)
+	if err != nil {
+		l.E.Printf("Error fetching email for %v from DB, error: %v\n", user, err)
+		return http.StatusInternalServerError
+	}
+
+	status := FeverDisable(l, user)
+	if status != http.StatusOK {
+		return status
+	}
+	err = Data.ApiKeyAdd(feverKey(email, password), user, "fever", time.Now().Unix())
+	if err != nil {
+		l.E.Printf("Cannot add Fever API key for user %v, error: %v\n", user, err)
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
+
+// /api/user/fever-disable
+// =====================================================================================================================
+
+func FeverDisable(l *SessionLogger, user string) int {
+	err := Data.ApiKeyDelete(user, "fever")
+	if err != nil {
+		l.E.Printf("Cannot delete Fever API key for user %v, error: %v\n", user, err)
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
+
+// ApiKeyUser returns the user an API key belongs to, or an empty string if it isn't valid.
+func ApiKeyUser(l *SessionLogger, key, kind string) string {
+	user, err := Data.ApiKeyUser(key, kind)
+	if err != nil && err != ErrNotFound {
+		l.E.Printf("Cannot look up %v API key, error: %v\n", kind, err)
+	}
+	return user
+}
+
 // /api/feed/list
 // =====================================================================================================================
 
@@ -494,26 +631,27 @@ type Feed struct {
 	Name   string
 	URL    string
 	Paused bool
+	Folder string // Empty if not in a folder.
+
+	// From the feed itself, these are empty until the first time the feed is fetched.
+	Title       string
+	Link        string // The site, not the feed.
+	Description string
+	Image       string
+	Language    string
+
+	// How the last fetch went. Fetched is the zero time if the feed hasn't been fetched yet, Error is empty if the
+	// fetch worked.
+	Fetched time.Time
+	Error   string
 }
 
 func FeedList(l *SessionLogger, id string) []*Feed {
-	rows, err := Queries["FeedList"].Preped.Query(id)
+	feeds, err := Data.FeedList(id)
 	if err != nil {
 		l.E.Printf("Feed list failed for user %v, error: %v\n", id, err)
 		return nil
 	}
-	defer rows.Close()
-
-	feeds := []*Feed{}
-	for rows.Next() {
-		f := &Feed{}
-		err := rows.Scan(&f.ID, &f.Name, &f.URL, &f.Paused)
-		if err != nil {
-			l.E.Printf("Feed list failed for user %v, error: %v\n", id, err)
-			return nil
-		}
-		feeds = append(feeds, f)
-	}
 	return feeds
 }
 
@@ -521,8 +659,7 @@ func FeedList(l *SessionLogger, id string) []*Feed {
 // =====================================================================================================================
 
 func FeedDetails(l *SessionLogger, user, feed string) *Feed {
-	f := &Feed{}
-	err := Queries["FeedDetails"].Preped.QueryRow(user, feed).Scan(&f.ID, &f.Name, &f.URL, &f.Paused)
+	f, err := Data.FeedDetails(user, feed)
 	if err != nil {
 		l.W.Printf("Error reading feed %v for user %v, error: %v\n", feed, user, err)
 		return nil
@@ -539,29 +676,32 @@ type Article struct {
 	URL       string
 	Published time.Time
 	Read      bool
+	Starred   bool
+}
+
+type ArticlePage struct {
+	Articles []*Article
+	Next     string // Cursor for the next page, empty if this is the last one.
 }
 
-func FeedArticles(l *SessionLogger, user, feed string) []*Article {
-	rows, err := Queries["FeedArticles"].Preped.Query(user, feed)
+func FeedArticles(l *SessionLogger, user, feed string, p *PageParams) *ArticlePage {
+	articles, err := Data.FeedArticles(user, feed, p)
 	if err != nil {
 		l.E.Printf("Feed article list failed for feed %v, user %v. Error: %v\n", feed, user, err)
 		return nil
 	}
-	defer rows.Close()
 
-	articles := []*Article{}
-	for rows.Next() {
-		a := &Article{}
-		var stamp int64
-		err := rows.Scan(&a.ID, &a.Title, &a.URL, &stamp, &a.Read)
-		if err != nil {
-			l.E.Printf("Feed article list failed for feed %v, user %v. Error: %v\n", feed, user, err)
-			return nil
+	page := &ArticlePage{Articles: []*Article{}}
+	for _, a := range articles {
+		// We always ask for one more than we need so we know if there is another page.
+		if len(page.Articles) == p.Limit {
+			last := page.Articles[p.Limit-1]
+			page.Next = Cursor(last.Published.Unix(), last.ID)
+			break
 		}
-		a.Published = time.Unix(stamp, 0)
-		articles = append(articles, a)
+		page.Articles = append(page.Articles, a)
 	}
-	return articles
+	return page
 }
 
 // /api/feed/subscribe
@@ -587,89 +727,134 @@ type FeedSubscribeData struct {
 	Name string
 }
 
-func FeedSubscribe(l *SessionLogger, id, url, name string) int {
-	// First things first: Check to see if a feed with this url already esists.
-	feed := ""
-	err := Queries["FeedExistsByURL"].Preped.QueryRow(url).Scan(&feed)
+// FeedKnown checks if there is already a feed with the given URL.
+func FeedKnown(l *SessionLogger, url string) (bool, int) {
+	feed, err := Data.FeedByURL(url)
 	if err != nil {
-		l.E.Printf("DB existence check failed for new feed %v, error: %v\n", url, err)
-		return http.StatusInternalServerError
+		l.E.Printf("DB existence check failed for feed %v, error: %v\n", url, err)
+		return false, http.StatusInternalServerError
 	}
-	if feed == "" {
-		// Create new feed.
-		feed = <-feedIDService
-		_, err = Queries["FeedAdd"].Preped.Exec(feed, url)
-		if err != nil {
-			l.E.Printf("Cannot insert feed %v into db, error: %v\n", url, err)
-			return http.StatusInternalServerError
-		}
+	return feed != "", http.StatusOK
+}
+
+// FeedTitle returns the title a feed gave itself the last time it was fetched, empty if unknown.
+func FeedTitle(l *SessionLogger, url string) string {
+	title, err := Data.FeedTitleByURL(url)
+	if err != nil {
+		l.E.Printf("Cannot load title for feed %v, error: %v\n", url, err)
 	}
+	return title
+}
 
-	ok := 0
-	err = Queries["FeedAlreadySubscibed"].Preped.QueryRow(id, feed).Scan(&ok)
+// FeedSubscribe returns the ID of the feed along with the status, the ID is only valid for 200 and 202.
+func FeedSubscribe(l *SessionLogger, id, url, name string) (string, int) {
+	// The feed is created if nobody is subscribed to it yet, with a new ID.
+	feed, created, ok, err := Data.Subscribe(id, url, <-feedIDService, name)
 	if err != nil {
-		l.E.Printf("DB existence check failed for subscribed feed %v by user %v, error: %v\n", feed, id, err)
-		return http.StatusInternalServerError
+		l.E.Printf("Failed subscribing feed %v as user %v, error: %v\n", url, id, err)
+		return "", http.StatusInternalServerError
 	}
-	if ok == 1 {
+	if ok {
 		l.W.Printf("Feed %v already subscribed by user %v.\n", feed, id)
 		// This isn't a straight up error, but it isn't OK either.
-		return http.StatusAccepted
+		return feed, http.StatusAccepted
 	}
 
-	_, err = Queries["FeedSubscibe"].Preped.Exec(id, feed, name)
-	if err != nil {
-		l.E.Printf("Failed subscribing feed %v as user %v, error: %v\n", feed, id, err)
-		return http.StatusInternalServerError
+	// A new feed has no articles at all, so don't make the user wait for the background process to find it.
+	if created {
+		feedRefreshQueue(l, id, feed, url)
+	} else {
+		Feeds.SendFeedArticles(l, id, feed)
 	}
-	return http.StatusOK
+	return feed, http.StatusOK
 }
 
 // /api/feed/unsubscribe
 // =====================================================================================================================
 
 func FeedUnsub(l *SessionLogger, user, feed string) int {
-	_, err := Queries["FeedUnsub1"].Preped.Exec(user, feed)
+	// Delete the subscription and everything we were keeping track of for it, and the feed if that was the last
+	// subscriber.
+	err := Data.Unsubscribe(user, feed)
 	if err != nil {
 		l.E.Printf("Failed unsubscribing feed %v as user %v, error: %v\n", feed, user, err)
 		return http.StatusInternalServerError
 	}
+	Feeds.Send(l, user, "feed.removed", &FeedEvent{Feed: feed})
+	return http.StatusOK
+}
+
+// /api/feed/mark-read
+// =====================================================================================================================
 
-	// Now check if the feed has no subscribers.
-	hassub := 0
-	err = Queries["FeedHasSubs"].Preped.QueryRow(feed).Scan(&hassub)
+// FeedMarkRead marks everything in a feed published before the given time as read.
+func FeedMarkRead(l *SessionLogger, user, feed string, before int64) int {
+	ok, err := Data.Subscribed(user, feed)
 	if err != nil {
-		l.E.Printf("Feed subscriber check failed for feed %v, error: %v\n", feed, err)
+		l.E.Printf("DB existence check failed for subscribed feed %v by user %v, error: %v\n", feed, user, err)
 		return http.StatusInternalServerError
 	}
-	if hassub == 1 {
-		// If the feed still has other subscribers delete our paused flags and slink off into the night.
-		_, err = Queries["FeedUnsub2"].Preped.Exec(user, feed)
-		if err != nil {
-			l.E.Printf("Failed unsubscribing feed %v as user %v, error: %v\n", feed, user, err)
-			return http.StatusInternalServerError
-		}
-		return http.StatusOK
+	if !ok {
+		l.W.Printf("Feed %v not subscribed by user %v.\n", feed, user)
+		return http.StatusBadRequest
+	}
+
+	err = Data.FeedMarkRead(user, feed, before)
+	if err != nil {
+		l.E.Printf("Failed marking feed %v read as user %v, error: %v\n", feed, user, err)
+		return http.StatusInternalServerError
+	}
+
+	Feeds.Send(l, user, "feed.read", &FeedReadEvent{Feed: feed, Before: before})
+	return http.StatusOK
+}
+
+// /api/feed/folder
+// =====================================================================================================================
+
+// FeedSetFolder files a subscription under a folder, an empty folder name removes it from any folder.
+func FeedSetFolder(l *SessionLogger, user, feed, folder string) int {
+	ok, err := Data.Subscribed(user, feed)
+	if err != nil {
+		l.E.Printf("DB existence check failed for subscribed feed %v by user %v, error: %v\n", feed, user, err)
+		return http.StatusInternalServerError
+	}
+	if !ok {
+		l.W.Printf("Feed %v not subscribed by user %v.\n", feed, user)
+		return http.StatusBadRequest
 	}
 
-	// No subscribers left, delete feed for real.
-	_, err = Queries["FeedDelete"].Preped.Exec(feed)
+	err = Data.SetFolder(user, feed, folder)
 	if err != nil {
-		l.E.Printf("Failed deleting feed %v, error: %v\n", feed, err)
+		l.E.Printf("Failed setting folder for feed %v as user %v, error: %v\n", feed, user, err)
 		return http.StatusInternalServerError
 	}
+
+	Feeds.Send(l, user, "feed.moved", &FeedFolderEvent{Feed: feed, Folder: folder})
 	return http.StatusOK
 }
 
+// FolderFeeds lists the feeds a user has filed under a folder. Returns nil on error.
+func FolderFeeds(l *SessionLogger, user, folder string) []string {
+	feeds, err := Data.FolderFeeds(user, folder)
+	if err != nil {
+		l.E.Printf("Feed list failed for folder %v, user %v. Error: %v\n", folder, user, err)
+		return nil
+	}
+	return feeds
+}
+
 // /api/feed/pause
 // =====================================================================================================================
 
 func FeedPause(l *SessionLogger, user, feed string) int {
-	_, err := Queries["FeedPause"].Preped.Exec(user, feed)
+	err := Data.Pause(user, feed)
 	if err != nil {
 		l.E.Printf("Failed pausing feed %v, error: %v\n", feed, err)
 		return http.StatusInternalServerError
 	}
+
+	Feeds.Send(l, user, "feed.paused", &FeedEvent{Feed: feed})
 	return http.StatusOK
 }
 
@@ -677,11 +862,14 @@ func FeedPause(l *SessionLogger, user, feed string) int {
 // =====================================================================================================================
 
 func FeedUnpause(l *SessionLogger, user, feed string) int {
-	_, err := Queries["FeedUnpause"].Preped.Exec(user, feed)
+	err := Data.Unpause(user, feed)
 	if err != nil {
 		l.E.Printf("Failed unpausing feed %v, error: %v\n", feed, err)
 		return http.StatusInternalServerError
 	}
+
+	Feeds.Send(l, user, "feed.unpaused", &FeedEvent{Feed: feed})
+	Feeds.SendFeedArticles(l, user, feed)
 	return http.StatusOK
 }
 
@@ -689,11 +877,17 @@ func FeedUnpause(l *SessionLogger, user, feed string) int {
 // =====================================================================================================================
 
 func ArticleMarkRead(l *SessionLogger, user, article string) int {
-	_, err := Queries["ArticleRead"].Preped.Exec(user, article)
+	err := Data.MarkRead(user, article)
+	if err == ErrNotFound {
+		l.W.Printf("Article %v does not exist.\n", article)
+		return http.StatusBadRequest
+	}
 	if err != nil {
 		l.E.Printf("Failed marking article (%v) read, error: %v\n", article, err)
 		return http.StatusInternalServerError
 	}
+
+	Feeds.Send(l, user, "article.read", &ArticleIDsEvent{Articles: []string{article}})
 	return http.StatusOK
 }
 
@@ -701,11 +895,45 @@ func ArticleMarkRead(l *SessionLogger, user, article string) int {
 // =====================================================================================================================
 
 func ArticleMarkUnread(l *SessionLogger, user, article string) int {
-	_, err := Queries["ArticleUnread"].Preped.Exec(user, article)
+	err := Data.MarkUnread(user, article)
+	if err == ErrNotFound {
+		l.W.Printf("Article %v does not exist.\n", article)
+		return http.StatusBadRequest
+	}
 	if err != nil {
 		l.E.Printf("Failed marking article (%v) unread, error: %v\n", article, err)
 		return http.StatusInternalServerError
 	}
+
+	Feeds.SendArticles(l, user, "article.unread", []string{article})
+	return http.StatusOK
+}
+
+// /api/article/star
+// =====================================================================================================================
+
+func ArticleStar(l *SessionLogger, user, article string) int {
+	err := Data.Star(user, article)
+	if err != nil {
+		l.E.Printf("Failed starring article (%v), error: %v\n", article, err)
+		return http.StatusInternalServerError
+	}
+
+	Feeds.Send(l, user, "article.starred", &ArticleIDsEvent{Articles: []string{article}})
+	return http.StatusOK
+}
+
+// /api/article/unstar
+// =====================================================================================================================
+
+func ArticleUnstar(l *SessionLogger, user, article string) int {
+	err := Data.Unstar(user, article)
+	if err != nil {
+		l.E.Printf("Failed unstarring article (%v), error: %v\n", article, err)
+		return http.StatusInternalServerError
+	}
+
+	Feeds.Send(l, user, "article.unstarred", &ArticleIDsEvent{Articles: []string{article}})
 	return http.StatusOK
 }
 
@@ -714,31 +942,61 @@ func ArticleMarkUnread(l *SessionLogger, user, article string) int {
 
 type UnreadArticle struct {
 	ID        string
+	Feed      string
 	Title     string
 	URL       string
 	FeedName  string // Feed *name*, not ID.
 	Published time.Time
 }
 
-func GetUnread(l *SessionLogger, user string) []*UnreadArticle {
-	rows, err := Queries["GetUnread"].Preped.Query(user)
+type UnreadPage struct {
+	Articles []*UnreadArticle
+	Next     string // Cursor for the next page, empty if this is the last one.
+}
+
+// GetUnread lists unread articles, only from feeds in the given folder if it isn't empty.
+func GetUnread(l *SessionLogger, user, folder string, p *PageParams) *UnreadPage {
+	articles, err := Data.Unread(user, folder, p)
 	if err != nil {
 		l.E.Printf("Unread article list failed for user %v. Error: %v\n", user, err)
 		return nil
 	}
-	defer rows.Close()
 
-	articles := []*UnreadArticle{}
-	for rows.Next() {
-		a := &UnreadArticle{}
-		var stamp int64
-		err := rows.Scan(&a.ID, &a.Title, &a.URL, &a.FeedName, &stamp)
+	page := &UnreadPage{Articles: []*UnreadArticle{}}
+	for _, a := range articles {
+		if len(page.Articles) == p.Limit {
+			last := page.Articles[p.Limit-1]
+			page.Next = Cursor(last.Published.Unix(), last.ID)
+			break
+		}
+		page.Articles = append(page.Articles, a)
+	}
+	return page
+}
+
+// UnreadArticles loads the given articles, skipping any that are not unread and visible to the user.
+func UnreadArticles(l *SessionLogger, user string, articles []string) []*UnreadArticle {
+	unread := []*UnreadArticle{}
+	for _, article := range articles {
+		a, err := Data.UnreadArticle(user, article)
+		if err == ErrNotFound {
+			continue
+		}
 		if err != nil {
-			l.E.Printf("Unread article list failed for user %v. Error: %v\n", user, err)
-			return nil
+			l.E.Printf("Failed loading unread article %v for user %v. Error: %v\n", article, user, err)
+			continue
 		}
-		a.Published = time.Unix(stamp, 0)
-		articles = append(articles, a)
+		unread = append(unread, a)
+	}
+	return unread
+}
+
+// UnreadFeedArticles loads the oldest unread articles in a feed.
+func UnreadFeedArticles(l *SessionLogger, user, feed string, limit int) []*UnreadArticle {
+	unread, err := Data.UnreadFeedArticles(user, feed, limit)
+	if err != nil {
+		l.E.Printf("Unread article list failed for feed %v, user %v. Error: %v\n", feed, user, err)
+		return nil
 	}
-	return articles
+	return unread
 }
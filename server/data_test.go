@@ -0,0 +1,240 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "context"
+import "fmt"
+import "sync"
+import "testing"
+import "net/http"
+
+import "github.com/mmcdole/gofeed"
+
+// testReadState checks which of the articles in a feed the user sees as read, and how many read exceptions they have.
+func testReadState(t *testing.T, user, feed string, read []bool, exceptions int) {
+	t.Helper()
+
+	articles := testArticles(t, user, feed)
+	if len(articles) != len(read) {
+		t.Fatalf("Got %v articles, expected %v", len(articles), len(read))
+	}
+	for i, a := range articles {
+		if a.Read != read[i] {
+			t.Fatalf("Article %v (%v) read is %v, expected %v", i, a.Title, a.Read, read[i])
+		}
+	}
+
+	count := 0
+	err := DB.QueryRow(`select count(*) from ReadExceptions where "User" = $1;`, user).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != exceptions {
+		t.Fatalf("User %v has %v read exceptions, expected %v", user, count, exceptions)
+	}
+}
+
+// testReadMark checks the user's watermark for a feed is on the given article.
+func testReadMark(t *testing.T, user, article string) {
+	t.Helper()
+
+	seq, mark := int64(0), int64(0)
+	err := DB.QueryRow(`
+		select a.Seq, coalesce(m.Seq, 0) from Articles a
+		left join ReadMarks m on m."User" = $1 and m.Feed = a.Feed
+		where a.ID = $2;
+	`, user, article).Scan(&seq, &mark)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mark != seq {
+		t.Fatalf("Watermark for user %v is %v, expected %v", user, mark, seq)
+	}
+}
+
+func TestReadMarks(t *testing.T) {
+	testDB(t, func(t *testing.T) {
+		testUser(t, "u1", "one@example.com")
+		testUser(t, "u2", "two@example.com")
+		feed := testFeed(t, "https://example.com/feed", "u1", "u2")
+		ids := testIngest(t, feed,
+			testItem("https://example.com/1", "One", 1),
+			testItem("https://example.com/2", "Two", 2),
+			testItem("https://example.com/3", "Three", 3),
+			testItem("https://example.com/4", "Four", 4),
+		)
+		testReadState(t, "u1", feed, []bool{false, false, false, false}, 0)
+		if unread := testUnread(t, "u1"); len(unread) != 4 {
+			t.Fatalf("Got %v unread articles, expected 4", len(unread))
+		}
+
+		// Reading in order just moves the watermark.
+		testStatus(t, "read 1", ArticleMarkRead(ml, "u1", ids[0]), http.StatusOK)
+		testReadMark(t, "u1", ids[0])
+		testReadState(t, "u1", feed, []bool{true, false, false, false}, 0)
+
+		// Skipping ahead needs an exception until the gap is filled, then the watermark jumps over it.
+		testStatus(t, "read 3", ArticleMarkRead(ml, "u1", ids[2]), http.StatusOK)
+		testReadMark(t, "u1", ids[0])
+		testReadState(t, "u1", feed, []bool{true, false, true, false}, 1)
+		testStatus(t, "read 2", ArticleMarkRead(ml, "u1", ids[1]), http.StatusOK)
+		testReadMark(t, "u1", ids[2])
+		testReadState(t, "u1", feed, []bool{true, true, true, false}, 0)
+
+		// Below the watermark unread is the exception.
+		testStatus(t, "unread 2", ArticleMarkUnread(ml, "u1", ids[1]), http.StatusOK)
+		testReadState(t, "u1", feed, []bool{true, false, true, false}, 1)
+		unread := testUnread(t, "u1")
+		if len(unread) != 2 || unread[0].ID != ids[1] || unread[1].ID != ids[3] {
+			t.Fatalf("Unread articles: %+v", unread)
+		}
+		testStatus(t, "read 2 again", ArticleMarkRead(ml, "u1", ids[1]), http.StatusOK)
+		testReadState(t, "u1", feed, []bool{true, true, true, false}, 0)
+
+		// Above it unread is the default, so nothing is left behind.
+		testStatus(t, "unread 4", ArticleMarkUnread(ml, "u1", ids[3]), http.StatusOK)
+		testReadState(t, "u1", feed, []bool{true, true, true, false}, 0)
+		testStatus(t, "read 4", ArticleMarkRead(ml, "u1", ids[3]), http.StatusOK)
+		testReadMark(t, "u1", ids[3])
+
+		// New articles come in unread.
+		more := testIngest(t, feed, testItem("https://example.com/5", "Five", 5))
+		testReadState(t, "u1", feed, []bool{true, true, true, true, false}, 0)
+		if unread := testUnread(t, "u1"); len(unread) != 1 || unread[0].ID != more[0] {
+			t.Fatalf("Unread articles: %+v", unread)
+		}
+
+		// None of that touched the other subscriber.
+		testReadState(t, "u2", feed, []bool{false, false, false, false, false}, 0)
+
+		testStatus(t, "missing article", ArticleMarkRead(ml, "u1", "nope"), http.StatusBadRequest)
+
+		// Unsubscribing drops the user's read state, even though the feed stays for u2.
+		testStatus(t, "unread 1", ArticleMarkUnread(ml, "u1", ids[0]), http.StatusOK)
+		testStatus(t, "unsubscribe", FeedUnsub(ml, "u1", feed), http.StatusOK)
+		for _, table := range []string{"ReadMarks", "ReadExceptions"} {
+			count := 0
+			err := DB.QueryRow(`select count(*) from `+table+` where "User" = $1;`, "u1").Scan(&count)
+			if err != nil || count != 0 {
+				t.Fatalf("%v has %v rows left for u1, error: %v", table, count, err)
+			}
+		}
+	})
+}
+
+func TestReadMarksConcurrent(t *testing.T) {
+	testDB(t, func(t *testing.T) {
+		testUser(t, "u1", "one@example.com")
+		feed := testFeed(t, "https://example.com/feed", "u1")
+		items := []*gofeed.Item{}
+		for i := int64(0); i < 20; i++ {
+			items = append(items, testItem(fmt.Sprintf("https://example.com/%v", i), fmt.Sprint(i), i))
+		}
+		ids := testIngest(t, feed, items...)
+
+		// Read everything but the first article at once, each one is an exception that has to survive until the
+		// first is read and the watermark can jump over them all.
+		var wg sync.WaitGroup
+		statuses := make([]int, len(ids))
+		for i := len(ids) - 1; i > 0; i-- {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				statuses[i] = ArticleMarkRead(ml, "u1", ids[i])
+			}(i)
+		}
+		wg.Wait()
+		for i, status := range statuses[1:] {
+			testStatus(t, fmt.Sprintf("read %v", i+1), status, http.StatusOK)
+		}
+
+		read := make([]bool, len(ids))
+		for i := range read {
+			read[i] = i > 0
+		}
+		testReadState(t, "u1", feed, read, len(ids)-1)
+
+		testStatus(t, "read 0", ArticleMarkRead(ml, "u1", ids[0]), http.StatusOK)
+		testReadMark(t, "u1", ids[len(ids)-1])
+		read[0] = true
+		testReadState(t, "u1", feed, read, 0)
+
+		// A stale watermark never moves it back.
+		_, err := Data.(*sqlStore).q["ReadMarkSet"].Exec("u1", feed, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testReadMark(t, "u1", ids[len(ids)-1])
+	})
+}
+
+func TestUnsubscribeLast(t *testing.T) {
+	testDB(t, func(t *testing.T) {
+		testUser(t, "u1", "one@example.com")
+		testUser(t, "u2", "two@example.com")
+		feed := testFeed(t, "https://example.com/feed", "u1", "u2")
+		testIngest(t, feed, testItem("https://example.com/1", "One", 1), testItem("https://example.com/2", "Two", 2))
+		FeedFetchOK(ml, feed, 1000)
+		FeedUpdateInfo(ml, feed, &gofeed.Feed{Title: "Feed"})
+		webSubSave(ml, &webSub{Feed: feed, Hub: "https://hub.example.com/", Topic: "https://example.com/feed", State: "active"})
+
+		// Keep a connection busy, so the unsubscribe happens on another one. Every connection has to clean up after a
+		// deleted feed, not just the first.
+		ctx := context.Background()
+		conn, err := DB.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		count := func(table string) int {
+			t.Helper()
+			n := 0
+			err := DB.QueryRow(`select count(*) from ` + table + `;`).Scan(&n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return n
+		}
+		tables := []string{"Articles", "ArticleContent", "FeedInfo", "FeedStatus", "WebSub"}
+
+		testStatus(t, "unsubscribe u1", FeedUnsub(ml, "u1", feed), http.StatusOK)
+		for _, table := range tables {
+			if count(table) == 0 {
+				t.Fatalf("%v was emptied while u2 is still subscribed", table)
+			}
+		}
+
+		testStatus(t, "unsubscribe u2", FeedUnsub(ml, "u2", feed), http.StatusOK)
+		for _, table := range tables {
+			if n := count(table); n != 0 {
+				t.Fatalf("%v has %v rows left after the last subscriber left", table, n)
+			}
+		}
+
+		// Nothing left behind gets in the way of adding it all again.
+		feed = testFeed(t, "https://example.com/feed", "u1")
+		testIngest(t, feed, testItem("https://example.com/1", "One", 1))
+		testReadState(t, "u1", feed, []bool{false}, 0)
+	})
+}
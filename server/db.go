@@ -22,14 +22,17 @@ misrepresented as being the original software.
 
 package main
 
-import _ "github.com/mattn/go-sqlite3"
+import "os"
+import "errors"
+import "strings"
 import "database/sql"
 
+import _ "github.com/mattn/go-sqlite3"
+
 var DB *sql.DB
 
+// InitCode is the schema as of the first migration. Schema changes go in a new migration (see migrate.go), never here.
 var InitCode = `
-pragma foreign_keys = on;
-
 create table if not exists Users (
 	ID text primary key,
 	Email text unique not null,
@@ -45,8 +48,11 @@ create table if not exists Feeds (
 );
 create unique index if not exists FeedURLs on Feeds(URL);
 
+-- Seq gives every article a stable number in the order we found them, used for read state and the APIs that
+-- want integer IDs.
 create table if not exists Articles (
-	ID text primary key,
+	Seq integer primary key autoincrement,
+	ID text unique not null,
 	Feed text not null,
 
 	Title text collate nocase,
@@ -58,10 +64,37 @@ create table if not exists Articles (
 );
 create unique index if not exists ArticleURLs on Articles(URL);
 
-create table if not exists ReadFlags (
+create index if not exists ArticleFeeds on Articles(Feed);
+create index if not exists ArticleDates on Articles(Feed, Published, ID);
+
+-- Read state is a per-user-per-feed watermark plus a small set of exceptions. Everything in the feed with a Seq at or
+-- below the watermark is read unless it has an exception with Read = 0, everything above is unread unless it has an
+-- exception with Read = 1. The watermark is advanced whenever possible so the exceptions stay bounded.
+create table if not exists ReadMarks (
+	User text not null,
+	Feed text not null,
+	Seq integer not null,
+
+	primary key (User, Feed),
+	foreign key (User) references Users(ID) on delete cascade,
+	foreign key (Feed) references Feeds(ID) on delete cascade
+);
+
+create table if not exists ReadExceptions (
 	User text not null,
 	Article text not null,
+	Read integer not null,
 
+	primary key (User, Article),
+	foreign key (User) references Users(ID) on delete cascade,
+	foreign key (Article) references Articles(ID) on delete cascade
+);
+
+create table if not exists StarFlags (
+	User text not null,
+	Article text not null,
+
+	primary key (User, Article),
 	foreign key (User) references Users(ID) on delete cascade,
 	foreign key (Article) references Articles(ID) on delete cascade
 );
@@ -82,161 +115,664 @@ create table if not exists Subscribed (
 	foreign key (User) references Users(ID) on delete cascade,
 	foreign key (Feed) references Feeds(ID) on delete cascade
 );
+
+-- Whatever the feed says about itself, updated every time it is fetched.
+create table if not exists FeedInfo (
+	Feed text primary key,
+	Title text not null,
+	Link text not null,
+	Description text not null,
+	Image text not null,
+	Language text not null,
+
+	foreign key (Feed) references Feeds(ID) on delete cascade
+);
+
+-- Cached favicons. A row with no data is a failed fetch, so we don't keep trying on every request.
+create table if not exists FeedIcons (
+	Feed text primary key,
+	Type text not null,
+	Data blob,
+	Fetched integer not null,
+
+	foreign key (Feed) references Feeds(ID) on delete cascade
+);
+
+-- Credentials for the compatibility APIs, Kind is the API the key is for.
+create table if not exists ApiKeys (
+	Key text primary key,
+	User text not null,
+	Kind text not null,
+	Created integer not null,
+
+	foreign key (User) references Users(ID) on delete cascade
+);
+
+-- The folder each subscription is filed under, if any.
+create table if not exists FeedFolders (
+	User text not null,
+	Feed text not null,
+	Folder text not null,
+
+	primary key (User, Feed),
+	foreign key (User) references Users(ID) on delete cascade,
+	foreign key (Feed) references Feeds(ID) on delete cascade
+);
+
+-- Per-feed overrides for the retention policy, null columns fall back to the global policy.
+create table if not exists FeedRetention (
+	Feed text primary key,
+	MaxAge integer,
+	MaxCount integer,
+	KeepUnread integer,
+	KeepStarred integer,
+
+	foreign key (Feed) references Feeds(ID) on delete cascade
+);
+
+-- Tombstones for pruned articles. These are kept as long as the article is still in the feed so it doesn't come
+-- back as a new article the next time the feed is fetched.
+create table if not exists Pruned (
+	URL text primary key,
+	Feed text not null,
+	Seen integer not null,
+
+	foreign key (Feed) references Feeds(ID) on delete cascade
+);
+
+-- Outgoing webhooks, an empty Feed means every feed the user is subscribed to.
+create table if not exists Webhooks (
+	ID text primary key,
+	User text not null,
+	Feed text not null,
+	URL text not null,
+	Secret text not null,
+	Created integer not null,
+
+	foreign key (User) references Users(ID) on delete cascade
+);
+create index if not exists WebhookFeeds on Webhooks(Feed);
+
+-- Recent webhook deliveries, trimmed to the last few per hook.
+create table if not exists WebhookDeliveries (
+	ID integer primary key autoincrement,
+	Hook text not null,
+	Event text not null,
+	Article text not null,
+	Attempts integer not null,
+	Status integer not null,
+	Error text not null,
+	Time integer not null,
+
+	foreign key (Hook) references Webhooks(ID) on delete cascade
+);
+create index if not exists WebhookDeliveryHooks on WebhookDeliveries(Hook, ID);
+
+-- Article data that is only kept so filter rules can be run against old articles.
+create table if not exists ArticleContent (
+	Article text primary key,
+	Author text not null,
+	Categories text not null, -- One per line
+	Content text not null,
+
+	foreign key (Article) references Articles(ID) on delete cascade
+);
+
+-- Filter rules, Conditions and Actions are JSON. An empty Feed means every feed the user is subscribed to.
+create table if not exists FilterRules (
+	ID text primary key,
+	User text not null,
+	Name text not null,
+	Feed text not null,
+	MatchAny integer not null,
+	Conditions text not null,
+	Actions text not null,
+	Disabled integer not null,
+	Created integer not null,
+
+	foreign key (User) references Users(ID) on delete cascade
+);
+
+create table if not exists HiddenFlags (
+	User text not null,
+	Article text not null,
+
+	primary key (User, Article),
+	foreign key (User) references Users(ID) on delete cascade,
+	foreign key (Article) references Articles(ID) on delete cascade
+);
+
+create table if not exists ArticleTags (
+	User text not null,
+	Article text not null,
+	Tag text not null,
+
+	primary key (User, Article, Tag),
+	foreign key (User) references Users(ID) on delete cascade,
+	foreign key (Article) references Articles(ID) on delete cascade
+);
+create index if not exists ArticleTagNames on ArticleTags(User, Tag);
+
+create table if not exists Notifications (
+	ID integer primary key autoincrement,
+	User text not null,
+	Article text not null,
+	Rule text not null,
+	Time integer not null,
+
+	foreign key (User) references Users(ID) on delete cascade,
+	foreign key (Article) references Articles(ID) on delete cascade
+);
+
+-- Feeds generated from a selection of a user's articles, fetched by anyone with the token.
+create table if not exists OutputFeeds (
+	ID text primary key,
+	Token text unique not null,
+	User text not null,
+	Kind text not null,
+	Value text not null,
+	Title text not null,
+	Created integer not null,
+
+	foreign key (User) references Users(ID) on delete cascade
+);
+
+-- The result of the last fetch of each feed. Error is empty when it worked, Failures counts the fetches in a row that
+-- didn't.
+create table if not exists FeedStatus (
+	Feed text primary key,
+	Fetched integer not null,
+	Succeeded integer not null,
+	Error text not null,
+	Failures integer not null,
+
+	foreign key (Feed) references Feeds(ID) on delete cascade
+);
+
+-- WebSub subscriptions, one per feed no matter how many users it has. Token is the last part of the callback URL, State
+-- is one of pending, active, denied, or unsubscribing.
+create table if not exists WebSub (
+	Feed text primary key,
+	Hub text not null,
+	Topic text not null,
+	Token text unique not null,
+	Secret text not null,
+	State text not null,
+	Expires integer not null,
+	Requested integer not null,
+
+	foreign key (Feed) references Feeds(ID) on delete cascade
+);
 `
 
 var Queries = map[string]*queryHolder{
-	// Background updater
-	"GetAllFeeds": &queryHolder{`
-		select URL, ID from Feeds;
+	// Retention
+	"FeedRetentionGet": &queryHolder{`
+		select MaxAge, MaxCount, KeepUnread, KeepStarred from FeedRetention where Feed = ?1;
 	`, nil},
-	"ArticleExistsByURL": &queryHolder{`
-		select ID from Articles where URL = ?1 union select "" order by 1 desc limit 1;
+	"FeedRetentionSet": &queryHolder{`
+		insert into FeedRetention (Feed, MaxAge, MaxCount, KeepUnread, KeepStarred) values (?1, ?2, ?3, ?4, ?5)
+		on conflict (Feed) do update set
+			MaxAge = excluded.MaxAge,
+			MaxCount = excluded.MaxCount,
+			KeepUnread = excluded.KeepUnread,
+			KeepStarred = excluded.KeepStarred;
 	`, nil},
-	"ArticleAdd": &queryHolder{`
-		insert into Articles (ID, Feed, Title, URL, Published) values (?1, ?2, ?3, ?4, ?5);
+	"PruneCandidates": &queryHolder{`
+		select a.ID from Articles a where (
+			a.Feed = ?1 and
+			(
+				a.Published < ?2 or
+				a.ID not in (select ID from Articles where Feed = ?1 order by Published desc, ID desc limit coalesce(?3, -1))
+			) and
+			not (?4 and exists (
+				select 1 from Subscribed s
+				left join ReadMarks m on m.User = s.User and m.Feed = s.Feed
+				left join ReadExceptions x on x.User = s.User and x.Article = a.ID
+				where s.Feed = a.Feed and not coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0))
+			)) and
+			not (?5 and exists (select 1 from StarFlags where Article = a.ID))
+		) limit ?6;
 	`, nil},
-	"FeedListSubs": &queryHolder{`
-		select User from Subscribed where Feed = ?1;
+	"PruneTombstone": &queryHolder{`
+		insert or replace into Pruned (URL, Feed, Seen) select URL, Feed, ?2 from Articles where ID = ?1;
 	`, nil},
-
-	// /api/user/confirm-email
-	"ConfirmEmail": &queryHolder{`
-		update Users set CanLogin = 1 where ID = ?1;
+	"PruneReadExceptions": &queryHolder{`
+		delete from ReadExceptions where Article = ?1;
+	`, nil},
+	"PruneStarFlags": &queryHolder{`
+		delete from StarFlags where Article = ?1;
 	`, nil},
-	"GetEmail": &queryHolder{`
-		select Email from Users where ID = ?1;
+	"PruneArticleContent": &queryHolder{`
+		delete from ArticleContent where Article = ?1;
 	`, nil},
-	// /api/user/delete-email
-	"DeleteEmail": &queryHolder{`
-		delete from Users where ID = ?1 and CanLogin = 0;
+	"PruneHiddenFlags": &queryHolder{`
+		delete from HiddenFlags where Article = ?1;
 	`, nil},
-	// /api/user/login (one row)
-	"UserLogin": &queryHolder{`
-		select ID, Password, CanLogin from Users where Email = ?1;
+	"PruneArticleTags": &queryHolder{`
+		delete from ArticleTags where Article = ?1;
 	`, nil},
-	// /api/user/new
-	"UserNew": &queryHolder{`
-		insert into Users (ID, Email, Password, CanLogin) values (?1, ?2, ?3, 0);
+	"PruneNotifications": &queryHolder{`
+		delete from Notifications where Article = ?1;
 	`, nil},
-	"UserEmailExists": &queryHolder{`
-		select exists(select 1 from Users where Email = ?1);
+	"PruneArticle": &queryHolder{`
+		delete from Articles where ID = ?1;
+	`, nil},
+
+	// /api/feed/pause
+	"FeedExists": &queryHolder{`
+		select exists(select 1 from Feeds where ID = ?1 limit 1);
 	`, nil},
-	// /api/user/new-pass
-	"UserNewPass": &queryHolder{`
-		update Users set Password = ?2 where ID = ?1;
+
+	// /api/feed/icon
+	"FeedIconGet": &queryHolder{`
+		select Type, Data, Fetched from FeedIcons where Feed = ?1;
 	`, nil},
-	"UserGetPass": &queryHolder{`
-		select Password from Users where ID = ?1;
+	"FeedIconSet": &queryHolder{`
+		insert into FeedIcons (Feed, Type, Data, Fetched) values (?1, ?2, ?3, ?4)
+		on conflict (Feed) do update set Type = excluded.Type, Data = excluded.Data, Fetched = excluded.Fetched;
 	`, nil},
-	// /api/user/new-name
-	"UserNewName": &queryHolder{`
-		update Users set Email = ?2, CanLogin = 0 where ID = ?1;
+	"FeedLinks": &queryHolder{`
+		select f.URL, coalesce(i.Link, "") from Feeds f left join FeedInfo i on i.Feed = f.ID where f.ID = ?1;
 	`, nil},
 
-	// /api/feed/list
-	"FeedList": &queryHolder{`
-		select ID, (
-				select Name from Subscribed where Feed = Feeds.ID and User = ?1
-			), URL, (
-			ID in (select Feed from PausedFlags where User = ?1)
-		) from Feeds where (
-			ID in (select Feed from Subscribed where User = ?1)
-		);
+	// Fever API
+	"FeverFeeds": &queryHolder{`
+		select f.ID, s.Name, f.URL, coalesce(i.Link, ""), coalesce((
+			select Folder from FeedFolders where User = ?1 and Feed = f.ID
+		), ""), coalesce((
+			select max(Published) from Articles where Feed = f.ID
+		), 0) from Subscribed s
+		join Feeds f on f.ID = s.Feed
+		left join FeedInfo i on i.Feed = f.ID
+		where s.User = ?1;
 	`, nil},
-	// /api/feed/details (one row)
-	"FeedDetails": &queryHolder{`
-		select ID, (
-			select Name from Subscribed where Feed = ?2 and User = ?1
-		), URL, (
-			ID in (select Feed from PausedFlags where User = ?1)
-		) from Feeds where (
-			ID = ?2 and
-			ID in (select Feed from Subscribed where User = ?1)
-		);
+	"FeverIcons": &queryHolder{`
+		select i.Feed, i.Type, i.Data from FeedIcons i
+		join Subscribed s on s.Feed = i.Feed and s.User = ?1
+		where length(i.Data) > 0;
 	`, nil},
-	// /api/feed/articles
-	"FeedArticles": &queryHolder{`
-		select ID, Title, URL, Published, (
-			ID in (select Article from ReadFlags where User = ?1)
-		) from Articles where (
-			Feed = ?2 and
-			Feed in (select Feed from Subscribed where User = ?1)
-		) order by Published;
+	"FeverItemsSince": &queryHolder{`
+		select a.Seq, a.Feed, a.Title, a.URL, a.Published, coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0)), (
+			exists (select 1 from StarFlags where User = ?1 and Article = a.ID)
+		) from Articles a
+		join Subscribed s on s.Feed = a.Feed and s.User = ?1
+		left join ReadMarks m on m.User = ?1 and m.Feed = a.Feed
+		left join ReadExceptions x on x.User = ?1 and x.Article = a.ID
+		where a.Seq > ?2 order by a.Seq limit ?3;
 	`, nil},
-	// /api/feed/subscribe
-	"FeedExistsByURL": &queryHolder{`
-		select ID from Feeds where URL = ?1 union select "" order by 1 desc limit 1;
+	"FeverItemsMax": &queryHolder{`
+		select a.Seq, a.Feed, a.Title, a.URL, a.Published, coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0)), (
+			exists (select 1 from StarFlags where User = ?1 and Article = a.ID)
+		) from Articles a
+		join Subscribed s on s.Feed = a.Feed and s.User = ?1
+		left join ReadMarks m on m.User = ?1 and m.Feed = a.Feed
+		left join ReadExceptions x on x.User = ?1 and x.Article = a.ID
+		where a.Seq < ?2 order by a.Seq desc limit ?3;
 	`, nil},
-	"FeedAdd": &queryHolder{`
-		insert into Feeds (ID, URL) values (?1, ?2);
+	"FeverItem": &queryHolder{`
+		select a.Seq, a.Feed, a.Title, a.URL, a.Published, coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0)), (
+			exists (select 1 from StarFlags where User = ?1 and Article = a.ID)
+		) from Articles a
+		join Subscribed s on s.Feed = a.Feed and s.User = ?1
+		left join ReadMarks m on m.User = ?1 and m.Feed = a.Feed
+		left join ReadExceptions x on x.User = ?1 and x.Article = a.ID
+		where a.Seq = ?2;
 	`, nil},
-	"FeedAlreadySubscibed": &queryHolder{`
-		select exists(select 1 from Subscribed where User = ?1 and Feed = ?2);
+	"FeverItemCount": &queryHolder{`
+		select count(*) from Articles where Feed in (select Feed from Subscribed where User = ?1);
 	`, nil},
-	"FeedSubscibe": &queryHolder{`
-		insert into Subscribed (User, Feed, Name) values (?1, ?2, ?3);
+	"FeverUnreadIDs": &queryHolder{`
+		select a.Seq from Subscribed s
+		join Articles a on a.Feed = s.Feed and a.Seq > coalesce((
+			select Seq from ReadMarks where User = ?1 and Feed = s.Feed
+		), 0)
+		where (
+			s.User = ?1 and
+			not s.Feed in (select Feed from PausedFlags where User = ?1) and
+			not exists (select 1 from ReadExceptions x where x.User = ?1 and x.Article = a.ID and x.Read = 1)
+		)
+		union all
+		select a.Seq from ReadExceptions x
+		join Articles a on a.ID = x.Article
+		join Subscribed s on s.Feed = a.Feed and s.User = ?1
+		where (
+			x.User = ?1 and
+			x.Read = 0 and
+			not s.Feed in (select Feed from PausedFlags where User = ?1)
+		) order by 1;
 	`, nil},
-	// /api/feed/unsubscribe
-	"FeedUnsub1": &queryHolder{`
-		delete from Subscribed where User = ?1 and Feed = ?2;
+	"FeverSavedIDs": &queryHolder{`
+		select a.Seq from StarFlags x
+		join Articles a on a.ID = x.Article
+		join Subscribed s on s.Feed = a.Feed and s.User = ?1
+		where x.User = ?1 order by 1;
 	`, nil},
-	"FeedUnsub2": &queryHolder{`
-		delete from PausedFlags where User = ?1 and Feed = ?2;
+	"ArticleBySeq": &queryHolder{`
+		select a.ID from Articles a
+		join Subscribed s on s.Feed = a.Feed and s.User = ?1
+		where a.Seq = ?2;
 	`, nil},
-	"FeedHasSubs": &queryHolder{`
-		select exists(select 1 from Subscribed where Feed = ?1 limit 1);
+	// Google Reader API
+	"ApiKeyGet": &queryHolder{`
+		select Key from ApiKeys where User = ?1 and Kind = ?2;
 	`, nil},
-	"FeedDelete": &queryHolder{`
-		delete from Feeds where ID = ?1;
+	"GReaderItemsOldest": &queryHolder{`
+		select a.Seq, a.ID, a.Feed, a.Title, a.URL, a.Published, coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0)), (
+			exists (select 1 from StarFlags where User = ?1 and Article = a.ID)
+		), s.Name, coalesce(i.Link, ""), coalesce(d.Folder, "") from Articles a
+		join Subscribed s on s.Feed = a.Feed and s.User = ?1
+		left join ReadMarks m on m.User = ?1 and m.Feed = a.Feed
+		left join ReadExceptions x on x.User = ?1 and x.Article = a.ID
+		left join FeedInfo i on i.Feed = a.Feed
+		left join FeedFolders d on d.User = ?1 and d.Feed = a.Feed
+		where (
+			(?2 = "" or a.Feed = ?2) and
+			(?3 = "" or d.Folder = ?3) and
+			(not ?4 or exists (select 1 from StarFlags where User = ?1 and Article = a.ID)) and
+			(?5 is null or coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0)) = ?5) and
+			a.Published >= ?6 and a.Published < ?7 and
+			(a.Published, a.ID) > (?8, ?9)
+		) order by a.Published, a.ID limit ?10;
 	`, nil},
-	// /api/feed/pause
-	"FeedExists": &queryHolder{`
-		select exists(select 1 from Feeds where ID = ?1 limit 1);
+	"GReaderItemsNewest": &queryHolder{`
+		select a.Seq, a.ID, a.Feed, a.Title, a.URL, a.Published, coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0)), (
+			exists (select 1 from StarFlags where User = ?1 and Article = a.ID)
+		), s.Name, coalesce(i.Link, ""), coalesce(d.Folder, "") from Articles a
+		join Subscribed s on s.Feed = a.Feed and s.User = ?1
+		left join ReadMarks m on m.User = ?1 and m.Feed = a.Feed
+		left join ReadExceptions x on x.User = ?1 and x.Article = a.ID
+		left join FeedInfo i on i.Feed = a.Feed
+		left join FeedFolders d on d.User = ?1 and d.Feed = a.Feed
+		where (
+			(?2 = "" or a.Feed = ?2) and
+			(?3 = "" or d.Folder = ?3) and
+			(not ?4 or exists (select 1 from StarFlags where User = ?1 and Article = a.ID)) and
+			(?5 is null or coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0)) = ?5) and
+			a.Published >= ?6 and a.Published < ?7 and
+			(a.Published, a.ID) < (?8, ?9)
+		) order by a.Published desc, a.ID desc limit ?10;
+	`, nil},
+	"GReaderItem": &queryHolder{`
+		select a.Seq, a.ID, a.Feed, a.Title, a.URL, a.Published, coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0)), (
+			exists (select 1 from StarFlags where User = ?1 and Article = a.ID)
+		), s.Name, coalesce(i.Link, ""), coalesce(d.Folder, "") from Articles a
+		join Subscribed s on s.Feed = a.Feed and s.User = ?1
+		left join ReadMarks m on m.User = ?1 and m.Feed = a.Feed
+		left join ReadExceptions x on x.User = ?1 and x.Article = a.ID
+		left join FeedInfo i on i.Feed = a.Feed
+		left join FeedFolders d on d.User = ?1 and d.Feed = a.Feed
+		where a.Seq = ?2;
+	`, nil},
+	"GReaderUnreadCounts": &queryHolder{`
+		select s.Feed, count(a.Seq), coalesce(max(a.Published), 0) from Subscribed s
+		join Articles a on a.Feed = s.Feed
+		left join ReadMarks m on m.User = ?1 and m.Feed = s.Feed
+		left join ReadExceptions x on x.User = ?1 and x.Article = a.ID
+		where s.User = ?1 and not coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0))
+		group by s.Feed;
+	`, nil},
+	"FeedRename": &queryHolder{`
+		update Subscribed set Name = ?3 where User = ?1 and Feed = ?2;
+	`, nil},
+	// /api/webhook/...
+	"WebhookAdd": &queryHolder{`
+		insert into Webhooks (ID, User, Feed, URL, Secret, Created) values (?1, ?2, ?3, ?4, ?5, ?6);
+	`, nil},
+	"WebhookList": &queryHolder{`
+		select ID, Feed, URL, Secret, Created from Webhooks where User = ?1 order by Created;
+	`, nil},
+	"WebhookGet": &queryHolder{`
+		select ID, Feed, URL, Secret, Created from Webhooks where User = ?1 and ID = ?2;
+	`, nil},
+	"WebhookDelete1": &queryHolder{`
+		delete from WebhookDeliveries where Hook in (select ID from Webhooks where User = ?1 and ID = ?2);
+	`, nil},
+	"WebhookDelete2": &queryHolder{`
+		delete from Webhooks where User = ?1 and ID = ?2;
+	`, nil},
+	"WebhooksForFeed": &queryHolder{`
+		select h.ID, h.URL, h.Secret, s.Name, f.URL from Webhooks h
+		join Subscribed s on s.User = h.User and s.Feed = ?1
+		join Feeds f on f.ID = ?1
+		where h.Feed = ?1 or h.Feed = "";
+	`, nil},
+	"WebhookDeliveryAdd": &queryHolder{`
+		insert into WebhookDeliveries (Hook, Event, Article, Attempts, Status, Error, Time) values (?1, ?2, ?3, 0, 0, "", ?4);
+	`, nil},
+	"WebhookDeliveryUpdate": &queryHolder{`
+		update WebhookDeliveries set Attempts = ?2, Status = ?3, Error = ?4, Time = ?5 where ID = ?1;
+	`, nil},
+	"WebhookDeliveryTrim": &queryHolder{`
+		delete from WebhookDeliveries where Hook = ?1 and ID <= (
+			select ID from WebhookDeliveries where Hook = ?1 order by ID desc limit 1 offset ?2
+		);
+	`, nil},
+	"WebhookDeliveries": &queryHolder{`
+		select ID, Event, Article, Attempts, Status, Error, Time from WebhookDeliveries
+		where Hook = ?1 order by ID desc;
+	`, nil},
+	// /api/filter/...
+	"ArticleContentAdd": &queryHolder{`
+		insert or replace into ArticleContent (Article, Author, Categories, Content) values (?1, ?2, ?3, ?4);
+	`, nil},
+	"FilterRulesForFeed": &queryHolder{`
+		select r.User, r.ID, r.Name, r.Feed, r.MatchAny, r.Conditions, r.Actions, r.Disabled, r.Created from FilterRules r
+		join Subscribed s on s.User = r.User and s.Feed = ?1
+		where not r.Disabled and (r.Feed = ?1 or r.Feed = "") order by r.Created;
 	`, nil},
-	"FeedPause": &queryHolder{`
-		insert into PausedFlags (User, Feed) values (?1, ?2);
+	"FilterRuleList": &queryHolder{`
+		select ID, Name, Feed, MatchAny, Conditions, Actions, Disabled, Created from FilterRules
+		where User = ?1 order by Created;
 	`, nil},
-	// //api/feed/unpause
-	"FeedUnpause": &queryHolder{`
-		delete from PausedFlags where User = ?1 and Feed = ?2;
+	"FilterRuleGet": &queryHolder{`
+		select ID, Name, Feed, MatchAny, Conditions, Actions, Disabled, Created from FilterRules
+		where User = ?1 and ID = ?2;
+	`, nil},
+	"FilterRuleAdd": &queryHolder{`
+		insert into FilterRules (ID, User, Name, Feed, MatchAny, Conditions, Actions, Disabled, Created)
+		values (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9);
+	`, nil},
+	"FilterRuleUpdate": &queryHolder{`
+		update FilterRules set Name = ?3, Feed = ?4, MatchAny = ?5, Conditions = ?6, Actions = ?7, Disabled = ?8
+		where User = ?1 and ID = ?2;
+	`, nil},
+	"FilterRuleDelete": &queryHolder{`
+		delete from FilterRules where User = ?1 and ID = ?2;
+	`, nil},
+	"FilterArticles": &queryHolder{`
+		select a.ID, a.Feed, a.Title, a.URL, a.Published, coalesce(c.Author, ""), coalesce(c.Categories, ""), (
+			coalesce(c.Content, "")
+		) from Articles a
+		join Subscribed s on s.Feed = a.Feed and s.User = ?1
+		left join ArticleContent c on c.Article = a.ID
+		where ?2 = "" or a.Feed = ?2
+		order by a.Published desc, a.ID desc;
+	`, nil},
+	"FilterHide": &queryHolder{`
+		insert or ignore into HiddenFlags (User, Article) values (?1, ?2);
+	`, nil},
+	"FilterNotify": &queryHolder{`
+		insert into Notifications (User, Article, Rule, Time) values (?1, ?2, ?3, ?4);
 	`, nil},
 
-	// /api/article/read
-	"ArticleRead": &queryHolder{`
-		insert into ReadFlags (User, Article) values (?1, ?2);
+	// /api/notification/...
+	"NotificationList": &queryHolder{`
+		select n.ID, n.Article, n.Rule, n.Time, a.Title, a.URL, s.Name from Notifications n
+		join Articles a on a.ID = n.Article
+		join Subscribed s on s.User = n.User and s.Feed = a.Feed
+		where n.User = ?1 order by n.ID desc;
+	`, nil},
+	"NotificationClear": &queryHolder{`
+		delete from Notifications where User = ?1 and ID <= ?2;
+	`, nil},
+	// /api/tag/...
+	"ArticleTag": &queryHolder{`
+		insert or ignore into ArticleTags (User, Article, Tag)
+		select ?1, ID, ?3 from Articles where ID = ?2 and Feed in (select Feed from Subscribed where User = ?1);
+	`, nil},
+	"ArticleUntag": &queryHolder{`
+		delete from ArticleTags where User = ?1 and Article = ?2 and Tag = ?3;
+	`, nil},
+	"TagCounts": &queryHolder{`
+		select Tag, count(*) from ArticleTags where User = ?1 group by Tag order by Tag;
+	`, nil},
+	"TagArticlesOldest": &queryHolder{`
+		select a.ID, a.Title, a.URL, s.Name, a.Published, coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0)), (
+			exists (select 1 from StarFlags where User = ?1 and Article = a.ID)
+		) from ArticleTags t
+		join Articles a on a.ID = t.Article
+		join Subscribed s on s.Feed = a.Feed and s.User = ?1
+		left join ReadMarks m on m.User = ?1 and m.Feed = a.Feed
+		left join ReadExceptions x on x.User = ?1 and x.Article = a.ID
+		where (
+			t.User = ?1 and
+			t.Tag = ?2 and
+			(a.Published, a.ID) > (?3, ?4)
+		) order by a.Published, a.ID limit ?5;
 	`, nil},
-	// /api/article/unread
-	"ArticleUnread": &queryHolder{`
-		delete from ReadFlags where User = ?1 and Article = ?2;
+	"TagArticlesNewest": &queryHolder{`
+		select a.ID, a.Title, a.URL, s.Name, a.Published, coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0)), (
+			exists (select 1 from StarFlags where User = ?1 and Article = a.ID)
+		) from ArticleTags t
+		join Articles a on a.ID = t.Article
+		join Subscribed s on s.Feed = a.Feed and s.User = ?1
+		left join ReadMarks m on m.User = ?1 and m.Feed = a.Feed
+		left join ReadExceptions x on x.User = ?1 and x.Article = a.ID
+		where (
+			t.User = ?1 and
+			t.Tag = ?2 and
+			(a.Published, a.ID) < (?3, ?4)
+		) order by a.Published desc, a.ID desc limit ?5;
 	`, nil},
-	// /api/article/feed
-	"GetUnread": &queryHolder{`
-		select a.ID, a.Title, a.URL, fn.Name, a.Published from Articles a
-		left join Subscribed fn on fn.Feed = a.Feed and fn.User = ?1 where (
-			not a.ID in (select Article from ReadFlags where User = ?1) and
-			not a.Feed in (select Feed from PausedFlags where User = ?1)
-		) order by Published;
+	// /api/outfeed/..., /out/
+	"OutputFeedAdd": &queryHolder{`
+		insert into OutputFeeds (ID, Token, User, Kind, Value, Title, Created) values (?1, ?2, ?3, ?4, ?5, ?6, ?7);
+	`, nil},
+	"OutputFeedList": &queryHolder{`
+		select ID, Token, Kind, Value, Title, Created from OutputFeeds where User = ?1 order by Created;
+	`, nil},
+	"OutputFeedDelete": &queryHolder{`
+		delete from OutputFeeds where User = ?1 and ID = ?2;
+	`, nil},
+	"OutputFeedByToken": &queryHolder{`
+		select ID, Token, User, Kind, Value, Title, Created from OutputFeeds where Token = ?1;
+	`, nil},
+	"OutputFeedItems": &queryHolder{`
+		select a.ID, a.Title, a.URL, a.Published, s.Name, f.URL, coalesce(i.Link, ""), coalesce(c.Content, "") from Articles a
+		join Subscribed s on s.Feed = a.Feed and s.User = ?1
+		join Feeds f on f.ID = a.Feed
+		left join FeedInfo i on i.Feed = a.Feed
+		left join ArticleContent c on c.Article = a.ID
+		where case ?2
+			when "starred" then exists (select 1 from StarFlags where User = ?1 and Article = a.ID)
+			when "tag" then exists (select 1 from ArticleTags where User = ?1 and Article = a.ID and Tag = ?3)
+			when "folder" then (
+				exists (select 1 from FeedFolders where User = ?1 and Feed = a.Feed and Folder = ?3) and
+				not exists (select 1 from HiddenFlags where User = ?1 and Article = a.ID)
+			)
+			else 0
+		end
+		order by a.Published desc, a.ID desc limit ?4;
+	`, nil},
+	// WebSub
+	"WebSubGet": &queryHolder{`
+		select Feed, Hub, Topic, Token, Secret, State, Expires, Requested from WebSub where Feed = ?1;
+	`, nil},
+	"WebSubByToken": &queryHolder{`
+		select Feed, Hub, Topic, Token, Secret, State, Expires, Requested from WebSub where Token = ?1;
+	`, nil},
+	"WebSubSet": &queryHolder{`
+		insert into WebSub (Feed, Hub, Topic, Token, Secret, State, Expires, Requested)
+		values (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8)
+		on conflict (Feed) do update set
+			Hub = excluded.Hub,
+			Topic = excluded.Topic,
+			Token = excluded.Token,
+			Secret = excluded.Secret,
+			State = excluded.State,
+			Expires = excluded.Expires,
+			Requested = excluded.Requested;
+	`, nil},
+	"WebSubDelete": &queryHolder{`
+		delete from WebSub where Feed = ?1;
+	`, nil},
+	"WebSubPollSkip": &queryHolder{`
+		select w.Feed from WebSub w join FeedStatus s on s.Feed = w.Feed
+		where w.State = "active" and w.Expires > ?1 and s.Fetched > ?2 and s.Error = "";
 	`, nil},
 }
 
+// RSN2_DATABASE is a postgres:// (or postgresql://) URL to use PostgreSQL, anything else is a SQLite database. The
+// default is feeds.db in the working directory.
+var DBSource = "file:feeds.db"
+
+// DBPostgres is set when DBSource is a PostgreSQL URL.
+var DBPostgres bool
+
+// The SQLite version of every query, DBOpen replaces the code in Queries when using PostgreSQL.
+var sqliteQueries = map[string]string{}
+
 func init() {
+	if v := os.Getenv("RSN2_DATABASE"); v != "" {
+		DBSource = v
+	}
+
+	for name, v := range Queries {
+		sqliteQueries[name] = v.Code
+	}
+}
+
+// DBOpen connects to DBSource, brings the schema up to date, and prepares every query. Nothing may touch the database
+// before it is called. The tests call it again for each database they run against.
+func DBOpen() error {
+	DBPostgres = strings.HasPrefix(DBSource, "postgres://") || strings.HasPrefix(DBSource, "postgresql://")
+
+	driver, source := "sqlite3", DBSource
+	if DBPostgres {
+		driver = "postgres"
+	} else {
+		// Foreign keys are a per connection setting in SQLite, and the pool opens connections as it likes.
+		sep := "?"
+		if strings.Contains(source, "?") {
+			sep = "&"
+		}
+		source += sep + "_foreign_keys=1"
+	}
+
 	var err error
-	DB, err = sql.Open("sqlite3", "file:feeds.db")
+	DB, err = sql.Open(driver, source)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	_, err = DB.Exec(InitCode)
+	err = Migrate()
 	if err != nil {
-		panic("Error loading DB init code:\n" + err.Error())
+		return errors.New("Error migrating DB:\n" + err.Error())
 	}
 
-	for _, v := range Queries {
+	for name, v := range Queries {
+		v.Code = sqliteQueries[name]
+		if DBPostgres {
+			code, ok := postgresQueries[name]
+			if !ok {
+				return errors.New("No PostgreSQL version of query: " + name)
+			}
+			v.Code = code
+		}
+
 		err := v.Init()
 		if err != nil {
-			panic("Error loading query: " + v.Code + "\n\n" + err.Error())
+			return errors.New("Error loading query: " + v.Code + "\n\n" + err.Error())
 		}
 	}
+
+	storeQueries := sqliteStoreQueries
+	if DBPostgres {
+		storeQueries = postgresStoreQueries
+	}
+	Data, err = newSQLStore(DB, storeQueries)
+	return err
 }
 
 type queryHolder struct {
@@ -249,3 +785,19 @@ func (q *queryHolder) Init() error {
 	q.Preped, err = DB.Prepare(q.Code)
 	return err
 }
+
+// InsertID runs an insert into a table with an integer key and returns the new key. PostgreSQL can't report it after
+// the fact, so the PostgreSQL version of the query has to return it.
+func (q *queryHolder) InsertID(args ...interface{}) (int64, error) {
+	if DBPostgres {
+		id := int64(0)
+		err := q.Preped.QueryRow(args...).Scan(&id)
+		return id, err
+	}
+
+	res, err := q.Preped.Exec(args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "os"
+import "time"
+import "testing"
+import "net/http"
+import "database/sql"
+import "path/filepath"
+
+import "github.com/mmcdole/gofeed"
+
+// The tests run against a new SQLite database every time. Set RSN2_TEST_POSTGRES to a postgres:// URL to run them
+// against PostgreSQL as well, everything in that database is dropped first. devops/test.sh does this with docker.
+var testPostgres = os.Getenv("RSN2_TEST_POSTGRES")
+
+// testDB runs f once for each database under test, each time with an empty database.
+func testDB(t *testing.T, f func(t *testing.T)) {
+	t.Run("sqlite", func(t *testing.T) {
+		DBSource = "file:" + filepath.Join(t.TempDir(), "feeds.db")
+		testOpen(t)
+		f(t)
+	})
+
+	if testPostgres == "" {
+		return
+	}
+	t.Run("postgres", func(t *testing.T) {
+		db, err := sql.Open("postgres", testPostgres)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`drop schema public cascade; create schema public;`)
+		db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		DBSource = testPostgres
+		testOpen(t)
+		f(t)
+	})
+}
+
+func testOpen(t *testing.T) {
+	err := DBOpen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { DB.Close() })
+}
+
+// testUser adds a confirmed user. The store doesn't care what the password hash looks like.
+func testUser(t *testing.T, user, email string) {
+	err := Data.UserAdd(user, email, "hash")
+	if err == nil {
+		err = Data.UserConfirm(user)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testFeed subscribes each of the users to a feed, returning its ID.
+func testFeed(t *testing.T, url string, users ...string) string {
+	feed := ""
+	for _, user := range users {
+		id, status := FeedSubscribe(ml, user, url, "Feed "+url)
+		if status != http.StatusOK {
+			t.Fatalf("Subscribing user %v to %v failed with status %v", user, url, status)
+		}
+		feed = id
+	}
+	return feed
+}
+
+// testItem makes a feed item published the given number of hours after the epoch.
+func testItem(link, title string, hour int64) *gofeed.Item {
+	published := time.Unix(hour*3600, 0)
+	return &gofeed.Item{Title: title, Link: link, Content: "Content of " + title, PublishedParsed: &published}
+}
+
+// testIngest adds the items to a feed the same way fetching it would, returning the article IDs in the same order.
+func testIngest(t *testing.T, feed string, items ...*gofeed.Item) []string {
+	FeedIngest(ml, feed, &gofeed.Feed{Items: items}, time.Now().Unix(), map[string][]string{})
+
+	ids := []string{}
+	for _, item := range items {
+		id, err := Data.ArticleByURL(item.Link)
+		if err != nil || id == "" {
+			t.Fatalf("Article %v was not added, error: %v", item.Link, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// testArticles lists the articles in a feed as the user sees them, oldest first.
+func testArticles(t *testing.T, user, feed string) []*Article {
+	page := FeedArticles(ml, user, feed, NewPageParams(false, MaxPageSize))
+	if page == nil {
+		t.Fatalf("Listing feed %v for user %v failed", feed, user)
+	}
+	return page.Articles
+}
+
+// testUnread lists the user's unread articles, oldest first.
+func testUnread(t *testing.T, user string) []*UnreadArticle {
+	page := GetUnread(ml, user, "", NewPageParams(false, MaxPageSize))
+	if page == nil {
+		t.Fatalf("Listing unread articles for user %v failed", user)
+	}
+	return page.Articles
+}
+
+// testStatus fails the test if a data function didn't return the expected status.
+func testStatus(t *testing.T, what string, got, want int) {
+	t.Helper()
+	if got != want {
+		t.Fatalf("%v: got status %v, expected %v", what, got, want)
+	}
+}
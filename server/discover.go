@@ -0,0 +1,247 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "io"
+import "sync"
+import "time"
+import "bytes"
+import "strings"
+import "net/url"
+import "net/http"
+import "io/ioutil"
+
+import "golang.org/x/net/html"
+import "golang.org/x/net/html/atom"
+
+import "github.com/mmcdole/gofeed"
+
+const MaxDiscoverBytes = int64(4 << 20)
+
+// A page may link to any number of feeds, only this many are checked.
+const MaxDiscoverCandidates = 10
+
+// How many candidates are checked at once.
+const DiscoverWorkers = 4
+
+var discoverClient = &http.Client{Timeout: 15 * time.Second}
+
+// Link types that mark a feed in a HTML page.
+var feedLinkTypes = map[string]bool{
+	"application/rss+xml":   true,
+	"application/atom+xml":  true,
+	"application/feed+json": true,
+	"application/json":      true,
+	"application/xml":       true,
+	"text/xml":              true,
+}
+
+// Tried against the site root when a page doesn't link to any feeds.
+var commonFeedPaths = []string{
+	"/feed",
+	"/rss",
+	"/feed.xml",
+	"/rss.xml",
+	"/atom.xml",
+	"/index.xml",
+	"/feed.json",
+}
+
+type FeedCandidate struct {
+	URL   string
+	Title string
+}
+
+// FeedDiscover looks for feeds at the given URL. If the URL is itself a feed it is the only candidate returned,
+// otherwise it is treated as a web page and any feeds it links to (or that are at the usual places) are returned.
+// Every candidate has been fetched and parsed, so they are all known to be good.
+func FeedDiscover(l *SessionLogger, page string) ([]*FeedCandidate, int) {
+	res, err := Fetch(discoverClient, page, MaxDiscoverBytes)
+	if err != nil {
+		l.W.Printf("Could not fetch %v for discovery. Error: %v\n", page, err)
+		return nil, http.StatusBadRequest
+	}
+
+	f, err := FeedParse(res)
+	if err == nil {
+		return []*FeedCandidate{{URL: page, Title: f.Title}}, http.StatusOK
+	}
+
+	links := discoverLinks(res.Body, res.URL)
+	if len(links) == 0 {
+		for _, p := range commonFeedPaths {
+			u := *res.URL
+			u.Path, u.RawQuery, u.Fragment = p, "", ""
+			links = append(links, u.String())
+		}
+	}
+
+	if len(links) > MaxDiscoverCandidates {
+		links = links[:MaxDiscoverCandidates]
+	}
+
+	// Check several at once, some of these may be slow and most of them will fail.
+	found := make([]*FeedCandidate, len(links))
+	jobs := make(chan int)
+	wg := sync.WaitGroup{}
+	for i := 0; i < DiscoverWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				f, ok := discoverValidate(links[i])
+				if ok {
+					found[i] = &FeedCandidate{URL: links[i], Title: f.Title}
+				}
+			}
+		}()
+	}
+	for i := range links {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	candidates := []*FeedCandidate{}
+	for _, c := range found {
+		if c != nil {
+			candidates = append(candidates, c)
+		}
+	}
+	l.I.Printf("Found %v feeds from %v.\n", len(candidates), page)
+	return candidates, http.StatusOK
+}
+
+// FeedCheck makes sure a URL is a feed before anyone is subscribed to it, and returns the title it gives itself.
+// Feeds we already have were checked when they were added, anything else has to actually be a feed. If it isn't
+// whatever feeds could be found there are returned with StatusMultipleChoices so the user can pick one.
+func FeedCheck(l *SessionLogger, link string) (string, []*FeedCandidate, int) {
+	_, err := url.ParseRequestURI(link)
+	if err != nil {
+		l.W.Printf("Malformed URL. Error: %v\n", err)
+		return "", nil, http.StatusBadRequest
+	}
+
+	known, status := FeedKnown(l, link)
+	if status != http.StatusOK {
+		return "", nil, status
+	}
+	if known {
+		return FeedTitle(l, link), nil, http.StatusOK
+	}
+
+	candidates, status := FeedDiscover(l, link)
+	if candidates == nil {
+		return "", nil, status
+	}
+	if len(candidates) == 0 {
+		l.W.Printf("No feeds found at %v.\n", link)
+		return "", nil, http.StatusBadRequest
+	}
+	if len(candidates) > 1 || candidates[0].URL != link {
+		return "", candidates, http.StatusMultipleChoices
+	}
+	return candidates[0].Title, nil, http.StatusOK
+}
+
+// discoverFetch gets a URL as-is, for things like icons that aren't text.
+func discoverFetch(page string, limit int64) ([]byte, *url.URL, error) {
+	resp, err := discoverClient.Get(page)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, nil, gofeed.HTTPError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit))
+	if err != nil {
+		return nil, nil, err
+	}
+	return body, resp.Request.URL, nil
+}
+
+func discoverValidate(link string) (*gofeed.Feed, bool) {
+	res, err := Fetch(discoverClient, link, MaxDiscoverBytes)
+	if err != nil {
+		return nil, false
+	}
+	f, err := FeedParse(res)
+	if err != nil {
+		return nil, false
+	}
+	return f, true
+}
+
+// discoverLinks pulls the feed links out of a HTML page, resolved against the page (or its <base>) URL.
+func discoverLinks(body []byte, base *url.URL) []string {
+	doc, err := html.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil
+	}
+
+	links := []string{}
+	seen := map[string]bool{}
+
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.DataAtom == atom.Base {
+			if u, err := base.Parse(attr(n, "href")); err == nil && attr(n, "href") != "" {
+				base = u
+			}
+		}
+		if n.Type == html.ElementNode && (n.DataAtom == atom.Link || n.DataAtom == atom.A) {
+			rels := strings.Fields(strings.ToLower(attr(n, "rel")))
+			typ := strings.ToLower(strings.TrimSpace(strings.Split(attr(n, "type"), ";")[0]))
+			href := attr(n, "href")
+
+			isalt := false
+			for _, rel := range rels {
+				isalt = isalt || rel == "alternate" || rel == "feed"
+			}
+			if isalt && feedLinkTypes[typ] && href != "" {
+				if u, err := base.Parse(href); err == nil && !seen[u.String()] {
+					seen[u.String()] = true
+					links = append(links, u.String())
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	return links
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
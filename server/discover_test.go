@@ -0,0 +1,135 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "fmt"
+import "testing"
+import "net/url"
+import "net/http"
+import "net/http/httptest"
+
+// testRSS makes a RSS feed with an item for each link.
+func testRSS(title string, links ...string) string {
+	items := ""
+	for _, link := range links {
+		items += "<item><title>" + link + "</title><link>" + link + "</link></item>"
+	}
+	return `<?xml version="1.0"?><rss version="2.0"><channel><title>` + title + `</title>` + items + `</channel></rss>`
+}
+
+// testServer serves each of the pages with the given content type, anything else is a 404.
+func testServer(t *testing.T, typ string, pages map[string]string) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", typ)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func testCandidates(t *testing.T, got []*FeedCandidate, want ...FeedCandidate) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("Got %v candidates, expected %v", len(got), len(want))
+	}
+	for i, c := range got {
+		if *c != want[i] {
+			t.Fatalf("Got candidate %+v, expected %+v", c, want[i])
+		}
+	}
+}
+
+func TestFeedDiscover(t *testing.T) {
+	s := testServer(t, "text/html", map[string]string{
+		"/feed.xml":     testRSS("Main"),
+		"/sub/comments": testRSS("Comments"),
+		"/rss":          testRSS("Guessed"),
+		"/page": `<html><head>
+			<base href="/sub/">
+			<link rel="alternate" type="application/rss+xml" href="/feed.xml">
+			<link rel="alternate" type="application/rss+xml; charset=utf-8" href="/feed.xml">
+			<link rel="Alternate feed" type="application/atom+xml" href="comments">
+			<link rel="alternate" type="application/rss+xml" href="/missing.xml">
+			<link rel="stylesheet" type="text/css" href="/style.css">
+		</head><body><a rel="alternate" type="application/rss+xml" href="/page">Not a feed</a></body></html>`,
+		"/bare": `<html><body>Nothing to see here.</body></html>`,
+	})
+
+	candidates, status := FeedDiscover(ml, s.URL+"/feed.xml")
+	testStatus(t, "feed", status, http.StatusOK)
+	testCandidates(t, candidates, FeedCandidate{s.URL + "/feed.xml", "Main"})
+
+	// Duplicates, broken links, and links that aren't feeds are all dropped, and relative links use the <base>.
+	candidates, status = FeedDiscover(ml, s.URL+"/page")
+	testStatus(t, "page", status, http.StatusOK)
+	testCandidates(t, candidates, FeedCandidate{s.URL + "/feed.xml", "Main"}, FeedCandidate{s.URL + "/sub/comments", "Comments"})
+
+	// No links at all, so it falls back on guessing.
+	candidates, status = FeedDiscover(ml, s.URL+"/bare?x=1")
+	testStatus(t, "bare", status, http.StatusOK)
+	testCandidates(t, candidates, FeedCandidate{s.URL + "/rss", "Guessed"}, FeedCandidate{s.URL + "/feed.xml", "Main"})
+
+	candidates, status = FeedDiscover(ml, s.URL+"/missing")
+	testStatus(t, "missing", status, http.StatusBadRequest)
+	if candidates != nil {
+		t.Fatalf("Got candidates %v for a missing page", candidates)
+	}
+}
+
+func TestFeedDiscoverLimit(t *testing.T) {
+	pages := map[string]string{}
+	page := "<html><head>"
+	for i := 0; i < MaxDiscoverCandidates+5; i++ {
+		path := fmt.Sprintf("/feed%v.xml", i)
+		pages[path] = testRSS(fmt.Sprint(i))
+		page += `<link rel="alternate" type="application/rss+xml" href="` + path + `">`
+	}
+	pages["/page"] = page + "</head></html>"
+	s := testServer(t, "text/html", pages)
+
+	// Only the first links on the page are checked, in the order they are on it.
+	want := []FeedCandidate{}
+	for i := 0; i < MaxDiscoverCandidates; i++ {
+		want = append(want, FeedCandidate{fmt.Sprintf("%v/feed%v.xml", s.URL, i), fmt.Sprint(i)})
+	}
+	candidates, status := FeedDiscover(ml, s.URL+"/page")
+	testStatus(t, "page", status, http.StatusOK)
+	testCandidates(t, candidates, want...)
+}
+
+func TestDiscoverLinks(t *testing.T) {
+	base, _ := url.Parse("https://example.com/blog/post")
+	links := discoverLinks([]byte(`<link rel="feed" type="application/feed+json" href="feed.json">
+		<link rel="alternate" type="text/html" href="/other">
+		<link rel="alternate" type="application/atom+xml" href="">
+		<link rel="alternate" type="application/atom+xml" href="https://other.example.com/atom">`), base)
+	want := []string{"https://example.com/blog/feed.json", "https://other.example.com/atom"}
+	if len(links) != len(want) || links[0] != want[0] || links[1] != want[1] {
+		t.Fatalf("Got links %v, expected %v", links, want)
+	}
+}
@@ -0,0 +1,286 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "io"
+import "fmt"
+import "net"
+import "mime"
+import "time"
+import "bytes"
+import "regexp"
+import "strings"
+import "net/url"
+import "net/http"
+import "io/ioutil"
+import "unicode/utf8"
+import "encoding/xml"
+import "compress/gzip"
+
+import "golang.org/x/net/html/charset"
+
+import "github.com/mmcdole/gofeed"
+
+// Everything we fetch goes through here before it is parsed, so a bad response fails with a reason the user can act on
+// instead of whatever the XML parser happened to choke on first.
+
+// Real feeds are rarely more than a couple MB, anything this big is broken or hostile.
+const MaxFeedBytes = int64(16 << 20)
+
+var fetchClient = &http.Client{Timeout: 30 * time.Second}
+
+const fetchAccept = "application/atom+xml, application/rss+xml, application/feed+json, application/xml;q=0.9, " +
+	"text/xml;q=0.9, application/json;q=0.8, */*;q=0.5"
+
+// Only matches at the very start of the document, where a declaration is allowed to be.
+var xmlDeclEncoding = regexp.MustCompile(`^\s*<\?xml[^>]*?encoding\s*=\s*["']([^"']*)["']`)
+
+// FetchError is a fetch that failed. Reason is short and meant for the user, Err has the details if there are any.
+type FetchError struct {
+	Reason string
+	Err    error
+}
+
+func (e *FetchError) Error() string {
+	if e.Err == nil {
+		return e.Reason
+	}
+	return e.Reason + ": " + e.Err.Error()
+}
+
+func fetchFail(err error, format string, v ...interface{}) *FetchError {
+	return &FetchError{Reason: fmt.Sprintf(format, v...), Err: err}
+}
+
+type FetchResult struct {
+	Body   []byte // Decompressed and converted to UTF-8.
+	Type   string // The Content-Type header.
+	URL    *url.URL
+	Header http.Header
+}
+
+// FeedFetch fetches and parses a feed. The fetch result is returned even if parsing fails.
+func FeedFetch(page string) (*gofeed.Feed, *FetchResult, error) {
+	res, err := Fetch(fetchClient, page, MaxFeedBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := FeedParse(res)
+	return f, res, err
+}
+
+// Fetch GETs a URL, with limits on how much it will read.
+func Fetch(client *http.Client, page string, limit int64) (*FetchResult, error) {
+	req, err := http.NewRequest("GET", page, nil)
+	if err != nil {
+		return nil, fetchFail(err, "Invalid URL")
+	}
+	req.Header.Set("Accept", fetchAccept)
+	req.Header.Set("User-Agent", "RSN2")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			return nil, fetchFail(err, "Timed out")
+		}
+		return nil, fetchFail(err, "Could not connect")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fetchFail(nil, "Server responded with HTTP %v", resp.Status)
+	}
+	if resp.ContentLength > limit {
+		return nil, fetchFail(nil, "Response is larger than the %v MB limit", limit>>20)
+	}
+
+	// The transport undoes any Content-Encoding itself and the limit applies to what comes out of that, so a small
+	// compressed response can't turn into a huge one.
+	body, err := fetchRead(resp.Body, limit)
+	if err != nil {
+		return nil, err
+	}
+	return FetchPrepare(body, resp.Header, resp.Request.URL, limit)
+}
+
+// FetchPrepare takes a raw body, however it was received, and decompresses and decodes it.
+func FetchPrepare(body []byte, header http.Header, from *url.URL, limit int64) (*FetchResult, error) {
+	// Some servers serve gzipped files as-is, without a Content-Encoding.
+	if bytes.HasPrefix(body, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fetchFail(err, "Invalid gzip data")
+		}
+		body, err = fetchRead(zr, limit)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctype := header.Get("Content-Type")
+	body, err := fetchDecode(body, ctype)
+	if err != nil {
+		return nil, err
+	}
+	return &FetchResult{Body: body, Type: ctype, URL: from, Header: header}, nil
+}
+
+func fetchRead(r io.Reader, limit int64) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, fetchFail(err, "Error reading response")
+	}
+	if int64(len(body)) > limit {
+		return nil, fetchFail(nil, "Response is larger than the %v MB limit", limit>>20)
+	}
+	return body, nil
+}
+
+// fetchDecode converts a body to UTF-8. A byte order mark wins, then the XML declaration, then the Content-Type header.
+// The header is last because servers get it wrong far more often than documents do.
+func fetchDecode(body []byte, ctype string) ([]byte, error) {
+	label := ""
+	switch {
+	case bytes.HasPrefix(body, []byte{0xef, 0xbb, 0xbf}):
+		body, label = body[3:], "utf-8"
+	case bytes.HasPrefix(body, []byte{0xff, 0xfe}):
+		body, label = body[2:], "utf-16le"
+	case bytes.HasPrefix(body, []byte{0xfe, 0xff}):
+		body, label = body[2:], "utf-16be"
+	}
+
+	if label == "" {
+		if m := xmlDeclEncoding.FindSubmatch(body); m != nil {
+			label = string(m[1])
+
+			// We just read the declaration as ASCII, so whatever it says this isn't UTF-16.
+			if _, name := charset.Lookup(label); strings.HasPrefix(name, "utf-16") {
+				label = ""
+			}
+		}
+	}
+	if label == "" {
+		if _, params, err := mime.ParseMediaType(ctype); err == nil {
+			label = params["charset"]
+		}
+	}
+	if label == "" {
+		label = "utf-8"
+	}
+
+	enc, name := charset.Lookup(label)
+	if enc == nil {
+		return nil, fetchFail(nil, "Unknown character set %q", label)
+	}
+	if name == "utf-8" {
+		enc = nil
+		if !utf8.Valid(body) {
+			// Claims to be UTF-8 but isn't, almost always because it is really Windows-1252. Browsers assume the
+			// same thing.
+			enc, _ = charset.Lookup("windows-1252")
+		}
+	}
+	if enc != nil {
+		decoded, err := enc.NewDecoder().Bytes(body)
+		if err != nil {
+			return nil, fetchFail(err, "Invalid %v text", name)
+		}
+		body = decoded
+	}
+
+	// The body is UTF-8 now, whatever the declaration says. Leaving it alone would have the XML parser convert again.
+	if loc := xmlDeclEncoding.FindSubmatchIndex(body); loc != nil && !strings.EqualFold(string(body[loc[2]:loc[3]]), "utf-8") {
+		fixed := make([]byte, 0, len(body))
+		fixed = append(fixed, body[:loc[2]]...)
+		fixed = append(fixed, "utf-8"...)
+		body = append(fixed, body[loc[3]:]...)
+	}
+	return body, nil
+}
+
+// FeedParse parses a fetched document as RSS, Atom, or JSON Feed, with a useful error if it is none of those.
+func FeedParse(res *FetchResult) (*gofeed.Feed, error) {
+	mtype, _, _ := mime.ParseMediaType(res.Type)
+
+	body := bytes.TrimLeft(res.Body, " \t\r\n")
+	if len(body) == 0 {
+		return nil, fetchFail(nil, "Server returned an empty response")
+	}
+
+	switch body[0] {
+	case '{':
+		f, err := jsonFeedParse(body)
+		if err == errNotJSONFeed {
+			return nil, fetchFail(nil, "Response is JSON, but not a JSON Feed")
+		}
+		if err != nil {
+			return nil, fetchFail(err, "Invalid JSON Feed")
+		}
+		return f, nil
+	case '<':
+		switch root := xmlRoot(body); root {
+		case "rss", "rdf", "feed":
+			f, err := gofeed.NewParser().Parse(bytes.NewReader(body))
+			if err != nil {
+				return nil, fetchFail(err, "Feed could not be parsed")
+			}
+			return f, nil
+		case "html":
+			return nil, fetchFail(nil, "Server returned a web page instead of a feed")
+		case "":
+			if mtype == "text/html" {
+				return nil, fetchFail(nil, "Server returned a web page instead of a feed")
+			}
+			return nil, fetchFail(nil, "Response is not valid XML")
+		default:
+			return nil, fetchFail(nil, "Response is XML, but not a feed (root element <%v>)", root)
+		}
+	}
+
+	if mtype == "text/html" {
+		return nil, fetchFail(nil, "Server returned a web page instead of a feed")
+	}
+	if mtype == "" {
+		mtype = "unknown type"
+	}
+	return nil, fetchFail(nil, "Response is not a feed (%v)", mtype)
+}
+
+// xmlRoot returns the lower case name of the first element in a document, or "" if it doesn't look like markup.
+func xmlRoot(body []byte) string {
+	d := xml.NewDecoder(bytes.NewReader(body))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	d.CharsetReader = charset.NewReaderLabel
+
+	for {
+		t, err := d.RawToken()
+		if err != nil {
+			return ""
+		}
+		if se, ok := t.(xml.StartElement); ok {
+			return strings.ToLower(se.Name.Local)
+		}
+	}
+}
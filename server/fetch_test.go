@@ -0,0 +1,172 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "bytes"
+import "strings"
+import "testing"
+import "net/http"
+import "compress/gzip"
+import "unicode/utf16"
+
+// testFetchFail checks that err is a FetchError starting with reason.
+func testFetchFail(t *testing.T, err error, reason string) {
+	t.Helper()
+	ferr, ok := err.(*FetchError)
+	if !ok {
+		t.Fatalf("Expected a fetch error starting with %q, got: %v", reason, err)
+	}
+	if !strings.HasPrefix(ferr.Reason, reason) {
+		t.Fatalf("Got fetch error %q, expected %q", ferr.Reason, reason)
+	}
+}
+
+func TestFetchDecode(t *testing.T) {
+	utf16le := []byte{0xff, 0xfe}
+	for _, r := range utf16.Encode([]rune(`<?xml version="1.0" encoding="utf-16"?><a>é</a>`)) {
+		utf16le = append(utf16le, byte(r), byte(r>>8))
+	}
+
+	cases := []struct {
+		name, body, ctype, want string
+	}{
+		{"plain", "<a>é</a>", "text/xml", "<a>é</a>"},
+		{"header", "<a>\xe9</a>", "text/xml; charset=iso-8859-1", "<a>é</a>"},
+		{"bom", "\xef\xbb\xbf<a>é</a>", "text/xml; charset=iso-8859-1", "<a>é</a>"},
+		{"bom utf-16", string(utf16le), "text/xml", `<?xml version="1.0" encoding="utf-8"?><a>é</a>`},
+		{
+			// The declaration beats the header, and gets rewritten so the parser doesn't convert again.
+			"declaration",
+			`<?xml version="1.0" encoding="ISO-8859-1"?><a>` + "\xe9</a>",
+			"text/xml; charset=utf-8",
+			`<?xml version="1.0" encoding="utf-8"?><a>é</a>`,
+		},
+		{"windows-1252", "<a>\x93quoted\x94</a>", "text/xml", "<a>“quoted”</a>"},
+	}
+	for _, c := range cases {
+		got, err := fetchDecode([]byte(c.body), c.ctype)
+		if err != nil {
+			t.Fatalf("Decoding %v failed, error: %v", c.name, err)
+		}
+		if string(got) != c.want {
+			t.Fatalf("Decoding %v gave %q, expected %q", c.name, got, c.want)
+		}
+	}
+
+	_, err := fetchDecode([]byte("<a></a>"), "text/xml; charset=no-such-thing")
+	testFetchFail(t, err, "Unknown character set")
+}
+
+func TestFetchLimits(t *testing.T) {
+	big := strings.Repeat("x", 2<<20)
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	zw.Write([]byte(big))
+	zw.Close()
+
+	s := testServer(t, "text/xml", map[string]string{
+		"/small":   testRSS("Small"),
+		"/big":     big,
+		"/gzipped": buf.String(),
+	})
+
+	res, err := Fetch(http.DefaultClient, s.URL+"/small", 1<<20)
+	if err != nil {
+		t.Fatalf("Fetch failed, error: %v", err)
+	}
+	if string(res.Body) != testRSS("Small") || res.Type != "text/xml" || res.URL.Path != "/small" {
+		t.Fatalf("Unexpected fetch result: %+v", res)
+	}
+
+	_, err = Fetch(http.DefaultClient, s.URL+"/big", 1<<20)
+	testFetchFail(t, err, "Response is larger than the 1 MB limit")
+
+	// Small on the wire, but not once it is decompressed.
+	_, err = Fetch(http.DefaultClient, s.URL+"/gzipped", 1<<20)
+	testFetchFail(t, err, "Response is larger than the 1 MB limit")
+
+	_, err = Fetch(http.DefaultClient, s.URL+"/missing", 1<<20)
+	testFetchFail(t, err, "Server responded with HTTP 404")
+}
+
+func TestFeedParse(t *testing.T) {
+	parse := func(typ, body string) error {
+		_, err := FeedParse(&FetchResult{Body: []byte(body), Type: typ})
+		return err
+	}
+
+	f, err := FeedParse(&FetchResult{Type: "application/feed+json", Body: []byte(`{
+		"version": "https://jsonfeed.org/version/1.1",
+		"title": "JSON",
+		"home_page_url": "https://example.com/",
+		"items": [{"id": 1, "url": "https://example.com/1", "title": "One", "date_published": "2021-01-02T03:04:05Z"}]
+	}`)})
+	if err != nil {
+		t.Fatalf("JSON Feed parse failed, error: %v", err)
+	}
+	if f.Title != "JSON" || len(f.Items) != 1 || f.Items[0].GUID != "1" || f.Items[0].Link != "https://example.com/1" {
+		t.Fatalf("Unexpected JSON Feed result: %+v", f)
+	}
+	if f.Items[0].PublishedParsed == nil || f.Items[0].PublishedParsed.Unix() != 1609556645 {
+		t.Fatalf("Unexpected JSON Feed item date: %v", f.Items[0].PublishedParsed)
+	}
+
+	f, err = FeedParse(&FetchResult{Type: "text/xml", Body: []byte("\n  " + testRSS("RSS", "https://example.com/1"))})
+	if err != nil || f.Title != "RSS" || len(f.Items) != 1 {
+		t.Fatalf("RSS parse failed, error: %v", err)
+	}
+
+	testFetchFail(t, parse("text/xml", "  "), "Server returned an empty response")
+	testFetchFail(t, parse("application/json", `{"items": []}`), "Response is JSON, but not a JSON Feed")
+	testFetchFail(t, parse("text/html", "<!DOCTYPE html><html><body></body></html>"), "Server returned a web page")
+	testFetchFail(t, parse("text/xml", `<?xml version="1.0"?><svg></svg>`), "Response is XML, but not a feed")
+	testFetchFail(t, parse("image/png", "\x89PNG"), "Response is not a feed (image/png)")
+}
+
+func TestFeedFetchStatus(t *testing.T) {
+	s := testServer(t, "text/html", map[string]string{"/page": "<html></html>"})
+
+	testDB(t, func(t *testing.T) {
+		testUser(t, "u1", "one@example.com")
+		feed := testFeed(t, s.URL+"/page", "u1")
+
+		f := FeedDetails(ml, "u1", feed)
+		if f == nil || !f.Fetched.IsZero() || f.Error != "" {
+			t.Fatalf("Unexpected status for a new feed: %+v", f)
+		}
+
+		_, _, err := FeedFetch(s.URL + "/page")
+		testFetchFail(t, err, "Server returned a web page")
+		FeedFetchFailed(ml, feed, 1000, err)
+		f = FeedDetails(ml, "u1", feed)
+		if f == nil || f.Fetched.Unix() != 1000 || f.Error != err.Error() {
+			t.Fatalf("Unexpected status after a failed fetch: %+v", f)
+		}
+
+		FeedFetchOK(ml, feed, 2000)
+		f = FeedDetails(ml, "u1", feed)
+		if f == nil || f.Fetched.Unix() != 2000 || f.Error != "" {
+			t.Fatalf("Unexpected status after a good fetch: %+v", f)
+		}
+	})
+}
@@ -0,0 +1,432 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "sort"
+import "strconv"
+import "strings"
+import "net/http"
+import "hash/fnv"
+import "sync/atomic"
+import "encoding/json"
+import "encoding/base64"
+import "database/sql"
+
+// The Fever API (as used by Reeder, Unread, and friends) wants integer IDs everywhere. Articles use their Seq, feeds
+// and folders (Fever calls them groups) get a hash of their ID or name since they don't have a number of their own.
+// Group 0 is special and means "everything".
+
+const FeverMaxItems = 50
+
+func feverID(s string) int64 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	id := int64(h.Sum32() & 0x7fffffff)
+	if id == 0 {
+		id = 1
+	}
+	return id
+}
+
+type feverGroup struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+}
+
+type feverFeedsGroup struct {
+	GroupID int64  `json:"group_id"`
+	FeedIDs string `json:"feed_ids"`
+}
+
+type feverFeed struct {
+	ID                int64  `json:"id"`
+	FaviconID         int64  `json:"favicon_id"`
+	Title             string `json:"title"`
+	URL               string `json:"url"`
+	SiteURL           string `json:"site_url"`
+	IsSpark           int    `json:"is_spark"`
+	LastUpdatedOnTime int64  `json:"last_updated_on_time"`
+
+	feed   string
+	folder string
+}
+
+type feverFavicon struct {
+	ID   int64  `json:"id"`
+	Data string `json:"data"`
+}
+
+type feverItem struct {
+	ID            int64  `json:"id"`
+	FeedID        int64  `json:"feed_id"`
+	Title         string `json:"title"`
+	Author        string `json:"author"`
+	HTML          string `json:"html"`
+	URL           string `json:"url"`
+	IsSaved       int    `json:"is_saved"`
+	IsRead        int    `json:"is_read"`
+	CreatedOnTime int64  `json:"created_on_time"`
+}
+
+func FeverHandler(w http.ResponseWriter, r *http.Request) {
+	l := newSessionLogger("/fever/")
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
+	err := r.ParseMultipartForm(MaxBodyBytes)
+	if err != nil && err != http.ErrNotMultipart {
+		l.W.Printf("Error parsing Fever request. Error: %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	has := func(key string) bool {
+		_, ok := r.Form[key]
+		return ok
+	}
+
+	if !has("api") {
+		l.W.Printf("Not a Fever API request.\n")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"api_version": 3,
+		"auth":        0,
+	}
+	defer func() {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(resp)
+		if err != nil {
+			l.E.Printf("Error encoding payload. Error: %v\n", err)
+		}
+	}()
+
+	user := ApiKeyUser(l, strings.ToLower(r.FormValue("api_key")), "fever")
+	if user == "" {
+		l.W.Printf("Invalid Fever API key.\n")
+		return
+	}
+	resp["auth"] = 1
+	resp["last_refreshed_on_time"] = atomic.LoadInt64(&LastRefresh)
+
+	// Everything else wants the feeds, so just load them up front.
+	feeds := feverFeeds(l, user)
+	if feeds == nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if has("mark") {
+		status := feverMark(l, user, feeds, r)
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+
+		switch r.FormValue("as") {
+		case "read", "unread":
+			r.Form["unread_item_ids"] = nil
+		case "saved", "unsaved":
+			r.Form["saved_item_ids"] = nil
+		}
+	}
+
+	if has("groups") || has("feeds") {
+		groups, feedsgroups := feverGroups(feeds)
+		if has("groups") {
+			resp["groups"] = groups
+		}
+		if has("feeds") {
+			resp["feeds"] = feeds
+		}
+		resp["feeds_groups"] = feedsgroups
+	}
+
+	if has("favicons") {
+		icons := feverFavicons(l, user)
+		if icons == nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		resp["favicons"] = icons
+	}
+
+	if has("items") {
+		items, total := feverItems(l, user, feeds, r)
+		if items == nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		resp["items"] = items
+		resp["total_items"] = total
+	}
+
+	if has("links") {
+		// We don't do Sparks or Hot links.
+		resp["links"] = []struct{}{}
+	}
+
+	if has("unread_item_ids") {
+		ids := feverIDList(l, user, "FeverUnreadIDs")
+		if ids == nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		resp["unread_item_ids"] = *ids
+	}
+
+	if has("saved_item_ids") {
+		ids := feverIDList(l, user, "FeverSavedIDs")
+		if ids == nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		resp["saved_item_ids"] = *ids
+	}
+}
+
+func feverFeeds(l *SessionLogger, user string) []*feverFeed {
+	rows, err := Queries["FeverFeeds"].Preped.Query(user)
+	if err != nil {
+		l.E.Printf("Fever feed list failed for user %v, error: %v\n", user, err)
+		return nil
+	}
+	defer rows.Close()
+
+	feeds := []*feverFeed{}
+	for rows.Next() {
+		f := &feverFeed{}
+		err := rows.Scan(&f.feed, &f.Title, &f.URL, &f.SiteURL, &f.folder, &f.LastUpdatedOnTime)
+		if err != nil {
+			l.E.Printf("Fever feed list failed for user %v, error: %v\n", user, err)
+			return nil
+		}
+		f.ID = feverID(f.feed)
+		f.FaviconID = f.ID
+		feeds = append(feeds, f)
+	}
+	return feeds
+}
+
+func feverGroups(feeds []*feverFeed) ([]*feverGroup, []*feverFeedsGroup) {
+	members := map[string][]string{}
+	for _, f := range feeds {
+		if f.folder != "" {
+			members[f.folder] = append(members[f.folder], strconv.FormatInt(f.ID, 10))
+		}
+	}
+
+	names := []string{}
+	for name := range members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	groups := []*feverGroup{}
+	feedsgroups := []*feverFeedsGroup{}
+	for _, name := range names {
+		id := feverID(name)
+		groups = append(groups, &feverGroup{ID: id, Title: name})
+		feedsgroups = append(feedsgroups, &feverFeedsGroup{GroupID: id, FeedIDs: strings.Join(members[name], ",")})
+	}
+	return groups, feedsgroups
+}
+
+func feverFavicons(l *SessionLogger, user string) []*feverFavicon {
+	rows, err := Queries["FeverIcons"].Preped.Query(user)
+	if err != nil {
+		l.E.Printf("Fever favicon list failed for user %v, error: %v\n", user, err)
+		return nil
+	}
+	defer rows.Close()
+
+	icons := []*feverFavicon{}
+	for rows.Next() {
+		feed, typ, data := "", "", []byte(nil)
+		err := rows.Scan(&feed, &typ, &data)
+		if err != nil {
+			l.E.Printf("Fever favicon list failed for user %v, error: %v\n", user, err)
+			return nil
+		}
+		icons = append(icons, &feverFavicon{
+			ID:   feverID(feed),
+			Data: typ + ";base64," + base64.StdEncoding.EncodeToString(data),
+		})
+	}
+	return icons
+}
+
+func feverItems(l *SessionLogger, user string, feeds []*feverFeed, r *http.Request) ([]*feverItem, int) {
+	total := 0
+	err := Queries["FeverItemCount"].Preped.QueryRow(user).Scan(&total)
+	if err != nil {
+		l.E.Printf("Fever item count failed for user %v, error: %v\n", user, err)
+		return nil, 0
+	}
+
+	feedids := map[string]int64{}
+	for _, f := range feeds {
+		feedids[f.feed] = f.ID
+	}
+
+	items := []*feverItem{}
+	scan := func(s interface{ Scan(...interface{}) error }) error {
+		i := &feverItem{}
+		feed := ""
+		read, saved := false, false
+		err := s.Scan(&i.ID, &feed, &i.Title, &i.URL, &i.CreatedOnTime, &read, &saved)
+		if err != nil {
+			return err
+		}
+		i.FeedID = feedids[feed]
+		if read {
+			i.IsRead = 1
+		}
+		if saved {
+			i.IsSaved = 1
+		}
+		items = append(items, i)
+		return nil
+	}
+
+	if v := r.FormValue("with_ids"); v != "" {
+		ids := strings.Split(v, ",")
+		if len(ids) > FeverMaxItems {
+			ids = ids[:FeverMaxItems]
+		}
+		for _, raw := range ids {
+			id, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+			if err != nil {
+				continue
+			}
+			err = scan(Queries["FeverItem"].Preped.QueryRow(user, id))
+			if err != nil && err != sql.ErrNoRows {
+				l.E.Printf("Fever item list failed for user %v, error: %v\n", user, err)
+				return nil, 0
+			}
+		}
+		return items, total
+	}
+
+	q, from := "FeverItemsSince", int64(0)
+	if v := r.FormValue("max_id"); v != "" {
+		q = "FeverItemsMax"
+		from, _ = strconv.ParseInt(v, 10, 64)
+	} else if v := r.FormValue("since_id"); v != "" {
+		from, _ = strconv.ParseInt(v, 10, 64)
+	}
+
+	rows, err := Queries[q].Preped.Query(user, from, FeverMaxItems)
+	if err != nil {
+		l.E.Printf("Fever item list failed for user %v, error: %v\n", user, err)
+		return nil, 0
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		err := scan(rows)
+		if err != nil {
+			l.E.Printf("Fever item list failed for user %v, error: %v\n", user, err)
+			return nil, 0
+		}
+	}
+	return items, total
+}
+
+func feverIDList(l *SessionLogger, user, query string) *string {
+	rows, err := Queries[query].Preped.Query(user)
+	if err != nil {
+		l.E.Printf("Fever ID list failed for user %v, error: %v\n", user, err)
+		return nil
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		id := int64(0)
+		err := rows.Scan(&id)
+		if err != nil {
+			l.E.Printf("Fever ID list failed for user %v, error: %v\n", user, err)
+			return nil
+		}
+		ids = append(ids, strconv.FormatInt(id, 10))
+	}
+	list := strings.Join(ids, ",")
+	return &list
+}
+
+func feverMark(l *SessionLogger, user string, feeds []*feverFeed, r *http.Request) int {
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		l.W.Printf("Invalid Fever mark ID: %v\n", r.FormValue("id"))
+		return http.StatusBadRequest
+	}
+	as := r.FormValue("as")
+
+	switch r.FormValue("mark") {
+	case "item":
+		article := ""
+		err := Queries["ArticleBySeq"].Preped.QueryRow(user, id).Scan(&article)
+		if err != nil {
+			l.W.Printf("Fever item %v not found for user %v, error: %v\n", id, user, err)
+			return http.StatusBadRequest
+		}
+
+		switch as {
+		case "read":
+			return ArticleMarkRead(l, user, article)
+		case "unread":
+			return ArticleMarkUnread(l, user, article)
+		case "saved":
+			return ArticleStar(l, user, article)
+		case "unsaved":
+			return ArticleUnstar(l, user, article)
+		}
+	case "feed", "group":
+		if as != "read" {
+			break
+		}
+		before, err := strconv.ParseInt(r.FormValue("before"), 10, 64)
+		if err != nil {
+			l.W.Printf("Invalid Fever mark time: %v\n", r.FormValue("before"))
+			return http.StatusBadRequest
+		}
+
+		for _, f := range feeds {
+			match := f.ID == id
+			if r.FormValue("mark") == "group" {
+				match = id == 0 || (f.folder != "" && feverID(f.folder) == id)
+			}
+			if !match {
+				continue
+			}
+			if status := FeedMarkRead(l, user, f.feed, before); status != http.StatusOK {
+				return status
+			}
+		}
+		return http.StatusOK
+	}
+
+	l.W.Printf("Invalid Fever mark request: %v as %v\n", r.FormValue("mark"), as)
+	return http.StatusBadRequest
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "time"
+import "strings"
+import "testing"
+import "net/url"
+import "net/http"
+import "encoding/json"
+import "net/http/httptest"
+
+// testFever makes a Fever API call and returns the decoded response.
+func testFever(t *testing.T, key string, form url.Values) map[string]interface{} {
+	t.Helper()
+
+	form.Set("api_key", key)
+	r := httptest.NewRequest(http.MethodPost, "/fever/?api", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	FeverHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Fever %v: status %v", form, w.Code)
+	}
+
+	resp := map[string]interface{}{}
+	err := json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func testFeverIDs(resp map[string]interface{}, key string) []string {
+	ids, _ := resp[key].(string)
+	if ids == "" {
+		return []string{}
+	}
+	return strings.Split(ids, ",")
+}
+
+func TestFever(t *testing.T) {
+	testDB(t, func(t *testing.T) {
+		testUser(t, "u1", "one@example.com")
+		key := feverKey("one@example.com", "password")
+		err := Data.ApiKeyAdd(key, "u1", "fever", time.Now().Unix())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f1 := testFeed(t, "https://example.com/one", "u1")
+		f2 := testFeed(t, "https://example.com/two", "u1")
+		testStatus(t, "set folder", FeedSetFolder(ml, "u1", f1, "News"), http.StatusOK)
+		testIngest(t, f1, testItem("https://example.com/one/1", "One", 1), testItem("https://example.com/one/2", "Two", 2))
+		testIngest(t, f2, testItem("https://example.com/two/1", "Three", 3))
+
+		resp := testFever(t, "bad", url.Values{})
+		if resp["auth"].(float64) != 0 {
+			t.Fatalf("Bad key was accepted")
+		}
+
+		resp = testFever(t, key, url.Values{"groups": {""}, "feeds": {""}})
+		groups, _ := resp["groups"].([]interface{})
+		feeds, _ := resp["feeds"].([]interface{})
+		if resp["auth"].(float64) != 1 || len(groups) != 1 || len(feeds) != 2 {
+			t.Fatalf("Groups and feeds: %v", resp)
+		}
+
+		resp = testFever(t, key, url.Values{"items": {""}})
+		items, _ := resp["items"].([]interface{})
+		if len(items) != 3 || resp["total_items"].(float64) != 3 {
+			t.Fatalf("Items: %v", resp)
+		}
+		unread := testFeverIDs(testFever(t, key, url.Values{"unread_item_ids": {""}}), "unread_item_ids")
+		if len(unread) != 3 {
+			t.Fatalf("Unread: %v", unread)
+		}
+		first := unread[0]
+
+		resp = testFever(t, key, url.Values{"items": {""}, "with_ids": {first + ",999999999"}})
+		items, _ = resp["items"].([]interface{})
+		if len(items) != 1 {
+			t.Fatalf("Items by ID: %v", resp)
+		}
+
+		resp = testFever(t, key, url.Values{"mark": {"item"}, "as": {"read"}, "id": {first}})
+		if ids := testFeverIDs(resp, "unread_item_ids"); len(ids) != 2 {
+			t.Fatalf("Unread after marking an item read: %v", ids)
+		}
+		resp = testFever(t, key, url.Values{"mark": {"item"}, "as": {"saved"}, "id": {first}})
+		if ids := testFeverIDs(resp, "saved_item_ids"); len(ids) != 1 || ids[0] != first {
+			t.Fatalf("Saved after saving an item: %v", ids)
+		}
+
+		resp = testFever(t, key, url.Values{"mark": {"group"}, "as": {"read"}, "id": {"0"}, "before": {"1000000"}})
+		if ids := testFeverIDs(resp, "unread_item_ids"); len(ids) != 0 {
+			t.Fatalf("Unread after marking everything read: %v", ids)
+		}
+	})
+}
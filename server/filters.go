@@ -0,0 +1,613 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "sync"
+import "time"
+import "regexp"
+import "strings"
+import "net/http"
+import "database/sql"
+import "encoding/json"
+import "container/list"
+
+import "golang.org/x/net/html"
+
+import "github.com/teris-io/shortid"
+
+import "github.com/mmcdole/gofeed"
+
+// Filter rules run against every new article for every subscriber, and can be run against old articles on request.
+// A rule matches when all (or any, if MatchAny is set) of its conditions match, a rule with no conditions matches
+// everything in its feed.
+
+// Article content kept for filtering is cut off at this size.
+const MaxFilterContent = 64 << 10
+
+// How many matches a dry run returns, the total is always returned.
+const FilterDryRunLimit = 100
+
+var filterIDService <-chan string
+
+func init() {
+	c := make(chan string)
+	filterIDService = c
+	go func() {
+		idsource := shortid.MustNew(9, shortid.DefaultABC, uint64(time.Now().UnixNano()))
+
+		for {
+			c <- idsource.MustGenerate()
+		}
+	}()
+}
+
+var filterFields = map[string]bool{
+	"title":    true,
+	"content":  true,
+	"author":   true,
+	"url":      true,
+	"category": true,
+}
+
+type FilterCondition struct {
+	Field    string   // One of title, content, author, url, or category.
+	Regex    string   // Either a regular expression...
+	Keywords []string // ...or a list of keywords, any of which match (case insensitive).
+	Negate   bool
+
+	re *regexp.Regexp
+}
+
+type FilterAction struct {
+	Action string // One of read, star, tag, hide, or notify.
+	Tag    string // For tag.
+}
+
+type FilterRule struct {
+	ID         string
+	Name       string
+	Feed       string // Empty for every feed.
+	MatchAny   bool
+	Conditions []*FilterCondition
+	Actions    []*FilterAction
+	Disabled   bool
+	Created    int64
+}
+
+// FilterArticle is everything a rule can look at.
+type FilterArticle struct {
+	ID         string
+	Feed       string
+	Title      string
+	URL        string
+	Published  int64
+	Author     string
+	Categories []string
+	Content    string
+}
+
+// NewFilterArticle collects the parts of a feed item filter rules care about.
+func NewFilterArticle(feed, article string, item *gofeed.Item, published time.Time) *FilterArticle {
+	a := &FilterArticle{
+		ID:         article,
+		Feed:       feed,
+		Title:      item.Title,
+		URL:        item.Link,
+		Published:  published.Unix(),
+		Categories: item.Categories,
+		Content:    item.Content,
+	}
+	if item.Author != nil {
+		a.Author = item.Author.Name
+	}
+	if a.Content == "" {
+		a.Content = item.Description
+	}
+	a.Content = htmlText(a.Content)
+	if len(a.Content) > MaxFilterContent {
+		a.Content = strings.ToValidUTF8(a.Content[:MaxFilterContent], "")
+	}
+	return a
+}
+
+// htmlText strips the markup from a bit of HTML.
+func htmlText(s string) string {
+	b := strings.Builder{}
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return strings.Join(strings.Fields(b.String()), " ")
+		case html.TextToken:
+			b.Write(z.Text())
+			b.WriteByte(' ')
+		}
+	}
+}
+
+func ArticleContentAdd(l *SessionLogger, a *FilterArticle) {
+	_, err := Queries["ArticleContentAdd"].Preped.Exec(a.ID, a.Author, strings.Join(a.Categories, "\n"), a.Content)
+	if err != nil {
+		l.E.Printf("Cannot store content for article %v, error: %v\n", a.ID, err)
+	}
+}
+
+// Matching
+// =====================================================================================================================
+
+// Compiled expressions are shared, most users will have a handful of rules that run on every new article. Rules are
+// loaded fresh for each article, so the cache is what saves compiling them every time. It is kept to the most
+// recently used expressions so edited and deleted rules don't stay in memory forever.
+const FilterRegexCacheSize = 256
+
+type filterRegexEntry struct {
+	expr string
+	re   *regexp.Regexp
+}
+
+var filterRegexCache = map[string]*list.Element{}
+var filterRegexOrder = list.New() // Most recently used at the front.
+var filterRegexLock sync.Mutex
+
+func filterRegex(expr string) (*regexp.Regexp, error) {
+	filterRegexLock.Lock()
+	defer filterRegexLock.Unlock()
+
+	if e, ok := filterRegexCache[expr]; ok {
+		filterRegexOrder.MoveToFront(e)
+		return e.Value.(*filterRegexEntry).re, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	filterRegexCache[expr] = filterRegexOrder.PushFront(&filterRegexEntry{expr: expr, re: re})
+	if filterRegexOrder.Len() > FilterRegexCacheSize {
+		e := filterRegexOrder.Back()
+		filterRegexOrder.Remove(e)
+		delete(filterRegexCache, e.Value.(*filterRegexEntry).expr)
+	}
+	return re, nil
+}
+
+// compile checks the rule and prepares it for matching.
+func (r *FilterRule) compile() bool {
+	for _, c := range r.Conditions {
+		if c == nil || !filterFields[c.Field] || (c.Regex == "") == (len(c.Keywords) == 0) {
+			return false
+		}
+		if c.Regex != "" {
+			re, err := filterRegex(c.Regex)
+			if err != nil {
+				return false
+			}
+			c.re = re
+		}
+	}
+	if len(r.Actions) == 0 {
+		return false
+	}
+	for _, a := range r.Actions {
+		if a == nil {
+			return false
+		}
+		switch a.Action {
+		case "read", "star", "hide", "notify":
+		case "tag":
+			tag, ok := TagClean(a.Tag)
+			if !ok {
+				return false
+			}
+			a.Tag = tag
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (c *FilterCondition) matchString(s string) bool {
+	if c.re != nil {
+		return c.re.MatchString(s)
+	}
+	s = strings.ToLower(s)
+	for _, k := range c.Keywords {
+		if k != "" && strings.Contains(s, strings.ToLower(k)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *FilterCondition) match(a *FilterArticle) bool {
+	values := []string{}
+	switch c.Field {
+	case "title":
+		values = append(values, a.Title)
+	case "content":
+		values = append(values, a.Content)
+	case "author":
+		values = append(values, a.Author)
+	case "url":
+		values = append(values, a.URL)
+	case "category":
+		values = a.Categories
+	}
+
+	hit := false
+	for _, v := range values {
+		if c.matchString(v) {
+			hit = true
+			break
+		}
+	}
+	return hit != c.Negate
+}
+
+func (r *FilterRule) Match(a *FilterArticle) bool {
+	if r.Feed != "" && r.Feed != a.Feed {
+		return false
+	}
+	if len(r.Conditions) == 0 {
+		return true
+	}
+	for _, c := range r.Conditions {
+		if c.match(a) == r.MatchAny {
+			return r.MatchAny
+		}
+	}
+	return !r.MatchAny
+}
+
+// Apply runs the rule's actions on an article.
+func (r *FilterRule) Apply(l *SessionLogger, user, article string) int {
+	for _, a := range r.Actions {
+		status := http.StatusOK
+		switch a.Action {
+		case "read":
+			status = ArticleMarkRead(l, user, article)
+		case "star":
+			status = ArticleStar(l, user, article)
+		case "hide":
+			status = ArticleMarkRead(l, user, article)
+			if status == http.StatusOK {
+				status = filterExec(l, "FilterHide", user, article)
+			}
+		case "tag":
+			status = filterExec(l, "ArticleTag", user, article, a.Tag)
+		case "notify":
+			status = filterExec(l, "FilterNotify", user, article, r.ID, time.Now().Unix())
+		}
+		if status != http.StatusOK {
+			return status
+		}
+	}
+	return http.StatusOK
+}
+
+func filterExec(l *SessionLogger, query string, args ...interface{}) int {
+	_, err := Queries[query].Preped.Exec(args...)
+	if err != nil {
+		l.E.Printf("Failed applying filter action (%v) to article %v for user %v, error: %v\n", query, args[1], args[0], err)
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
+
+// FilterArticleAdded runs every subscriber's rules against a new article.
+func FilterArticleAdded(l *SessionLogger, a *FilterArticle) {
+	rows, err := Queries["FilterRulesForFeed"].Preped.Query(a.Feed)
+	if err != nil {
+		l.E.Printf("Cannot load filter rules for feed %v, error: %v\n", a.Feed, err)
+		return
+	}
+
+	users := []string{}
+	rules := []*FilterRule{}
+	for rows.Next() {
+		user := ""
+		r, err := filterScanRule(rows, &user)
+		if err != nil {
+			l.E.Printf("Cannot load filter rules for feed %v, error: %v\n", a.Feed, err)
+			rows.Close()
+			return
+		}
+		users = append(users, user)
+		rules = append(rules, r)
+	}
+	rows.Close()
+
+	for i, r := range rules {
+		if !r.compile() {
+			l.W.Printf("Filter rule %v for user %v is invalid, skipping.\n", r.ID, users[i])
+			continue
+		}
+		if r.Match(a) {
+			r.Apply(l, users[i], a.ID)
+		}
+	}
+}
+
+// filterScanRule reads a rule, the user is only read if user is not nil.
+func filterScanRule(s interface{ Scan(...interface{}) error }, user *string) (*FilterRule, error) {
+	r := &FilterRule{}
+	conditions, actions := "", ""
+	dest := []interface{}{&r.ID, &r.Name, &r.Feed, &r.MatchAny, &conditions, &actions, &r.Disabled, &r.Created}
+	if user != nil {
+		dest = append([]interface{}{user}, dest...)
+	}
+	err := s.Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal([]byte(conditions), &r.Conditions)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(actions), &r.Actions)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// /api/filter/list
+// =====================================================================================================================
+
+func FilterRuleList(l *SessionLogger, user string) []*FilterRule {
+	rows, err := Queries["FilterRuleList"].Preped.Query(user)
+	if err != nil {
+		l.E.Printf("Filter rule list failed for user %v, error: %v\n", user, err)
+		return nil
+	}
+	defer rows.Close()
+
+	rules := []*FilterRule{}
+	for rows.Next() {
+		r, err := filterScanRule(rows, nil)
+		if err != nil {
+			l.E.Printf("Filter rule list failed for user %v, error: %v\n", user, err)
+			return nil
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+func filterRuleGet(l *SessionLogger, user, rule string) (*FilterRule, int) {
+	r, err := filterScanRule(Queries["FilterRuleGet"].Preped.QueryRow(user, rule), nil)
+	if err == sql.ErrNoRows {
+		l.W.Printf("Filter rule %v not found for user %v.\n", rule, user)
+		return nil, http.StatusBadRequest
+	}
+	if err != nil {
+		l.E.Printf("Failed loading filter rule %v for user %v, error: %v\n", rule, user, err)
+		return nil, http.StatusInternalServerError
+	}
+	return r, http.StatusOK
+}
+
+// /api/filter/add, /api/filter/update
+// =====================================================================================================================
+
+// filterValidate makes sure a rule from a client is usable.
+func filterValidate(l *SessionLogger, user string, r *FilterRule) int {
+	if r.Conditions == nil {
+		r.Conditions = []*FilterCondition{}
+	}
+	if !r.compile() {
+		l.W.Printf("Invalid filter rule from user %v.\n", user)
+		return http.StatusBadRequest
+	}
+
+	if r.Feed != "" {
+		ok, err := Data.Subscribed(user, r.Feed)
+		if err != nil {
+			l.E.Printf("DB existence check failed for subscribed feed %v by user %v, error: %v\n", r.Feed, user, err)
+			return http.StatusInternalServerError
+		}
+		if !ok {
+			l.W.Printf("Feed %v not subscribed by user %v.\n", r.Feed, user)
+			return http.StatusBadRequest
+		}
+	}
+	return http.StatusOK
+}
+
+func filterEncode(r *FilterRule) (string, string) {
+	conditions, _ := json.Marshal(r.Conditions)
+	actions, _ := json.Marshal(r.Actions)
+	return string(conditions), string(actions)
+}
+
+func FilterRuleAdd(l *SessionLogger, user string, r *FilterRule) (*FilterRule, int) {
+	if status := filterValidate(l, user, r); status != http.StatusOK {
+		return nil, status
+	}
+
+	r.ID = <-filterIDService
+	r.Created = time.Now().Unix()
+	conditions, actions := filterEncode(r)
+	_, err := Queries["FilterRuleAdd"].Preped.Exec(r.ID, user, r.Name, r.Feed, r.MatchAny, conditions, actions, r.Disabled, r.Created)
+	if err != nil {
+		l.E.Printf("Cannot add filter rule for user %v, error: %v\n", user, err)
+		return nil, http.StatusInternalServerError
+	}
+	return r, http.StatusOK
+}
+
+func FilterRuleUpdate(l *SessionLogger, user string, r *FilterRule) int {
+	if old, status := filterRuleGet(l, user, r.ID); old == nil {
+		return status
+	}
+	if status := filterValidate(l, user, r); status != http.StatusOK {
+		return status
+	}
+
+	conditions, actions := filterEncode(r)
+	_, err := Queries["FilterRuleUpdate"].Preped.Exec(user, r.ID, r.Name, r.Feed, r.MatchAny, conditions, actions, r.Disabled)
+	if err != nil {
+		l.E.Printf("Cannot update filter rule %v for user %v, error: %v\n", r.ID, user, err)
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
+
+// /api/filter/delete
+// =====================================================================================================================
+
+func FilterRuleDelete(l *SessionLogger, user, rule string) int {
+	_, err := Queries["FilterRuleDelete"].Preped.Exec(user, rule)
+	if err != nil {
+		l.E.Printf("Cannot delete filter rule %v for user %v, error: %v\n", rule, user, err)
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
+
+// /api/filter/dry-run, /api/filter/apply
+// =====================================================================================================================
+
+type FilterMatches struct {
+	Total    int
+	Articles []*FilterArticle // Only filled in for dry runs, and only the first few.
+}
+
+// filterMatch runs a rule over every article the user can see. The matches are collected before anything is done with
+// them so the listing isn't holding the database while the actions run.
+func filterMatch(l *SessionLogger, user string, r *FilterRule) []*FilterArticle {
+	rows, err := Queries["FilterArticles"].Preped.Query(user, r.Feed)
+	if err != nil {
+		l.E.Printf("Filter article list failed for user %v, error: %v\n", user, err)
+		return nil
+	}
+	defer rows.Close()
+
+	matches := []*FilterArticle{}
+	for rows.Next() {
+		a := &FilterArticle{}
+		categories := ""
+		err := rows.Scan(&a.ID, &a.Feed, &a.Title, &a.URL, &a.Published, &a.Author, &categories, &a.Content)
+		if err != nil {
+			l.E.Printf("Filter article list failed for user %v, error: %v\n", user, err)
+			return nil
+		}
+		if categories != "" {
+			a.Categories = strings.Split(categories, "\n")
+		}
+		if r.Match(a) {
+			a.Content = ""
+			matches = append(matches, a)
+		}
+	}
+	return matches
+}
+
+// FilterDryRun shows what a rule would match without doing anything.
+func FilterDryRun(l *SessionLogger, user string, r *FilterRule) (*FilterMatches, int) {
+	if status := filterValidate(l, user, r); status != http.StatusOK {
+		return nil, status
+	}
+
+	matches := filterMatch(l, user, r)
+	if matches == nil {
+		return nil, http.StatusInternalServerError
+	}
+
+	m := &FilterMatches{Total: len(matches), Articles: matches}
+	if len(matches) > FilterDryRunLimit {
+		m.Articles = matches[:FilterDryRunLimit]
+	}
+	return m, http.StatusOK
+}
+
+// FilterApply runs a saved rule against every existing article.
+func FilterApply(l *SessionLogger, user, rule string) (*FilterMatches, int) {
+	r, status := filterRuleGet(l, user, rule)
+	if r == nil {
+		return nil, status
+	}
+	if !r.compile() {
+		l.W.Printf("Filter rule %v for user %v is invalid.\n", rule, user)
+		return nil, http.StatusBadRequest
+	}
+
+	matches := filterMatch(l, user, r)
+	if matches == nil {
+		return nil, http.StatusInternalServerError
+	}
+	for _, a := range matches {
+		if status := r.Apply(l, user, a.ID); status != http.StatusOK {
+			return nil, status
+		}
+	}
+	return &FilterMatches{Total: len(matches), Articles: []*FilterArticle{}}, http.StatusOK
+}
+
+// /api/notification/list
+// =====================================================================================================================
+
+type Notification struct {
+	ID       int64
+	Article  string
+	Rule     string
+	Time     int64
+	Title    string
+	URL      string
+	FeedName string
+}
+
+func NotificationList(l *SessionLogger, user string) []*Notification {
+	rows, err := Queries["NotificationList"].Preped.Query(user)
+	if err != nil {
+		l.E.Printf("Notification list failed for user %v, error: %v\n", user, err)
+		return nil
+	}
+	defer rows.Close()
+
+	notes := []*Notification{}
+	for rows.Next() {
+		n := &Notification{}
+		err := rows.Scan(&n.ID, &n.Article, &n.Rule, &n.Time, &n.Title, &n.URL, &n.FeedName)
+		if err != nil {
+			l.E.Printf("Notification list failed for user %v, error: %v\n", user, err)
+			return nil
+		}
+		notes = append(notes, n)
+	}
+	return notes
+}
+
+// /api/notification/clear
+// =====================================================================================================================
+
+// NotificationClear removes every notification up to and including the given ID.
+func NotificationClear(l *SessionLogger, user string, id int64) int {
+	_, err := Queries["NotificationClear"].Preped.Exec(user, id)
+	if err != nil {
+		l.E.Printf("Cannot clear notifications for user %v, error: %v\n", user, err)
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
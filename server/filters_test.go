@@ -0,0 +1,159 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "fmt"
+import "reflect"
+import "testing"
+import "net/http"
+
+func TestFilters(t *testing.T) {
+	testDB(t, func(t *testing.T) {
+		testUser(t, "u1", "one@example.com")
+		testUser(t, "u2", "two@example.com")
+		testUser(t, "u3", "three@example.com")
+		feed := testFeed(t, "https://example.com/feed", "u1", "u2")
+
+		star, status := FilterRuleAdd(ml, "u1", &FilterRule{
+			Name:       "Go",
+			Conditions: []*FilterCondition{{Field: "title", Keywords: []string{"golang"}}},
+			Actions:    []*FilterAction{{Action: "star"}, {Action: "tag", Tag: "go"}, {Action: "notify"}},
+		})
+		testStatus(t, "keyword rule", status, http.StatusOK)
+		_, status = FilterRuleAdd(ml, "u2", &FilterRule{
+			Feed:       feed,
+			Conditions: []*FilterCondition{{Field: "content", Regex: "(?i)other"}},
+			Actions:    []*FilterAction{{Action: "read"}},
+		})
+		testStatus(t, "regex rule", status, http.StatusOK)
+
+		_, status = FilterRuleAdd(ml, "u1", &FilterRule{
+			Conditions: []*FilterCondition{{Field: "title", Regex: "("}},
+			Actions:    []*FilterAction{{Action: "read"}},
+		})
+		testStatus(t, "bad regex", status, http.StatusBadRequest)
+		_, status = FilterRuleAdd(ml, "u3", &FilterRule{Feed: feed, Actions: []*FilterAction{{Action: "read"}}})
+		testStatus(t, "unsubscribed feed", status, http.StatusBadRequest)
+
+		ids := testIngest(t, feed,
+			testItem("https://example.com/1", "Golang 2.0 released", 1),
+			testItem("https://example.com/2", "Other news", 2),
+			testItem("https://example.com/3", "Something else", 3),
+		)
+
+		// Each user's rules only touch their own view of the articles.
+		starred, read := []bool{}, []bool{}
+		for _, a := range testArticles(t, "u1", feed) {
+			starred = append(starred, a.Starred)
+		}
+		for _, a := range testArticles(t, "u2", feed) {
+			read = append(read, a.Read)
+		}
+		if !reflect.DeepEqual(starred, []bool{true, false, false}) || !reflect.DeepEqual(read, []bool{false, true, false}) {
+			t.Fatalf("After filtering, u1 starred %v and u2 read %v", starred, read)
+		}
+		tags := TagList(ml, "u1")
+		if len(tags) != 1 || *tags[0] != (TagCount{Tag: "go", Count: 1}) {
+			t.Fatalf("Tags: %+v", tags)
+		}
+		if tags := TagList(ml, "u2"); len(tags) != 0 {
+			t.Fatalf("Other user's tags: %+v", tags)
+		}
+		notes := NotificationList(ml, "u1")
+		if len(notes) != 1 || notes[0].Article != ids[0] || notes[0].Rule != star.ID {
+			t.Fatalf("Notifications: %+v", notes)
+		}
+
+		// A dry run changes nothing, applying a saved rule runs it over what is already there.
+		rule := &FilterRule{
+			Conditions: []*FilterCondition{{Field: "title", Keywords: []string{"NEWS", "else"}}},
+			Actions:    []*FilterAction{{Action: "read"}},
+		}
+		m, status := FilterDryRun(ml, "u1", rule)
+		testStatus(t, "dry run", status, http.StatusOK)
+		if m.Total != 2 || len(m.Articles) != 2 {
+			t.Fatalf("Dry run: %+v", m)
+		}
+		if a := testArticles(t, "u1", feed); a[1].Read || a[2].Read {
+			t.Fatalf("Dry run marked articles read")
+		}
+		rule, status = FilterRuleAdd(ml, "u1", rule)
+		testStatus(t, "add", status, http.StatusOK)
+		m, status = FilterApply(ml, "u1", rule.ID)
+		testStatus(t, "apply", status, http.StatusOK)
+		if a := testArticles(t, "u1", feed); m.Total != 2 || !a[1].Read || !a[2].Read {
+			t.Fatalf("Apply: %+v", m)
+		}
+
+		// Disabled rules don't run on new articles.
+		star.Disabled = true
+		testStatus(t, "update", FilterRuleUpdate(ml, "u1", star), http.StatusOK)
+		testIngest(t, feed, testItem("https://example.com/4", "More golang", 4))
+		if a := testArticles(t, "u1", feed); a[3].Starred {
+			t.Fatalf("Disabled rule ran")
+		}
+
+		rules := FilterRuleList(ml, "u1")
+		if len(rules) != 2 {
+			t.Fatalf("Got %v rules, expected 2", len(rules))
+		}
+		for _, r := range rules {
+			testStatus(t, "delete", FilterRuleDelete(ml, "u1", r.ID), http.StatusOK)
+		}
+		if rules := FilterRuleList(ml, "u1"); len(rules) != 0 {
+			t.Fatalf("Rules left after deleting: %+v", rules)
+		}
+
+		testStatus(t, "clear", NotificationClear(ml, "u1", notes[0].ID), http.StatusOK)
+		if notes := NotificationList(ml, "u1"); len(notes) != 0 {
+			t.Fatalf("Notifications left after clearing: %+v", notes)
+		}
+	})
+}
+
+func TestFilterRegexCache(t *testing.T) {
+	first, err := filterRegex("^first$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < FilterRegexCacheSize*2; i++ {
+		// Keep using the first one, so it is never the oldest.
+		if re, _ := filterRegex("^first$"); re != first {
+			t.Fatalf("Cached expression was compiled again")
+		}
+		_, err := filterRegex(fmt.Sprintf("^expr %v$", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(filterRegexCache) != FilterRegexCacheSize || filterRegexOrder.Len() != FilterRegexCacheSize {
+		t.Fatalf("Cache holds %v expressions, expected %v", len(filterRegexCache), FilterRegexCacheSize)
+	}
+	if _, ok := filterRegexCache["^expr 0$"]; ok {
+		t.Fatalf("Least recently used expression is still cached")
+	}
+
+	if _, err := filterRegex("("); err == nil {
+		t.Fatalf("Invalid expression compiled")
+	}
+}
@@ -0,0 +1,860 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "fmt"
+import "math"
+import "time"
+import "sort"
+import "strconv"
+import "strings"
+import "net/url"
+import "net/http"
+import "crypto/rand"
+import "database/sql"
+import "encoding/hex"
+import "encoding/json"
+
+// The Google Reader API, as spoken by FreshRSS, NetNewsWire, Reeder, and friends. Clients should be given
+// "https://<domain>/greader" as the server URL.
+//
+// Item IDs are 64 bit integers in this API, so we use the article's Seq. Like the short ID it never changes for the
+// life of the article (it survives vacuums), and it maps back to the short ID with a single lookup. Feeds are
+// "feed/<feed ID>" and folders are labels.
+
+const GReaderMaxItems = 10000
+const GReaderDefaultItems = 20
+
+const greaderItemPrefix = "tag:google.com,2005:reader/item/"
+
+const (
+	greaderReadingList = "user/-/state/com.google/reading-list"
+	greaderRead        = "user/-/state/com.google/read"
+	greaderStarred     = "user/-/state/com.google/starred"
+	greaderKeptUnread  = "user/-/state/com.google/kept-unread"
+	greaderLabel       = "user/-/label/"
+)
+
+func GReaderHandler(w http.ResponseWriter, r *http.Request) {
+	l := newSessionLogger("/greader/")
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
+	err := r.ParseForm()
+	if err != nil {
+		l.W.Printf("Error parsing Google Reader request. Error: %v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/greader")
+	if path == "/accounts/ClientLogin" {
+		greaderLogin(l, w, r)
+		return
+	}
+
+	if !strings.HasPrefix(path, "/reader/api/0/") {
+		l.W.Printf("Unknown Google Reader endpoint: %v\n", path)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	path = strings.TrimPrefix(path, "/reader/api/0/")
+
+	user, token := greaderUser(l, r)
+	if user == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	// Everything that changes something is a POST and carries a "T" token. That exists to stop CSRF, but these
+	// requests are authenticated by a header a browser would never add on its own, so we don't bother checking it.
+	if r.Method != http.MethodPost {
+		switch path {
+		case "subscription/edit", "subscription/quickadd", "edit-tag", "mark-all-as-read":
+			l.W.Printf("Google Reader %v requires POST.\n", path)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+	}
+
+	var resp interface{}
+	status := http.StatusOK
+	switch {
+	case path == "token":
+		fmt.Fprint(w, token)
+		return
+	case path == "user-info":
+		resp, status = greaderUserInfo(l, user)
+	case path == "subscription/list":
+		resp, status = greaderSubscriptions(l, user)
+	case path == "subscription/edit":
+		status = greaderSubscriptionEdit(l, user, r)
+	case path == "subscription/quickadd":
+		resp, status = greaderQuickAdd(l, user, r)
+	case path == "tag/list":
+		resp, status = greaderTags(l, user)
+	case path == "unread-count":
+		resp, status = greaderUnreadCounts(l, user)
+	case path == "stream/items/ids":
+		resp, status = greaderItemIDs(l, user, r)
+	case path == "stream/items/contents":
+		resp, status = greaderItemContents(l, user, r)
+	case path == "stream/contents" || strings.HasPrefix(path, "stream/contents/"):
+		// The stream is normally part of the path, escaped, but some clients use "s" like everything else.
+		stream := r.FormValue("s")
+		if raw := strings.TrimPrefix(strings.TrimPrefix(r.URL.EscapedPath(), "/greader/reader/api/0/stream/contents"), "/"); raw != "" {
+			stream, err = url.PathUnescape(raw)
+			if err != nil {
+				l.W.Printf("Invalid Google Reader stream: %v\n", raw)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		resp, status = greaderStreamContents(l, user, stream, r)
+	case path == "edit-tag":
+		status = greaderEditTag(l, user, r)
+	case path == "mark-all-as-read":
+		status = greaderMarkAllRead(l, user, r)
+	default:
+		l.W.Printf("Unknown Google Reader endpoint: %v\n", path)
+		status = http.StatusNotFound
+	}
+
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+	if resp == nil {
+		fmt.Fprint(w, "OK")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		l.E.Printf("Error encoding payload. Error: %v\n", err)
+	}
+}
+
+// Authentication
+// =====================================================================================================================
+
+// greaderLogin handles ClientLogin. The token stays the same until the user changes their password, so every client
+// the user sets up shares it.
+func greaderLogin(l *SessionLogger, w http.ResponseWriter, r *http.Request) {
+	status, user, canlogin := UserLogin(l, r.FormValue("Email"), r.FormValue("Passwd"))
+	if status != http.StatusOK || !canlogin {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "Error=BadAuthentication\n")
+		return
+	}
+
+	token := ""
+	err := Queries["ApiKeyGet"].Preped.QueryRow(user, "greader").Scan(&token)
+	if err == sql.ErrNoRows {
+		buf := make([]byte, 20)
+		_, err = rand.Read(buf)
+		if err == nil {
+			token = hex.EncodeToString(buf)
+			err = Data.ApiKeyAdd(token, user, "greader", time.Now().Unix())
+		}
+	}
+	if err != nil {
+		l.E.Printf("Cannot create Google Reader token for user %v, error: %v\n", user, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if r.FormValue("output") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"SID": token, "LSID": token, "Auth": token})
+		return
+	}
+	fmt.Fprintf(w, "SID=%v\nLSID=%v\nAuth=%v\n", token, token, token)
+}
+
+// greaderUser returns the user and token from the "Authorization: GoogleLogin auth=<token>" header.
+func greaderUser(l *SessionLogger, r *http.Request) (string, string) {
+	token := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "GoogleLogin auth="))
+	if token == "" {
+		l.W.Printf("Missing Google Reader token.\n")
+		return "", ""
+	}
+	user := ApiKeyUser(l, token, "greader")
+	if user == "" {
+		l.W.Printf("Invalid Google Reader token.\n")
+	}
+	return user, token
+}
+
+func greaderUserInfo(l *SessionLogger, user string) (interface{}, int) {
+	email, err := Data.UserEmail(user)
+	if err != nil {
+		l.E.Printf("Error fetching email for %v from DB, error: %v\n", user, err)
+		return nil, http.StatusInternalServerError
+	}
+	return map[string]string{
+		"userId":        user,
+		"userName":      email,
+		"userProfileId": user,
+		"userEmail":     email,
+	}, http.StatusOK
+}
+
+// IDs and streams
+// =====================================================================================================================
+
+func greaderItemID(seq int64) string {
+	return fmt.Sprintf("%v%016x", greaderItemPrefix, seq)
+}
+
+// greaderParseItemID accepts either the long form (hex) or the short form (signed decimal) of an item ID.
+func greaderParseItemID(id string) (int64, bool) {
+	if strings.HasPrefix(id, greaderItemPrefix) {
+		v, err := strconv.ParseUint(strings.TrimPrefix(id, greaderItemPrefix), 16, 64)
+		return int64(v), err == nil
+	}
+	v, err := strconv.ParseInt(id, 10, 64)
+	return v, err == nil
+}
+
+// greaderNormalize replaces the user ID in a stream or tag with "-", clients are allowed to use either.
+func greaderNormalize(s string) string {
+	if !strings.HasPrefix(s, "user/") {
+		return s
+	}
+	parts := strings.SplitN(s, "/", 3)
+	if len(parts) != 3 {
+		return s
+	}
+	return "user/-/" + parts[2]
+}
+
+// greaderFilter is what a stream, and the include/exclude targets applied to it, boil down to.
+type greaderFilter struct {
+	Feed    string
+	Folder  string
+	Starred bool
+	Read    interface{} // nil for either, otherwise a bool.
+}
+
+func (f *greaderFilter) apply(stream string, include bool) bool {
+	stream = greaderNormalize(stream)
+	switch {
+	case stream == greaderReadingList:
+	case stream == greaderStarred:
+		f.Starred = true
+	case stream == greaderRead:
+		f.Read = include
+	case stream == greaderKeptUnread:
+		f.Read = !include
+	case strings.HasPrefix(stream, greaderLabel):
+		f.Folder = strings.TrimPrefix(stream, greaderLabel)
+	case strings.HasPrefix(stream, "feed/"):
+		f.Feed = strings.TrimPrefix(stream, "feed/")
+	default:
+		return false
+	}
+	return true
+}
+
+// greaderParseFilter reads the stream and the "xt", "it", "ot", "nt" parameters.
+func greaderParseFilter(l *SessionLogger, stream string, r *http.Request) (*greaderFilter, int) {
+	f := &greaderFilter{}
+	if stream == "" {
+		stream = greaderReadingList
+	}
+	if !f.apply(stream, true) {
+		l.W.Printf("Unknown Google Reader stream: %v\n", stream)
+		return nil, http.StatusBadRequest
+	}
+	for _, it := range r.Form["it"] {
+		f.apply(it, true)
+	}
+	for _, xt := range r.Form["xt"] {
+		// Only excluding the read state makes sense here, anything else is ignored.
+		if greaderNormalize(xt) == greaderRead {
+			f.Read = false
+		}
+	}
+	return f, http.StatusOK
+}
+
+// Subscriptions
+// =====================================================================================================================
+
+type greaderCategory struct {
+	ID    string `json:"id"`
+	Label string `json:"label"`
+}
+
+type greaderSubscription struct {
+	ID         string             `json:"id"`
+	Title      string             `json:"title"`
+	Categories []*greaderCategory `json:"categories"`
+	URL        string             `json:"url"`
+	HTMLURL    string             `json:"htmlUrl"`
+	IconURL    string             `json:"iconUrl"`
+}
+
+func greaderSubscriptions(l *SessionLogger, user string) (interface{}, int) {
+	feeds := FeedList(l, user)
+	if feeds == nil {
+		return nil, http.StatusInternalServerError
+	}
+
+	subs := []*greaderSubscription{}
+	for _, f := range feeds {
+		s := &greaderSubscription{
+			ID:         "feed/" + f.ID,
+			Title:      f.Name,
+			Categories: []*greaderCategory{},
+			URL:        f.URL,
+			HTMLURL:    f.Link,
+		}
+		if f.Folder != "" {
+			s.Categories = append(s.Categories, &greaderCategory{ID: greaderLabel + f.Folder, Label: f.Folder})
+		}
+		subs = append(subs, s)
+	}
+	return map[string]interface{}{"subscriptions": subs}, http.StatusOK
+}
+
+// greaderFeed finds the user's subscription for a stream. Google used the feed URL as the ID, so some clients send
+// that instead of the ID they were given.
+func greaderFeed(l *SessionLogger, user, stream string) *Feed {
+	feeds := FeedList(l, user)
+	if feeds == nil {
+		return nil
+	}
+
+	id := strings.TrimPrefix(stream, "feed/")
+	for _, f := range feeds {
+		if f.ID == id || f.URL == id {
+			return f
+		}
+	}
+	l.W.Printf("Feed %v not subscribed by user %v.\n", stream, user)
+	return nil
+}
+
+// greaderSubscribe subscribes to a URL, using the first feed found there if it isn't a feed itself.
+func greaderSubscribe(l *SessionLogger, user, link, name string) (string, int) {
+	_, err := url.ParseRequestURI(link)
+	if err != nil {
+		l.W.Printf("Malformed URL. Error: %v\n", err)
+		return "", http.StatusBadRequest
+	}
+
+	known, status := FeedKnown(l, link)
+	if status != http.StatusOK {
+		return "", status
+	}
+	title := ""
+	if known {
+		title = FeedTitle(l, link)
+	} else {
+		candidates, status := FeedDiscover(l, link)
+		if candidates == nil {
+			return "", status
+		}
+		if len(candidates) == 0 {
+			l.W.Printf("No feeds found at %v.\n", link)
+			return "", http.StatusBadRequest
+		}
+		link, title = candidates[0].URL, candidates[0].Title
+	}
+
+	if name == "" {
+		name = title
+	}
+	if name == "" {
+		name = link
+	}
+
+	feed, status := FeedSubscribe(l, user, link, name)
+	if status == http.StatusAccepted {
+		status = http.StatusOK
+	}
+	return feed, status
+}
+
+func greaderSubscriptionEdit(l *SessionLogger, user string, r *http.Request) int {
+	streams := r.Form["s"]
+	if len(streams) == 0 {
+		l.W.Printf("Missing Google Reader stream.\n")
+		return http.StatusBadRequest
+	}
+	add := strings.TrimPrefix(greaderNormalize(r.FormValue("a")), greaderLabel)
+	remove := strings.TrimPrefix(greaderNormalize(r.FormValue("r")), greaderLabel)
+
+	for _, stream := range streams {
+		feed := ""
+		switch r.FormValue("ac") {
+		case "subscribe":
+			id, status := greaderSubscribe(l, user, strings.TrimPrefix(stream, "feed/"), r.FormValue("t"))
+			if status != http.StatusOK {
+				return status
+			}
+			feed = id
+		case "unsubscribe":
+			f := greaderFeed(l, user, stream)
+			if f == nil {
+				return http.StatusBadRequest
+			}
+			if status := FeedUnsub(l, user, f.ID); status != http.StatusOK {
+				return status
+			}
+			continue
+		case "edit":
+			f := greaderFeed(l, user, stream)
+			if f == nil {
+				return http.StatusBadRequest
+			}
+			feed = f.ID
+
+			if t := r.FormValue("t"); t != "" {
+				_, err := Queries["FeedRename"].Preped.Exec(user, feed, t)
+				if err != nil {
+					l.E.Printf("Failed renaming feed %v as user %v, error: %v\n", feed, user, err)
+					return http.StatusInternalServerError
+				}
+			}
+			if remove != "" && remove == f.Folder && add == "" {
+				if status := FeedSetFolder(l, user, feed, ""); status != http.StatusOK {
+					return status
+				}
+			}
+		default:
+			l.W.Printf("Unknown Google Reader subscription action: %v\n", r.FormValue("ac"))
+			return http.StatusBadRequest
+		}
+
+		if add != "" {
+			if status := FeedSetFolder(l, user, feed, add); status != http.StatusOK {
+				return status
+			}
+		}
+	}
+	return http.StatusOK
+}
+
+func greaderQuickAdd(l *SessionLogger, user string, r *http.Request) (interface{}, int) {
+	link := strings.TrimPrefix(r.FormValue("quickadd"), "feed/")
+	feed, status := greaderSubscribe(l, user, link, "")
+	if status != http.StatusOK {
+		return nil, status
+	}
+	return map[string]interface{}{
+		"numResults": 1,
+		"query":      link,
+		"streamId":   "feed/" + feed,
+	}, http.StatusOK
+}
+
+// Tags and counts
+// =====================================================================================================================
+
+type greaderTag struct {
+	ID   string `json:"id"`
+	Type string `json:"type,omitempty"`
+}
+
+func greaderFolders(feeds []*Feed) []string {
+	seen := map[string]bool{}
+	folders := []string{}
+	for _, f := range feeds {
+		if f.Folder != "" && !seen[f.Folder] {
+			seen[f.Folder] = true
+			folders = append(folders, f.Folder)
+		}
+	}
+	sort.Strings(folders)
+	return folders
+}
+
+func greaderTags(l *SessionLogger, user string) (interface{}, int) {
+	feeds := FeedList(l, user)
+	if feeds == nil {
+		return nil, http.StatusInternalServerError
+	}
+
+	tags := []*greaderTag{{ID: greaderStarred}}
+	for _, folder := range greaderFolders(feeds) {
+		tags = append(tags, &greaderTag{ID: greaderLabel + folder, Type: "folder"})
+	}
+	return map[string]interface{}{"tags": tags}, http.StatusOK
+}
+
+type greaderUnreadCount struct {
+	ID     string `json:"id"`
+	Count  int    `json:"count"`
+	Newest string `json:"newestItemTimestampUsec"`
+	newest int64
+}
+
+func greaderUnreadCounts(l *SessionLogger, user string) (interface{}, int) {
+	feeds := FeedList(l, user)
+	if feeds == nil {
+		return nil, http.StatusInternalServerError
+	}
+	folders := map[string]string{}
+	for _, f := range feeds {
+		folders[f.ID] = f.Folder
+	}
+
+	rows, err := Queries["GReaderUnreadCounts"].Preped.Query(user)
+	if err != nil {
+		l.E.Printf("Failed counting unread articles for user %v, error: %v\n", user, err)
+		return nil, http.StatusInternalServerError
+	}
+	defer rows.Close()
+
+	counts := []*greaderUnreadCount{}
+	all := &greaderUnreadCount{ID: greaderReadingList}
+	labels := map[string]*greaderUnreadCount{}
+	add := func(c *greaderUnreadCount, count int, newest int64) {
+		c.Count += count
+		if newest > c.newest {
+			c.newest = newest
+		}
+	}
+	for rows.Next() {
+		feed, count, newest := "", 0, int64(0)
+		err := rows.Scan(&feed, &count, &newest)
+		if err != nil {
+			l.E.Printf("Failed counting unread articles for user %v, error: %v\n", user, err)
+			return nil, http.StatusInternalServerError
+		}
+
+		c := &greaderUnreadCount{ID: "feed/" + feed}
+		add(c, count, newest)
+		counts = append(counts, c)
+		add(all, count, newest)
+
+		if folder := folders[feed]; folder != "" {
+			if labels[folder] == nil {
+				labels[folder] = &greaderUnreadCount{ID: greaderLabel + folder}
+				counts = append(counts, labels[folder])
+			}
+			add(labels[folder], count, newest)
+		}
+	}
+	counts = append(counts, all)
+
+	for _, c := range counts {
+		c.Newest = strconv.FormatInt(c.newest*1000000, 10)
+	}
+	return map[string]interface{}{"max": GReaderMaxItems, "unreadcounts": counts}, http.StatusOK
+}
+
+// Items
+// =====================================================================================================================
+
+type greaderLink struct {
+	Href string `json:"href"`
+	Type string `json:"type,omitempty"`
+}
+
+type greaderOrigin struct {
+	StreamID string `json:"streamId"`
+	Title    string `json:"title"`
+	HTMLURL  string `json:"htmlUrl"`
+}
+
+type greaderContent struct {
+	Direction string `json:"direction"`
+	Content   string `json:"content"`
+}
+
+type greaderItem struct {
+	ID            string          `json:"id"`
+	CrawlTimeMsec string          `json:"crawlTimeMsec"`
+	TimestampUsec string          `json:"timestampUsec"`
+	Published     int64           `json:"published"`
+	Updated       int64           `json:"updated"`
+	Title         string          `json:"title"`
+	Author        string          `json:"author"`
+	Canonical     []*greaderLink  `json:"canonical"`
+	Alternate     []*greaderLink  `json:"alternate"`
+	Categories    []string        `json:"categories"`
+	Origin        *greaderOrigin  `json:"origin"`
+	Summary       *greaderContent `json:"summary"`
+
+	seq     int64
+	article string
+}
+
+func greaderScanItem(s interface{ Scan(...interface{}) error }) (*greaderItem, error) {
+	i := &greaderItem{Origin: &greaderOrigin{}}
+	feed, link, folder := "", "", ""
+	read, starred := false, false
+	err := s.Scan(&i.seq, &i.article, &feed, &i.Title, &link, &i.Published, &read, &starred, &i.Origin.Title, &i.Origin.HTMLURL, &folder)
+	if err != nil {
+		return nil, err
+	}
+
+	i.ID = greaderItemID(i.seq)
+	i.Updated = i.Published
+	i.CrawlTimeMsec = strconv.FormatInt(i.Published*1000, 10)
+	i.TimestampUsec = strconv.FormatInt(i.Published*1000000, 10)
+	i.Canonical = []*greaderLink{{Href: link}}
+	i.Alternate = []*greaderLink{{Href: link, Type: "text/html"}}
+	i.Origin.StreamID = "feed/" + feed
+	i.Summary = &greaderContent{Direction: "ltr"}
+
+	i.Categories = []string{greaderReadingList}
+	if read {
+		i.Categories = append(i.Categories, greaderRead)
+	}
+	if starred {
+		i.Categories = append(i.Categories, greaderStarred)
+	}
+	if folder != "" {
+		i.Categories = append(i.Categories, greaderLabel+folder)
+	}
+	return i, nil
+}
+
+// greaderItems lists a stream, newest first unless "r=o" is given.
+func greaderItems(l *SessionLogger, user, stream string, r *http.Request) ([]*greaderItem, string, int) {
+	f, status := greaderParseFilter(l, stream, r)
+	if f == nil {
+		return nil, "", status
+	}
+
+	p := NewPageParams(r.FormValue("r") != "o", GReaderDefaultItems)
+	if v := r.FormValue("n"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			l.W.Printf("Invalid Google Reader item count: %v\n", v)
+			return nil, "", http.StatusBadRequest
+		}
+		if n > GReaderMaxItems {
+			n = GReaderMaxItems
+		}
+		p.Limit = n
+	}
+	if v := r.FormValue("c"); v != "" {
+		parts := strings.SplitN(v, ".", 2)
+		stamp, err := strconv.ParseInt(parts[0], 10, 64)
+		if len(parts) != 2 || err != nil {
+			l.W.Printf("Malformed continuation: %v\n", v)
+			return nil, "", http.StatusBadRequest
+		}
+		p.Published, p.ID = stamp, parts[1]
+	}
+
+	oldest, newest := int64(math.MinInt64), int64(math.MaxInt64)
+	if v := r.FormValue("ot"); v != "" {
+		oldest, _ = strconv.ParseInt(v, 10, 64)
+	}
+	if v := r.FormValue("nt"); v != "" {
+		newest, _ = strconv.ParseInt(v, 10, 64)
+	}
+
+	rows, err := Queries["GReaderItems"+p.Query()].Preped.Query(user, f.Feed, f.Folder, f.Starred, f.Read, oldest, newest, p.Published, p.ID, p.Limit)
+	if err != nil {
+		l.E.Printf("Failed listing Google Reader stream %v for user %v, error: %v\n", stream, user, err)
+		return nil, "", http.StatusInternalServerError
+	}
+	defer rows.Close()
+
+	items := []*greaderItem{}
+	for rows.Next() {
+		i, err := greaderScanItem(rows)
+		if err != nil {
+			l.E.Printf("Failed listing Google Reader stream %v for user %v, error: %v\n", stream, user, err)
+			return nil, "", http.StatusInternalServerError
+		}
+		items = append(items, i)
+	}
+
+	continuation := ""
+	if len(items) == p.Limit {
+		last := items[len(items)-1]
+		continuation = Cursor(last.Published, last.article)
+	}
+	return items, continuation, http.StatusOK
+}
+
+type greaderItemRef struct {
+	ID              string   `json:"id"`
+	DirectStreamIDs []string `json:"directStreamIds"`
+	TimestampUsec   string   `json:"timestampUsec"`
+}
+
+func greaderItemIDs(l *SessionLogger, user string, r *http.Request) (interface{}, int) {
+	items, continuation, status := greaderItems(l, user, r.FormValue("s"), r)
+	if items == nil {
+		return nil, status
+	}
+
+	refs := []*greaderItemRef{}
+	for _, i := range items {
+		refs = append(refs, &greaderItemRef{
+			ID:              strconv.FormatInt(i.seq, 10),
+			DirectStreamIDs: []string{},
+			TimestampUsec:   i.TimestampUsec,
+		})
+	}
+	resp := map[string]interface{}{"itemRefs": refs}
+	if continuation != "" {
+		resp["continuation"] = continuation
+	}
+	return resp, http.StatusOK
+}
+
+func greaderStreamContents(l *SessionLogger, user, stream string, r *http.Request) (interface{}, int) {
+	items, continuation, status := greaderItems(l, user, stream, r)
+	if items == nil {
+		return nil, status
+	}
+
+	resp := map[string]interface{}{
+		"id":      stream,
+		"updated": time.Now().Unix(),
+		"items":   items,
+	}
+	if continuation != "" {
+		resp["continuation"] = continuation
+	}
+	return resp, http.StatusOK
+}
+
+// greaderItemContents loads specific items, most clients list the IDs first and then ask for the ones they need.
+func greaderItemContents(l *SessionLogger, user string, r *http.Request) (interface{}, int) {
+	items := []*greaderItem{}
+	for _, id := range r.Form["i"] {
+		seq, ok := greaderParseItemID(id)
+		if !ok {
+			l.W.Printf("Invalid Google Reader item ID: %v\n", id)
+			return nil, http.StatusBadRequest
+		}
+
+		i, err := greaderScanItem(Queries["GReaderItem"].Preped.QueryRow(user, seq))
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			l.E.Printf("Failed loading Google Reader item %v for user %v, error: %v\n", id, user, err)
+			return nil, http.StatusInternalServerError
+		}
+		items = append(items, i)
+	}
+
+	return map[string]interface{}{
+		"id":      greaderReadingList,
+		"updated": time.Now().Unix(),
+		"items":   items,
+	}, http.StatusOK
+}
+
+// Marking
+// =====================================================================================================================
+
+func greaderEditTag(l *SessionLogger, user string, r *http.Request) int {
+	for _, id := range r.Form["i"] {
+		seq, ok := greaderParseItemID(id)
+		if !ok {
+			l.W.Printf("Invalid Google Reader item ID: %v\n", id)
+			return http.StatusBadRequest
+		}
+		article := ""
+		err := Queries["ArticleBySeq"].Preped.QueryRow(user, seq).Scan(&article)
+		if err != nil {
+			l.W.Printf("Google Reader item %v not found for user %v, error: %v\n", id, user, err)
+			return http.StatusBadRequest
+		}
+
+		// Labels on individual items aren't something we have, so those are ignored.
+		for _, tag := range r.Form["a"] {
+			status := http.StatusOK
+			switch greaderNormalize(tag) {
+			case greaderRead:
+				status = ArticleMarkRead(l, user, article)
+			case greaderKeptUnread:
+				status = ArticleMarkUnread(l, user, article)
+			case greaderStarred:
+				status = ArticleStar(l, user, article)
+			}
+			if status != http.StatusOK {
+				return status
+			}
+		}
+		for _, tag := range r.Form["r"] {
+			status := http.StatusOK
+			switch greaderNormalize(tag) {
+			case greaderRead:
+				status = ArticleMarkUnread(l, user, article)
+			case greaderStarred:
+				status = ArticleUnstar(l, user, article)
+			}
+			if status != http.StatusOK {
+				return status
+			}
+		}
+	}
+	return http.StatusOK
+}
+
+func greaderMarkAllRead(l *SessionLogger, user string, r *http.Request) int {
+	stream := greaderNormalize(r.FormValue("s"))
+	before := int64(math.MaxInt64)
+	if v := r.FormValue("ts"); v != "" {
+		usec, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			l.W.Printf("Invalid Google Reader timestamp: %v\n", v)
+			return http.StatusBadRequest
+		}
+		// Microseconds, and inclusive.
+		before = usec/1000000 + 1
+	}
+
+	feeds := FeedList(l, user)
+	if feeds == nil {
+		return http.StatusInternalServerError
+	}
+
+	for _, f := range feeds {
+		match := false
+		switch {
+		case stream == greaderReadingList:
+			match = true
+		case strings.HasPrefix(stream, greaderLabel):
+			match = f.Folder == strings.TrimPrefix(stream, greaderLabel)
+		case strings.HasPrefix(stream, "feed/"):
+			id := strings.TrimPrefix(stream, "feed/")
+			match = f.ID == id || f.URL == id
+		default:
+			l.W.Printf("Cannot mark Google Reader stream %v read.\n", stream)
+			return http.StatusBadRequest
+		}
+		if !match {
+			continue
+		}
+		if status := FeedMarkRead(l, user, f.ID, before); status != http.StatusOK {
+			return status
+		}
+	}
+	return http.StatusOK
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "time"
+import "strings"
+import "testing"
+import "net/url"
+import "net/http"
+import "encoding/json"
+import "net/http/httptest"
+
+// testGReader makes a Google Reader API call, decoding the response into resp if it isn't nil.
+func testGReader(t *testing.T, method, path string, form url.Values, resp interface{}) int {
+	t.Helper()
+
+	r := httptest.NewRequest(method, "/greader/reader/api/0/"+path+"?"+form.Encode(), nil)
+	r.Header.Set("Authorization", "GoogleLogin auth=token1")
+	w := httptest.NewRecorder()
+	GReaderHandler(w, r)
+	if w.Code == http.StatusOK && resp != nil {
+		err := json.NewDecoder(w.Body).Decode(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code
+}
+
+type testGReaderRefs struct {
+	ItemRefs []struct {
+		ID string `json:"id"`
+	} `json:"itemRefs"`
+	Continuation string `json:"continuation"`
+}
+
+type testGReaderStream struct {
+	Items []*greaderItem `json:"items"`
+}
+
+func TestGReader(t *testing.T) {
+	testDB(t, func(t *testing.T) {
+		testUser(t, "u1", "one@example.com")
+		err := Data.ApiKeyAdd("token1", "u1", "greader", time.Now().Unix())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f1 := testFeed(t, "https://example.com/one", "u1")
+		f2 := testFeed(t, "https://example.com/two", "u1")
+		testStatus(t, "set folder", FeedSetFolder(ml, "u1", f1, "News"), http.StatusOK)
+		testIngest(t, f1, testItem("https://example.com/one/1", "One", 1), testItem("https://example.com/one/2", "Two", 2))
+		testIngest(t, f2, testItem("https://example.com/two/1", "Three", 3))
+
+		r := httptest.NewRequest(http.MethodGet, "/greader/reader/api/0/subscription/list", nil)
+		w := httptest.NewRecorder()
+		GReaderHandler(w, r)
+		testStatus(t, "no token", w.Code, http.StatusUnauthorized)
+
+		subs := struct {
+			Subscriptions []*greaderSubscription `json:"subscriptions"`
+		}{}
+		testStatus(t, "subscriptions", testGReader(t, http.MethodGet, "subscription/list", url.Values{}, &subs), http.StatusOK)
+		if len(subs.Subscriptions) != 2 {
+			t.Fatalf("Got %v subscriptions, expected 2", len(subs.Subscriptions))
+		}
+
+		for _, path := range []string{"user-info", "tag/list", "unread-count"} {
+			testStatus(t, path, testGReader(t, http.MethodGet, path, url.Values{}, nil), http.StatusOK)
+		}
+
+		// Paging, newest first.
+		refs := testGReaderRefs{}
+		form := url.Values{"s": {greaderReadingList}, "n": {"2"}}
+		testStatus(t, "first page", testGReader(t, http.MethodGet, "stream/items/ids", form, &refs), http.StatusOK)
+		if len(refs.ItemRefs) != 2 || refs.Continuation == "" {
+			t.Fatalf("First page: %+v", refs)
+		}
+		ids := []string{refs.ItemRefs[0].ID, refs.ItemRefs[1].ID}
+		form.Set("c", refs.Continuation)
+		refs = testGReaderRefs{}
+		testStatus(t, "second page", testGReader(t, http.MethodGet, "stream/items/ids", form, &refs), http.StatusOK)
+		if len(refs.ItemRefs) != 1 || refs.Continuation != "" {
+			t.Fatalf("Second page: %+v", refs)
+		}
+		ids = append(ids, refs.ItemRefs[0].ID)
+
+		stream := testGReaderStream{}
+		path := "stream/contents/" + url.PathEscape(greaderLabel+"News")
+		testStatus(t, "folder stream", testGReader(t, http.MethodGet, path, url.Values{}, &stream), http.StatusOK)
+		if len(stream.Items) != 2 || stream.Items[0].Title != "Two" {
+			t.Fatalf("Folder stream: %+v", stream.Items)
+		}
+
+		form = url.Values{"i": {ids[0]}, "a": {greaderRead, greaderStarred}}
+		testStatus(t, "edit-tag as GET", testGReader(t, http.MethodGet, "edit-tag", form, nil), http.StatusMethodNotAllowed)
+		testStatus(t, "edit-tag", testGReader(t, http.MethodPost, "edit-tag", form, nil), http.StatusOK)
+
+		stream = testGReaderStream{}
+		form = url.Values{"i": {ids[0]}}
+		testStatus(t, "item contents", testGReader(t, http.MethodGet, "stream/items/contents", form, &stream), http.StatusOK)
+		if len(stream.Items) != 1 || !strings.Contains(strings.Join(stream.Items[0].Categories, " "), greaderStarred) {
+			t.Fatalf("Item contents: %+v", stream.Items)
+		}
+
+		refs = testGReaderRefs{}
+		form = url.Values{"s": {greaderReadingList}, "xt": {greaderRead}}
+		testStatus(t, "unread", testGReader(t, http.MethodGet, "stream/items/ids", form, &refs), http.StatusOK)
+		if len(refs.ItemRefs) != 2 {
+			t.Fatalf("Unread after marking one read: %+v", refs)
+		}
+
+		form = url.Values{"s": {greaderReadingList}}
+		testStatus(t, "mark all read", testGReader(t, http.MethodPost, "mark-all-as-read", form, nil), http.StatusOK)
+		refs = testGReaderRefs{}
+		form = url.Values{"s": {greaderReadingList}, "xt": {greaderRead}}
+		testStatus(t, "unread", testGReader(t, http.MethodGet, "stream/items/ids", form, &refs), http.StatusOK)
+		if len(refs.ItemRefs) != 0 {
+			t.Fatalf("Unread after marking everything read: %+v", refs)
+		}
+	})
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "time"
+import "bytes"
+import "errors"
+import "strings"
+import "net/url"
+import "net/http"
+import "database/sql"
+
+import "golang.org/x/net/html"
+import "golang.org/x/net/html/atom"
+
+const MaxIconBytes = int64(256 << 10)
+
+// How long a fetched icon is good for, and how long to wait before trying again after a failure.
+const IconMaxAge = 7 * 24 * time.Hour
+const IconRetry = 24 * time.Hour
+
+// /api/feed/icon
+// =====================================================================================================================
+
+// FeedIcon returns the favicon for the site a feed belongs to, fetching it if it isn't cached or is stale. Users only
+// get icons for feeds they are subscribed to, anything else is not found.
+func FeedIcon(l *SessionLogger, user, feed string) (string, []byte, int) {
+	ok, err := Data.Subscribed(user, feed)
+	if err != nil {
+		l.E.Printf("DB existence check failed for subscribed feed %v by user %v, error: %v\n", feed, user, err)
+		return "", nil, http.StatusInternalServerError
+	}
+	if !ok {
+		l.W.Printf("Feed %v not subscribed by user %v.\n", feed, user)
+		return "", nil, http.StatusNotFound
+	}
+
+	typ, data, fetched := "", []byte(nil), int64(0)
+	err = Queries["FeedIconGet"].Preped.QueryRow(feed).Scan(&typ, &data, &fetched)
+	if err != nil && err != sql.ErrNoRows {
+		l.E.Printf("Failed loading icon for feed %v, error: %v\n", feed, err)
+		return "", nil, http.StatusInternalServerError
+	}
+
+	age := time.Since(time.Unix(fetched, 0))
+	if err == nil && ((len(data) > 0 && age < IconMaxAge) || (len(data) == 0 && age < IconRetry)) {
+		if len(data) == 0 {
+			return "", nil, http.StatusNotFound
+		}
+		return typ, data, http.StatusOK
+	}
+
+	ntyp, ndata, ferr := iconFetch(feed)
+	if ferr != nil {
+		l.W.Printf("Could not fetch icon for feed %v, error: %v\n", feed, ferr)
+	}
+
+	// A stale icon is better than no icon.
+	if ferr == nil || len(data) == 0 {
+		typ, data = ntyp, ndata
+	}
+	_, err = Queries["FeedIconSet"].Preped.Exec(feed, typ, data, time.Now().Unix())
+	if err != nil {
+		l.E.Printf("Failed caching icon for feed %v, error: %v\n", feed, err)
+	}
+
+	if len(data) == 0 {
+		return "", nil, http.StatusNotFound
+	}
+	return typ, data, http.StatusOK
+}
+
+func iconFetch(feed string) (string, []byte, error) {
+	feedurl, link := "", ""
+	err := Queries["FeedLinks"].Preped.QueryRow(feed).Scan(&feedurl, &link)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Sites that do not give a link in the feed are assumed to live at the same host as the feed.
+	if link == "" {
+		link = feedurl
+	}
+	site, err := url.Parse(link)
+	if err != nil {
+		return "", nil, err
+	}
+
+	icons := []string{}
+	body, final, err := discoverFetch(site.String(), MaxDiscoverBytes)
+	if err == nil {
+		icons = iconLinks(body, final)
+		site = final
+	}
+	fallback := *site
+	fallback.Path, fallback.RawQuery, fallback.Fragment = "/favicon.ico", "", ""
+	icons = append(icons, fallback.String())
+
+	for _, icon := range icons {
+		data, _, err := discoverFetch(icon, MaxIconBytes)
+		if err != nil || len(data) == 0 {
+			continue
+		}
+		typ := http.DetectContentType(data)
+		if strings.HasPrefix(typ, "text/xml") || strings.HasPrefix(typ, "text/plain") {
+			// SVG icons sniff as text.
+			if bytes.Contains(data, []byte("<svg")) {
+				typ = "image/svg+xml"
+			}
+		}
+		if !strings.HasPrefix(typ, "image/") {
+			continue
+		}
+		return typ, data, nil
+	}
+	return "", nil, errors.New("no usable icon found")
+}
+
+// iconLinks pulls the icon links out of a HTML page.
+func iconLinks(body []byte, base *url.URL) []string {
+	doc, err := html.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil
+	}
+
+	links := []string{}
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.DataAtom == atom.Link && attr(n, "href") != "" {
+			for _, rel := range strings.Fields(strings.ToLower(attr(n, "rel"))) {
+				if rel != "icon" && rel != "apple-touch-icon" {
+					continue
+				}
+				if u, err := base.Parse(attr(n, "href")); err == nil {
+					links = append(links, u.String())
+				}
+				break
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	return links
+}
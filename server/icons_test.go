@@ -0,0 +1,136 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "testing"
+import "net/http"
+import "net/http/httptest"
+
+import "github.com/mmcdole/gofeed"
+
+func TestFeedInfo(t *testing.T) {
+	testDB(t, func(t *testing.T) {
+		testUser(t, "u1", "one@example.com")
+		feed := testFeed(t, "https://example.com/feed", "u1")
+
+		if f := FeedDetails(ml, "u1", feed); f == nil || f.Title != "" || f.Link != "" {
+			t.Fatalf("Got feed %+v before it was ever fetched", f)
+		}
+
+		FeedUpdateInfo(ml, feed, &gofeed.Feed{
+			Title:       "Example",
+			Link:        "https://example.com/",
+			Description: "Things happen.",
+			Image:       &gofeed.Image{URL: "https://example.com/logo.png"},
+			Language:    "en",
+		})
+		f := FeedDetails(ml, "u1", feed)
+		want := Feed{
+			ID:          feed,
+			Name:        "Feed https://example.com/feed",
+			URL:         "https://example.com/feed",
+			Title:       "Example",
+			Link:        "https://example.com/",
+			Description: "Things happen.",
+			Image:       "https://example.com/logo.png",
+			Language:    "en",
+		}
+		if f == nil || *f != want {
+			t.Fatalf("Got feed %+v, expected %+v", f, want)
+		}
+		if feeds := FeedList(ml, "u1"); len(feeds) != 1 || *feeds[0] != want {
+			t.Fatalf("Got feeds %+v, expected %+v", feeds, want)
+		}
+		if title := FeedTitle(ml, "https://example.com/feed"); title != "Example" {
+			t.Fatalf("Got title %q", title)
+		}
+
+		// Later fetches replace it all.
+		FeedUpdateInfo(ml, feed, &gofeed.Feed{Title: "Renamed"})
+		if f := FeedDetails(ml, "u1", feed); f == nil || f.Title != "Renamed" || f.Image != "" {
+			t.Fatalf("Got feed %+v after it changed", f)
+		}
+	})
+}
+
+func TestFeedIcon(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"
+	svg := `<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"></svg>`
+
+	hits := map[string]int{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits[r.URL.Path]++
+		switch r.URL.Path {
+		case "/png/":
+			w.Write([]byte(`<html><head><link rel="shortcut icon" href="icon.png"></head></html>`))
+		case "/png/icon.png":
+			w.Write([]byte(png))
+		case "/svg/":
+			w.Write([]byte(`<html><head><link rel="icon" href="/icon.svg"></head></html>`))
+		case "/icon.svg":
+			w.Write([]byte(svg))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+
+	testDB(t, func(t *testing.T) {
+		testUser(t, "u1", "one@example.com")
+		testUser(t, "u2", "two@example.com")
+		pngfeed := testFeed(t, s.URL+"/png/feed", "u1")
+		svgfeed := testFeed(t, s.URL+"/svg/feed", "u1")
+		nofeed := testFeed(t, s.URL+"/none/feed", "u1")
+		FeedUpdateInfo(ml, pngfeed, &gofeed.Feed{Link: s.URL + "/png/"})
+		FeedUpdateInfo(ml, svgfeed, &gofeed.Feed{Link: s.URL + "/svg/"})
+
+		for i := 0; i < 2; i++ {
+			typ, data, status := FeedIcon(ml, "u1", pngfeed)
+			if status != http.StatusOK || typ != "image/png" || string(data) != png {
+				t.Fatalf("Got %v icon %q with status %v", typ, data, status)
+			}
+			typ, data, status = FeedIcon(ml, "u1", svgfeed)
+			if status != http.StatusOK || typ != "image/svg+xml" || string(data) != svg {
+				t.Fatalf("Got %v icon %q with status %v", typ, data, status)
+			}
+
+			// No link in the feed, so it tries the root of the feed's host.
+			_, _, status = FeedIcon(ml, "u1", nofeed)
+			testStatus(t, "no icon", status, http.StatusNotFound)
+		}
+
+		// Only subscribers get to see it, even when it is cached.
+		_, _, status := FeedIcon(ml, "u2", pngfeed)
+		testStatus(t, "not subscribed", status, http.StatusNotFound)
+
+		// Everything was cached the first time round, including the failure.
+		for path, n := range hits {
+			if n != 1 {
+				t.Fatalf("Fetched %v %v times", path, n)
+			}
+		}
+		if hits["/favicon.ico"] != 1 {
+			t.Fatalf("Never tried the default icon, fetched %v", hits)
+		}
+	})
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "html"
+import "time"
+import "bytes"
+import "errors"
+import "strconv"
+import "strings"
+import "encoding/json"
+
+import "github.com/mmcdole/gofeed"
+
+// The version of gofeed we use only knows RSS and Atom, so JSON Feed (https://jsonfeed.org) is handled here. The same
+// types are used to write the output feeds.
+
+const jsonFeedVersionPrefix = "https://jsonfeed.org/version/"
+
+var errNotJSONFeed = errors.New("JSON document is not a JSON Feed")
+
+// jsonFeedID is a string, but a lot of feeds use numbers for item IDs anyway.
+type jsonFeedID string
+
+func (id *jsonFeedID) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if len(b) > 0 && b[0] != '"' {
+		var n json.Number
+		err := json.Unmarshal(b, &n)
+		*id = jsonFeedID(n)
+		return err
+	}
+	var s string
+	err := json.Unmarshal(b, &s)
+	*id = jsonFeedID(s)
+	return err
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+	URL  string `json:"url,omitempty"`
+}
+
+type jsonFeedAttachment struct {
+	URL      string `json:"url"`
+	MimeType string `json:"mime_type"`
+	Size     int64  `json:"size_in_bytes,omitempty"`
+}
+
+type jsonFeedItem struct {
+	ID            jsonFeedID            `json:"id"`
+	URL           string                `json:"url,omitempty"`
+	ExternalURL   string                `json:"external_url,omitempty"`
+	Title         string                `json:"title,omitempty"`
+	ContentHTML   string                `json:"content_html,omitempty"`
+	ContentText   string                `json:"content_text"`
+	Summary       string                `json:"summary,omitempty"`
+	Image         string                `json:"image,omitempty"`
+	DatePublished string                `json:"date_published"`
+	DateModified  string                `json:"date_modified,omitempty"`
+	Authors       []*jsonFeedAuthor     `json:"authors,omitempty"`
+	Author        *jsonFeedAuthor       `json:"author,omitempty"` // Version 1.0 only
+	Tags          []string              `json:"tags,omitempty"`
+	Attachments   []*jsonFeedAttachment `json:"attachments,omitempty"`
+}
+
+type jsonFeedHub struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+type jsonFeed struct {
+	Version     string            `json:"version"`
+	Title       string            `json:"title"`
+	HomePageURL string            `json:"home_page_url"`
+	FeedURL     string            `json:"feed_url"`
+	Description string            `json:"description,omitempty"`
+	Icon        string            `json:"icon,omitempty"`
+	Favicon     string            `json:"favicon,omitempty"`
+	Language    string            `json:"language,omitempty"`
+	Authors     []*jsonFeedAuthor `json:"authors,omitempty"`
+	Author      *jsonFeedAuthor   `json:"author,omitempty"` // Version 1.0 only
+	Hubs        []*jsonFeedHub    `json:"hubs,omitempty"`
+	Items       []*jsonFeedItem   `json:"items"`
+}
+
+// jsonFeedParse reads a JSON Feed, version 1.0 or 1.1, into the same structure gofeed uses for everything else.
+func jsonFeedParse(body []byte) (*gofeed.Feed, error) {
+	jf := &jsonFeed{}
+	err := json.Unmarshal(body, jf)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(jf.Version, jsonFeedVersionPrefix) {
+		return nil, errNotJSONFeed
+	}
+
+	f := &gofeed.Feed{
+		Title:       jf.Title,
+		Description: jf.Description,
+		Link:        jf.HomePageURL,
+		FeedLink:    jf.FeedURL,
+		Language:    jf.Language,
+		Author:      jsonFeedPerson(jf.Authors, jf.Author),
+		Items:       []*gofeed.Item{},
+		FeedType:    "json",
+		FeedVersion: strings.TrimPrefix(jf.Version, jsonFeedVersionPrefix),
+	}
+	if jf.Icon != "" {
+		f.Image = &gofeed.Image{URL: jf.Icon}
+	}
+
+	for _, ji := range jf.Items {
+		i := &gofeed.Item{
+			Title:       ji.Title,
+			Description: ji.Summary,
+			Content:     ji.ContentHTML,
+			Link:        ji.URL,
+			GUID:        string(ji.ID),
+			Author:      jsonFeedPerson(ji.Authors, ji.Author),
+			Categories:  ji.Tags,
+		}
+		if i.Author == nil {
+			i.Author = f.Author
+		}
+
+		// Everything downstream expects HTML content.
+		if i.Content == "" && ji.ContentText != "" {
+			i.Content = "<p>" + strings.ReplaceAll(html.EscapeString(ji.ContentText), "\n", "<br>") + "</p>"
+		}
+
+		// Items without a URL are allowed, but we key articles on them. Microblog style feeds often use the permalink
+		// as the ID, so try that before giving up.
+		if i.Link == "" {
+			i.Link = ji.ExternalURL
+		}
+		if i.Link == "" && (strings.HasPrefix(i.GUID, "https://") || strings.HasPrefix(i.GUID, "http://")) {
+			i.Link = i.GUID
+		}
+
+		if ji.Image != "" {
+			i.Image = &gofeed.Image{URL: ji.Image}
+		}
+		for _, a := range ji.Attachments {
+			e := &gofeed.Enclosure{URL: a.URL, Type: a.MimeType}
+			if a.Size > 0 {
+				e.Length = strconv.FormatInt(a.Size, 10)
+			}
+			i.Enclosures = append(i.Enclosures, e)
+		}
+
+		if t, err := time.Parse(time.RFC3339, ji.DatePublished); err == nil {
+			i.Published, i.PublishedParsed = ji.DatePublished, &t
+		}
+		if t, err := time.Parse(time.RFC3339, ji.DateModified); err == nil {
+			i.Updated, i.UpdatedParsed = ji.DateModified, &t
+		}
+
+		f.Items = append(f.Items, i)
+	}
+	return f, nil
+}
+
+func jsonFeedPerson(authors []*jsonFeedAuthor, author *jsonFeedAuthor) *gofeed.Person {
+	if len(authors) > 0 {
+		author = authors[0]
+	}
+	if author == nil || author.Name == "" {
+		return nil
+	}
+	return &gofeed.Person{Name: author.Name}
+}
@@ -58,10 +58,9 @@ func init() {
 		E: log.New(errorLog, "ERROR@master: ", log.Ldate|log.Ltime|log.Lshortfile),
 	}
 
+	c := make(chan string)
+	logIDService = c
 	go func() {
-		c := make(chan string)
-		logIDService = c
-
 		idsource := shortid.MustNew(16, shortid.DefaultABC, uint64(time.Now().UnixNano()))
 
 		for {
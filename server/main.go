@@ -23,11 +23,16 @@ misrepresented as being the original software.
 // RSN2: Multi-user RSS feed tracker.
 package main
 
+import "io"
 import "os"
 import "fmt"
+import "math"
 import "mime"
+import "strconv"
+import "strings"
 import "net/url"
 import "net/http"
+import "encoding/xml"
 import "encoding/json"
 
 import "github.com/milochristiansen/axis2"
@@ -35,7 +40,33 @@ import "github.com/milochristiansen/axis2/sources"
 
 const MaxBodyBytes = int64(65536)
 
+// RSN2_ROLE splits the work between processes sharing a database:
+//
+//	all     Everything, the default.
+//	web     Serves the site and APIs, and runs the jobs requests hand work to (refreshes and webhook deliveries).
+//	worker  Updates feeds and prunes old articles, with no web server. Set RSN2_EVENTS_BROKER so its events reach
+//	        the web processes.
+//	broker  Only runs the event broker on RSN2_EVENTS_LISTEN, see broker.go. It doesn't touch the database.
+var Role = os.Getenv("RSN2_ROLE")
+
 func main() {
+	switch Role {
+	case "", "all", "web", "worker":
+	case "broker":
+		if EventBrokerListen == "" {
+			panic("RSN2_ROLE is broker, but RSN2_EVENTS_LISTEN is not set.")
+		}
+		eventBrokerServe(newSessionLogger("events"), EventBrokerListen)
+		panic("Event broker stopped.")
+	default:
+		panic("Unknown RSN2_ROLE: " + Role)
+	}
+
+	err := DBOpen()
+	if err != nil {
+		panic(err)
+	}
+
 	// /api/user/confirm-email
 	http.HandleFunc("/api/user/confirm-email", func(w http.ResponseWriter, r *http.Request) {
 		l := newSessionLogger("/api/user/confirm-email")
@@ -90,6 +121,10 @@ func main() {
 	http.HandleFunc("/api/user/login", func(w http.ResponseWriter, r *http.Request) {
 		l := newSessionLogger("/api/user/login")
 
+		if !AllowMethods(l, w, r, http.MethodPost) {
+			return
+		}
+
 		r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
 
 		data := &UserLoginData{}
@@ -115,6 +150,16 @@ func main() {
 		session, _ := SessionStore.Get(r, "rsn2-session")
 		session.Values["user"] = user
 		session.Values["auth"] = true
+
+		// A new login gets a new token.
+		delete(session.Values, "csrf")
+		_, _, err = CSRFToken(w, r, session)
+		if err != nil {
+			l.E.Printf("Error creating CSRF token. Error: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
 		err = session.Save(r, w)
 		if err != nil {
 			l.W.Printf("Error saving session. Error: %v\n", err)
@@ -127,11 +172,20 @@ func main() {
 
 	// /api/user/logout
 	http.HandleFunc("/api/user/logout", func(w http.ResponseWriter, r *http.Request) {
-		l := newSessionLogger("/api/user/login")
+		l := newSessionLogger("/api/user/logout")
+
+		if !AllowMethods(l, w, r, http.MethodPost) {
+			return
+		}
 
 		session, _ := SessionStore.Get(r, "rsn2-session")
+		if token, ok := session.Values["csrf"].(string); ok && !csrfCheck(l, r, token) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
 		session.Values["user"] = ""
 		session.Values["auth"] = false
+		delete(session.Values, "csrf")
 		err := session.Save(r, w)
 		if err != nil {
 			l.W.Printf("Error saving session. Error: %v\n", err)
@@ -146,6 +200,10 @@ func main() {
 	http.HandleFunc("/api/user/new", func(w http.ResponseWriter, r *http.Request) {
 		l := newSessionLogger("/api/user/new")
 
+		if !AllowMethods(l, w, r, http.MethodPost) {
+			return
+		}
+
 		r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
 
 		data := &UserLoginData{}
@@ -163,6 +221,10 @@ func main() {
 	http.HandleFunc("/api/user/new-pass", func(w http.ResponseWriter, r *http.Request) {
 		l := newSessionLogger("/api/user/new-pass")
 
+		if !AllowMethods(l, w, r, http.MethodPost) {
+			return
+		}
+
 		user, status := GetSession(l, w, r)
 		if user == "" {
 			w.WriteHeader(status)
@@ -186,6 +248,10 @@ func main() {
 	http.HandleFunc("/api/user/new-name", func(w http.ResponseWriter, r *http.Request) {
 		l := newSessionLogger("/api/user/new-name")
 
+		if !AllowMethods(l, w, r, http.MethodPost) {
+			return
+		}
+
 		user, status := GetSession(l, w, r)
 		if user == "" {
 			w.WriteHeader(status)
@@ -205,6 +271,50 @@ func main() {
 		w.WriteHeader(UserNewName(l, user, data.Password, data.Email))
 	})
 
+	// /api/user/fever
+	http.HandleFunc("/api/user/fever", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/user/fever")
+
+		if !AllowMethods(l, w, r, http.MethodPost) {
+			return
+		}
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
+
+		data := &UserLoginData{}
+		err := json.NewDecoder(r.Body).Decode(data)
+		if err != nil {
+			l.W.Printf("Error parsing Fever enable body. Error: %v\n", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(FeverEnable(l, user, data.Password))
+	})
+
+	// /api/user/fever-disable
+	http.HandleFunc("/api/user/fever-disable", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/user/fever-disable")
+
+		if !AllowMethods(l, w, r, http.MethodPost) {
+			return
+		}
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		w.WriteHeader(FeverDisable(l, user))
+	})
+
 	// /api/feed/list
 	http.HandleFunc("/api/feed/list", func(w http.ResponseWriter, r *http.Request) {
 		l := newSessionLogger("/api/feed/list")
@@ -258,6 +368,37 @@ func main() {
 		}
 	})
 
+	// /api/feed/icon
+	http.HandleFunc("/api/feed/icon", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/feed/icon")
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		feed := r.FormValue("id")
+		if feed == "" {
+			l.W.Printf("Missing feed ID.\n")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		typ, icon, status := FeedIcon(l, user, feed)
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+
+		// Icons come from other sites, so make sure nothing in them (SVG scripts) runs as us.
+		w.Header().Set("Content-Type", typ)
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Cache-Control", "private, max-age=86400")
+		w.Write(icon)
+	})
+
 	// /api/feed/articles
 	http.HandleFunc("/api/feed/articles", func(w http.ResponseWriter, r *http.Request) {
 		l := newSessionLogger("/api/feed/articles")
@@ -275,7 +416,13 @@ func main() {
 			return
 		}
 
-		articles := FeedArticles(l, user, feed)
+		page, status := ParsePageParams(l, r)
+		if page == nil {
+			w.WriteHeader(status)
+			return
+		}
+
+		articles := FeedArticles(l, user, feed, page)
 		if articles == nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
@@ -288,10 +435,78 @@ func main() {
 		}
 	})
 
+	// /api/feed/retention
+	http.HandleFunc("/api/feed/retention", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/feed/retention")
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		feed := r.FormValue("id")
+		if feed == "" {
+			l.W.Printf("Missing feed ID.\n")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		details := FeedRetention(l, user, feed)
+		if details == nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		err := json.NewEncoder(w).Encode(details)
+		if err != nil {
+			l.E.Printf("Error encoding payload. Error: %v\n", err)
+			return
+		}
+	})
+
+	// /api/feed/set-retention
+	http.HandleFunc("/api/feed/set-retention", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/feed/set-retention")
+
+		if !AllowMethods(l, w, r, http.MethodPost) {
+			return
+		}
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		feed := r.FormValue("id")
+		if feed == "" {
+			l.W.Printf("Missing feed ID.\n")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
+
+		data := &FeedRetentionData{}
+		err := json.NewDecoder(r.Body).Decode(data)
+		if err != nil {
+			l.W.Printf("Error parsing retention body. Error: %v\n", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(FeedSetRetention(l, user, feed, data))
+	})
+
 	// /api/feed/subscribe
 	http.HandleFunc("/api/feed/subscribe", func(w http.ResponseWriter, r *http.Request) {
 		l := newSessionLogger("/api/feed/subscribe")
 
+		if !AllowMethods(l, w, r, http.MethodPost) {
+			return
+		}
+
 		user, status := GetSession(l, w, r)
 		if user == "" {
 			w.WriteHeader(status)
@@ -308,25 +523,72 @@ func main() {
 			return
 		}
 
+		title, candidates, status := FeedCheck(l, data.URL)
+		if status == http.StatusMultipleChoices {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			err := json.NewEncoder(w).Encode(candidates)
+			if err != nil {
+				l.E.Printf("Error encoding payload. Error: %v\n", err)
+			}
+			return
+		}
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+
+		// If the user didn't name the feed use whatever the feed calls itself.
 		if data.Name == "" {
-			l.W.Printf("No feed name given.\n")
-			w.WriteHeader(http.StatusBadRequest)
+			data.Name = title
+		}
+		if data.Name == "" {
+			data.Name = data.URL
+		}
+
+		_, status = FeedSubscribe(l, user, data.URL, data.Name)
+		w.WriteHeader(status)
+	})
+
+	// /api/feed/discover
+	http.HandleFunc("/api/feed/discover", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/feed/discover")
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
 			return
 		}
-		_, err = url.ParseRequestURI(data.URL)
+
+		page := r.FormValue("url")
+		_, err := url.ParseRequestURI(page)
 		if err != nil {
 			l.W.Printf("Malformed URL. Error: %v\n", err)
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		w.WriteHeader(FeedSubscribe(l, user, data.URL, data.Name))
+		candidates, status := FeedDiscover(l, page)
+		if candidates == nil {
+			w.WriteHeader(status)
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(candidates)
+		if err != nil {
+			l.E.Printf("Error encoding payload. Error: %v\n", err)
+			return
+		}
 	})
 
 	// /api/feed/unsubscribe
 	http.HandleFunc("/api/feed/unsubscribe", func(w http.ResponseWriter, r *http.Request) {
 		l := newSessionLogger("/api/feed/unsubscribe")
 
+		if !AllowMethods(l, w, r, http.MethodPost, http.MethodDelete) {
+			return
+		}
+
 		user, status := GetSession(l, w, r)
 		if user == "" {
 			w.WriteHeader(status)
@@ -343,9 +605,13 @@ func main() {
 		w.WriteHeader(FeedUnsub(l, user, feed))
 	})
 
-	// /api/feed/pause
-	http.HandleFunc("/api/feed/pause", func(w http.ResponseWriter, r *http.Request) {
-		l := newSessionLogger("/api/feed/pause")
+	// /api/feed/folder
+	http.HandleFunc("/api/feed/folder", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/feed/folder")
+
+		if !AllowMethods(l, w, r, http.MethodPost) {
+			return
+		}
 
 		user, status := GetSession(l, w, r)
 		if user == "" {
@@ -360,16 +626,16 @@ func main() {
 			return
 		}
 
-		s := FeedPause(l, user, feed)
-		if s == http.StatusOK {
-			Feeds.BroadcastTo(l, user)
-		}
-		w.WriteHeader(s)
+		w.WriteHeader(FeedSetFolder(l, user, feed, r.FormValue("folder")))
 	})
 
-	// /api/feed/unpause
-	http.HandleFunc("/api/feed/unpause", func(w http.ResponseWriter, r *http.Request) {
-		l := newSessionLogger("/api/feed/unpause")
+	// /api/feed/mark-read
+	http.HandleFunc("/api/feed/mark-read", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/feed/mark-read")
+
+		if !AllowMethods(l, w, r, http.MethodPost) {
+			return
+		}
 
 		user, status := GetSession(l, w, r)
 		if user == "" {
@@ -384,16 +650,28 @@ func main() {
 			return
 		}
 
-		s := FeedUnpause(l, user, feed)
-		if s == http.StatusOK {
-			Feeds.BroadcastTo(l, user)
+		// Everything, unless told otherwise.
+		before := int64(math.MaxInt64)
+		if raw := r.FormValue("before"); raw != "" {
+			v, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				l.W.Printf("Invalid mark read time: %v\n", raw)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			before = v
 		}
-		w.WriteHeader(s)
+
+		w.WriteHeader(FeedMarkRead(l, user, feed, before))
 	})
 
-	// /api/article/read
-	http.HandleFunc("/api/article/read", func(w http.ResponseWriter, r *http.Request) {
-		l := newSessionLogger("/api/article/read")
+	// /api/feed/refresh
+	http.HandleFunc("/api/feed/refresh", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/feed/refresh")
+
+		if !AllowMethods(l, w, r, http.MethodPost) {
+			return
+		}
 
 		user, status := GetSession(l, w, r)
 		if user == "" {
@@ -401,23 +679,23 @@ func main() {
 			return
 		}
 
-		article := r.FormValue("id")
-		if article == "" {
-			l.W.Printf("Missing article ID.\n")
+		feed := r.FormValue("id")
+		if feed == "" {
+			l.W.Printf("Missing feed ID.\n")
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		s := ArticleMarkRead(l, user, article)
-		if s == http.StatusOK {
-			Feeds.BroadcastTo(l, user)
-		}
-		w.WriteHeader(s)
+		w.WriteHeader(FeedRefresh(l, user, feed))
 	})
 
-	// /api/article/unread
-	http.HandleFunc("/api/article/unread", func(w http.ResponseWriter, r *http.Request) {
-		l := newSessionLogger("/api/article/unread")
+	// /api/feed/pause
+	http.HandleFunc("/api/feed/pause", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/feed/pause")
+
+		if !AllowMethods(l, w, r, http.MethodPost) {
+			return
+		}
 
 		user, status := GetSession(l, w, r)
 		if user == "" {
@@ -425,23 +703,23 @@ func main() {
 			return
 		}
 
-		article := r.FormValue("id")
-		if article == "" {
-			l.W.Printf("Missing article ID.\n")
+		feed := r.FormValue("id")
+		if feed == "" {
+			l.W.Printf("Missing feed ID.\n")
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		s := ArticleMarkUnread(l, user, article)
-		if s == http.StatusOK {
-			Feeds.BroadcastTo(l, user)
-		}
-		w.WriteHeader(s)
+		w.WriteHeader(FeedPause(l, user, feed))
 	})
 
-	// /api/article/feed
-	http.HandleFunc("/api/article/feed", func(w http.ResponseWriter, r *http.Request) {
-		l := newSessionLogger("/api/article/feed")
+	// /api/feed/unpause
+	http.HandleFunc("/api/feed/unpause", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/feed/unpause")
+
+		if !AllowMethods(l, w, r, http.MethodPost) {
+			return
+		}
 
 		user, status := GetSession(l, w, r)
 		if user == "" {
@@ -449,25 +727,861 @@ func main() {
 			return
 		}
 
-		Feeds.Upgrade(l, w, r, user)
+		feed := r.FormValue("id")
+		if feed == "" {
+			l.W.Printf("Missing feed ID.\n")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(FeedUnpause(l, user, feed))
 	})
 
-	ml.I.Println("Initializing AXIS VFS.")
-	fs := new(axis2.FileSystem)
-	if os.Getenv("RSN2_ISDEV") == "" {
-		fs.Mount("", sources.NewOSDir("/app/html"), false)
-	} else {
-		fs.Mount("", sources.NewOSDir("./dist"), false)
-	}
+	// /api/opml/import
+	http.HandleFunc("/api/opml/import", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/opml/import")
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		l := newSessionLogger("/")
+		if !AllowMethods(l, w, r, http.MethodPost) {
+			return
+		}
 
-		l.I.Println("Page Request:" + r.URL.Path)
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
 
-		typ := mime.TypeByExtension(GetExt(r.URL.Path))
-		content, err := fs.ReadAll(r.URL.Path[1:])
-		if err != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, MaxOPMLBytes)
+
+		// Accept either a form upload or the raw document as the body.
+		var src io.Reader = r.Body
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			file, _, err := r.FormFile("file")
+			if err != nil {
+				l.W.Printf("Error reading OPML upload. Error: %v\n", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			defer file.Close()
+			src = file
+		}
+
+		doc, status := ParseOPML(l, src)
+		if doc == nil {
+			w.WriteHeader(status)
+			return
+		}
+
+		err := json.NewEncoder(w).Encode(OPMLImport(l, user, doc))
+		if err != nil {
+			l.E.Printf("Error encoding payload. Error: %v\n", err)
+			return
+		}
+	})
+
+	// /api/opml/export
+	http.HandleFunc("/api/opml/export", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/opml/export")
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		doc := OPMLExport(l, user)
+		if doc == nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/x-opml; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="rsn2.opml"`)
+		io.WriteString(w, xml.Header)
+		enc := xml.NewEncoder(w)
+		enc.Indent("", "\t")
+		err := enc.Encode(doc)
+		if err != nil {
+			l.E.Printf("Error encoding payload. Error: %v\n", err)
+			return
+		}
+	})
+
+	// /api/webhook/list
+	http.HandleFunc("/api/webhook/list", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/webhook/list")
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		hooks := WebhookList(l, user)
+		if hooks == nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		err := json.NewEncoder(w).Encode(hooks)
+		if err != nil {
+			l.E.Printf("Error encoding payload. Error: %v\n", err)
+			return
+		}
+	})
+
+	// /api/webhook/add
+	http.HandleFunc("/api/webhook/add", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/webhook/add")
+
+		if !AllowMethods(l, w, r, http.MethodPost) {
+			return
+		}
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
+
+		data := &WebhookAddData{}
+		err := json.NewDecoder(r.Body).Decode(data)
+		if err != nil {
+			l.W.Printf("Error parsing webhook body. Error: %v\n", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		hook, status := WebhookAdd(l, user, data)
+		if hook == nil {
+			w.WriteHeader(status)
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(hook)
+		if err != nil {
+			l.E.Printf("Error encoding payload. Error: %v\n", err)
+			return
+		}
+	})
+
+	// /api/webhook/delete
+	http.HandleFunc("/api/webhook/delete", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/webhook/delete")
+
+		if !AllowMethods(l, w, r, http.MethodPost, http.MethodDelete) {
+			return
+		}
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		hook := r.FormValue("id")
+		if hook == "" {
+			l.W.Printf("Missing webhook ID.\n")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(WebhookDelete(l, user, hook))
+	})
+
+	// /api/webhook/deliveries
+	http.HandleFunc("/api/webhook/deliveries", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/webhook/deliveries")
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		hook := r.FormValue("id")
+		if hook == "" {
+			l.W.Printf("Missing webhook ID.\n")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		deliveries, status := WebhookDeliveries(l, user, hook)
+		if deliveries == nil {
+			w.WriteHeader(status)
+			return
+		}
+
+		err := json.NewEncoder(w).Encode(deliveries)
+		if err != nil {
+			l.E.Printf("Error encoding payload. Error: %v\n", err)
+			return
+		}
+	})
+
+	// /api/webhook/test
+	http.HandleFunc("/api/webhook/test", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/webhook/test")
+
+		if !AllowMethods(l, w, r, http.MethodPost) {
+			return
+		}
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		hook := r.FormValue("id")
+		if hook == "" {
+			l.W.Printf("Missing webhook ID.\n")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		delivery, status := WebhookTest(l, user, hook)
+		if delivery == nil {
+			w.WriteHeader(status)
+			return
+		}
+
+		err := json.NewEncoder(w).Encode(delivery)
+		if err != nil {
+			l.E.Printf("Error encoding payload. Error: %v\n", err)
+			return
+		}
+	})
+
+	// /api/filter/list
+	http.HandleFunc("/api/filter/list", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/filter/list")
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		rules := FilterRuleList(l, user)
+		if rules == nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		err := json.NewEncoder(w).Encode(rules)
+		if err != nil {
+			l.E.Printf("Error encoding payload. Error: %v\n", err)
+			return
+		}
+	})
+
+	// /api/filter/add
+	http.HandleFunc("/api/filter/add", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/filter/add")
+
+		if !AllowMethods(l, w, r, http.MethodPost) {
+			return
+		}
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
+
+		data := &FilterRule{}
+		err := json.NewDecoder(r.Body).Decode(data)
+		if err != nil {
+			l.W.Printf("Error parsing filter rule body. Error: %v\n", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		rule, status := FilterRuleAdd(l, user, data)
+		if rule == nil {
+			w.WriteHeader(status)
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(rule)
+		if err != nil {
+			l.E.Printf("Error encoding payload. Error: %v\n", err)
+			return
+		}
+	})
+
+	// /api/filter/update
+	http.HandleFunc("/api/filter/update", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/filter/update")
+
+		if !AllowMethods(l, w, r, http.MethodPost) {
+			return
+		}
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
+
+		data := &FilterRule{}
+		err := json.NewDecoder(r.Body).Decode(data)
+		if err != nil {
+			l.W.Printf("Error parsing filter rule body. Error: %v\n", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(FilterRuleUpdate(l, user, data))
+	})
+
+	// /api/filter/delete
+	http.HandleFunc("/api/filter/delete", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/filter/delete")
+
+		if !AllowMethods(l, w, r, http.MethodPost, http.MethodDelete) {
+			return
+		}
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		rule := r.FormValue("id")
+		if rule == "" {
+			l.W.Printf("Missing filter rule ID.\n")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(FilterRuleDelete(l, user, rule))
+	})
+
+	// /api/filter/dry-run
+	http.HandleFunc("/api/filter/dry-run", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/filter/dry-run")
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
+
+		data := &FilterRule{}
+		err := json.NewDecoder(r.Body).Decode(data)
+		if err != nil {
+			l.W.Printf("Error parsing filter rule body. Error: %v\n", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		matches, status := FilterDryRun(l, user, data)
+		if matches == nil {
+			w.WriteHeader(status)
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(matches)
+		if err != nil {
+			l.E.Printf("Error encoding payload. Error: %v\n", err)
+			return
+		}
+	})
+
+	// /api/filter/apply
+	http.HandleFunc("/api/filter/apply", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/filter/apply")
+
+		if !AllowMethods(l, w, r, http.MethodPost) {
+			return
+		}
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		rule := r.FormValue("id")
+		if rule == "" {
+			l.W.Printf("Missing filter rule ID.\n")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		matches, status := FilterApply(l, user, rule)
+		if matches == nil {
+			w.WriteHeader(status)
+			return
+		}
+
+		err := json.NewEncoder(w).Encode(matches)
+		if err != nil {
+			l.E.Printf("Error encoding payload. Error: %v\n", err)
+			return
+		}
+	})
+
+	// /api/notification/list
+	http.HandleFunc("/api/notification/list", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/notification/list")
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		notes := NotificationList(l, user)
+		if notes == nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		err := json.NewEncoder(w).Encode(notes)
+		if err != nil {
+			l.E.Printf("Error encoding payload. Error: %v\n", err)
+			return
+		}
+	})
+
+	// /api/notification/clear
+	http.HandleFunc("/api/notification/clear", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/notification/clear")
+
+		if !AllowMethods(l, w, r, http.MethodPost, http.MethodDelete) {
+			return
+		}
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+		if err != nil {
+			l.W.Printf("Invalid notification ID: %v\n", r.FormValue("id"))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(NotificationClear(l, user, id))
+	})
+
+	// /api/tag/add
+	http.HandleFunc("/api/tag/add", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/tag/add")
+
+		if !AllowMethods(l, w, r, http.MethodPost) {
+			return
+		}
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
+
+		data := &TagEditData{}
+		err := json.NewDecoder(r.Body).Decode(data)
+		if err != nil {
+			l.W.Printf("Error parsing tag edit body. Error: %v\n", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(TagEdit(l, user, data, true))
+	})
+
+	// /api/tag/remove
+	http.HandleFunc("/api/tag/remove", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/tag/remove")
+
+		if !AllowMethods(l, w, r, http.MethodPost, http.MethodDelete) {
+			return
+		}
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
+
+		data := &TagEditData{}
+		err := json.NewDecoder(r.Body).Decode(data)
+		if err != nil {
+			l.W.Printf("Error parsing tag edit body. Error: %v\n", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(TagEdit(l, user, data, false))
+	})
+
+	// /api/tag/list
+	http.HandleFunc("/api/tag/list", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/tag/list")
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		tags := TagList(l, user)
+		if tags == nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		err := json.NewEncoder(w).Encode(tags)
+		if err != nil {
+			l.E.Printf("Error encoding payload. Error: %v\n", err)
+			return
+		}
+	})
+
+	// /api/tag/articles
+	http.HandleFunc("/api/tag/articles", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/tag/articles")
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		tag := r.FormValue("tag")
+		if tag == "" {
+			l.W.Printf("Missing tag.\n")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		page, status := ParsePageParams(l, r)
+		if page == nil {
+			w.WriteHeader(status)
+			return
+		}
+
+		articles := TagArticles(l, user, tag, page)
+		if articles == nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		err := json.NewEncoder(w).Encode(articles)
+		if err != nil {
+			l.E.Printf("Error encoding payload. Error: %v\n", err)
+			return
+		}
+	})
+
+	// /api/outfeed/list
+	http.HandleFunc("/api/outfeed/list", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/outfeed/list")
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		feeds := OutputFeedList(l, user)
+		if feeds == nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		err := json.NewEncoder(w).Encode(feeds)
+		if err != nil {
+			l.E.Printf("Error encoding payload. Error: %v\n", err)
+			return
+		}
+	})
+
+	// /api/outfeed/add
+	http.HandleFunc("/api/outfeed/add", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/outfeed/add")
+
+		if !AllowMethods(l, w, r, http.MethodPost) {
+			return
+		}
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
+
+		data := &OutputFeedAddData{}
+		err := json.NewDecoder(r.Body).Decode(data)
+		if err != nil {
+			l.W.Printf("Error parsing output feed body. Error: %v\n", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		feed, status := OutputFeedAdd(l, user, data)
+		if feed == nil {
+			w.WriteHeader(status)
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(feed)
+		if err != nil {
+			l.E.Printf("Error encoding payload. Error: %v\n", err)
+			return
+		}
+	})
+
+	// /api/outfeed/delete
+	http.HandleFunc("/api/outfeed/delete", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/outfeed/delete")
+
+		if !AllowMethods(l, w, r, http.MethodPost, http.MethodDelete) {
+			return
+		}
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		feed := r.FormValue("id")
+		if feed == "" {
+			l.W.Printf("Missing output feed ID.\n")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(OutputFeedDelete(l, user, feed))
+	})
+
+	// /api/article/read
+	http.HandleFunc("/api/article/read", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/article/read")
+
+		if !AllowMethods(l, w, r, http.MethodPost) {
+			return
+		}
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		article := r.FormValue("id")
+		if article == "" {
+			l.W.Printf("Missing article ID.\n")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(ArticleMarkRead(l, user, article))
+	})
+
+	// /api/article/unread
+	http.HandleFunc("/api/article/unread", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/article/unread")
+
+		if !AllowMethods(l, w, r, http.MethodPost) {
+			return
+		}
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		article := r.FormValue("id")
+		if article == "" {
+			l.W.Printf("Missing article ID.\n")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(ArticleMarkUnread(l, user, article))
+	})
+
+	// /api/article/star
+	http.HandleFunc("/api/article/star", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/article/star")
+
+		if !AllowMethods(l, w, r, http.MethodPost) {
+			return
+		}
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		article := r.FormValue("id")
+		if article == "" {
+			l.W.Printf("Missing article ID.\n")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(ArticleStar(l, user, article))
+	})
+
+	// /api/article/unstar
+	http.HandleFunc("/api/article/unstar", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/article/unstar")
+
+		if !AllowMethods(l, w, r, http.MethodPost) {
+			return
+		}
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		article := r.FormValue("id")
+		if article == "" {
+			l.W.Printf("Missing article ID.\n")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(ArticleUnstar(l, user, article))
+	})
+
+	// /api/article/list
+	http.HandleFunc("/api/article/list", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/article/list")
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		page, status := ParsePageParams(l, r)
+		if page == nil {
+			w.WriteHeader(status)
+			return
+		}
+
+		unread := GetUnread(l, user, r.FormValue("folder"), page)
+		if unread == nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		err := json.NewEncoder(w).Encode(unread)
+		if err != nil {
+			l.W.Printf("Error encoding payload. Error: %v\n", err)
+			return
+		}
+	})
+
+	// /api/article/feed
+	http.HandleFunc("/api/article/feed", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/article/feed")
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		// Where a reconnecting client left off.
+		since := int64(0)
+		if raw := r.FormValue("since"); raw != "" {
+			v, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				l.W.Printf("Invalid event sequence number: %v\n", raw)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			since = v
+		}
+
+		Feeds.Upgrade(l, w, r, user, since, r.FormValue("folder"))
+	})
+
+	// /api/events
+	http.HandleFunc("/api/events", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/api/events")
+
+		user, status := GetSession(l, w, r)
+		if user == "" {
+			w.WriteHeader(status)
+			return
+		}
+
+		// Browsers send the last ID they saw when they reconnect, other clients may prefer the websocket's parameter.
+		since := int64(0)
+		raw := r.Header.Get("Last-Event-ID")
+		if raw == "" {
+			raw = r.FormValue("since")
+		}
+		if raw != "" {
+			v, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				l.W.Printf("Invalid event sequence number: %v\n", raw)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			since = v
+		}
+
+		Feeds.Stream(l, w, r, user, since, r.FormValue("folder"))
+	})
+
+	ml.I.Println("Initializing AXIS VFS.")
+	fs := new(axis2.FileSystem)
+	if os.Getenv("RSN2_ISDEV") == "" {
+		fs.Mount("", sources.NewOSDir("/app/html"), false)
+	} else {
+		fs.Mount("", sources.NewOSDir("./dist"), false)
+	}
+
+	// Fever and Google Reader APIs, for third party clients.
+	http.HandleFunc("/fever/", FeverHandler)
+	http.HandleFunc("/greader/", GReaderHandler)
+
+	// Output feeds are public, the token in the URL is the only access control.
+	http.HandleFunc("/out/", OutputFeedHandler)
+
+	// WebSub hubs call back here to verify subscriptions and deliver content.
+	http.HandleFunc("/websub/", WebSubHandler)
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		l := newSessionLogger("/")
+
+		l.I.Println("Page Request:" + r.URL.Path)
+
+		typ := mime.TypeByExtension(GetExt(r.URL.Path))
+		content, err := fs.ReadAll(r.URL.Path[1:])
+		if err != nil {
 			typ = "text/html"
 			content, _ = fs.ReadAll("index.html")
 		}
@@ -477,7 +1591,24 @@ func main() {
 		fmt.Fprintf(w, "%s", content)
 	})
 
-	go Background()
+	web, worker := Role != "worker", Role != "web"
+	if worker {
+		if !web && EventBrokerAddr == "" {
+			ml.W.Println("Running as a worker without RSN2_EVENTS_BROKER, nobody will get its events.")
+		}
+		go Background()
+		go RetentionJob()
+	}
+	if web {
+		go RefreshJob()
+		go EventSweepJob()
+	}
+	go WebhookJob()
+	go EventBus()
+
+	if !web {
+		select {}
+	}
 
 	if os.Getenv("RSN2_ISDEV") == "" {
 		err := http.ListenAndServeTLS(":443", "/app/cert/server.crt", "/app/cert/server.key", nil)
@@ -487,7 +1618,7 @@ func main() {
 		return
 	}
 
-	err := http.ListenAndServe(":1025", nil)
+	err = http.ListenAndServe(":1025", nil)
 	if err != nil {
 		panic(err)
 	}
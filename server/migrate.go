@@ -0,0 +1,226 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "fmt"
+import "time"
+import "context"
+import "database/sql"
+
+// The schema is built by applying every migration in order, each in its own transaction. schema_version records what
+// has been applied, and a database newer than the binary is refused rather than risk damaging it.
+//
+// Migrations are never changed once released, a fix is a new migration. Versions must increase by one. PostgreSQL has
+// its own list (PostgresMigrations), a version must mean the same schema in both.
+
+type Migration struct {
+	Version int
+	Name    string
+	Code    string                 // Run first, if not empty.
+	Func    func(tx *sql.Tx) error // Then this, if not nil.
+}
+
+var Migrations = []*Migration{
+	// Databases from before migrations existed get all of these. They are written so that is harmless.
+	{Version: 1, Name: "Initial schema", Code: InitCode},
+	{Version: 2, Name: "Explicit article Seq", Func: migrateArticleSeq},
+	{Version: 3, Name: "Read marks", Func: migrateReadFlags},
+	{Version: 4, Name: "Unique subscriptions and pauses", Code: migrateUniqueSubscribedCode},
+}
+
+var schemaVersionCode = `
+create table if not exists schema_version (
+	Version integer primary key,
+	Name text not null,
+	Applied bigint not null
+);
+`
+
+// Migrate brings the database up to date.
+func Migrate() error {
+	migrations := Migrations
+	if DBPostgres {
+		migrations = PostgresMigrations
+	}
+	latest := migrations[len(migrations)-1].Version
+
+	// Everything happens on one connection, since the foreign keys setting is per connection.
+	ctx := context.Background()
+	conn, err := DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, schemaVersionCode)
+	if err != nil {
+		return err
+	}
+
+	current := 0
+	err = conn.QueryRowContext(ctx, `select coalesce(max(Version), 0) from schema_version;`).Scan(&current)
+	if err != nil {
+		return err
+	}
+	if current > latest {
+		return fmt.Errorf("database schema is version %v, but this binary only knows up to version %v", current, latest)
+	}
+	if current == latest {
+		return nil
+	}
+
+	// Foreign keys have to be off while tables are replaced, and that can't be changed inside a transaction.
+	if !DBPostgres {
+		_, err = conn.ExecContext(ctx, `pragma foreign_keys = off;`)
+		if err != nil {
+			return err
+		}
+		defer conn.ExecContext(ctx, `pragma foreign_keys = on;`)
+	}
+
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return fmt.Errorf("migration %q has version %v, expected %v", m.Name, m.Version, i+1)
+		}
+		if m.Version <= current {
+			continue
+		}
+
+		err := migrateApply(ctx, conn, m)
+		if err != nil {
+			return fmt.Errorf("migration %v (%v) failed: %v", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+func migrateApply(ctx context.Context, conn *sql.Conn, m *Migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if m.Code != "" {
+		_, err = tx.Exec(m.Code)
+	}
+	if err == nil && m.Func != nil {
+		err = m.Func(tx)
+	}
+	if err == nil {
+		insert := `insert into schema_version (Version, Name, Applied) values (?1, ?2, ?3);`
+		if DBPostgres {
+			insert = `insert into schema_version (Version, Name, Applied) values ($1, $2, $3);`
+		}
+		_, err = tx.Exec(insert, m.Version, m.Name, time.Now().Unix())
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Older databases used the implicit rowid of Articles where Seq is now used, but vacuum is free to renumber those.
+// This rebuilds the table with an explicit Seq holding the same values.
+var migrateArticleSeqCode = `
+create table NewArticles (
+	Seq integer primary key autoincrement,
+	ID text unique not null,
+	Feed text not null,
+
+	Title text collate nocase,
+	URL text unique not null,
+
+	Published integer,
+
+	foreign key (Feed) references Feeds(ID) on delete cascade
+);
+
+insert into NewArticles (Seq, ID, Feed, Title, URL, Published)
+select rowid, ID, Feed, Title, URL, Published from Articles;
+
+drop table Articles;
+alter table NewArticles rename to Articles;
+
+create unique index ArticleURLs on Articles(URL);
+create index ArticleFeeds on Articles(Feed);
+create index ArticleDates on Articles(Feed, Published, ID);
+`
+
+func migrateArticleSeq(tx *sql.Tx) error {
+	exists := 0
+	err := tx.QueryRow(`select exists(select 1 from pragma_table_info('Articles') where name = 'Seq');`).Scan(&exists)
+	if err != nil || exists == 1 {
+		return err
+	}
+
+	_, err = tx.Exec(migrateArticleSeqCode)
+	return err
+}
+
+// Older databases stored one ReadFlags row per user per read article. This converts those into watermarks and
+// exceptions, then drops the old table so this only ever runs once.
+var migrateReadFlagsCode = `
+insert or ignore into ReadMarks (User, Feed, Seq)
+select s.User, s.Feed, coalesce((
+	select max(a.Seq) from Articles a where (
+		a.Feed = s.Feed and
+		a.Seq < coalesce((
+			select min(b.Seq) from Articles b where (
+				b.Feed = s.Feed and
+				not exists (select 1 from ReadFlags r where r.User = s.User and r.Article = b.ID)
+			)
+		), 9223372036854775807)
+	)
+), 0) from Subscribed s;
+
+insert or ignore into ReadExceptions (User, Article, Read)
+select r.User, r.Article, 1 from ReadFlags r
+join Articles a on a.ID = r.Article
+join ReadMarks m on m.User = r.User and m.Feed = a.Feed
+where a.Seq > m.Seq;
+
+drop table ReadFlags;
+`
+
+func migrateReadFlags(tx *sql.Tx) error {
+	exists := 0
+	err := tx.QueryRow(`select exists(select 1 from sqlite_master where type = 'table' and name = 'ReadFlags');`).Scan(&exists)
+	if err != nil || exists == 0 {
+		return err
+	}
+
+	_, err = tx.Exec(migrateReadFlagsCode)
+	return err
+}
+
+// Nothing used to stop a user subscribing to a feed, or pausing it, twice. This drops the duplicates, keeping the
+// first, so both can have a unique index. (ReadFlags had the same problem, but version 3 replaced it with
+// ReadExceptions, which has a primary key.)
+var migrateUniqueSubscribedCode = `
+delete from Subscribed where rowid not in (select min(rowid) from Subscribed group by User, Feed);
+create unique index if not exists Subscriptions on Subscribed(User, Feed);
+
+delete from PausedFlags where rowid not in (select min(rowid) from PausedFlags group by User, Feed);
+create unique index if not exists PausedFeeds on PausedFlags(User, Feed);
+`
@@ -0,0 +1,155 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "testing"
+
+// testMigrateFrom forgets every migration after version, then brings the database up to date again.
+func testMigrateFrom(t *testing.T, version int) {
+	t.Helper()
+	_, err := DB.Exec(`delete from schema_version where Version > $1;`, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Migrate()
+	if err != nil {
+		t.Fatalf("Migration from version %v failed, error: %v", version, err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	testDB(t, func(t *testing.T) {
+		migrations := Migrations
+		if DBPostgres {
+			migrations = PostgresMigrations
+		}
+		latest := migrations[len(migrations)-1].Version
+		versions := 0
+		err := DB.QueryRow(`select count(*) from schema_version;`).Scan(&versions)
+		if err != nil || versions != latest {
+			t.Fatalf("Got %v applied migrations, expected %v, error: %v", versions, latest, err)
+		}
+
+		// Already up to date, nothing happens.
+		testMigrateFrom(t, latest)
+
+		// A database from a newer binary is left alone.
+		_, err = DB.Exec(`insert into schema_version (Version, Name, Applied) values ($1, 'From the future', 0);`, latest+1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if Migrate() == nil {
+			t.Fatalf("Migrated a database newer than the binary")
+		}
+	})
+}
+
+func TestReadFlagsMigration(t *testing.T) {
+	testDB(t, func(t *testing.T) {
+		if DBPostgres {
+			t.Skip("Only SQLite databases are old enough to need this.")
+		}
+
+		testUser(t, "u1", "one@example.com")
+		feed := testFeed(t, "https://example.com/feed", "u1")
+		ids := testIngest(t, feed,
+			testItem("https://example.com/1", "One", 1),
+			testItem("https://example.com/2", "Two", 2),
+			testItem("https://example.com/3", "Three", 3),
+			testItem("https://example.com/4", "Four", 4),
+		)
+
+		_, err := DB.Exec(`create table ReadFlags (User text not null, Article text not null);`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range []string{ids[0], ids[1], ids[3]} {
+			_, err := DB.Exec(`insert into ReadFlags (User, Article) values (?1, ?2);`, "u1", id)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		testMigrateFrom(t, 2)
+		testReadMark(t, "u1", ids[1])
+		testReadState(t, "u1", feed, []bool{true, true, false, true}, 1)
+
+		// The old table is gone, so running it again does nothing.
+		testMigrateFrom(t, 2)
+		testReadState(t, "u1", feed, []bool{true, true, false, true}, 1)
+	})
+}
+
+func TestArticleSeqMigration(t *testing.T) {
+	testDB(t, func(t *testing.T) {
+		if DBPostgres {
+			t.Skip("Only SQLite databases are old enough to need this.")
+		}
+
+		testUser(t, "u1", "one@example.com")
+		feed := testFeed(t, "https://example.com/feed", "u1")
+
+		// Put Articles back the way older databases had it, with the gaps in the rowids a vacuum would close up.
+		_, err := DB.Exec(`
+			drop table Articles;
+			create table Articles (
+				ID text primary key,
+				Feed text not null,
+				Title text collate nocase,
+				URL text unique not null,
+				Published integer,
+				foreign key (Feed) references Feeds(ID) on delete cascade
+			);
+		`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = DB.Exec(`
+			insert into Articles (rowid, ID, Feed, Title, URL, Published) values
+				(3, 'a', ?1, 'One', 'https://example.com/1', 3600),
+				(7, 'b', ?1, 'Two', 'https://example.com/2', 7200),
+				(8, 'c', ?1, 'Three', 'https://example.com/3', 10800);
+		`, feed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = DB.Exec(`insert into ReadMarks (User, Feed, Seq) values ('u1', ?1, 7);`, feed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		testMigrateFrom(t, 1)
+		testReadMark(t, "u1", "b")
+		testReadState(t, "u1", feed, []bool{true, true, false}, 0)
+
+		ids := testIngest(t, feed, testItem("https://example.com/4", "Four", 4))
+		seq := 0
+		err = DB.QueryRow(`select Seq from Articles where ID = ?1;`, ids[0]).Scan(&seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq != 9 {
+			t.Fatalf("New article got Seq %v, expected 9", seq)
+		}
+	})
+}
@@ -0,0 +1,242 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "io"
+import "sync"
+import "time"
+import "net/http"
+import "encoding/xml"
+
+import "golang.org/x/net/html/charset"
+
+// Subscription lists are a lot bigger than the normal API payloads.
+const MaxOPMLBytes = int64(4 << 20)
+
+type OPML struct {
+	XMLName xml.Name `xml:"opml"`
+	Version string   `xml:"version,attr"`
+	Head    OPMLHead `xml:"head"`
+	Body    OPMLBody `xml:"body"`
+}
+
+type OPMLHead struct {
+	Title       string `xml:"title"`
+	DateCreated string `xml:"dateCreated,omitempty"`
+}
+
+type OPMLBody struct {
+	Outlines []*OPMLOutline `xml:"outline"`
+}
+
+// OPMLOutline is either a feed (if it has a XMLURL) or a folder holding more outlines.
+type OPMLOutline struct {
+	Text     string         `xml:"text,attr"`
+	Title    string         `xml:"title,attr,omitempty"`
+	Type     string         `xml:"type,attr,omitempty"`
+	XMLURL   string         `xml:"xmlUrl,attr,omitempty"`
+	HTMLURL  string         `xml:"htmlUrl,attr,omitempty"`
+	Outlines []*OPMLOutline `xml:"outline"`
+}
+
+func (o *OPMLOutline) name() string {
+	if o.Title != "" {
+		return o.Title
+	}
+	return o.Text
+}
+
+// /api/opml/import
+// =====================================================================================================================
+
+type OPMLImportResult struct {
+	URL    string
+	Name   string
+	Folder string
+	Feed   string // Feed ID, empty if the subscription failed.
+	Status int    // Same codes as /api/feed/subscribe
+	Error  string
+
+	Candidates []*FeedCandidate // Feeds found at the URL if it wasn't one itself.
+}
+
+// Every feed in an import is fetched to check it, so an import is limited to this many.
+const MaxOPMLFeeds = 500
+
+// ParseOPML reads an OPML document, it does not care about the version. Documents with more than MaxOPMLFeeds feeds
+// are refused.
+func ParseOPML(l *SessionLogger, r io.Reader) (*OPML, int) {
+	doc := &OPML{}
+	dec := xml.NewDecoder(r)
+	dec.CharsetReader = charset.NewReaderLabel
+	err := dec.Decode(doc)
+	if err != nil {
+		l.W.Printf("Error parsing OPML. Error: %v\n", err)
+		return nil, http.StatusBadRequest
+	}
+
+	if n := doc.Body.feeds(); n > MaxOPMLFeeds {
+		l.W.Printf("OPML has %v feeds, the limit is %v.\n", n, MaxOPMLFeeds)
+		return nil, http.StatusRequestEntityTooLarge
+	}
+	return doc, http.StatusOK
+}
+
+// feeds counts the feeds in the document, including the ones in folders.
+func (b *OPMLBody) feeds() int {
+	var count func(outlines []*OPMLOutline) int
+	count = func(outlines []*OPMLOutline) int {
+		n := 0
+		for _, o := range outlines {
+			if o.XMLURL == "" {
+				n += count(o.Outlines)
+				continue
+			}
+			n++
+		}
+		return n
+	}
+	return count(b.Outlines)
+}
+
+// How many feeds in an import are checked at once.
+const OPMLCheckWorkers = 8
+
+// OPMLImport subscribes the user to every feed in the document. Folders are not nested, so a feed is filed under the
+// closest outline holding it. Every feed goes through the same checks as /api/feed/subscribe first.
+func OPMLImport(l *SessionLogger, user string, doc *OPML) []*OPMLImportResult {
+	results := []*OPMLImportResult{}
+
+	var walk func(outlines []*OPMLOutline, folder string)
+	walk = func(outlines []*OPMLOutline, folder string) {
+		for _, o := range outlines {
+			if o.XMLURL == "" {
+				walk(o.Outlines, o.name())
+				continue
+			}
+			results = append(results, &OPMLImportResult{URL: o.XMLURL, Name: o.name(), Folder: folder})
+		}
+	}
+	walk(doc.Body.Outlines, "")
+
+	// Checking means fetching, which is slow, so do several at once. Subscribing is left until after so that it
+	// doesn't fight over the database.
+	titles := make([]string, len(results))
+	jobs := make(chan int)
+	wg := sync.WaitGroup{}
+	for i := 0; i < OPMLCheckWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				res := results[i]
+				titles[i], res.Candidates, res.Status = FeedCheck(l, res.URL)
+			}
+		}()
+	}
+	for i := range results {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	for i, res := range results {
+		switch res.Status {
+		case http.StatusOK:
+		case http.StatusMultipleChoices:
+			res.Error = "Not a feed, pick one of the feeds found there."
+			continue
+		default:
+			res.Error = "Not a feed."
+			continue
+		}
+
+		if res.Name == "" {
+			res.Name = titles[i]
+		}
+		if res.Name == "" {
+			res.Name = res.URL
+		}
+
+		res.Feed, res.Status = FeedSubscribe(l, user, res.URL, res.Name)
+		switch res.Status {
+		case http.StatusOK:
+		case http.StatusAccepted:
+			res.Error = "Already subscribed."
+		default:
+			res.Feed = ""
+			res.Error = "Could not subscribe."
+			continue
+		}
+
+		if res.Folder != "" {
+			if FeedSetFolder(l, user, res.Feed, res.Folder) != http.StatusOK {
+				res.Error = "Subscribed, but could not set folder."
+			}
+		}
+	}
+
+	return results
+}
+
+// /api/opml/export
+// =====================================================================================================================
+
+func OPMLExport(l *SessionLogger, user string) *OPML {
+	feeds := FeedList(l, user)
+	if feeds == nil {
+		return nil
+	}
+
+	doc := &OPML{
+		Version: "2.0",
+		Head: OPMLHead{
+			Title:       "RSN2 Subscriptions",
+			DateCreated: time.Now().UTC().Format(time.RFC1123Z),
+		},
+	}
+
+	folders := map[string]*OPMLOutline{}
+	for _, f := range feeds {
+		o := &OPMLOutline{
+			Text:   f.Name,
+			Title:  f.Name,
+			Type:   "rss",
+			XMLURL: f.URL,
+		}
+
+		if f.Folder == "" {
+			doc.Body.Outlines = append(doc.Body.Outlines, o)
+			continue
+		}
+
+		folder, ok := folders[f.Folder]
+		if !ok {
+			folder = &OPMLOutline{Text: f.Folder, Title: f.Folder}
+			folders[f.Folder] = folder
+			doc.Body.Outlines = append(doc.Body.Outlines, folder)
+		}
+		folder.Outlines = append(folder.Outlines, o)
+	}
+	return doc
+}
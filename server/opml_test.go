@@ -0,0 +1,163 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "fmt"
+import "bytes"
+import "testing"
+import "net/http"
+import "encoding/xml"
+
+// testOPMLDoc is in Latin-1, so the charset handling gets a look in.
+func testOPMLDoc(base string) string {
+	return "<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?>\n" + `<opml version="1.0">
+	<head><title>Subscriptions</title></head>
+	<body>
+		<outline text="Loose" xmlUrl="` + base + `/loose"/>
+		<outline text="News">
+			<outline text="Caf` + "\xe9" + `" title="Caf` + "\xe9" + ` News" xmlUrl="` + base + `/cafe"/>
+			<outline text="Bad" xmlUrl="not a url"/>
+			<outline text="Page" xmlUrl="` + base + `/page"/>
+			<outline text="Nested">
+				<outline xmlUrl="` + base + `/nested"/>
+			</outline>
+		</outline>
+	</body>
+</opml>`
+}
+
+func TestOPMLImport(t *testing.T) {
+	s := testServer(t, "text/html", map[string]string{
+		"/loose":  testRSS("Loose"),
+		"/cafe":   testRSS("Cafe"),
+		"/nested": testRSS("Nested Feed"),
+		"/page":   `<html><head><link rel="alternate" type="application/rss+xml" href="/loose"></head></html>`,
+	})
+
+	testDB(t, func(t *testing.T) {
+		testUser(t, "u1", "one@example.com")
+
+		_, status := ParseOPML(ml, bytes.NewBufferString("<opml><body>"))
+		testStatus(t, "truncated", status, http.StatusBadRequest)
+
+		big := "<opml><body><outline text=\"Folder\">"
+		for i := 0; i <= MaxOPMLFeeds; i++ {
+			big += fmt.Sprintf("<outline xmlUrl=\"%v/%v\"/>", s.URL, i)
+		}
+		_, status = ParseOPML(ml, bytes.NewBufferString(big+"</outline></body></opml>"))
+		testStatus(t, "too many feeds", status, http.StatusRequestEntityTooLarge)
+
+		doc, status := ParseOPML(ml, bytes.NewBufferString(testOPMLDoc(s.URL)))
+		testStatus(t, "parse", status, http.StatusOK)
+
+		// Feeds are checked before subscribing, anything that isn't one comes back with whatever was found there.
+		results := OPMLImport(ml, "u1", doc)
+		want := []OPMLImportResult{
+			{URL: s.URL + "/loose", Name: "Loose", Status: http.StatusOK},
+			{URL: s.URL + "/cafe", Name: "Café News", Folder: "News", Status: http.StatusOK},
+			{URL: "not a url", Name: "Bad", Folder: "News", Status: http.StatusBadRequest, Error: "Not a feed."},
+			{
+				URL: s.URL + "/page", Name: "Page", Folder: "News", Status: http.StatusMultipleChoices,
+				Error: "Not a feed, pick one of the feeds found there.",
+			},
+			{URL: s.URL + "/nested", Name: "Nested Feed", Folder: "Nested", Status: http.StatusOK},
+		}
+		testOPMLResults(t, results, want)
+		testCandidates(t, results[3].Candidates, FeedCandidate{URL: s.URL + "/loose", Title: "Loose"})
+
+		feeds := FeedList(ml, "u1")
+		if len(feeds) != 3 {
+			t.Fatalf("Got %v feeds, expected 3", len(feeds))
+		}
+		for _, f := range feeds {
+			for _, w := range want {
+				if f.URL == w.URL && (f.Name != w.Name || f.Folder != w.Folder) {
+					t.Fatalf("Got feed %+v, expected %+v", f, w)
+				}
+			}
+		}
+
+		// Importing again doesn't add anything. Known feeds aren't fetched again, so the one without a name gets its URL
+		// until the background process has filled in its title.
+		for i := range want {
+			if want[i].Status == http.StatusOK {
+				want[i].Status, want[i].Error = http.StatusAccepted, "Already subscribed."
+			}
+		}
+		want[4].Name = want[4].URL
+		testOPMLResults(t, OPMLImport(ml, "u1", doc), want)
+	})
+}
+
+func testOPMLResults(t *testing.T, got []*OPMLImportResult, want []OPMLImportResult) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("Got %v import results, expected %v", len(got), len(want))
+	}
+	for i, res := range got {
+		w := want[i]
+		if res.URL != w.URL || res.Name != w.Name || res.Folder != w.Folder || res.Status != w.Status || res.Error != w.Error {
+			t.Fatalf("Got import result %+v, expected %+v", res, w)
+		}
+		if (res.Feed != "") != (res.Status == http.StatusOK || res.Status == http.StatusAccepted) {
+			t.Fatalf("Import result %+v has the wrong feed ID", res)
+		}
+	}
+}
+
+func TestOPMLExport(t *testing.T) {
+	testDB(t, func(t *testing.T) {
+		testUser(t, "u1", "one@example.com")
+		testFeed(t, "https://example.com/loose", "u1")
+		news := testFeed(t, "https://example.com/news", "u1")
+		testStatus(t, "set folder", FeedSetFolder(ml, "u1", news, "News"), http.StatusOK)
+		testStatus(t, "unsubscribed folder", FeedSetFolder(ml, "u1", "nope", "News"), http.StatusBadRequest)
+
+		// Export, then read it back in like another reader would.
+		raw, err := xml.Marshal(OPMLExport(ml, "u1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, status := ParseOPML(ml, bytes.NewBuffer(raw))
+		testStatus(t, "parse export", status, http.StatusOK)
+
+		outlines := doc.Body.Outlines
+		if doc.Version != "2.0" || len(outlines) != 2 {
+			t.Fatalf("Exported %s", raw)
+		}
+		for _, o := range outlines {
+			switch {
+			case o.XMLURL == "https://example.com/loose" && o.name() == "Feed https://example.com/loose":
+			case o.name() == "News" && len(o.Outlines) == 1 && o.Outlines[0].XMLURL == "https://example.com/news":
+			default:
+				t.Fatalf("Exported %s", raw)
+			}
+		}
+
+		// Taking it back out of the folder.
+		testStatus(t, "clear folder", FeedSetFolder(ml, "u1", news, ""), http.StatusOK)
+		if doc := OPMLExport(ml, "u1"); len(doc.Body.Outlines) != 2 || doc.Body.Outlines[0].XMLURL == "" || doc.Body.Outlines[1].XMLURL == "" {
+			t.Fatalf("Got outlines %+v after clearing the folder", doc.Body.Outlines)
+		}
+	})
+}
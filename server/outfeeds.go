@@ -0,0 +1,487 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "time"
+import "bytes"
+import "strings"
+import "net/http"
+import "crypto/rand"
+import "crypto/sha256"
+import "database/sql"
+import "encoding/hex"
+import "encoding/xml"
+import "encoding/json"
+
+import "github.com/teris-io/shortid"
+
+// Output feeds republish the user's starred articles, a tag, or everything in a folder. They are served from
+// /out/<token>.atom, .rss, or .json without a session, so the token is all that protects them.
+
+const OutputFeedItems = 50
+
+var outputFeedIDService <-chan string
+
+func init() {
+	c := make(chan string)
+	outputFeedIDService = c
+	go func() {
+		idsource := shortid.MustNew(10, shortid.DefaultABC, uint64(time.Now().UnixNano()))
+
+		for {
+			c <- idsource.MustGenerate()
+		}
+	}()
+}
+
+type OutputFeed struct {
+	ID      string
+	Token   string
+	Kind    string // One of starred, tag, or folder.
+	Value   string // The tag or folder name.
+	Title   string
+	Created int64
+
+	user string
+}
+
+type outputItem struct {
+	ID        string
+	Title     string
+	URL       string
+	Published time.Time
+	FeedName  string
+	FeedURL   string
+	FeedLink  string
+	Summary   string
+}
+
+// /api/outfeed/list
+// =====================================================================================================================
+
+func OutputFeedList(l *SessionLogger, user string) []*OutputFeed {
+	rows, err := Queries["OutputFeedList"].Preped.Query(user)
+	if err != nil {
+		l.E.Printf("Output feed list failed for user %v, error: %v\n", user, err)
+		return nil
+	}
+	defer rows.Close()
+
+	feeds := []*OutputFeed{}
+	for rows.Next() {
+		f := &OutputFeed{}
+		err := rows.Scan(&f.ID, &f.Token, &f.Kind, &f.Value, &f.Title, &f.Created)
+		if err != nil {
+			l.E.Printf("Output feed list failed for user %v, error: %v\n", user, err)
+			return nil
+		}
+		feeds = append(feeds, f)
+	}
+	return feeds
+}
+
+// /api/outfeed/add
+// =====================================================================================================================
+
+type OutputFeedAddData struct {
+	Kind  string
+	Value string
+	Title string // Optional
+}
+
+func OutputFeedAdd(l *SessionLogger, user string, data *OutputFeedAddData) (*OutputFeed, int) {
+	f := &OutputFeed{Kind: data.Kind, Title: strings.TrimSpace(data.Title)}
+
+	ok := true
+	def := ""
+	switch data.Kind {
+	case "starred":
+		def = "Starred"
+	case "tag":
+		f.Value, ok = TagClean(data.Value)
+		def = "Tagged " + f.Value
+	case "folder":
+		f.Value = strings.TrimSpace(data.Value)
+		ok = f.Value != ""
+		def = f.Value
+	default:
+		ok = false
+	}
+	if !ok {
+		l.W.Printf("Invalid output feed selection: %v %q\n", data.Kind, data.Value)
+		return nil, http.StatusBadRequest
+	}
+	if f.Title == "" {
+		f.Title = def
+	}
+
+	token := make([]byte, 24)
+	_, err := rand.Read(token)
+	if err != nil {
+		l.E.Printf("Cannot generate output feed token, error: %v\n", err)
+		return nil, http.StatusInternalServerError
+	}
+	f.ID = <-outputFeedIDService
+	f.Token = hex.EncodeToString(token)
+	f.Created = time.Now().Unix()
+
+	_, err = Queries["OutputFeedAdd"].Preped.Exec(f.ID, f.Token, user, f.Kind, f.Value, f.Title, f.Created)
+	if err != nil {
+		l.E.Printf("Cannot add output feed for user %v, error: %v\n", user, err)
+		return nil, http.StatusInternalServerError
+	}
+	return f, http.StatusOK
+}
+
+// /api/outfeed/delete
+// =====================================================================================================================
+
+func OutputFeedDelete(l *SessionLogger, user, id string) int {
+	_, err := Queries["OutputFeedDelete"].Preped.Exec(user, id)
+	if err != nil {
+		l.E.Printf("Cannot delete output feed %v for user %v, error: %v\n", id, user, err)
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
+
+// /out/
+// =====================================================================================================================
+
+func OutputFeedHandler(w http.ResponseWriter, r *http.Request) {
+	l := newSessionLogger("/out/")
+
+	name := strings.TrimPrefix(r.URL.Path, "/out/")
+	dot := strings.LastIndex(name, ".")
+	if dot == -1 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	token, ext := name[:dot], name[dot+1:]
+
+	f := &OutputFeed{}
+	err := Queries["OutputFeedByToken"].Preped.QueryRow(token).Scan(&f.ID, &f.Token, &f.user, &f.Kind, &f.Value, &f.Title, &f.Created)
+	if err == sql.ErrNoRows {
+		l.W.Printf("Unknown output feed token.\n")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		l.E.Printf("Failed loading output feed, error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	items := outputFeedItems(l, f)
+	if items == nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	updated := time.Unix(f.Created, 0)
+	for _, i := range items {
+		if i.Published.After(updated) {
+			updated = i.Published
+		}
+	}
+	updated = updated.UTC()
+
+	base := Domain
+	if base == "" {
+		base = "https://" + r.Host
+	}
+	self := base + r.URL.Path
+
+	var body []byte
+	switch ext {
+	case "atom":
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		body, err = outputAtom(f, items, self, base, updated)
+	case "rss":
+		w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+		body, err = outputRSS(f, items, self, base, updated)
+	case "json":
+		w.Header().Set("Content-Type", "application/feed+json; charset=utf-8")
+		body, err = outputJSON(f, items, self, base)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		l.E.Printf("Error encoding output feed %v. Error: %v\n", f.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, max-age=300")
+
+	// Starring or tagging an old article doesn't change the newest date, so only folder feeds can be trusted to
+	// answer If-Modified-Since. Everything else relies on the ETag.
+	modified := time.Time{}
+	if f.Kind == "folder" {
+		modified = updated
+		w.Header().Set("Last-Modified", updated.Format(http.TimeFormat))
+	}
+
+	if outputNotModified(r, etag, modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write(body)
+}
+
+// outputNotModified checks the conditional GET headers, If-None-Match wins if both are given.
+func outputNotModified(r *http.Request, etag string, updated time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+			if t == etag || t == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !updated.IsZero() {
+		t, err := http.ParseTime(ims)
+		return err == nil && !updated.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+func outputFeedItems(l *SessionLogger, f *OutputFeed) []*outputItem {
+	rows, err := Queries["OutputFeedItems"].Preped.Query(f.user, f.Kind, f.Value, OutputFeedItems)
+	if err != nil {
+		l.E.Printf("Output feed %v item list failed, error: %v\n", f.ID, err)
+		return nil
+	}
+	defer rows.Close()
+
+	items := []*outputItem{}
+	for rows.Next() {
+		i := &outputItem{}
+		var stamp int64
+		err := rows.Scan(&i.ID, &i.Title, &i.URL, &stamp, &i.FeedName, &i.FeedURL, &i.FeedLink, &i.Summary)
+		if err != nil {
+			l.E.Printf("Output feed %v item list failed, error: %v\n", f.ID, err)
+			return nil
+		}
+		i.Published = time.Unix(stamp, 0).UTC()
+		items = append(items, i)
+	}
+	return items
+}
+
+func outputFeedID(f *OutputFeed) string {
+	return "urn:rsn2:output:" + f.ID
+}
+
+func outputItemID(i *outputItem) string {
+	return "urn:rsn2:article:" + i.ID
+}
+
+// Atom
+// =====================================================================================================================
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr,omitempty"`
+	Body string `xml:",chardata"`
+}
+
+type atomSource struct {
+	ID    string     `xml:"id,omitempty"`
+	Title string     `xml:"title"`
+	Link  []atomLink `xml:"link"`
+}
+
+type atomEntry struct {
+	ID        string      `xml:"id"`
+	Title     atomText    `xml:"title"`
+	Link      []atomLink  `xml:"link"`
+	Published string      `xml:"published"`
+	Updated   string      `xml:"updated"`
+	Author    atomPerson  `xml:"author"`
+	Summary   *atomText   `xml:"summary,omitempty"`
+	Source    *atomSource `xml:"source,omitempty"`
+}
+
+type atomFeed struct {
+	XMLName   xml.Name     `xml:"http://www.w3.org/2005/Atom feed"`
+	ID        string       `xml:"id"`
+	Title     atomText     `xml:"title"`
+	Updated   string       `xml:"updated"`
+	Link      []atomLink   `xml:"link"`
+	Generator string       `xml:"generator"`
+	Entries   []*atomEntry `xml:"entry"`
+}
+
+func outputAtom(f *OutputFeed, items []*outputItem, self, base string, updated time.Time) ([]byte, error) {
+	feed := &atomFeed{
+		ID:      outputFeedID(f),
+		Title:   atomText{Type: "text", Body: f.Title},
+		Updated: updated.Format(time.RFC3339),
+		Link: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: self},
+			{Rel: "alternate", Type: "text/html", Href: base},
+		},
+		Generator: "RSN2",
+		Entries:   []*atomEntry{},
+	}
+	for _, i := range items {
+		e := &atomEntry{
+			ID:        outputItemID(i),
+			Title:     atomText{Type: "text", Body: i.Title},
+			Link:      []atomLink{{Rel: "alternate", Href: i.URL}},
+			Published: i.Published.Format(time.RFC3339),
+			Updated:   i.Published.Format(time.RFC3339),
+			Author:    atomPerson{Name: i.FeedName, URI: i.FeedLink},
+			Source: &atomSource{
+				Title: i.FeedName,
+				Link:  []atomLink{{Rel: "self", Href: i.FeedURL}},
+			},
+		}
+		if i.Summary != "" {
+			e.Summary = &atomText{Type: "text", Body: i.Summary}
+		}
+		feed.Entries = append(feed.Entries, e)
+	}
+	return outputXML(feed)
+}
+
+// RSS 2.0
+// =====================================================================================================================
+
+type rssGUID struct {
+	IsPermaLink string `xml:"isPermaLink,attr"`
+	Body        string `xml:",chardata"`
+}
+
+type rssSource struct {
+	URL  string `xml:"url,attr"`
+	Body string `xml:",chardata"`
+}
+
+type rssItem struct {
+	Title       string     `xml:"title"`
+	Link        string     `xml:"link"`
+	GUID        rssGUID    `xml:"guid"`
+	PubDate     string     `xml:"pubDate"`
+	Description string     `xml:"description,omitempty"`
+	Source      *rssSource `xml:"source,omitempty"`
+}
+
+type rssAtomLink struct {
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+	Href string `xml:"href,attr"`
+}
+
+type rssChannel struct {
+	Title         string      `xml:"title"`
+	Link          string      `xml:"link"`
+	Description   string      `xml:"description"`
+	LastBuildDate string      `xml:"lastBuildDate"`
+	Generator     string      `xml:"generator"`
+	Self          rssAtomLink `xml:"http://www.w3.org/2005/Atom link"`
+	Items         []*rssItem  `xml:"item"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+func outputRSS(f *OutputFeed, items []*outputItem, self, base string, updated time.Time) ([]byte, error) {
+	feed := &rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:         f.Title,
+			Link:          base,
+			Description:   f.Title + " from RSN2",
+			LastBuildDate: updated.Format(time.RFC1123Z),
+			Generator:     "RSN2",
+			Self:          rssAtomLink{Rel: "self", Type: "application/rss+xml", Href: self},
+			Items:         []*rssItem{},
+		},
+	}
+	for _, i := range items {
+		feed.Channel.Items = append(feed.Channel.Items, &rssItem{
+			Title:       i.Title,
+			Link:        i.URL,
+			GUID:        rssGUID{IsPermaLink: "false", Body: outputItemID(i)},
+			PubDate:     i.Published.Format(time.RFC1123Z),
+			Description: i.Summary,
+			Source:      &rssSource{URL: i.FeedURL, Body: i.FeedName},
+		})
+	}
+	return outputXML(feed)
+}
+
+func outputXML(v interface{}) ([]byte, error) {
+	buf := bytes.NewBufferString(xml.Header)
+	enc := xml.NewEncoder(buf)
+	enc.Indent("", "\t")
+	err := enc.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// JSON Feed 1.1
+// =====================================================================================================================
+
+func outputJSON(f *OutputFeed, items []*outputItem, self, base string) ([]byte, error) {
+	feed := &jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       f.Title,
+		HomePageURL: base,
+		FeedURL:     self,
+		Items:       []*jsonFeedItem{},
+	}
+	for _, i := range items {
+		feed.Items = append(feed.Items, &jsonFeedItem{
+			ID:            jsonFeedID(outputItemID(i)),
+			URL:           i.URL,
+			Title:         i.Title,
+			ContentText:   i.Summary,
+			DatePublished: i.Published.Format(time.RFC3339),
+			Authors:       []*jsonFeedAuthor{{Name: i.FeedName, URL: i.FeedLink}},
+		})
+	}
+	return json.MarshalIndent(feed, "", "\t")
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "strings"
+import "testing"
+import "net/http"
+import "net/http/httptest"
+
+// testOutputFeed fetches an output feed, returning the status, ETag, and body.
+func testOutputFeed(t *testing.T, path, etag string) (int, string, string) {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	if etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	w := httptest.NewRecorder()
+	OutputFeedHandler(w, r)
+	return w.Code, w.Header().Get("ETag"), w.Body.String()
+}
+
+func TestOutputFeeds(t *testing.T) {
+	testDB(t, func(t *testing.T) {
+		testUser(t, "u1", "one@example.com")
+		f1 := testFeed(t, "https://example.com/one", "u1")
+		f2 := testFeed(t, "https://example.com/two", "u1")
+		testStatus(t, "set folder", FeedSetFolder(ml, "u1", f1, "News"), http.StatusOK)
+		one := testIngest(t, f1, testItem("https://example.com/one/1", "One", 1), testItem("https://example.com/one/2", "Two", 2))
+		two := testIngest(t, f2, testItem("https://example.com/two/1", "Three", 3))
+
+		testStatus(t, "star", ArticleStar(ml, "u1", two[0]), http.StatusOK)
+		testStatus(t, "tag", TagEdit(ml, "u1", &TagEditData{Tag: "later", Articles: one[:1]}, true), http.StatusOK)
+
+		_, status := OutputFeedAdd(ml, "u1", &OutputFeedAddData{Kind: "everything"})
+		testStatus(t, "bad kind", status, http.StatusBadRequest)
+		_, status = OutputFeedAdd(ml, "u1", &OutputFeedAddData{Kind: "tag", Value: " "})
+		testStatus(t, "empty tag", status, http.StatusBadRequest)
+
+		for _, c := range []struct {
+			data *OutputFeedAddData
+			has  []string
+			not  []string
+		}{
+			{&OutputFeedAddData{Kind: "starred"}, []string{"two/1"}, []string{"one/1", "one/2"}},
+			{&OutputFeedAddData{Kind: "tag", Value: "later"}, []string{"one/1"}, []string{"one/2", "two/1"}},
+			{&OutputFeedAddData{Kind: "folder", Value: "News"}, []string{"one/1", "one/2"}, []string{"two/1"}},
+		} {
+			f, status := OutputFeedAdd(ml, "u1", c.data)
+			testStatus(t, "add "+c.data.Kind, status, http.StatusOK)
+
+			for _, ext := range []string{"atom", "rss", "json"} {
+				path := "/out/" + f.Token + "." + ext
+				status, etag, body := testOutputFeed(t, path, "")
+				testStatus(t, path, status, http.StatusOK)
+				for _, link := range c.has {
+					if !strings.Contains(body, "https://example.com/"+link) {
+						t.Fatalf("%v %v feed is missing %v:\n%v", c.data.Kind, ext, link, body)
+					}
+				}
+				for _, link := range c.not {
+					if strings.Contains(body, "https://example.com/"+link) {
+						t.Fatalf("%v %v feed has %v:\n%v", c.data.Kind, ext, link, body)
+					}
+				}
+
+				status, _, _ = testOutputFeed(t, path, etag)
+				testStatus(t, path+" with ETag", status, http.StatusNotModified)
+			}
+		}
+
+		status, _, _ = testOutputFeed(t, "/out/nope.rss", "")
+		testStatus(t, "unknown token", status, http.StatusNotFound)
+
+		feeds := OutputFeedList(ml, "u1")
+		if len(feeds) != 3 {
+			t.Fatalf("Got %v output feeds, expected 3", len(feeds))
+		}
+		status, _, _ = testOutputFeed(t, "/out/"+feeds[0].Token+".html", "")
+		testStatus(t, "unknown format", status, http.StatusNotFound)
+
+		testStatus(t, "delete", OutputFeedDelete(ml, "u1", feeds[0].ID), http.StatusOK)
+		status, _, _ = testOutputFeed(t, "/out/"+feeds[0].Token+".rss", "")
+		testStatus(t, "deleted feed", status, http.StatusNotFound)
+		if feeds := OutputFeedList(ml, "u1"); len(feeds) != 2 {
+			t.Fatalf("Got %v output feeds after deleting, expected 2", len(feeds))
+		}
+	})
+}
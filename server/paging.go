@@ -0,0 +1,126 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "os"
+import "math"
+import "strconv"
+import "strings"
+import "net/http"
+
+// Article listings are paged with a cursor made from the published time and ID of the last item on the previous
+// page. Clients should treat the cursor as opaque, it is only a string so it can be passed back in a query parameter.
+
+const MaxPageSize = 500
+
+var DefaultPageSize = 100
+
+func init() {
+	if v := os.Getenv("RSN2_PAGE_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > MaxPageSize {
+			panic("Invalid RSN2_PAGE_SIZE: " + v)
+		}
+		DefaultPageSize = n
+	}
+}
+
+type PageParams struct {
+	Newest bool // Newest first instead of oldest first.
+	Limit  int
+
+	// Position of the last item on the previous page.
+	Published int64
+	ID        string
+}
+
+// NewPageParams returns the parameters for the first page of a listing.
+func NewPageParams(newest bool, limit int) *PageParams {
+	p := &PageParams{Newest: newest, Limit: limit}
+	p.Reset()
+	return p
+}
+
+// Reset moves the params back to the first page.
+func (p *PageParams) Reset() {
+	p.ID = ""
+	p.Published = math.MinInt64
+	if p.Newest {
+		p.Published = math.MaxInt64
+	}
+}
+
+// ParsePageParams reads the "cursor", "limit", and "order" request parameters.
+func ParsePageParams(l *SessionLogger, r *http.Request) (*PageParams, int) {
+	p := NewPageParams(false, DefaultPageSize)
+
+	switch order := r.FormValue("order"); order {
+	case "", "oldest":
+	case "newest":
+		p.Newest = true
+		p.Reset()
+	default:
+		l.W.Printf("Invalid sort order: %v\n", order)
+		return nil, http.StatusBadRequest
+	}
+
+	if v := r.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			l.W.Printf("Invalid page size: %v\n", v)
+			return nil, http.StatusBadRequest
+		}
+		if n > MaxPageSize {
+			n = MaxPageSize
+		}
+		p.Limit = n
+	}
+
+	if v := r.FormValue("cursor"); v != "" {
+		parts := strings.SplitN(v, ".", 2)
+		if len(parts) != 2 {
+			l.W.Printf("Malformed cursor: %v\n", v)
+			return nil, http.StatusBadRequest
+		}
+		stamp, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			l.W.Printf("Malformed cursor: %v\n", v)
+			return nil, http.StatusBadRequest
+		}
+		p.Published, p.ID = stamp, parts[1]
+	}
+	return p, http.StatusOK
+}
+
+// Cursor returns the cursor that continues a listing after the given item.
+func Cursor(published int64, id string) string {
+	return strconv.FormatInt(published, 10) + "." + id
+}
+
+// Query returns the suffix used to pick the right variant of a paged query.
+func (p *PageParams) Query() string {
+	if p.Newest {
+		return "Newest"
+	}
+	return "Oldest"
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "testing"
+import "net/http"
+import "net/url"
+import "net/http/httptest"
+
+func testPageParams(t *testing.T, query string) (*PageParams, int) {
+	r := httptest.NewRequest(http.MethodGet, "/api/feed/articles?"+query, nil)
+	return ParsePageParams(ml, r)
+}
+
+func TestParsePageParams(t *testing.T) {
+	p, status := testPageParams(t, "")
+	testStatus(t, "defaults", status, http.StatusOK)
+	if p.Newest || p.Limit != DefaultPageSize || p.ID != "" {
+		t.Fatalf("Default params: %+v", p)
+	}
+
+	p, status = testPageParams(t, "order=newest&limit=100000&cursor=3600.abc.d")
+	testStatus(t, "newest", status, http.StatusOK)
+	if !p.Newest || p.Limit != MaxPageSize || p.Published != 3600 || p.ID != "abc.d" {
+		t.Fatalf("Parsed params: %+v", p)
+	}
+
+	for _, query := range []string{"order=random", "limit=0", "limit=ten", "cursor=abc", "cursor=abc.def"} {
+		_, status := testPageParams(t, query)
+		testStatus(t, query, status, http.StatusBadRequest)
+	}
+}
+
+func TestPaging(t *testing.T) {
+	testDB(t, func(t *testing.T) {
+		testUser(t, "u1", "one@example.com")
+		feed := testFeed(t, "https://example.com/feed", "u1")
+
+		// Two articles published at the same time, so the cursor has to fall back on the ID.
+		ids := testIngest(t, feed,
+			testItem("https://example.com/1", "One", 1),
+			testItem("https://example.com/2", "Two", 2),
+			testItem("https://example.com/3", "Three", 2),
+			testItem("https://example.com/4", "Four", 3),
+			testItem("https://example.com/5", "Five", 4),
+		)
+		testStatus(t, "read 5", ArticleMarkRead(ml, "u1", ids[4]), http.StatusOK)
+		if ids[1] > ids[2] {
+			ids[1], ids[2] = ids[2], ids[1]
+		}
+
+		for _, order := range []string{"oldest", "newest"} {
+			var articles, unread []string
+			cursor := ""
+			for pages := 0; ; pages++ {
+				p, status := testPageParams(t, "order="+order+"&limit=2&cursor="+url.QueryEscape(cursor))
+				testStatus(t, "page params", status, http.StatusOK)
+				page := FeedArticles(ml, "u1", feed, p)
+				if page == nil || len(page.Articles) > 2 || pages > 3 {
+					t.Fatalf("Bad %v page %v: %+v", order, pages, page)
+				}
+				for _, a := range page.Articles {
+					articles = append(articles, a.ID)
+				}
+				cursor = page.Next
+				if cursor == "" {
+					break
+				}
+			}
+			for pages := 0; ; pages++ {
+				p, status := testPageParams(t, "order="+order+"&limit=2&cursor="+url.QueryEscape(cursor))
+				testStatus(t, "page params", status, http.StatusOK)
+				page := GetUnread(ml, "u1", "", p)
+				if page == nil || len(page.Articles) > 2 || pages > 3 {
+					t.Fatalf("Bad unread %v page %v: %+v", order, pages, page)
+				}
+				for _, a := range page.Articles {
+					unread = append(unread, a.ID)
+				}
+				cursor = page.Next
+				if cursor == "" {
+					break
+				}
+			}
+
+			want := ids
+			if order == "newest" {
+				want = []string{ids[4], ids[3], ids[2], ids[1], ids[0]}
+			}
+			testPageOrder(t, order, articles, want)
+			wantUnread := []string{}
+			for _, id := range want {
+				if id != ids[4] {
+					wantUnread = append(wantUnread, id)
+				}
+			}
+			testPageOrder(t, order+" unread", unread, wantUnread)
+		}
+	})
+}
+
+func testPageOrder(t *testing.T, what string, got, want []string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%v: got %v, expected %v", what, got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("%v: got %v, expected %v", what, got, want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "sync"
+import "time"
+import "net/http"
+
+// Manual refreshes are done by their own worker, so the user doesn't have to wait for the background process to get
+// around to the feed. New items go out over the websocket like any other update.
+
+// How often one user can ask for the same feed.
+const RefreshInterval = time.Minute
+
+const RefreshQueueSize = 100
+
+var refreshQueue = make(chan *refreshJob, RefreshQueueSize)
+
+var refreshState = struct {
+	sync.Mutex
+
+	last   map[string]time.Time // When each user last asked for each feed, keyed by "user/feed".
+	queued map[string]bool      // Feeds waiting in the queue.
+}{
+	last:   map[string]time.Time{},
+	queued: map[string]bool{},
+}
+
+type refreshJob struct {
+	feed string
+	url  string
+}
+
+// RefreshJob runs the refresh worker.
+func RefreshJob() {
+	l := newSessionLogger("refresh")
+	l.I.Println("Starting refresh worker.")
+
+	for job := range refreshQueue {
+		refreshState.Lock()
+		delete(refreshState.queued, job.feed)
+		refreshState.Unlock()
+
+		l.I.Printf("Refreshing feed %v.\n", job.feed)
+		updated := map[string][]string{}
+		FeedUpdate(l, job.feed, job.url, updated)
+		if len(updated) > 0 {
+			Feeds.SendAdded(l, updated)
+		}
+	}
+}
+
+// /api/feed/refresh
+// =====================================================================================================================
+
+func FeedRefresh(l *SessionLogger, user, feed string) int {
+	ok, err := Data.Subscribed(user, feed)
+	if err != nil {
+		l.E.Printf("DB existence check failed for subscribed feed %v by user %v, error: %v\n", feed, user, err)
+		return http.StatusInternalServerError
+	}
+	if !ok {
+		l.W.Printf("Feed %v not subscribed by user %v.\n", feed, user)
+		return http.StatusBadRequest
+	}
+
+	url, link := "", ""
+	err = Queries["FeedLinks"].Preped.QueryRow(feed).Scan(&url, &link)
+	if err != nil {
+		l.E.Printf("Failed loading URL for feed %v, error: %v\n", feed, err)
+		return http.StatusInternalServerError
+	}
+
+	return feedRefreshQueue(l, user, feed, url)
+}
+
+// feedRefreshQueue queues a refresh on behalf of a user. Returns 202 if the feed is (or already was) queued.
+func feedRefreshQueue(l *SessionLogger, user, feed, url string) int {
+	now := time.Now()
+	key := user + "/" + feed
+
+	refreshState.Lock()
+	defer refreshState.Unlock()
+
+	if last, ok := refreshState.last[key]; ok && now.Sub(last) < RefreshInterval {
+		l.W.Printf("Refresh of feed %v by user %v is rate limited.\n", feed, user)
+		return http.StatusTooManyRequests
+	}
+
+	// Anything older than the interval doesn't matter any more.
+	for k, t := range refreshState.last {
+		if now.Sub(t) >= RefreshInterval {
+			delete(refreshState.last, k)
+		}
+	}
+	refreshState.last[key] = now
+
+	if refreshState.queued[feed] {
+		return http.StatusAccepted
+	}
+
+	select {
+	case refreshQueue <- &refreshJob{feed: feed, url: url}:
+		refreshState.queued[feed] = true
+		return http.StatusAccepted
+	default:
+		l.W.Printf("Refresh queue full, dropping refresh of feed %v.\n", feed)
+		delete(refreshState.last, key)
+		return http.StatusServiceUnavailable
+	}
+}
@@ -0,0 +1,396 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "os"
+import "math"
+import "time"
+import "strconv"
+import "net/http"
+import "database/sql"
+
+// How many articles are deleted per transaction.
+const PruneBatchSize = 500
+
+type RetentionPolicy struct {
+	MaxAge      int // Days, 0 for no limit.
+	MaxCount    int // Articles per feed, 0 for no limit.
+	KeepUnread  bool
+	KeepStarred bool
+}
+
+// The global policy, by default nothing is ever pruned.
+var Retention = RetentionPolicy{
+	KeepUnread:  true,
+	KeepStarred: true,
+}
+
+var RetentionInterval = 24 * time.Hour
+
+// One of "", "full", or "incremental".
+var RetentionVacuum = ""
+
+func init() {
+	envInt := func(name string, v *int) {
+		if raw := os.Getenv(name); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 0 {
+				panic("Invalid " + name + ": " + raw)
+			}
+			*v = n
+		}
+	}
+	envBool := func(name string, v *bool) {
+		if raw := os.Getenv(name); raw != "" {
+			*v = raw != "0"
+		}
+	}
+
+	envInt("RSN2_RETAIN_DAYS", &Retention.MaxAge)
+	envInt("RSN2_RETAIN_COUNT", &Retention.MaxCount)
+	envBool("RSN2_RETAIN_UNREAD", &Retention.KeepUnread)
+	envBool("RSN2_RETAIN_STARRED", &Retention.KeepStarred)
+
+	hours := 0
+	envInt("RSN2_RETAIN_INTERVAL", &hours)
+	if hours > 0 {
+		RetentionInterval = time.Duration(hours) * time.Hour
+	}
+
+	RetentionVacuum = os.Getenv("RSN2_RETAIN_VACUUM")
+	switch RetentionVacuum {
+	case "", "full", "incremental":
+	default:
+		panic("Invalid RSN2_RETAIN_VACUUM: " + RetentionVacuum)
+	}
+}
+
+// FeedRetentionData holds the per-feed overrides, nil fields use the global policy.
+type FeedRetentionData struct {
+	MaxAge      *int
+	MaxCount    *int
+	KeepUnread  *bool
+	KeepStarred *bool
+}
+
+// Apply returns the policy with any overrides applied. Only operators can set them, so they are used as they are.
+func (o *FeedRetentionData) Apply(p RetentionPolicy) RetentionPolicy {
+	if o.MaxAge != nil {
+		p.MaxAge = *o.MaxAge
+	}
+	if o.MaxCount != nil {
+		p.MaxCount = *o.MaxCount
+	}
+	if o.KeepUnread != nil {
+		p.KeepUnread = *o.KeepUnread
+	}
+	if o.KeepStarred != nil {
+		p.KeepStarred = *o.KeepStarred
+	}
+	return p
+}
+
+func FeedRetentionGet(l *SessionLogger, feed string) *FeedRetentionData {
+	var age, count sql.NullInt64
+	var unread, starred sql.NullBool
+	err := Queries["FeedRetentionGet"].Preped.QueryRow(feed).Scan(&age, &count, &unread, &starred)
+	if err == sql.ErrNoRows {
+		return &FeedRetentionData{}
+	}
+	if err != nil {
+		l.E.Printf("Failed loading retention policy for feed %v, error: %v\n", feed, err)
+		return nil
+	}
+
+	o := &FeedRetentionData{}
+	if age.Valid {
+		v := int(age.Int64)
+		o.MaxAge = &v
+	}
+	if count.Valid {
+		v := int(count.Int64)
+		o.MaxCount = &v
+	}
+	if unread.Valid {
+		o.KeepUnread = &unread.Bool
+	}
+	if starred.Valid {
+		o.KeepStarred = &starred.Bool
+	}
+	return o
+}
+
+// /api/feed/retention
+// =====================================================================================================================
+
+type FeedRetentionDetails struct {
+	Policy   RetentionPolicy // What will actually be used.
+	Override *FeedRetentionData
+}
+
+func FeedRetention(l *SessionLogger, user, feed string) *FeedRetentionDetails {
+	if FeedDetails(l, user, feed) == nil {
+		return nil
+	}
+
+	o := FeedRetentionGet(l, feed)
+	if o == nil {
+		return nil
+	}
+	return &FeedRetentionDetails{Policy: o.Apply(Retention), Override: o}
+}
+
+// /api/feed/set-retention
+// =====================================================================================================================
+
+// FeedSetRetention overrides the global policy for a feed. Feeds are shared between users, so only operators may.
+func FeedSetRetention(l *SessionLogger, user, feed string, o *FeedRetentionData) int {
+	if !IsOperator(l, user) {
+		l.W.Printf("User %v is not an operator, cannot set retention for feed %v.\n", user, feed)
+		return http.StatusForbidden
+	}
+
+	if FeedDetails(l, user, feed) == nil {
+		return http.StatusBadRequest
+	}
+
+	if (o.MaxAge != nil && *o.MaxAge < 0) || (o.MaxCount != nil && *o.MaxCount < 0) {
+		l.W.Printf("Negative retention limits for feed %v.\n", feed)
+		return http.StatusBadRequest
+	}
+
+	_, err := Queries["FeedRetentionSet"].Preped.Exec(feed, o.MaxAge, o.MaxCount, o.KeepUnread, o.KeepStarred)
+	if err != nil {
+		l.E.Printf("Failed setting retention policy for feed %v, error: %v\n", feed, err)
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
+
+// Pruning
+// =====================================================================================================================
+
+type PruneReport struct {
+	Feeds    int
+	Articles int64
+	Flags    int64
+	Took     time.Duration
+}
+
+func RetentionJob() {
+	l := newSessionLogger("retention")
+	l.I.Println("Starting retention job.")
+
+	for {
+		time.Sleep(RetentionInterval)
+
+		r := Prune(l)
+		if r == nil {
+			continue
+		}
+		l.I.Printf("Pruned %v articles and %v flags from %v feeds in %v.\n", r.Articles, r.Flags, r.Feeds, r.Took)
+
+		if r.Articles > 0 {
+			Vacuum(l)
+		}
+	}
+}
+
+// Prune deletes every article that falls outside the retention policy for its feed.
+func Prune(l *SessionLogger) *PruneReport {
+	start := time.Now()
+
+	feeds := GetAllFeeds(l)
+	if feeds == nil {
+		return nil
+	}
+
+	r := &PruneReport{}
+	for _, data := range feeds {
+		feed := data[1]
+
+		o := FeedRetentionGet(l, feed)
+		if o == nil {
+			continue
+		}
+		p := o.Apply(Retention)
+		if p.MaxAge == 0 && p.MaxCount == 0 {
+			continue
+		}
+
+		articles, flags, ok := pruneFeed(l, feed, p)
+		r.Articles += articles
+		r.Flags += flags
+		if articles > 0 {
+			r.Feeds++
+		}
+		if !ok {
+			l.W.Printf("Pruning feed %v stopped early.\n", feed)
+		}
+	}
+
+	r.Took = time.Since(start)
+	return r
+}
+
+func pruneFeed(l *SessionLogger, feed string, p RetentionPolicy) (articles, flags int64, ok bool) {
+	cutoff := int64(math.MinInt64)
+	if p.MaxAge > 0 {
+		cutoff = time.Now().AddDate(0, 0, -p.MaxAge).Unix()
+	}
+	var count interface{} // NULL for no limit, PostgreSQL won't take a negative one.
+	if p.MaxCount > 0 {
+		count = p.MaxCount
+	}
+
+	for {
+		batch := pruneCandidates(l, feed, cutoff, count, p)
+		if batch == nil {
+			return articles, flags, false
+		}
+		if len(batch) == 0 {
+			return articles, flags, true
+		}
+
+		a, f, ok := pruneBatch(l, batch)
+		if !ok {
+			return articles, flags, false
+		}
+		articles += a
+		flags += f
+
+		if len(batch) < PruneBatchSize {
+			return articles, flags, true
+		}
+	}
+}
+
+func pruneCandidates(l *SessionLogger, feed string, cutoff int64, count interface{}, p RetentionPolicy) []string {
+	rows, err := Queries["PruneCandidates"].Preped.Query(feed, cutoff, count, p.KeepUnread, p.KeepStarred, PruneBatchSize)
+	if err != nil {
+		l.E.Printf("Failed listing prunable articles for feed %v, error: %v\n", feed, err)
+		return nil
+	}
+	defer rows.Close()
+
+	batch := []string{}
+	for rows.Next() {
+		id := ""
+		err := rows.Scan(&id)
+		if err != nil {
+			l.E.Printf("Failed listing prunable articles for feed %v, error: %v\n", feed, err)
+			return nil
+		}
+		batch = append(batch, id)
+	}
+	return batch
+}
+
+func pruneBatch(l *SessionLogger, batch []string) (articles, flags int64, ok bool) {
+	tx, err := DB.Begin()
+	if err != nil {
+		l.E.Printf("Failed starting prune transaction, error: %v\n", err)
+		return 0, 0, false
+	}
+
+	seen := time.Now().Unix()
+	for _, id := range batch {
+		_, err := tx.Stmt(Queries["PruneTombstone"].Preped).Exec(id, seen)
+		if err != nil {
+			l.E.Printf("Failed pruning article %v, error: %v\n", id, err)
+			tx.Rollback()
+			return 0, 0, false
+		}
+
+		for _, q := range []string{
+			"PruneReadExceptions", "PruneStarFlags", "PruneArticleContent", "PruneHiddenFlags", "PruneArticleTags",
+			"PruneNotifications", "PruneArticle",
+		} {
+			res, err := tx.Stmt(Queries[q].Preped).Exec(id)
+			if err != nil {
+				l.E.Printf("Failed pruning article %v, error: %v\n", id, err)
+				tx.Rollback()
+				return 0, 0, false
+			}
+			n, _ := res.RowsAffected()
+			if q == "PruneArticle" {
+				articles += n
+			} else {
+				flags += n
+			}
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		l.E.Printf("Failed committing prune transaction, error: %v\n", err)
+		return 0, 0, false
+	}
+	return articles, flags, true
+}
+
+// Vacuum gives the space freed by pruning back to the file system, if configured to.
+func Vacuum(l *SessionLogger) {
+	// PostgreSQL only needs a plain vacuum to reuse the space, and autovacuum normally does that anyway.
+	if DBPostgres {
+		vacuum := `vacuum;`
+		if RetentionVacuum == "full" {
+			vacuum = `vacuum full;`
+		}
+		if RetentionVacuum != "" {
+			_, err := DB.Exec(vacuum)
+			if err != nil {
+				l.E.Printf("Vacuum failed, error: %v\n", err)
+			}
+		}
+		return
+	}
+
+	switch RetentionVacuum {
+	case "full":
+		_, err := DB.Exec(`vacuum;`)
+		if err != nil {
+			l.E.Printf("Vacuum failed, error: %v\n", err)
+		}
+	case "incremental":
+		// Switching an existing database to incremental mode requires a full vacuum, but only once.
+		mode := 0
+		err := DB.QueryRow(`pragma auto_vacuum;`).Scan(&mode)
+		if err != nil {
+			l.E.Printf("Vacuum failed, error: %v\n", err)
+			return
+		}
+		if mode != 2 {
+			_, err = DB.Exec(`pragma auto_vacuum = incremental; vacuum;`)
+			if err != nil {
+				l.E.Printf("Vacuum failed, error: %v\n", err)
+			}
+			return
+		}
+
+		_, err = DB.Exec(`pragma incremental_vacuum;`)
+		if err != nil {
+			l.E.Printf("Vacuum failed, error: %v\n", err)
+		}
+	}
+}
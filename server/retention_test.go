@@ -0,0 +1,160 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "reflect"
+import "testing"
+import "net/http"
+
+func testInt(v int) *int {
+	return &v
+}
+
+func testBool(v bool) *bool {
+	return &v
+}
+
+// testArticleIDs lists the IDs of the articles in a feed as the user sees them, oldest first.
+func testArticleIDs(t *testing.T, user, feed string) []string {
+	ids := []string{}
+	for _, a := range testArticles(t, user, feed) {
+		ids = append(ids, a.ID)
+	}
+	return ids
+}
+
+func TestRetentionOverrides(t *testing.T) {
+	defer func(p RetentionPolicy, ops []string) { Retention, Operators = p, ops }(Retention, Operators)
+	Retention = RetentionPolicy{MaxAge: 30, MaxCount: 100, KeepUnread: true, KeepStarred: true}
+	Operators = []string{"One@Example.com"}
+
+	testDB(t, func(t *testing.T) {
+		testUser(t, "u1", "one@example.com")
+		testUser(t, "u2", "two@example.com")
+		testUser(t, "u3", "three@example.com")
+		feed := testFeed(t, "https://example.com/feed", "u1", "u2")
+
+		// Feeds are shared, so other subscribers can't change what is kept either way.
+		for _, o := range []*FeedRetentionData{
+			{MaxAge: testInt(0)},
+			{MaxCount: testInt(50)},
+			{KeepUnread: testBool(false)},
+		} {
+			testStatus(t, "not an operator", FeedSetRetention(ml, "u2", feed, o), http.StatusForbidden)
+		}
+		testStatus(t, "negative age", FeedSetRetention(ml, "u1", feed, &FeedRetentionData{MaxAge: testInt(-1)}),
+			http.StatusBadRequest)
+		testStatus(t, "not subscribed", FeedSetRetention(ml, "u3", feed, &FeedRetentionData{}), http.StatusForbidden)
+
+		// Operators can go either way.
+		testStatus(t, "override", FeedSetRetention(ml, "u1", feed, &FeedRetentionData{
+			MaxAge:      testInt(0),
+			MaxCount:    testInt(50),
+			KeepStarred: testBool(false),
+		}), http.StatusOK)
+		for _, user := range []string{"u1", "u2"} {
+			d := FeedRetention(ml, user, feed)
+			want := RetentionPolicy{MaxAge: 0, MaxCount: 50, KeepUnread: true, KeepStarred: false}
+			if d == nil || d.Policy != want {
+				t.Fatalf("Got policy %+v for %v, expected %+v", d, user, want)
+			}
+		}
+
+		// Anything not overridden follows the global policy.
+		Retention = RetentionPolicy{MaxAge: 90, MaxCount: 500}
+		d := FeedRetention(ml, "u1", feed)
+		want := RetentionPolicy{MaxAge: 0, MaxCount: 50}
+		if d == nil || d.Policy != want {
+			t.Fatalf("Got policy %+v, expected %+v", d, want)
+		}
+	})
+}
+
+func TestPrune(t *testing.T) {
+	defer func(p RetentionPolicy, ops []string) { Retention, Operators = p, ops }(Retention, Operators)
+
+	testDB(t, func(t *testing.T) {
+		testUser(t, "u1", "one@example.com")
+		testUser(t, "u2", "two@example.com")
+		feed := testFeed(t, "https://example.com/feed", "u1", "u2")
+		ids := testIngest(t, feed,
+			testItem("https://example.com/1", "One", 1),
+			testItem("https://example.com/2", "Two", 2),
+			testItem("https://example.com/3", "Three", 3),
+			testItem("https://example.com/4", "Four", 4),
+			testItem("https://example.com/5", "Five", 5),
+		)
+
+		// u1 has read everything, u2 has one old article left unread and one starred.
+		for _, id := range ids {
+			testStatus(t, "mark read", ArticleMarkRead(ml, "u1", id), http.StatusOK)
+		}
+		for _, id := range []string{ids[0], ids[2]} {
+			testStatus(t, "mark read", ArticleMarkRead(ml, "u2", id), http.StatusOK)
+		}
+		testStatus(t, "star", ArticleStar(ml, "u2", ids[0]), http.StatusOK)
+
+		// Keep the newest two, and anything unread or starred.
+		Retention = RetentionPolicy{MaxCount: 2, KeepUnread: true, KeepStarred: true}
+		r := Prune(ml)
+		if r == nil || r.Articles != 1 {
+			t.Fatalf("Count prune report: %+v", r)
+		}
+		got, want := testArticleIDs(t, "u1", feed), []string{ids[0], ids[1], ids[3], ids[4]}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("After count prune got %v, expected %v", got, want)
+		}
+
+		// Pruned articles don't come back while the feed still has them, but are forgotten once it drops them.
+		if pruned, ok := ArticlePruned(ml, "https://example.com/3", 100); !ok || !pruned {
+			t.Fatal("Pruned article has no tombstone")
+		}
+		if pruned, ok := ArticlePruned(ml, "https://example.com/6", 100); !ok || pruned {
+			t.Fatal("New article has a tombstone")
+		}
+		PrunedTrim(ml, feed, 200)
+		if pruned, ok := ArticlePruned(ml, "https://example.com/3", 300); !ok || pruned {
+			t.Fatal("Tombstone was kept after the feed dropped the article")
+		}
+
+		// Everything here is decades old, so an age limit with no count limit prunes all but the starred one.
+		Retention = RetentionPolicy{MaxAge: 1, KeepStarred: true}
+		r = Prune(ml)
+		if r == nil || r.Articles != 3 {
+			t.Fatalf("Age prune report: %+v", r)
+		}
+		got, want = testArticleIDs(t, "u2", feed), []string{ids[0]}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("After age prune got %v, expected %v", got, want)
+		}
+
+		// A per-feed override takes the place of the global policy for that feed.
+		Operators = []string{"one@example.com"}
+		testStatus(t, "override", FeedSetRetention(ml, "u1", feed, &FeedRetentionData{MaxAge: testInt(0)}), http.StatusOK)
+		testIngest(t, feed, testItem("https://example.com/6", "Six", 6))
+		r = Prune(ml)
+		if r == nil || r.Articles != 0 || len(testArticleIDs(t, "u2", feed)) != 2 {
+			t.Fatalf("Override prune report: %+v", r)
+		}
+	})
+}
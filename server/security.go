@@ -0,0 +1,172 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "os"
+import "strings"
+import "net/url"
+import "net/http"
+import "crypto/rand"
+import "crypto/subtle"
+import "encoding/hex"
+
+import "github.com/gorilla/sessions"
+
+// Requests that change something must use POST (or DELETE), and carry the session's CSRF token in the X-CSRF-Token
+// header. The token is also in the rsn2-csrf cookie, which the frontend can read and other sites can't. GetSession
+// does the check, so handlers only have to check the method.
+
+const CSRFHeader = "X-CSRF-Token"
+const CSRFCookie = "rsn2-csrf"
+
+// Origins other than the server's own that may open a websocket, from RSN2_ALLOWED_ORIGINS (comma separated). "*"
+// allows any origin. In development any origin is allowed unless this is set, since the dev server is on another port.
+var AllowedOrigins []string
+
+func init() {
+	for _, origin := range strings.Split(os.Getenv("RSN2_ALLOWED_ORIGINS"), ",") {
+		origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+		if origin != "" {
+			AllowedOrigins = append(AllowedOrigins, origin)
+		}
+	}
+	if len(AllowedOrigins) == 0 && os.Getenv("RSN2_ISDEV") != "" {
+		AllowedOrigins = []string{"*"}
+	}
+}
+
+// The emails of the users that run the server, from RSN2_OPERATORS (comma separated). Only they may change settings
+// that affect everyone, like the retention of a shared feed.
+var Operators []string
+
+func init() {
+	for _, email := range strings.Split(os.Getenv("RSN2_OPERATORS"), ",") {
+		email = strings.TrimSpace(email)
+		if email != "" {
+			Operators = append(Operators, email)
+		}
+	}
+}
+
+// IsOperator returns true if the user is one of the Operators.
+func IsOperator(l *SessionLogger, user string) bool {
+	if len(Operators) == 0 {
+		return false
+	}
+
+	email, err := Data.UserEmail(user)
+	if err != nil {
+		l.E.Printf("Failed loading email for user %v, error: %v\n", user, err)
+		return false
+	}
+	for _, op := range Operators {
+		if strings.EqualFold(op, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckOrigin is for the websocket upgrader. Requests without an Origin aren't from a browser, so there is nothing to
+// protect against.
+func CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowMethods checks the request method, writing a 405 if it isn't one of the given methods.
+func AllowMethods(l *SessionLogger, w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+
+	l.W.Printf("Method %v not allowed.\n", r.Method)
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	return false
+}
+
+// csrfSafe reports if a method can't change anything, so it doesn't need a token.
+func csrfSafe(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// CSRFToken returns the session's token, creating it if needed, and makes sure the client has it in a cookie. If the
+// token was created the session must be saved afterwards.
+func CSRFToken(w http.ResponseWriter, r *http.Request, session *sessions.Session) (string, bool, error) {
+	created := false
+	token, ok := session.Values["csrf"].(string)
+	if !ok || token == "" {
+		raw := make([]byte, 32)
+		_, err := rand.Read(raw)
+		if err != nil {
+			return "", false, err
+		}
+		token = hex.EncodeToString(raw)
+		session.Values["csrf"] = token
+		created = true
+	}
+
+	if c, err := r.Cookie(CSRFCookie); err != nil || c.Value != token {
+		http.SetCookie(w, &http.Cookie{
+			Name:     CSRFCookie,
+			Value:    token,
+			Path:     "/",
+			Secure:   os.Getenv("RSN2_ISDEV") == "",
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+	return token, created, nil
+}
+
+// csrfCheck checks the token for requests that may change something.
+func csrfCheck(l *SessionLogger, r *http.Request, token string) bool {
+	if csrfSafe(r.Method) {
+		return true
+	}
+
+	sent := r.Header.Get(CSRFHeader)
+	if sent == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+		l.W.Printf("Missing or invalid CSRF token.\n")
+		return false
+	}
+	return true
+}
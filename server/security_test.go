@@ -0,0 +1,176 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "testing"
+import "net/http"
+import "net/http/httptest"
+
+import "github.com/gorilla/sessions"
+
+// testSession makes a request with a session for the user, and returns what GetSession made of it.
+func testSession(method, token string, cookies []*http.Cookie) (string, int, *httptest.ResponseRecorder) {
+	r := httptest.NewRequest(method, "http://example.com/api/test", nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	if token != "" {
+		r.Header.Set(CSRFHeader, token)
+	}
+	w := httptest.NewRecorder()
+	user, status := GetSession(ml, w, r)
+	return user, status, w
+}
+
+// testCookies merges the cookies set by a response into the ones a client already had.
+func testCookies(old []*http.Cookie, w *httptest.ResponseRecorder) []*http.Cookie {
+	merged := map[string]*http.Cookie{}
+	for _, c := range old {
+		merged[c.Name] = c
+	}
+	for _, c := range w.Result().Cookies() {
+		merged[c.Name] = &http.Cookie{Name: c.Name, Value: c.Value}
+	}
+
+	cookies := []*http.Cookie{}
+	for _, c := range merged {
+		cookies = append(cookies, c)
+	}
+	return cookies
+}
+
+func TestGetSession(t *testing.T) {
+	store := SessionStore
+	SessionStore = sessions.NewCookieStore([]byte("0123456789abcdef0123456789abcdef"))
+	t.Cleanup(func() { SessionStore = store })
+
+	// Log in, the way /api/user/login does.
+	r := httptest.NewRequest("POST", "http://example.com/api/user/login", nil)
+	w := httptest.NewRecorder()
+	session, _ := SessionStore.Get(r, "rsn2-session")
+	session.Values["auth"] = true
+	session.Values["user"] = "u1"
+	err := session.Save(r, w)
+	if err != nil {
+		t.Fatalf("Saving session failed, error: %v", err)
+	}
+	cookies := testCookies(nil, w)
+
+	if _, status, _ := testSession("GET", "", nil); status != http.StatusForbidden {
+		t.Fatalf("Got %v without a session, expected 403", status)
+	}
+
+	// The first request hands out the token.
+	user, status, w := testSession("GET", "", cookies)
+	if user != "u1" || status != http.StatusOK {
+		t.Fatalf("Got user %q and %v for a GET, expected u1", user, status)
+	}
+	cookies = testCookies(cookies, w)
+	token := ""
+	for _, c := range cookies {
+		if c.Name == CSRFCookie {
+			token = c.Value
+		}
+	}
+	if len(token) != 64 {
+		t.Fatalf("Got CSRF token %q", token)
+	}
+
+	// The session only changes when the token is new, so later requests leave the cookies alone.
+	_, _, w = testSession("GET", "", cookies)
+	if set := w.Result().Cookies(); len(set) != 0 {
+		t.Fatalf("Got %v cookies from a session that already had a token", len(set))
+	}
+
+	for _, method := range []string{"POST", "DELETE", "PUT"} {
+		if _, status, _ := testSession(method, "", cookies); status != http.StatusForbidden {
+			t.Fatalf("Got %v for a %v without a token, expected 403", status, method)
+		}
+		if _, status, _ := testSession(method, token[1:]+"0", cookies); status != http.StatusForbidden {
+			t.Fatalf("Got %v for a %v with the wrong token, expected 403", status, method)
+		}
+		if user, status, _ := testSession(method, token, cookies); user != "u1" || status != http.StatusOK {
+			t.Fatalf("Got user %q and %v for a %v with the token, expected u1", user, status, method)
+		}
+	}
+
+	// The token is tied to the session, one from another session is no good.
+	r = httptest.NewRequest("POST", "http://example.com/api/user/login", nil)
+	w = httptest.NewRecorder()
+	session, _ = SessionStore.Get(r, "rsn2-session")
+	session.Values["auth"] = true
+	session.Values["user"] = "u1"
+	session.Values["csrf"] = "other"
+	session.Save(r, w)
+	other := testCookies(nil, w)
+	if _, status, _ := testSession("POST", token, other); status != http.StatusForbidden {
+		t.Fatalf("Got %v for a token from another session, expected 403", status)
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	allowed := AllowedOrigins
+	AllowedOrigins = []string{"https://allowed.example.com"}
+	t.Cleanup(func() { AllowedOrigins = allowed })
+
+	cases := map[string]bool{
+		"":                             true,
+		"https://rsn.example.com":      true,
+		"http://RSN.example.com":       true,
+		"https://allowed.example.com":  true,
+		"https://evil.example.com":     false,
+		"https://rsn.example.com.evil": false,
+		"null":                         false,
+	}
+	for origin, want := range cases {
+		r := httptest.NewRequest("GET", "https://rsn.example.com/api/ws", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if got := CheckOrigin(r); got != want {
+			t.Fatalf("Origin %q allowed: %v, expected %v", origin, got, want)
+		}
+	}
+
+	AllowedOrigins = []string{"*"}
+	r := httptest.NewRequest("GET", "https://rsn.example.com/api/ws", nil)
+	r.Header.Set("Origin", "https://evil.example.com")
+	if !CheckOrigin(r) {
+		t.Fatalf("Origin not allowed with a wildcard")
+	}
+}
+
+func TestAllowMethods(t *testing.T) {
+	w := httptest.NewRecorder()
+	if !AllowMethods(ml, w, httptest.NewRequest("DELETE", "/", nil), "POST", "DELETE") {
+		t.Fatalf("DELETE not allowed")
+	}
+
+	w = httptest.NewRecorder()
+	if AllowMethods(ml, w, httptest.NewRequest("GET", "/", nil), "POST", "DELETE") {
+		t.Fatalf("GET allowed")
+	}
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "POST, DELETE" {
+		t.Fatalf("Got %v with Allow %q, expected 405", w.Code, w.Header().Get("Allow"))
+	}
+}
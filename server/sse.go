@@ -0,0 +1,122 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "fmt"
+import "time"
+import "net/http"
+import "encoding/json"
+
+// Server-Sent Events carry the same events as the websocket, for clients behind proxies that won't pass a websocket
+// upgrade. Each event is sent with its Seq as the ID and its type as the event name, and the data is the same JSON the
+// websocket would send. Streams are one way, so there are no commands.
+
+// Proxies tend to drop connections that are quiet for a minute or so.
+const SSEHeartbeat = 25 * time.Second
+
+// How long browsers wait before reconnecting, in milliseconds.
+const SSERetry = 5000
+
+type sseConn struct {
+	w http.ResponseWriter
+	f http.Flusher
+}
+
+func (conn *sseConn) WriteEvent(e *Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	// Replies have no Seq, but they never go to a stream anyway.
+	if e.Seq != 0 {
+		_, err = fmt.Fprintf(conn.w, "id: %v\n", e.Seq)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(conn.w, "event: %v\ndata: %s\n\n", e.Type, data)
+	if err != nil {
+		return err
+	}
+	conn.f.Flush()
+	return nil
+}
+
+func (conn *sseConn) Ping() error {
+	_, err := fmt.Fprint(conn.w, ": heartbeat\n\n")
+	if err != nil {
+		return err
+	}
+	conn.f.Flush()
+	return nil
+}
+
+// Close does nothing, the response ends when Stream returns. A write that is stuck ends when the connection does.
+func (conn *sseConn) Close() error {
+	return nil
+}
+
+// Stream sends events to the user as a text/event-stream. since and folder work as they do for Upgrade.
+func (d *dispatcher) Stream(l *SessionLogger, w http.ResponseWriter, r *http.Request, user string, since int64, folder string) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		l.E.Printf("Response writer does not support flushing.\n")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var feeds []string
+	if folder != "" {
+		feeds = FolderFeeds(l, user, folder)
+		if feeds == nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Proxies must not cache or buffer the stream. X-Accel-Buffering is for nginx.
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// Get the headers out now, some proxies wait for the first bytes before passing anything on.
+	_, err := fmt.Fprintf(w, "retry: %v\n\n", SSERetry)
+	if err != nil {
+		l.W.Println("Closed stream when trying to send retry: ", err)
+		return
+	}
+	f.Flush()
+
+	cc := newClientConn(&sseConn{w: w, f: f}, SSEHeartbeat, folder, feeds)
+
+	c := d.add(l, cc, user, since)
+	go func() {
+		<-r.Context().Done()
+		cc.close()
+	}()
+	c.newBabysitter(l, cc, user, since)
+
+	d.drop(c, cc)
+}
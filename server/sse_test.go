@@ -0,0 +1,127 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "bufio"
+import "strings"
+import "testing"
+import "strconv"
+import "net/http"
+import "net/http/httptest"
+
+// testStream reads events from a text/event-stream, ignoring comments.
+type testStream struct {
+	resp *http.Response
+	r    *bufio.Reader
+}
+
+func testStreamOpen(t *testing.T, d *dispatcher, lastID string) *testStream {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		since, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+		d.Stream(ml, w, r, "u1", since, "")
+	}))
+	t.Cleanup(s.Close)
+
+	req, _ := http.NewRequest("GET", s.URL, nil)
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Opening stream failed, error: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if ctype := resp.Header.Get("Content-Type"); ctype != "text/event-stream" {
+		t.Fatalf("Got content type %v", ctype)
+	}
+	return &testStream{resp: resp, r: bufio.NewReader(resp.Body)}
+}
+
+// next returns the ID and data of the next event, which must be of the given type.
+func (s *testStream) next(t *testing.T, typ string) (string, string) {
+	t.Helper()
+	fields := map[string]string{}
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Reading stream failed, error: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			if fields["event"] != "" {
+				break
+			}
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		parts := strings.SplitN(line, ": ", 2)
+		if len(parts) == 2 {
+			fields[parts[0]] = parts[1]
+		}
+	}
+	if fields["event"] != typ {
+		t.Fatalf("Got %v event, expected %v", fields["event"], typ)
+	}
+	return fields["id"], fields["data"]
+}
+
+func TestStreamResume(t *testing.T) {
+	testDB(t, func(t *testing.T) {
+		testUser(t, "u1", "one@example.com")
+		d := &dispatcher{clients: map[string]*client{}}
+
+		s := testStreamOpen(t, d, "")
+		hello, _ := s.next(t, "hello")
+		seq, _ := strconv.ParseInt(hello, 10, 64)
+
+		d.Send(ml, "u1", "article.read", &ArticleIDsEvent{Articles: []string{"a1"}})
+		d.Send(ml, "u1", "article.read", &ArticleIDsEvent{Articles: []string{"a2"}})
+		first, _ := s.next(t, "article.read")
+		second, data := s.next(t, "article.read")
+		if first != strconv.FormatInt(seq+1, 10) || second != strconv.FormatInt(seq+2, 10) {
+			t.Fatalf("Got events %v and %v after hello %v", first, second, seq)
+		}
+		if !strings.Contains(data, `"Seq":`+second) || !strings.Contains(data, `"a2"`) {
+			t.Fatalf("Unexpected event data: %v", data)
+		}
+		s.resp.Body.Close()
+
+		// Browsers reconnect with the last ID they saw.
+		d.Send(ml, "u1", "article.starred", &ArticleIDsEvent{Articles: []string{"a3"}})
+		s = testStreamOpen(t, d, first)
+		if id, _ := s.next(t, "article.read"); id != second {
+			t.Fatalf("Got event %v on resume, expected %v", id, second)
+		}
+		if id, _ := s.next(t, "article.starred"); id != strconv.FormatInt(seq+3, 10) {
+			t.Fatalf("Got event %v on resume, expected %v", id, seq+3)
+		}
+		s.resp.Body.Close()
+
+		s = testStreamOpen(t, d, "1")
+		if id, _ := s.next(t, "hello"); id != strconv.FormatInt(seq+3, 10) {
+			t.Fatalf("Got hello %v for a stale ID, expected %v", id, seq+3)
+		}
+	})
+}
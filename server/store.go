@@ -0,0 +1,105 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "errors"
+
+// Store holds users, feeds, articles, the per-user flags on them, and subscriptions. Everything in data.go goes through
+// it, the rest of the features still use Queries directly.
+//
+// Methods return ErrNotFound when asked for a single thing that doesn't exist. Paged listings return up to one more
+// item than p.Limit, so the caller can tell if there is another page.
+//
+// Both implementations are sqlStore with different SQL, see store_sqlite.go and store_postgres.go. Any new
+// implementation should pass the tests in store_test.go, see testDB in db_test.go for adding it to them.
+type Store interface {
+	// Users
+	UserAdd(id, email, password string) error
+	UserLogin(email string) (id, password string, canlogin bool, err error)
+	UserEmailExists(email string) (bool, error)
+	UserEmail(user string) (string, error)
+	UserPassword(user string) (string, error)
+	UserSetPassword(user, password string) error
+	UserSetEmail(user, email string) error // Also marks the email unconfirmed.
+	UserConfirm(user string) error
+	UserDeleteUnconfirmed(user string) error
+
+	// API keys for the compatibility APIs.
+	ApiKeyAdd(key, user, kind string, created int64) error
+	ApiKeyUpdate(user, kind, key string) error
+	ApiKeyDelete(user, kind string) error
+	ApiKeyUser(key, kind string) (string, error)
+
+	// Feeds
+	FeedByURL(url string) (string, error) // Empty if there is no such feed.
+	FeedTitleByURL(url string) (string, error)
+	FeedURLs() ([][2]string, error) // URL and ID of every feed.
+	FeedSetInfo(feed, title, link, description, image, language string) error
+	FeedFetchError(feed string) (string, error)
+	FeedFetchOK(feed string, fetched int64) error
+	FeedFetchFailed(feed string, fetched int64, msg string) error
+	FeedList(user string) ([]*Feed, error)
+	FeedDetails(user, feed string) (*Feed, error)
+
+	// Subscriptions are changed in one transaction each, since a feed only exists while someone is subscribed to it.
+	//
+	// Subscribe subscribes the user to the feed with the URL, adding it as newFeed if there is no such feed. It returns
+	// the feed's ID, if it was added, and if the user was already subscribed (nothing is changed then).
+	Subscribe(user, url, newFeed, name string) (feed string, added, subscribed bool, err error)
+	// Unsubscribe drops the subscription and everything kept for it, then the feed if nobody else is subscribed.
+	Unsubscribe(user, feed string) error
+	Subscribed(user, feed string) (bool, error)
+	Subscribers(feed string) ([]string, error)
+	HasSubscribers(feed string) (bool, error)
+	SetFolder(user, feed, folder string) error // An empty folder clears it.
+	FolderFeeds(user, folder string) ([]string, error)
+
+	// Articles
+	ArticleAdd(id, feed, title, url string, published int64) error
+	ArticleByURL(url string) (string, error) // Empty if there is no such article.
+	ArticlePrunedSeen(url string, seen int64) (bool, error)
+	PrunedTrim(feed string, before int64) error
+	FeedArticles(user, feed string, p *PageParams) ([]*Article, error)
+	Unread(user, folder string, p *PageParams) ([]*UnreadArticle, error)
+	UnreadArticle(user, article string) (*UnreadArticle, error) // ErrNotFound if it isn't unread and visible.
+	UnreadFeedArticles(user, feed string, limit int) ([]*UnreadArticle, error)
+
+	// Flags
+	Pause(user, feed string) error
+	Unpause(user, feed string) error
+	Star(user, article string) error
+	Unstar(user, article string) error
+	ReadMark(user, feed string) (int64, error)
+
+	// Read state is kept as a watermark per feed with exceptions on either side of it. Each of these changes it in one
+	// transaction that holds the watermark, so it only ever moves forward and nothing is lost to a concurrent change.
+	// The watermark is moved as far forward as it can go, dropping the exceptions it passes.
+	MarkRead(user, article string) error // ErrNotFound if there is no such article.
+	MarkUnread(user, article string) error
+	FeedMarkRead(user, feed string, before int64) error
+}
+
+var ErrNotFound = errors.New("not found")
+
+// Data is the store for the database in RSN2_DATABASE.
+var Data Store
@@ -0,0 +1,1039 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import _ "github.com/lib/pq"
+
+// PostgreSQL is used when RSN2_DATABASE is a postgres:// URL. The schema and queries here are the SQLite ones from
+// db.go and store_sqlite.go translated: booleans are real booleans, integers are 64 bit, and User has to be quoted
+// everywhere since it is a keyword.
+
+// The same tables and indexes as schema version 3 on SQLite, see InitCode for what they are for.
+var postgresInitCode = `
+create table if not exists Users (
+	ID text primary key,
+	Email text unique not null,
+	Password text not null,
+	CanLogin boolean
+);
+
+create table if not exists Feeds (
+	ID text primary key,
+
+	URL text unique not null
+);
+
+create table if not exists Articles (
+	Seq bigserial primary key,
+	ID text unique not null,
+	Feed text not null references Feeds(ID) on delete cascade,
+
+	Title text,
+	URL text unique not null,
+
+	Published bigint
+);
+create index if not exists ArticleFeeds on Articles(Feed);
+create index if not exists ArticleDates on Articles(Feed, Published, ID);
+
+create table if not exists ReadMarks (
+	"User" text not null references Users(ID) on delete cascade,
+	Feed text not null references Feeds(ID) on delete cascade,
+	Seq bigint not null,
+
+	primary key ("User", Feed)
+);
+
+create table if not exists ReadExceptions (
+	"User" text not null references Users(ID) on delete cascade,
+	Article text not null references Articles(ID) on delete cascade,
+	Read boolean not null,
+
+	primary key ("User", Article)
+);
+
+create table if not exists StarFlags (
+	"User" text not null references Users(ID) on delete cascade,
+	Article text not null references Articles(ID) on delete cascade,
+
+	primary key ("User", Article)
+);
+
+create table if not exists PausedFlags (
+	"User" text not null references Users(ID) on delete cascade,
+	Feed text not null references Feeds(ID) on delete cascade
+);
+
+create table if not exists Subscribed (
+	"User" text not null references Users(ID) on delete cascade,
+	Feed text not null references Feeds(ID) on delete cascade,
+	Name text
+);
+
+create table if not exists FeedInfo (
+	Feed text primary key references Feeds(ID) on delete cascade,
+	Title text not null,
+	Link text not null,
+	Description text not null,
+	Image text not null,
+	Language text not null
+);
+
+create table if not exists FeedIcons (
+	Feed text primary key references Feeds(ID) on delete cascade,
+	Type text not null,
+	Data bytea,
+	Fetched bigint not null
+);
+
+create table if not exists ApiKeys (
+	Key text primary key,
+	"User" text not null references Users(ID) on delete cascade,
+	Kind text not null,
+	Created bigint not null
+);
+
+create table if not exists FeedFolders (
+	"User" text not null references Users(ID) on delete cascade,
+	Feed text not null references Feeds(ID) on delete cascade,
+	Folder text not null,
+
+	primary key ("User", Feed)
+);
+
+create table if not exists FeedRetention (
+	Feed text primary key references Feeds(ID) on delete cascade,
+	MaxAge bigint,
+	MaxCount bigint,
+	KeepUnread boolean,
+	KeepStarred boolean
+);
+
+create table if not exists Pruned (
+	URL text primary key,
+	Feed text not null references Feeds(ID) on delete cascade,
+	Seen bigint not null
+);
+
+create table if not exists Webhooks (
+	ID text primary key,
+	"User" text not null references Users(ID) on delete cascade,
+	Feed text not null,
+	URL text not null,
+	Secret text not null,
+	Created bigint not null
+);
+create index if not exists WebhookFeeds on Webhooks(Feed);
+
+create table if not exists WebhookDeliveries (
+	ID bigserial primary key,
+	Hook text not null references Webhooks(ID) on delete cascade,
+	Event text not null,
+	Article text not null,
+	Attempts bigint not null,
+	Status bigint not null,
+	Error text not null,
+	Time bigint not null
+);
+create index if not exists WebhookDeliveryHooks on WebhookDeliveries(Hook, ID);
+
+create table if not exists ArticleContent (
+	Article text primary key references Articles(ID) on delete cascade,
+	Author text not null,
+	Categories text not null,
+	Content text not null
+);
+
+create table if not exists FilterRules (
+	ID text primary key,
+	"User" text not null references Users(ID) on delete cascade,
+	Name text not null,
+	Feed text not null,
+	MatchAny boolean not null,
+	Conditions text not null,
+	Actions text not null,
+	Disabled boolean not null,
+	Created bigint not null
+);
+
+create table if not exists HiddenFlags (
+	"User" text not null references Users(ID) on delete cascade,
+	Article text not null references Articles(ID) on delete cascade,
+
+	primary key ("User", Article)
+);
+
+create table if not exists ArticleTags (
+	"User" text not null references Users(ID) on delete cascade,
+	Article text not null references Articles(ID) on delete cascade,
+	Tag text not null,
+
+	primary key ("User", Article, Tag)
+);
+create index if not exists ArticleTagNames on ArticleTags("User", Tag);
+
+create table if not exists Notifications (
+	ID bigserial primary key,
+	"User" text not null references Users(ID) on delete cascade,
+	Article text not null references Articles(ID) on delete cascade,
+	Rule text not null,
+	Time bigint not null
+);
+
+create table if not exists OutputFeeds (
+	ID text primary key,
+	Token text unique not null,
+	"User" text not null references Users(ID) on delete cascade,
+	Kind text not null,
+	Value text not null,
+	Title text not null,
+	Created bigint not null
+);
+
+create table if not exists FeedStatus (
+	Feed text primary key references Feeds(ID) on delete cascade,
+	Fetched bigint not null,
+	Succeeded bigint not null,
+	Error text not null,
+	Failures bigint not null
+);
+
+create table if not exists WebSub (
+	Feed text primary key references Feeds(ID) on delete cascade,
+	Hub text not null,
+	Topic text not null,
+	Token text unique not null,
+	Secret text not null,
+	State text not null,
+	Expires bigint not null,
+	Requested bigint not null
+);
+`
+
+// Versions mean the same schema as in Migrations. Everything up to version 3 was folded into the first one, since
+// there were never any PostgreSQL databases that old.
+var PostgresMigrations = []*Migration{
+	{Version: 1, Name: "Initial schema", Code: postgresInitCode},
+	{Version: 2, Name: "Explicit article Seq"},
+	{Version: 3, Name: "Read marks"},
+	{Version: 4, Name: "Unique subscriptions and pauses", Code: postgresUniqueSubscribedCode},
+}
+
+var postgresUniqueSubscribedCode = `
+delete from Subscribed a using Subscribed b where a."User" = b."User" and a.Feed = b.Feed and a.ctid > b.ctid;
+create unique index if not exists Subscriptions on Subscribed ("User", Feed);
+
+delete from PausedFlags a using PausedFlags b where a."User" = b."User" and a.Feed = b.Feed and a.ctid > b.ctid;
+create unique index if not exists PausedFeeds on PausedFlags ("User", Feed);
+`
+
+var postgresStoreQueries = map[string]string{
+	// Background updater
+	"GetAllFeeds": `
+		select URL, ID from Feeds;
+	`,
+	"ArticleExistsByURL": `
+		select coalesce((select ID from Articles where URL = $1), '');
+	`,
+	"ArticleAdd": `
+		insert into Articles (ID, Feed, Title, URL, Published) values ($1, $2, $3, $4, $5);
+	`,
+	"FeedListSubs": `
+		select "User" from Subscribed where Feed = $1;
+	`,
+	"FeedInfoSet": `
+		insert into FeedInfo (Feed, Title, Link, Description, Image, Language) values ($1, $2, $3, $4, $5, $6)
+		on conflict (Feed) do update set
+			Title = excluded.Title,
+			Link = excluded.Link,
+			Description = excluded.Description,
+			Image = excluded.Image,
+			Language = excluded.Language;
+	`,
+	"ArticlePrunedSeen": `
+		update Pruned set Seen = $2 where URL = $1;
+	`,
+	"PrunedTrim": `
+		delete from Pruned where Feed = $1 and Seen < $2;
+	`,
+
+	// /api/user/confirm-email
+	"ConfirmEmail": `
+		update Users set CanLogin = true where ID = $1;
+	`,
+	"GetEmail": `
+		select Email from Users where ID = $1;
+	`,
+	// /api/user/delete-email
+	"DeleteEmail": `
+		delete from Users where ID = $1 and not CanLogin;
+	`,
+	// /api/user/login (one row)
+	"UserLogin": `
+		select ID, Password, CanLogin from Users where Email = $1;
+	`,
+	// /api/user/new
+	"UserNew": `
+		insert into Users (ID, Email, Password, CanLogin) values ($1, $2, $3, false);
+	`,
+	"UserEmailExists": `
+		select exists(select 1 from Users where Email = $1);
+	`,
+	// /api/user/new-pass
+	"UserNewPass": `
+		update Users set Password = $2 where ID = $1;
+	`,
+	"UserGetPass": `
+		select Password from Users where ID = $1;
+	`,
+	// /api/user/new-name
+	"UserNewName": `
+		update Users set Email = $2, CanLogin = false where ID = $1;
+	`,
+
+	// /api/user/fever
+	"ApiKeyAdd": `
+		insert into ApiKeys (Key, "User", Kind, Created) values ($1, $2, $3, $4);
+	`,
+	"ApiKeyDelete": `
+		delete from ApiKeys where "User" = $1 and Kind = $2;
+	`,
+	"ApiKeyUpdate": `
+		update ApiKeys set Key = $3 where "User" = $1 and Kind = $2;
+	`,
+	"ApiKeyUser": `
+		select "User" from ApiKeys where Key = $1 and Kind = $2;
+	`,
+
+	// /api/feed/list
+	"FeedList": `
+		select ID, (
+				select Name from Subscribed where Feed = Feeds.ID and "User" = $1
+			), URL, (
+			ID in (select Feed from PausedFlags where "User" = $1)
+		), coalesce((
+			select Folder from FeedFolders where Feed = Feeds.ID and "User" = $1
+		), ''), coalesce(i.Title, ''), coalesce(i.Link, ''), coalesce(i.Description, ''), coalesce(i.Image, ''), (
+			coalesce(i.Language, '')
+		), coalesce(st.Fetched, 0), coalesce(st.Error, '') from Feeds
+		left join FeedInfo i on i.Feed = Feeds.ID
+		left join FeedStatus st on st.Feed = Feeds.ID
+		where (
+			ID in (select Feed from Subscribed where "User" = $1)
+		);
+	`,
+	// /api/feed/details (one row)
+	"FeedDetails": `
+		select ID, (
+			select Name from Subscribed where Feed = $2 and "User" = $1
+		), URL, (
+			ID in (select Feed from PausedFlags where "User" = $1)
+		), coalesce((
+			select Folder from FeedFolders where Feed = $2 and "User" = $1
+		), ''), coalesce(i.Title, ''), coalesce(i.Link, ''), coalesce(i.Description, ''), coalesce(i.Image, ''), (
+			coalesce(i.Language, '')
+		), coalesce(st.Fetched, 0), coalesce(st.Error, '') from Feeds
+		left join FeedInfo i on i.Feed = Feeds.ID
+		left join FeedStatus st on st.Feed = Feeds.ID
+		where (
+			ID = $2 and
+			ID in (select Feed from Subscribed where "User" = $1)
+		);
+	`,
+	// /api/feed/articles
+	"FeedArticlesOldest": `
+		select a.ID, a.Title, a.URL, a.Published, coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0)), (
+			exists (select 1 from StarFlags where "User" = $1 and Article = a.ID)
+		) from Articles a
+		left join ReadMarks m on m."User" = $1 and m.Feed = a.Feed
+		left join ReadExceptions x on x."User" = $1 and x.Article = a.ID
+		where (
+			a.Feed = $2 and
+			a.Feed in (select Feed from Subscribed where "User" = $1) and
+			not exists (select 1 from HiddenFlags where "User" = $1 and Article = a.ID) and
+			(a.Published, a.ID) > ($3, $4)
+		) order by a.Published, a.ID limit $5;
+	`,
+	"FeedArticlesNewest": `
+		select a.ID, a.Title, a.URL, a.Published, coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0)), (
+			exists (select 1 from StarFlags where "User" = $1 and Article = a.ID)
+		) from Articles a
+		left join ReadMarks m on m."User" = $1 and m.Feed = a.Feed
+		left join ReadExceptions x on x."User" = $1 and x.Article = a.ID
+		where (
+			a.Feed = $2 and
+			a.Feed in (select Feed from Subscribed where "User" = $1) and
+			not exists (select 1 from HiddenFlags where "User" = $1 and Article = a.ID) and
+			(a.Published, a.ID) < ($3, $4)
+		) order by a.Published desc, a.ID desc limit $5;
+	`,
+	// /api/feed/subscribe
+	"FeedExistsByURL": `
+		select coalesce((select ID from Feeds where URL = $1), '');
+	`,
+	"FeedAdd": `
+		insert into Feeds (ID, URL) values ($1, $2) on conflict do nothing;
+	`,
+	"FeedTitleByURL": `
+		select coalesce((select i.Title from FeedInfo i join Feeds f on f.ID = i.Feed where f.URL = $1), '');
+	`,
+	"FeedAlreadySubscibed": `
+		select exists(select 1 from Subscribed where "User" = $1 and Feed = $2);
+	`,
+	"FeedSubscibe": `
+		insert into Subscribed ("User", Feed, Name) values ($1, $2, $3) on conflict do nothing;
+	`,
+	// /api/feed/unsubscribe
+	// Subscribing checks the foreign key, which waits for this lock.
+	"FeedLock": `
+		select 1 from Feeds where ID = $1 for update;
+	`,
+	"FeedUnsub1": `
+		delete from Subscribed where "User" = $1 and Feed = $2;
+	`,
+	"FeedUnsub2": `
+		delete from PausedFlags where "User" = $1 and Feed = $2;
+	`,
+	"FeedUnsub3": `
+		delete from ReadMarks where "User" = $1 and Feed = $2;
+	`,
+	"FeedUnsub4": `
+		delete from ReadExceptions where "User" = $1 and Article in (select ID from Articles where Feed = $2);
+	`,
+	"FeedUnsub5": `
+		delete from StarFlags where "User" = $1 and Article in (select ID from Articles where Feed = $2);
+	`,
+	"FeedUnsub6": `
+		delete from FeedFolders where "User" = $1 and Feed = $2;
+	`,
+	"FeedUnsub7": `
+		delete from WebhookDeliveries where Hook in (select ID from Webhooks where "User" = $1 and Feed = $2);
+	`,
+	"FeedUnsub8": `
+		delete from Webhooks where "User" = $1 and Feed = $2;
+	`,
+	"FeedUnsub9": `
+		delete from HiddenFlags where "User" = $1 and Article in (select ID from Articles where Feed = $2);
+	`,
+	"FeedUnsub10": `
+		delete from ArticleTags where "User" = $1 and Article in (select ID from Articles where Feed = $2);
+	`,
+	"FeedUnsub11": `
+		delete from Notifications where "User" = $1 and Article in (select ID from Articles where Feed = $2);
+	`,
+	"FeedUnsub12": `
+		delete from FilterRules where "User" = $1 and Feed = $2;
+	`,
+	"FeedHasSubs": `
+		select exists(select 1 from Subscribed where Feed = $1 limit 1);
+	`,
+	"FeedDeleteUnused": `
+		delete from Feeds where ID = $1 and not exists (select 1 from Subscribed where Feed = $1);
+	`,
+	// /api/feed/pause
+	"FeedPause": `
+		insert into PausedFlags ("User", Feed) values ($1, $2) on conflict do nothing;
+	`,
+	// //api/feed/unpause
+	"FeedUnpause": `
+		delete from PausedFlags where "User" = $1 and Feed = $2;
+	`,
+
+	// /api/feed/folder
+	"FeedSetFolder": `
+		insert into FeedFolders ("User", Feed, Folder) values ($1, $2, $3)
+		on conflict ("User", Feed) do update set Folder = excluded.Folder;
+	`,
+	"FeedClearFolder": `
+		delete from FeedFolders where "User" = $1 and Feed = $2;
+	`,
+
+	// /api/feed/mark-read
+	"ReadMarkGet": `
+		select coalesce((select Seq from ReadMarks where "User" = $1 and Feed = $2), 0);
+	`,
+	"FeedMarkReadAbove": `
+		insert into ReadExceptions ("User", Article, Read)
+		select $1::text, ID, true from Articles where Feed = $2 and Seq > $3 and Published < $4
+		on conflict ("User", Article) do update set Read = true;
+	`,
+	"FeedMarkReadBelow": `
+		delete from ReadExceptions where (
+			"User" = $1 and
+			not Read and
+			Article in (select ID from Articles where Feed = $2 and Seq <= $3 and Published < $4)
+		);
+	`,
+
+	// Writes the user's watermark for a feed without changing it, which holds it until the transaction ends.
+	"ReadMarkLock": `
+		insert into ReadMarks ("User", Feed, Seq) values ($1, $2, 0)
+		on conflict ("User", Feed) do update set Seq = ReadMarks.Seq;
+	`,
+	// Same, for the feed an article is in.
+	"ArticleReadMarkLock": `
+		insert into ReadMarks ("User", Feed, Seq) select $1, Feed, 0 from Articles where ID = $2
+		on conflict ("User", Feed) do update set Seq = ReadMarks.Seq;
+	`,
+
+	// /api/article/read (one row)
+	"ArticleReadState": `
+		select a.Feed, a.Seq, coalesce(m.Seq, 0) from Articles a
+		left join ReadMarks m on m."User" = $1 and m.Feed = a.Feed
+		where a.ID = $2;
+	`,
+	"ReadExceptionSet": `
+		insert into ReadExceptions ("User", Article, Read) values ($1, $2, $3)
+		on conflict ("User", Article) do update set Read = excluded.Read;
+	`,
+	"ReadExceptionClear": `
+		delete from ReadExceptions where "User" = $1 and Article = $2;
+	`,
+	// Finds the highest point the watermark can move to, which is just below the first unread article after it.
+	"ReadMarkNext": `
+		select greatest($3, coalesce(max(a.Seq), 0)) from Articles a where (
+			a.Feed = $2 and
+			a.Seq < coalesce((
+				select min(b.Seq) from Articles b where (
+					b.Feed = $2 and
+					b.Seq > $3 and
+					not exists (select 1 from ReadExceptions x where x."User" = $1 and x.Article = b.ID and x.Read)
+				)
+			), 9223372036854775807)
+		);
+	`,
+	"ReadMarkSet": `
+		insert into ReadMarks ("User", Feed, Seq) values ($1, $2, $3)
+		on conflict ("User", Feed) do update set Seq = greatest(ReadMarks.Seq, excluded.Seq);
+	`,
+	"ReadMarkTrim": `
+		delete from ReadExceptions where (
+			"User" = $1 and
+			Read and
+			Article in (select ID from Articles where Feed = $2 and Seq <= $3)
+		);
+	`,
+	// /api/article/star
+	"ArticleStar": `
+		insert into StarFlags ("User", Article) values ($1, $2) on conflict do nothing;
+	`,
+	// /api/article/unstar
+	"ArticleUnstar": `
+		delete from StarFlags where "User" = $1 and Article = $2;
+	`,
+	// /api/article/feed
+	// Split in two so that each half can walk an index instead of every article the user has ever seen.
+	"GetUnreadOldest": `
+		select a.ID, a.Feed, a.Title, a.URL, s.Name, a.Published from Subscribed s
+		join Articles a on a.Feed = s.Feed and a.Seq > coalesce((
+			select Seq from ReadMarks where "User" = $1 and Feed = s.Feed
+		), 0)
+		where (
+			s."User" = $1 and
+			not s.Feed in (select Feed from PausedFlags where "User" = $1) and
+			($5::text = '' or s.Feed in (select Feed from FeedFolders where "User" = $1 and Folder = $5)) and
+			not exists (select 1 from ReadExceptions x where x."User" = $1 and x.Article = a.ID and x.Read) and
+			(a.Published, a.ID) > ($2, $3)
+		)
+		union all
+		select a.ID, a.Feed, a.Title, a.URL, s.Name, a.Published from ReadExceptions x
+		join Articles a on a.ID = x.Article
+		join Subscribed s on s.Feed = a.Feed and s."User" = $1
+		where (
+			x."User" = $1 and
+			not x.Read and
+			not s.Feed in (select Feed from PausedFlags where "User" = $1) and
+			($5::text = '' or s.Feed in (select Feed from FeedFolders where "User" = $1 and Folder = $5)) and
+			(a.Published, a.ID) > ($2, $3)
+		) order by 6, 1 limit $4;
+	`,
+	"GetUnreadNewest": `
+		select a.ID, a.Feed, a.Title, a.URL, s.Name, a.Published from Subscribed s
+		join Articles a on a.Feed = s.Feed and a.Seq > coalesce((
+			select Seq from ReadMarks where "User" = $1 and Feed = s.Feed
+		), 0)
+		where (
+			s."User" = $1 and
+			not s.Feed in (select Feed from PausedFlags where "User" = $1) and
+			($5::text = '' or s.Feed in (select Feed from FeedFolders where "User" = $1 and Folder = $5)) and
+			not exists (select 1 from ReadExceptions x where x."User" = $1 and x.Article = a.ID and x.Read) and
+			(a.Published, a.ID) < ($2, $3)
+		)
+		union all
+		select a.ID, a.Feed, a.Title, a.URL, s.Name, a.Published from ReadExceptions x
+		join Articles a on a.ID = x.Article
+		join Subscribed s on s.Feed = a.Feed and s."User" = $1
+		where (
+			x."User" = $1 and
+			not x.Read and
+			not s.Feed in (select Feed from PausedFlags where "User" = $1) and
+			($5::text = '' or s.Feed in (select Feed from FeedFolders where "User" = $1 and Folder = $5)) and
+			(a.Published, a.ID) < ($2, $3)
+		) order by 6 desc, 1 desc limit $4;
+	`,
+	// Websocket events, the same columns as above for articles that are unread and visible.
+	"UnreadArticle": `
+		select a.ID, a.Feed, a.Title, a.URL, s.Name, a.Published from Articles a
+		join Subscribed s on s.Feed = a.Feed and s."User" = $1
+		left join ReadMarks m on m."User" = $1 and m.Feed = a.Feed
+		left join ReadExceptions x on x."User" = $1 and x.Article = a.ID
+		where (
+			a.ID = $2 and
+			not a.Feed in (select Feed from PausedFlags where "User" = $1) and
+			not coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0))
+		);
+	`,
+	"UnreadFeedArticles": `
+		select a.ID, a.Feed, a.Title, a.URL, s.Name, a.Published from Articles a
+		join Subscribed s on s.Feed = a.Feed and s."User" = $1
+		left join ReadMarks m on m."User" = $1 and m.Feed = a.Feed
+		left join ReadExceptions x on x."User" = $1 and x.Article = a.ID
+		where (
+			a.Feed = $2 and
+			not a.Feed in (select Feed from PausedFlags where "User" = $1) and
+			not coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0))
+		) order by a.Published, a.ID limit $3;
+	`,
+	"FolderFeeds": `
+		select Feed from FeedFolders where "User" = $1 and Folder = $2;
+	`,
+
+	// Background fetch
+	"FeedFetchError": `
+		select coalesce((select Error from FeedStatus where Feed = $1), '');
+	`,
+	"FeedFetchOK": `
+		insert into FeedStatus (Feed, Fetched, Succeeded, Error, Failures) values ($1, $2, $2, '', 0)
+		on conflict (Feed) do update set Fetched = $2, Succeeded = $2, Error = '', Failures = 0;
+	`,
+	"FeedFetchFailed": `
+		insert into FeedStatus (Feed, Fetched, Succeeded, Error, Failures) values ($1, $2, 0, $3, 1)
+		on conflict (Feed) do update set Fetched = $2, Error = $3, Failures = FeedStatus.Failures + 1;
+	`,
+}
+
+// Everything in Queries, by the same names.
+var postgresQueries = map[string]string{
+	// Retention
+	"FeedRetentionGet": `
+		select MaxAge, MaxCount, KeepUnread, KeepStarred from FeedRetention where Feed = $1;
+	`,
+	"FeedRetentionSet": `
+		insert into FeedRetention (Feed, MaxAge, MaxCount, KeepUnread, KeepStarred) values ($1, $2, $3, $4, $5)
+		on conflict (Feed) do update set
+			MaxAge = excluded.MaxAge,
+			MaxCount = excluded.MaxCount,
+			KeepUnread = excluded.KeepUnread,
+			KeepStarred = excluded.KeepStarred;
+	`,
+	"PruneCandidates": `
+		select a.ID from Articles a where (
+			a.Feed = $1 and
+			(
+				a.Published < $2 or
+				a.ID not in (select ID from Articles where Feed = $1 order by Published desc, ID desc limit $3)
+			) and
+			not ($4 and exists (
+				select 1 from Subscribed s
+				left join ReadMarks m on m."User" = s."User" and m.Feed = s.Feed
+				left join ReadExceptions x on x."User" = s."User" and x.Article = a.ID
+				where s.Feed = a.Feed and not coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0))
+			)) and
+			not ($5 and exists (select 1 from StarFlags where Article = a.ID))
+		) limit $6;
+	`,
+	"PruneTombstone": `
+		insert into Pruned (URL, Feed, Seen) select URL, Feed, $2::bigint from Articles where ID = $1
+		on conflict (URL) do update set Feed = excluded.Feed, Seen = excluded.Seen;
+	`,
+	"PruneReadExceptions": `
+		delete from ReadExceptions where Article = $1;
+	`,
+	"PruneStarFlags": `
+		delete from StarFlags where Article = $1;
+	`,
+	"PruneArticleContent": `
+		delete from ArticleContent where Article = $1;
+	`,
+	"PruneHiddenFlags": `
+		delete from HiddenFlags where Article = $1;
+	`,
+	"PruneArticleTags": `
+		delete from ArticleTags where Article = $1;
+	`,
+	"PruneNotifications": `
+		delete from Notifications where Article = $1;
+	`,
+	"PruneArticle": `
+		delete from Articles where ID = $1;
+	`,
+
+	// /api/feed/pause
+	"FeedExists": `
+		select exists(select 1 from Feeds where ID = $1 limit 1);
+	`,
+
+	// /api/feed/icon
+	"FeedIconGet": `
+		select Type, Data, Fetched from FeedIcons where Feed = $1;
+	`,
+	"FeedIconSet": `
+		insert into FeedIcons (Feed, Type, Data, Fetched) values ($1, $2, $3, $4)
+		on conflict (Feed) do update set Type = excluded.Type, Data = excluded.Data, Fetched = excluded.Fetched;
+	`,
+	"FeedLinks": `
+		select f.URL, coalesce(i.Link, '') from Feeds f left join FeedInfo i on i.Feed = f.ID where f.ID = $1;
+	`,
+
+	// Fever API
+	"FeverFeeds": `
+		select f.ID, s.Name, f.URL, coalesce(i.Link, ''), coalesce((
+			select Folder from FeedFolders where "User" = $1 and Feed = f.ID
+		), ''), coalesce((
+			select max(Published) from Articles where Feed = f.ID
+		), 0) from Subscribed s
+		join Feeds f on f.ID = s.Feed
+		left join FeedInfo i on i.Feed = f.ID
+		where s."User" = $1;
+	`,
+	"FeverIcons": `
+		select i.Feed, i.Type, i.Data from FeedIcons i
+		join Subscribed s on s.Feed = i.Feed and s."User" = $1
+		where length(i.Data) > 0;
+	`,
+	"FeverItemsSince": `
+		select a.Seq, a.Feed, a.Title, a.URL, a.Published, coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0)), (
+			exists (select 1 from StarFlags where "User" = $1 and Article = a.ID)
+		) from Articles a
+		join Subscribed s on s.Feed = a.Feed and s."User" = $1
+		left join ReadMarks m on m."User" = $1 and m.Feed = a.Feed
+		left join ReadExceptions x on x."User" = $1 and x.Article = a.ID
+		where a.Seq > $2 order by a.Seq limit $3;
+	`,
+	"FeverItemsMax": `
+		select a.Seq, a.Feed, a.Title, a.URL, a.Published, coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0)), (
+			exists (select 1 from StarFlags where "User" = $1 and Article = a.ID)
+		) from Articles a
+		join Subscribed s on s.Feed = a.Feed and s."User" = $1
+		left join ReadMarks m on m."User" = $1 and m.Feed = a.Feed
+		left join ReadExceptions x on x."User" = $1 and x.Article = a.ID
+		where a.Seq < $2 order by a.Seq desc limit $3;
+	`,
+	"FeverItem": `
+		select a.Seq, a.Feed, a.Title, a.URL, a.Published, coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0)), (
+			exists (select 1 from StarFlags where "User" = $1 and Article = a.ID)
+		) from Articles a
+		join Subscribed s on s.Feed = a.Feed and s."User" = $1
+		left join ReadMarks m on m."User" = $1 and m.Feed = a.Feed
+		left join ReadExceptions x on x."User" = $1 and x.Article = a.ID
+		where a.Seq = $2;
+	`,
+	"FeverItemCount": `
+		select count(*) from Articles where Feed in (select Feed from Subscribed where "User" = $1);
+	`,
+	"FeverUnreadIDs": `
+		select a.Seq from Subscribed s
+		join Articles a on a.Feed = s.Feed and a.Seq > coalesce((
+			select Seq from ReadMarks where "User" = $1 and Feed = s.Feed
+		), 0)
+		where (
+			s."User" = $1 and
+			not s.Feed in (select Feed from PausedFlags where "User" = $1) and
+			not exists (select 1 from ReadExceptions x where x."User" = $1 and x.Article = a.ID and x.Read)
+		)
+		union all
+		select a.Seq from ReadExceptions x
+		join Articles a on a.ID = x.Article
+		join Subscribed s on s.Feed = a.Feed and s."User" = $1
+		where (
+			x."User" = $1 and
+			not x.Read and
+			not s.Feed in (select Feed from PausedFlags where "User" = $1)
+		) order by 1;
+	`,
+	"FeverSavedIDs": `
+		select a.Seq from StarFlags x
+		join Articles a on a.ID = x.Article
+		join Subscribed s on s.Feed = a.Feed and s."User" = $1
+		where x."User" = $1 order by 1;
+	`,
+	"ArticleBySeq": `
+		select a.ID from Articles a
+		join Subscribed s on s.Feed = a.Feed and s."User" = $1
+		where a.Seq = $2;
+	`,
+	// Google Reader API
+	"ApiKeyGet": `
+		select Key from ApiKeys where "User" = $1 and Kind = $2;
+	`,
+	"GReaderItemsOldest": `
+		select a.Seq, a.ID, a.Feed, a.Title, a.URL, a.Published, coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0)), (
+			exists (select 1 from StarFlags where "User" = $1 and Article = a.ID)
+		), s.Name, coalesce(i.Link, ''), coalesce(d.Folder, '') from Articles a
+		join Subscribed s on s.Feed = a.Feed and s."User" = $1
+		left join ReadMarks m on m."User" = $1 and m.Feed = a.Feed
+		left join ReadExceptions x on x."User" = $1 and x.Article = a.ID
+		left join FeedInfo i on i.Feed = a.Feed
+		left join FeedFolders d on d."User" = $1 and d.Feed = a.Feed
+		where (
+			($2 = '' or a.Feed = $2) and
+			($3 = '' or d.Folder = $3) and
+			(not $4 or exists (select 1 from StarFlags where "User" = $1 and Article = a.ID)) and
+			($5::boolean is null or coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0)) = $5) and
+			a.Published >= $6 and a.Published < $7 and
+			(a.Published, a.ID) > ($8, $9)
+		) order by a.Published, a.ID limit $10;
+	`,
+	"GReaderItemsNewest": `
+		select a.Seq, a.ID, a.Feed, a.Title, a.URL, a.Published, coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0)), (
+			exists (select 1 from StarFlags where "User" = $1 and Article = a.ID)
+		), s.Name, coalesce(i.Link, ''), coalesce(d.Folder, '') from Articles a
+		join Subscribed s on s.Feed = a.Feed and s."User" = $1
+		left join ReadMarks m on m."User" = $1 and m.Feed = a.Feed
+		left join ReadExceptions x on x."User" = $1 and x.Article = a.ID
+		left join FeedInfo i on i.Feed = a.Feed
+		left join FeedFolders d on d."User" = $1 and d.Feed = a.Feed
+		where (
+			($2 = '' or a.Feed = $2) and
+			($3 = '' or d.Folder = $3) and
+			(not $4 or exists (select 1 from StarFlags where "User" = $1 and Article = a.ID)) and
+			($5::boolean is null or coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0)) = $5) and
+			a.Published >= $6 and a.Published < $7 and
+			(a.Published, a.ID) < ($8, $9)
+		) order by a.Published desc, a.ID desc limit $10;
+	`,
+	"GReaderItem": `
+		select a.Seq, a.ID, a.Feed, a.Title, a.URL, a.Published, coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0)), (
+			exists (select 1 from StarFlags where "User" = $1 and Article = a.ID)
+		), s.Name, coalesce(i.Link, ''), coalesce(d.Folder, '') from Articles a
+		join Subscribed s on s.Feed = a.Feed and s."User" = $1
+		left join ReadMarks m on m."User" = $1 and m.Feed = a.Feed
+		left join ReadExceptions x on x."User" = $1 and x.Article = a.ID
+		left join FeedInfo i on i.Feed = a.Feed
+		left join FeedFolders d on d."User" = $1 and d.Feed = a.Feed
+		where a.Seq = $2;
+	`,
+	"GReaderUnreadCounts": `
+		select s.Feed, count(a.Seq), coalesce(max(a.Published), 0) from Subscribed s
+		join Articles a on a.Feed = s.Feed
+		left join ReadMarks m on m."User" = $1 and m.Feed = s.Feed
+		left join ReadExceptions x on x."User" = $1 and x.Article = a.ID
+		where s."User" = $1 and not coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0))
+		group by s.Feed;
+	`,
+	"FeedRename": `
+		update Subscribed set Name = $3 where "User" = $1 and Feed = $2;
+	`,
+	// /api/webhook/...
+	"WebhookAdd": `
+		insert into Webhooks (ID, "User", Feed, URL, Secret, Created) values ($1, $2, $3, $4, $5, $6);
+	`,
+	"WebhookList": `
+		select ID, Feed, URL, Secret, Created from Webhooks where "User" = $1 order by Created;
+	`,
+	"WebhookGet": `
+		select ID, Feed, URL, Secret, Created from Webhooks where "User" = $1 and ID = $2;
+	`,
+	"WebhookDelete1": `
+		delete from WebhookDeliveries where Hook in (select ID from Webhooks where "User" = $1 and ID = $2);
+	`,
+	"WebhookDelete2": `
+		delete from Webhooks where "User" = $1 and ID = $2;
+	`,
+	"WebhooksForFeed": `
+		select h.ID, h.URL, h.Secret, s.Name, f.URL from Webhooks h
+		join Subscribed s on s."User" = h."User" and s.Feed = $1
+		join Feeds f on f.ID = $1
+		where h.Feed = $1 or h.Feed = '';
+	`,
+	"WebhookDeliveryAdd": `
+		insert into WebhookDeliveries (Hook, Event, Article, Attempts, Status, Error, Time) values ($1, $2, $3, 0, 0, '', $4)
+		returning ID;
+	`,
+	"WebhookDeliveryUpdate": `
+		update WebhookDeliveries set Attempts = $2, Status = $3, Error = $4, Time = $5 where ID = $1;
+	`,
+	"WebhookDeliveryTrim": `
+		delete from WebhookDeliveries where Hook = $1 and ID <= (
+			select ID from WebhookDeliveries where Hook = $1 order by ID desc limit 1 offset $2
+		);
+	`,
+	"WebhookDeliveries": `
+		select ID, Event, Article, Attempts, Status, Error, Time from WebhookDeliveries
+		where Hook = $1 order by ID desc;
+	`,
+	// /api/filter/...
+	"ArticleContentAdd": `
+		insert into ArticleContent (Article, Author, Categories, Content) values ($1, $2, $3, $4)
+		on conflict (Article) do update set
+			Author = excluded.Author,
+			Categories = excluded.Categories,
+			Content = excluded.Content;
+	`,
+	"FilterRulesForFeed": `
+		select r."User", r.ID, r.Name, r.Feed, r.MatchAny, r.Conditions, r.Actions, r.Disabled, r.Created from FilterRules r
+		join Subscribed s on s."User" = r."User" and s.Feed = $1
+		where not r.Disabled and (r.Feed = $1 or r.Feed = '') order by r.Created;
+	`,
+	"FilterRuleList": `
+		select ID, Name, Feed, MatchAny, Conditions, Actions, Disabled, Created from FilterRules
+		where "User" = $1 order by Created;
+	`,
+	"FilterRuleGet": `
+		select ID, Name, Feed, MatchAny, Conditions, Actions, Disabled, Created from FilterRules
+		where "User" = $1 and ID = $2;
+	`,
+	"FilterRuleAdd": `
+		insert into FilterRules (ID, "User", Name, Feed, MatchAny, Conditions, Actions, Disabled, Created)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9);
+	`,
+	"FilterRuleUpdate": `
+		update FilterRules set Name = $3, Feed = $4, MatchAny = $5, Conditions = $6, Actions = $7, Disabled = $8
+		where "User" = $1 and ID = $2;
+	`,
+	"FilterRuleDelete": `
+		delete from FilterRules where "User" = $1 and ID = $2;
+	`,
+	"FilterArticles": `
+		select a.ID, a.Feed, a.Title, a.URL, a.Published, coalesce(c.Author, ''), coalesce(c.Categories, ''), (
+			coalesce(c.Content, '')
+		) from Articles a
+		join Subscribed s on s.Feed = a.Feed and s."User" = $1
+		left join ArticleContent c on c.Article = a.ID
+		where $2 = '' or a.Feed = $2
+		order by a.Published desc, a.ID desc;
+	`,
+	"FilterHide": `
+		insert into HiddenFlags ("User", Article) values ($1, $2) on conflict do nothing;
+	`,
+	"FilterNotify": `
+		insert into Notifications ("User", Article, Rule, Time) values ($1, $2, $3, $4);
+	`,
+
+	// /api/notification/...
+	"NotificationList": `
+		select n.ID, n.Article, n.Rule, n.Time, a.Title, a.URL, s.Name from Notifications n
+		join Articles a on a.ID = n.Article
+		join Subscribed s on s."User" = n."User" and s.Feed = a.Feed
+		where n."User" = $1 order by n.ID desc;
+	`,
+	"NotificationClear": `
+		delete from Notifications where "User" = $1 and ID <= $2;
+	`,
+	// /api/tag/...
+	"ArticleTag": `
+		insert into ArticleTags ("User", Article, Tag)
+		select $1::text, ID, $3::text from Articles where ID = $2 and Feed in (select Feed from Subscribed where "User" = $1)
+		on conflict do nothing;
+	`,
+	"ArticleUntag": `
+		delete from ArticleTags where "User" = $1 and Article = $2 and Tag = $3;
+	`,
+	"TagCounts": `
+		select Tag, count(*) from ArticleTags where "User" = $1 group by Tag order by Tag;
+	`,
+	"TagArticlesOldest": `
+		select a.ID, a.Title, a.URL, s.Name, a.Published, coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0)), (
+			exists (select 1 from StarFlags where "User" = $1 and Article = a.ID)
+		) from ArticleTags t
+		join Articles a on a.ID = t.Article
+		join Subscribed s on s.Feed = a.Feed and s."User" = $1
+		left join ReadMarks m on m."User" = $1 and m.Feed = a.Feed
+		left join ReadExceptions x on x."User" = $1 and x.Article = a.ID
+		where (
+			t."User" = $1 and
+			t.Tag = $2 and
+			(a.Published, a.ID) > ($3, $4)
+		) order by a.Published, a.ID limit $5;
+	`,
+	"TagArticlesNewest": `
+		select a.ID, a.Title, a.URL, s.Name, a.Published, coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0)), (
+			exists (select 1 from StarFlags where "User" = $1 and Article = a.ID)
+		) from ArticleTags t
+		join Articles a on a.ID = t.Article
+		join Subscribed s on s.Feed = a.Feed and s."User" = $1
+		left join ReadMarks m on m."User" = $1 and m.Feed = a.Feed
+		left join ReadExceptions x on x."User" = $1 and x.Article = a.ID
+		where (
+			t."User" = $1 and
+			t.Tag = $2 and
+			(a.Published, a.ID) < ($3, $4)
+		) order by a.Published desc, a.ID desc limit $5;
+	`,
+	// /api/outfeed/..., /out/
+	"OutputFeedAdd": `
+		insert into OutputFeeds (ID, Token, "User", Kind, Value, Title, Created) values ($1, $2, $3, $4, $5, $6, $7);
+	`,
+	"OutputFeedList": `
+		select ID, Token, Kind, Value, Title, Created from OutputFeeds where "User" = $1 order by Created;
+	`,
+	"OutputFeedDelete": `
+		delete from OutputFeeds where "User" = $1 and ID = $2;
+	`,
+	"OutputFeedByToken": `
+		select ID, Token, "User", Kind, Value, Title, Created from OutputFeeds where Token = $1;
+	`,
+	"OutputFeedItems": `
+		select a.ID, a.Title, a.URL, a.Published, s.Name, f.URL, coalesce(i.Link, ''), coalesce(c.Content, '') from Articles a
+		join Subscribed s on s.Feed = a.Feed and s."User" = $1
+		join Feeds f on f.ID = a.Feed
+		left join FeedInfo i on i.Feed = a.Feed
+		left join ArticleContent c on c.Article = a.ID
+		where case $2::text
+			when 'starred' then exists (select 1 from StarFlags where "User" = $1 and Article = a.ID)
+			when 'tag' then exists (select 1 from ArticleTags where "User" = $1 and Article = a.ID and Tag = $3)
+			when 'folder' then (
+				exists (select 1 from FeedFolders where "User" = $1 and Feed = a.Feed and Folder = $3) and
+				not exists (select 1 from HiddenFlags where "User" = $1 and Article = a.ID)
+			)
+			else false
+		end
+		order by a.Published desc, a.ID desc limit $4;
+	`,
+	// WebSub
+	"WebSubGet": `
+		select Feed, Hub, Topic, Token, Secret, State, Expires, Requested from WebSub where Feed = $1;
+	`,
+	"WebSubByToken": `
+		select Feed, Hub, Topic, Token, Secret, State, Expires, Requested from WebSub where Token = $1;
+	`,
+	"WebSubSet": `
+		insert into WebSub (Feed, Hub, Topic, Token, Secret, State, Expires, Requested)
+		values ($1, $2, $3, $4, $5, $6, $7, $8)
+		on conflict (Feed) do update set
+			Hub = excluded.Hub,
+			Topic = excluded.Topic,
+			Token = excluded.Token,
+			Secret = excluded.Secret,
+			State = excluded.State,
+			Expires = excluded.Expires,
+			Requested = excluded.Requested;
+	`,
+	"WebSubDelete": `
+		delete from WebSub where Feed = $1;
+	`,
+	"WebSubPollSkip": `
+		select w.Feed from WebSub w join FeedStatus s on s.Feed = w.Feed
+		where w.State = 'active' and w.Expires > $1 and s.Fetched > $2 and s.Error = '';
+	`,
+}
@@ -0,0 +1,556 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "fmt"
+import "time"
+import "database/sql"
+
+// sqlStore is a Store for any database/sql driver. The SQL comes from the backend, which must have every query named
+// in sqliteStoreQueries, with the same parameters and result columns. Booleans may come back as integers.
+type sqlStore struct {
+	db *sql.DB
+	q  map[string]*sql.Stmt
+}
+
+func newSQLStore(db *sql.DB, queries map[string]string) (*sqlStore, error) {
+	s := &sqlStore{db: db, q: map[string]*sql.Stmt{}}
+	for name := range sqliteStoreQueries {
+		code, ok := queries[name]
+		if !ok {
+			return nil, fmt.Errorf("store query %v is missing", name)
+		}
+		stmt, err := db.Prepare(code)
+		if err != nil {
+			return nil, fmt.Errorf("error loading store query %v: %v", name, err)
+		}
+		s.q[name] = stmt
+	}
+	return s, nil
+}
+
+func (s *sqlStore) exec(query string, args ...interface{}) error {
+	_, err := s.q[query].Exec(args...)
+	return err
+}
+
+// row runs a query that returns one row, turning sql.ErrNoRows into ErrNotFound.
+func (s *sqlStore) row(query string, args []interface{}, dest ...interface{}) error {
+	err := s.q[query].QueryRow(args...).Scan(dest...)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *sqlStore) strings(query string, args ...interface{}) ([]string, error) {
+	rows, err := s.q[query].Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []string{}
+	for rows.Next() {
+		v := ""
+		err := rows.Scan(&v)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, rows.Err()
+}
+
+// transact runs f in a transaction, which is committed if f returns nil.
+func (s *sqlStore) transact(f func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = f(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// tx runs several queries in one transaction, all with the same arguments.
+func (s *sqlStore) tx(queries []string, args ...interface{}) error {
+	return s.transact(func(tx *sql.Tx) error {
+		for _, q := range queries {
+			_, err := tx.Stmt(s.q[q]).Exec(args...)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Users
+// =====================================================================================================================
+
+func (s *sqlStore) UserAdd(id, email, password string) error {
+	return s.exec("UserNew", id, email, password)
+}
+
+func (s *sqlStore) UserLogin(email string) (id, password string, canlogin bool, err error) {
+	err = s.row("UserLogin", []interface{}{email}, &id, &password, &canlogin)
+	return
+}
+
+func (s *sqlStore) UserEmailExists(email string) (bool, error) {
+	ok := false
+	err := s.row("UserEmailExists", []interface{}{email}, &ok)
+	return ok, err
+}
+
+func (s *sqlStore) UserEmail(user string) (string, error) {
+	email := ""
+	err := s.row("GetEmail", []interface{}{user}, &email)
+	return email, err
+}
+
+func (s *sqlStore) UserPassword(user string) (string, error) {
+	password := ""
+	err := s.row("UserGetPass", []interface{}{user}, &password)
+	return password, err
+}
+
+func (s *sqlStore) UserSetPassword(user, password string) error {
+	return s.exec("UserNewPass", user, password)
+}
+
+func (s *sqlStore) UserSetEmail(user, email string) error {
+	return s.exec("UserNewName", user, email)
+}
+
+func (s *sqlStore) UserConfirm(user string) error {
+	return s.exec("ConfirmEmail", user)
+}
+
+func (s *sqlStore) UserDeleteUnconfirmed(user string) error {
+	return s.exec("DeleteEmail", user)
+}
+
+func (s *sqlStore) ApiKeyAdd(key, user, kind string, created int64) error {
+	return s.exec("ApiKeyAdd", key, user, kind, created)
+}
+
+func (s *sqlStore) ApiKeyUpdate(user, kind, key string) error {
+	return s.exec("ApiKeyUpdate", user, kind, key)
+}
+
+func (s *sqlStore) ApiKeyDelete(user, kind string) error {
+	return s.exec("ApiKeyDelete", user, kind)
+}
+
+func (s *sqlStore) ApiKeyUser(key, kind string) (string, error) {
+	user := ""
+	err := s.row("ApiKeyUser", []interface{}{key, kind}, &user)
+	return user, err
+}
+
+// Feeds
+// =====================================================================================================================
+
+func (s *sqlStore) FeedByURL(url string) (string, error) {
+	feed := ""
+	err := s.row("FeedExistsByURL", []interface{}{url}, &feed)
+	return feed, err
+}
+
+func (s *sqlStore) FeedTitleByURL(url string) (string, error) {
+	title := ""
+	err := s.row("FeedTitleByURL", []interface{}{url}, &title)
+	return title, err
+}
+
+func (s *sqlStore) FeedURLs() ([][2]string, error) {
+	rows, err := s.q["GetAllFeeds"].Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	feeds := [][2]string{}
+	for rows.Next() {
+		f, id := "", ""
+		err := rows.Scan(&f, &id)
+		if err != nil {
+			return nil, err
+		}
+		feeds = append(feeds, [2]string{f, id})
+	}
+	return feeds, rows.Err()
+}
+
+func (s *sqlStore) FeedSetInfo(feed, title, link, description, image, language string) error {
+	return s.exec("FeedInfoSet", feed, title, link, description, image, language)
+}
+
+func (s *sqlStore) FeedFetchError(feed string) (string, error) {
+	last := ""
+	err := s.row("FeedFetchError", []interface{}{feed}, &last)
+	return last, err
+}
+
+func (s *sqlStore) FeedFetchOK(feed string, fetched int64) error {
+	return s.exec("FeedFetchOK", feed, fetched)
+}
+
+func (s *sqlStore) FeedFetchFailed(feed string, fetched int64, msg string) error {
+	return s.exec("FeedFetchFailed", feed, fetched, msg)
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func feedScan(row rowScanner) (*Feed, error) {
+	f := &Feed{}
+	var fetched int64
+	err := row.Scan(
+		&f.ID, &f.Name, &f.URL, &f.Paused, &f.Folder, &f.Title, &f.Link, &f.Description, &f.Image, &f.Language,
+		&fetched, &f.Error,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if fetched != 0 {
+		f.Fetched = time.Unix(fetched, 0)
+	}
+	return f, nil
+}
+
+func (s *sqlStore) FeedList(user string) ([]*Feed, error) {
+	rows, err := s.q["FeedList"].Query(user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	feeds := []*Feed{}
+	for rows.Next() {
+		f, err := feedScan(rows)
+		if err != nil {
+			return nil, err
+		}
+		feeds = append(feeds, f)
+	}
+	return feeds, rows.Err()
+}
+
+func (s *sqlStore) FeedDetails(user, feed string) (*Feed, error) {
+	f, err := feedScan(s.q["FeedDetails"].QueryRow(user, feed))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// Subscriptions
+// =====================================================================================================================
+
+func (s *sqlStore) Subscribe(user, url, newFeed, name string) (feed string, added, subscribed bool, err error) {
+	err = s.transact(func(tx *sql.Tx) error {
+		// Add the feed before looking for it, so on SQLite the transaction has the write lock from the start and can't
+		// deadlock with another one that read first.
+		_, err := tx.Stmt(s.q["FeedAdd"]).Exec(newFeed, url)
+		if err != nil {
+			return err
+		}
+		err = tx.Stmt(s.q["FeedExistsByURL"]).QueryRow(url).Scan(&feed)
+		if err != nil {
+			return err
+		}
+		added = feed == newFeed
+
+		res, err := tx.Stmt(s.q["FeedSubscibe"]).Exec(user, feed, name)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		subscribed = n == 0
+		return err
+	})
+	return
+}
+
+func (s *sqlStore) Unsubscribe(user, feed string) error {
+	return s.transact(func(tx *sql.Tx) error {
+		// Lock the feed so nobody can subscribe between checking for subscribers and deleting it.
+		_, err := tx.Stmt(s.q["FeedLock"]).Exec(feed)
+		if err != nil {
+			return err
+		}
+
+		for _, q := range []string{
+			"FeedUnsub1", "FeedUnsub2", "FeedUnsub3", "FeedUnsub4", "FeedUnsub5", "FeedUnsub6", "FeedUnsub7",
+			"FeedUnsub8", "FeedUnsub9", "FeedUnsub10", "FeedUnsub11", "FeedUnsub12",
+		} {
+			_, err := tx.Stmt(s.q[q]).Exec(user, feed)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.Stmt(s.q["FeedDeleteUnused"]).Exec(feed)
+		return err
+	})
+}
+
+func (s *sqlStore) Subscribed(user, feed string) (bool, error) {
+	ok := false
+	err := s.row("FeedAlreadySubscibed", []interface{}{user, feed}, &ok)
+	return ok, err
+}
+
+func (s *sqlStore) Subscribers(feed string) ([]string, error) {
+	return s.strings("FeedListSubs", feed)
+}
+
+func (s *sqlStore) HasSubscribers(feed string) (bool, error) {
+	ok := false
+	err := s.row("FeedHasSubs", []interface{}{feed}, &ok)
+	return ok, err
+}
+
+func (s *sqlStore) SetFolder(user, feed, folder string) error {
+	if folder == "" {
+		return s.exec("FeedClearFolder", user, feed)
+	}
+	return s.exec("FeedSetFolder", user, feed, folder)
+}
+
+func (s *sqlStore) FolderFeeds(user, folder string) ([]string, error) {
+	return s.strings("FolderFeeds", user, folder)
+}
+
+// Articles
+// =====================================================================================================================
+
+func (s *sqlStore) ArticleAdd(id, feed, title, url string, published int64) error {
+	return s.exec("ArticleAdd", id, feed, title, url, published)
+}
+
+func (s *sqlStore) ArticleByURL(url string) (string, error) {
+	article := ""
+	err := s.row("ArticleExistsByURL", []interface{}{url}, &article)
+	return article, err
+}
+
+func (s *sqlStore) ArticlePrunedSeen(url string, seen int64) (bool, error) {
+	res, err := s.q["ArticlePrunedSeen"].Exec(url, seen)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqlStore) PrunedTrim(feed string, before int64) error {
+	return s.exec("PrunedTrim", feed, before)
+}
+
+func (s *sqlStore) FeedArticles(user, feed string, p *PageParams) ([]*Article, error) {
+	rows, err := s.q["FeedArticles"+p.Query()].Query(user, feed, p.Published, p.ID, p.Limit+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	articles := []*Article{}
+	for rows.Next() {
+		a := &Article{}
+		var stamp int64
+		err := rows.Scan(&a.ID, &a.Title, &a.URL, &stamp, &a.Read, &a.Starred)
+		if err != nil {
+			return nil, err
+		}
+		a.Published = time.Unix(stamp, 0)
+		articles = append(articles, a)
+	}
+	return articles, rows.Err()
+}
+
+func unreadScan(row rowScanner) (*UnreadArticle, error) {
+	a := &UnreadArticle{}
+	var stamp int64
+	err := row.Scan(&a.ID, &a.Feed, &a.Title, &a.URL, &a.FeedName, &stamp)
+	if err != nil {
+		return nil, err
+	}
+	a.Published = time.Unix(stamp, 0)
+	return a, nil
+}
+
+func (s *sqlStore) unreadList(query string, args ...interface{}) ([]*UnreadArticle, error) {
+	rows, err := s.q[query].Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	unread := []*UnreadArticle{}
+	for rows.Next() {
+		a, err := unreadScan(rows)
+		if err != nil {
+			return nil, err
+		}
+		unread = append(unread, a)
+	}
+	return unread, rows.Err()
+}
+
+func (s *sqlStore) Unread(user, folder string, p *PageParams) ([]*UnreadArticle, error) {
+	return s.unreadList("GetUnread"+p.Query(), user, p.Published, p.ID, p.Limit+1, folder)
+}
+
+func (s *sqlStore) UnreadArticle(user, article string) (*UnreadArticle, error) {
+	a, err := unreadScan(s.q["UnreadArticle"].QueryRow(user, article))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return a, err
+}
+
+func (s *sqlStore) UnreadFeedArticles(user, feed string, limit int) ([]*UnreadArticle, error) {
+	return s.unreadList("UnreadFeedArticles", user, feed, limit)
+}
+
+// Flags
+// =====================================================================================================================
+
+func (s *sqlStore) Pause(user, feed string) error {
+	return s.exec("FeedPause", user, feed)
+}
+
+func (s *sqlStore) Unpause(user, feed string) error {
+	return s.exec("FeedUnpause", user, feed)
+}
+
+func (s *sqlStore) Star(user, article string) error {
+	return s.exec("ArticleStar", user, article)
+}
+
+func (s *sqlStore) Unstar(user, article string) error {
+	return s.exec("ArticleUnstar", user, article)
+}
+
+func (s *sqlStore) ReadMark(user, feed string) (int64, error) {
+	mark := int64(0)
+	err := s.row("ReadMarkGet", []interface{}{user, feed}, &mark)
+	return mark, err
+}
+
+// readState locks the user's watermark for the article's feed until tx ends, then returns the feed, the article's
+// sequence number, and the watermark.
+func (s *sqlStore) readState(tx *sql.Tx, user, article string) (feed string, seq, mark int64, err error) {
+	_, err = tx.Stmt(s.q["ArticleReadMarkLock"]).Exec(user, article)
+	if err != nil {
+		return
+	}
+	err = tx.Stmt(s.q["ArticleReadState"]).QueryRow(user, article).Scan(&feed, &seq, &mark)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return
+}
+
+// readMarkAdvance moves the watermark for a feed as far forward as it can go and drops the exceptions it passed over.
+func (s *sqlStore) readMarkAdvance(tx *sql.Tx, user, feed string, mark int64) error {
+	next := int64(0)
+	err := tx.Stmt(s.q["ReadMarkNext"]).QueryRow(user, feed, mark).Scan(&next)
+	if err != nil || next <= mark {
+		return err
+	}
+	for _, q := range []string{"ReadMarkSet", "ReadMarkTrim"} {
+		_, err := tx.Stmt(s.q[q]).Exec(user, feed, next)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) MarkRead(user, article string) error {
+	return s.transact(func(tx *sql.Tx) error {
+		feed, seq, mark, err := s.readState(tx, user, article)
+		if err != nil {
+			return err
+		}
+
+		// Below the watermark it is read by default, so all we need to do is clear any unread exception.
+		if seq <= mark {
+			_, err := tx.Stmt(s.q["ReadExceptionClear"]).Exec(user, article)
+			return err
+		}
+
+		_, err = tx.Stmt(s.q["ReadExceptionSet"]).Exec(user, article, true)
+		if err != nil {
+			return err
+		}
+		return s.readMarkAdvance(tx, user, feed, mark)
+	})
+}
+
+func (s *sqlStore) MarkUnread(user, article string) error {
+	return s.transact(func(tx *sql.Tx) error {
+		_, seq, mark, err := s.readState(tx, user, article)
+		if err != nil {
+			return err
+		}
+
+		if seq > mark {
+			_, err = tx.Stmt(s.q["ReadExceptionClear"]).Exec(user, article)
+		} else {
+			_, err = tx.Stmt(s.q["ReadExceptionSet"]).Exec(user, article, false)
+		}
+		return err
+	})
+}
+
+func (s *sqlStore) FeedMarkRead(user, feed string, before int64) error {
+	return s.transact(func(tx *sql.Tx) error {
+		_, err := tx.Stmt(s.q["ReadMarkLock"]).Exec(user, feed)
+		if err != nil {
+			return err
+		}
+		mark := int64(0)
+		err = tx.Stmt(s.q["ReadMarkGet"]).QueryRow(user, feed).Scan(&mark)
+		if err != nil {
+			return err
+		}
+
+		for _, q := range []string{"FeedMarkReadAbove", "FeedMarkReadBelow"} {
+			_, err := tx.Stmt(s.q[q]).Exec(user, feed, mark, before)
+			if err != nil {
+				return err
+			}
+		}
+		return s.readMarkAdvance(tx, user, feed, mark)
+	})
+}
@@ -0,0 +1,409 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+// The SQLite store queries. The SQL for the other features is in db.go.
+var sqliteStoreQueries = map[string]string{
+	// Background updater
+	"GetAllFeeds": `
+		select URL, ID from Feeds;
+	`,
+	"ArticleExistsByURL": `
+		select coalesce((select ID from Articles where URL = ?1), "");
+	`,
+	"ArticleAdd": `
+		insert into Articles (ID, Feed, Title, URL, Published) values (?1, ?2, ?3, ?4, ?5);
+	`,
+	"FeedListSubs": `
+		select User from Subscribed where Feed = ?1;
+	`,
+	"FeedInfoSet": `
+		insert into FeedInfo (Feed, Title, Link, Description, Image, Language) values (?1, ?2, ?3, ?4, ?5, ?6)
+		on conflict (Feed) do update set
+			Title = excluded.Title,
+			Link = excluded.Link,
+			Description = excluded.Description,
+			Image = excluded.Image,
+			Language = excluded.Language;
+	`,
+	"ArticlePrunedSeen": `
+		update Pruned set Seen = ?2 where URL = ?1;
+	`,
+	"PrunedTrim": `
+		delete from Pruned where Feed = ?1 and Seen < ?2;
+	`,
+
+	// /api/user/confirm-email
+	"ConfirmEmail": `
+		update Users set CanLogin = 1 where ID = ?1;
+	`,
+	"GetEmail": `
+		select Email from Users where ID = ?1;
+	`,
+	// /api/user/delete-email
+	"DeleteEmail": `
+		delete from Users where ID = ?1 and CanLogin = 0;
+	`,
+	// /api/user/login (one row)
+	"UserLogin": `
+		select ID, Password, CanLogin from Users where Email = ?1;
+	`,
+	// /api/user/new
+	"UserNew": `
+		insert into Users (ID, Email, Password, CanLogin) values (?1, ?2, ?3, 0);
+	`,
+	"UserEmailExists": `
+		select exists(select 1 from Users where Email = ?1);
+	`,
+	// /api/user/new-pass
+	"UserNewPass": `
+		update Users set Password = ?2 where ID = ?1;
+	`,
+	"UserGetPass": `
+		select Password from Users where ID = ?1;
+	`,
+	// /api/user/new-name
+	"UserNewName": `
+		update Users set Email = ?2, CanLogin = 0 where ID = ?1;
+	`,
+
+	// /api/user/fever
+	"ApiKeyAdd": `
+		insert into ApiKeys (Key, User, Kind, Created) values (?1, ?2, ?3, ?4);
+	`,
+	"ApiKeyDelete": `
+		delete from ApiKeys where User = ?1 and Kind = ?2;
+	`,
+	"ApiKeyUpdate": `
+		update ApiKeys set Key = ?3 where User = ?1 and Kind = ?2;
+	`,
+	"ApiKeyUser": `
+		select User from ApiKeys where Key = ?1 and Kind = ?2;
+	`,
+
+	// /api/feed/list
+	"FeedList": `
+		select ID, (
+				select Name from Subscribed where Feed = Feeds.ID and User = ?1
+			), URL, (
+			ID in (select Feed from PausedFlags where User = ?1)
+		), coalesce((
+			select Folder from FeedFolders where Feed = Feeds.ID and User = ?1
+		), ""), coalesce(i.Title, ""), coalesce(i.Link, ""), coalesce(i.Description, ""), coalesce(i.Image, ""), (
+			coalesce(i.Language, "")
+		), coalesce(st.Fetched, 0), coalesce(st.Error, "") from Feeds
+		left join FeedInfo i on i.Feed = Feeds.ID
+		left join FeedStatus st on st.Feed = Feeds.ID
+		where (
+			ID in (select Feed from Subscribed where User = ?1)
+		);
+	`,
+	// /api/feed/details (one row)
+	"FeedDetails": `
+		select ID, (
+			select Name from Subscribed where Feed = ?2 and User = ?1
+		), URL, (
+			ID in (select Feed from PausedFlags where User = ?1)
+		), coalesce((
+			select Folder from FeedFolders where Feed = ?2 and User = ?1
+		), ""), coalesce(i.Title, ""), coalesce(i.Link, ""), coalesce(i.Description, ""), coalesce(i.Image, ""), (
+			coalesce(i.Language, "")
+		), coalesce(st.Fetched, 0), coalesce(st.Error, "") from Feeds
+		left join FeedInfo i on i.Feed = Feeds.ID
+		left join FeedStatus st on st.Feed = Feeds.ID
+		where (
+			ID = ?2 and
+			ID in (select Feed from Subscribed where User = ?1)
+		);
+	`,
+	// /api/feed/articles
+	"FeedArticlesOldest": `
+		select a.ID, a.Title, a.URL, a.Published, coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0)), (
+			exists (select 1 from StarFlags where User = ?1 and Article = a.ID)
+		) from Articles a
+		left join ReadMarks m on m.User = ?1 and m.Feed = a.Feed
+		left join ReadExceptions x on x.User = ?1 and x.Article = a.ID
+		where (
+			a.Feed = ?2 and
+			a.Feed in (select Feed from Subscribed where User = ?1) and
+			not exists (select 1 from HiddenFlags where User = ?1 and Article = a.ID) and
+			(a.Published, a.ID) > (?3, ?4)
+		) order by a.Published, a.ID limit ?5;
+	`,
+	"FeedArticlesNewest": `
+		select a.ID, a.Title, a.URL, a.Published, coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0)), (
+			exists (select 1 from StarFlags where User = ?1 and Article = a.ID)
+		) from Articles a
+		left join ReadMarks m on m.User = ?1 and m.Feed = a.Feed
+		left join ReadExceptions x on x.User = ?1 and x.Article = a.ID
+		where (
+			a.Feed = ?2 and
+			a.Feed in (select Feed from Subscribed where User = ?1) and
+			not exists (select 1 from HiddenFlags where User = ?1 and Article = a.ID) and
+			(a.Published, a.ID) < (?3, ?4)
+		) order by a.Published desc, a.ID desc limit ?5;
+	`,
+	// /api/feed/subscribe
+	"FeedExistsByURL": `
+		select coalesce((select ID from Feeds where URL = ?1), "");
+	`,
+	"FeedAdd": `
+		insert or ignore into Feeds (ID, URL) values (?1, ?2);
+	`,
+	"FeedTitleByURL": `
+		select coalesce((select i.Title from FeedInfo i join Feeds f on f.ID = i.Feed where f.URL = ?1), "");
+	`,
+	"FeedAlreadySubscibed": `
+		select exists(select 1 from Subscribed where User = ?1 and Feed = ?2);
+	`,
+	"FeedSubscibe": `
+		insert or ignore into Subscribed (User, Feed, Name) values (?1, ?2, ?3);
+	`,
+	// /api/feed/unsubscribe
+	// SQLite locks the whole database for writes, so any write will do. It has to be first, see Subscribe.
+	"FeedLock": `
+		update Feeds set URL = URL where ID = ?1;
+	`,
+	"FeedUnsub1": `
+		delete from Subscribed where User = ?1 and Feed = ?2;
+	`,
+	"FeedUnsub2": `
+		delete from PausedFlags where User = ?1 and Feed = ?2;
+	`,
+	"FeedUnsub3": `
+		delete from ReadMarks where User = ?1 and Feed = ?2;
+	`,
+	"FeedUnsub4": `
+		delete from ReadExceptions where User = ?1 and Article in (select ID from Articles where Feed = ?2);
+	`,
+	"FeedUnsub5": `
+		delete from StarFlags where User = ?1 and Article in (select ID from Articles where Feed = ?2);
+	`,
+	"FeedUnsub6": `
+		delete from FeedFolders where User = ?1 and Feed = ?2;
+	`,
+	"FeedUnsub7": `
+		delete from WebhookDeliveries where Hook in (select ID from Webhooks where User = ?1 and Feed = ?2);
+	`,
+	"FeedUnsub8": `
+		delete from Webhooks where User = ?1 and Feed = ?2;
+	`,
+	"FeedUnsub9": `
+		delete from HiddenFlags where User = ?1 and Article in (select ID from Articles where Feed = ?2);
+	`,
+	"FeedUnsub10": `
+		delete from ArticleTags where User = ?1 and Article in (select ID from Articles where Feed = ?2);
+	`,
+	"FeedUnsub11": `
+		delete from Notifications where User = ?1 and Article in (select ID from Articles where Feed = ?2);
+	`,
+	"FeedUnsub12": `
+		delete from FilterRules where User = ?1 and Feed = ?2;
+	`,
+	"FeedHasSubs": `
+		select exists(select 1 from Subscribed where Feed = ?1 limit 1);
+	`,
+	"FeedDeleteUnused": `
+		delete from Feeds where ID = ?1 and not exists (select 1 from Subscribed where Feed = ?1);
+	`,
+	// /api/feed/pause
+	"FeedPause": `
+		insert or ignore into PausedFlags (User, Feed) values (?1, ?2);
+	`,
+	// //api/feed/unpause
+	"FeedUnpause": `
+		delete from PausedFlags where User = ?1 and Feed = ?2;
+	`,
+
+	// /api/feed/folder
+	"FeedSetFolder": `
+		insert into FeedFolders (User, Feed, Folder) values (?1, ?2, ?3)
+		on conflict (User, Feed) do update set Folder = excluded.Folder;
+	`,
+	"FeedClearFolder": `
+		delete from FeedFolders where User = ?1 and Feed = ?2;
+	`,
+
+	// /api/feed/mark-read
+	"ReadMarkGet": `
+		select coalesce((select Seq from ReadMarks where User = ?1 and Feed = ?2), 0);
+	`,
+	"FeedMarkReadAbove": `
+		insert into ReadExceptions (User, Article, Read)
+		select ?1, ID, 1 from Articles where Feed = ?2 and Seq > ?3 and Published < ?4
+		on conflict (User, Article) do update set Read = 1;
+	`,
+	"FeedMarkReadBelow": `
+		delete from ReadExceptions where (
+			User = ?1 and
+			Read = 0 and
+			Article in (select ID from Articles where Feed = ?2 and Seq <= ?3 and Published < ?4)
+		);
+	`,
+
+	// Writes the user's watermark for a feed without changing it, which holds it until the transaction ends.
+	"ReadMarkLock": `
+		insert into ReadMarks (User, Feed, Seq) values (?1, ?2, 0)
+		on conflict (User, Feed) do update set Seq = ReadMarks.Seq;
+	`,
+	// Same, for the feed an article is in.
+	"ArticleReadMarkLock": `
+		insert into ReadMarks (User, Feed, Seq) select ?1, Feed, 0 from Articles where ID = ?2
+		on conflict (User, Feed) do update set Seq = ReadMarks.Seq;
+	`,
+
+	// /api/article/read (one row)
+	"ArticleReadState": `
+		select a.Feed, a.Seq, coalesce(m.Seq, 0) from Articles a
+		left join ReadMarks m on m.User = ?1 and m.Feed = a.Feed
+		where a.ID = ?2;
+	`,
+	"ReadExceptionSet": `
+		insert into ReadExceptions (User, Article, Read) values (?1, ?2, ?3)
+		on conflict (User, Article) do update set Read = excluded.Read;
+	`,
+	"ReadExceptionClear": `
+		delete from ReadExceptions where User = ?1 and Article = ?2;
+	`,
+	// Finds the highest point the watermark can move to, which is just below the first unread article after it.
+	"ReadMarkNext": `
+		select max(?3, coalesce(max(a.Seq), 0)) from Articles a where (
+			a.Feed = ?2 and
+			a.Seq < coalesce((
+				select min(b.Seq) from Articles b where (
+					b.Feed = ?2 and
+					b.Seq > ?3 and
+					not exists (select 1 from ReadExceptions x where x.User = ?1 and x.Article = b.ID and x.Read = 1)
+				)
+			), 9223372036854775807)
+		);
+	`,
+	"ReadMarkSet": `
+		insert into ReadMarks (User, Feed, Seq) values (?1, ?2, ?3)
+		on conflict (User, Feed) do update set Seq = max(ReadMarks.Seq, excluded.Seq);
+	`,
+	"ReadMarkTrim": `
+		delete from ReadExceptions where (
+			User = ?1 and
+			Read = 1 and
+			Article in (select ID from Articles where Feed = ?2 and Seq <= ?3)
+		);
+	`,
+	// /api/article/star
+	"ArticleStar": `
+		insert or ignore into StarFlags (User, Article) values (?1, ?2);
+	`,
+	// /api/article/unstar
+	"ArticleUnstar": `
+		delete from StarFlags where User = ?1 and Article = ?2;
+	`,
+	// /api/article/feed
+	// Split in two so that each half can walk an index instead of every article the user has ever seen.
+	"GetUnreadOldest": `
+		select a.ID, a.Feed, a.Title, a.URL, s.Name, a.Published from Subscribed s
+		join Articles a on a.Feed = s.Feed and a.Seq > coalesce((
+			select Seq from ReadMarks where User = ?1 and Feed = s.Feed
+		), 0)
+		where (
+			s.User = ?1 and
+			not s.Feed in (select Feed from PausedFlags where User = ?1) and
+			(?5 = "" or s.Feed in (select Feed from FeedFolders where User = ?1 and Folder = ?5)) and
+			not exists (select 1 from ReadExceptions x where x.User = ?1 and x.Article = a.ID and x.Read = 1) and
+			(a.Published, a.ID) > (?2, ?3)
+		)
+		union all
+		select a.ID, a.Feed, a.Title, a.URL, s.Name, a.Published from ReadExceptions x
+		join Articles a on a.ID = x.Article
+		join Subscribed s on s.Feed = a.Feed and s.User = ?1
+		where (
+			x.User = ?1 and
+			x.Read = 0 and
+			not s.Feed in (select Feed from PausedFlags where User = ?1) and
+			(?5 = "" or s.Feed in (select Feed from FeedFolders where User = ?1 and Folder = ?5)) and
+			(a.Published, a.ID) > (?2, ?3)
+		) order by 6, 1 limit ?4;
+	`,
+	"GetUnreadNewest": `
+		select a.ID, a.Feed, a.Title, a.URL, s.Name, a.Published from Subscribed s
+		join Articles a on a.Feed = s.Feed and a.Seq > coalesce((
+			select Seq from ReadMarks where User = ?1 and Feed = s.Feed
+		), 0)
+		where (
+			s.User = ?1 and
+			not s.Feed in (select Feed from PausedFlags where User = ?1) and
+			(?5 = "" or s.Feed in (select Feed from FeedFolders where User = ?1 and Folder = ?5)) and
+			not exists (select 1 from ReadExceptions x where x.User = ?1 and x.Article = a.ID and x.Read = 1) and
+			(a.Published, a.ID) < (?2, ?3)
+		)
+		union all
+		select a.ID, a.Feed, a.Title, a.URL, s.Name, a.Published from ReadExceptions x
+		join Articles a on a.ID = x.Article
+		join Subscribed s on s.Feed = a.Feed and s.User = ?1
+		where (
+			x.User = ?1 and
+			x.Read = 0 and
+			not s.Feed in (select Feed from PausedFlags where User = ?1) and
+			(?5 = "" or s.Feed in (select Feed from FeedFolders where User = ?1 and Folder = ?5)) and
+			(a.Published, a.ID) < (?2, ?3)
+		) order by 6 desc, 1 desc limit ?4;
+	`,
+	// Websocket events, the same columns as above for articles that are unread and visible.
+	"UnreadArticle": `
+		select a.ID, a.Feed, a.Title, a.URL, s.Name, a.Published from Articles a
+		join Subscribed s on s.Feed = a.Feed and s.User = ?1
+		left join ReadMarks m on m.User = ?1 and m.Feed = a.Feed
+		left join ReadExceptions x on x.User = ?1 and x.Article = a.ID
+		where (
+			a.ID = ?2 and
+			not a.Feed in (select Feed from PausedFlags where User = ?1) and
+			not coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0))
+		);
+	`,
+	"UnreadFeedArticles": `
+		select a.ID, a.Feed, a.Title, a.URL, s.Name, a.Published from Articles a
+		join Subscribed s on s.Feed = a.Feed and s.User = ?1
+		left join ReadMarks m on m.User = ?1 and m.Feed = a.Feed
+		left join ReadExceptions x on x.User = ?1 and x.Article = a.ID
+		where (
+			a.Feed = ?2 and
+			not a.Feed in (select Feed from PausedFlags where User = ?1) and
+			not coalesce(x.Read, a.Seq <= coalesce(m.Seq, 0))
+		) order by a.Published, a.ID limit ?3;
+	`,
+	"FolderFeeds": `
+		select Feed from FeedFolders where User = ?1 and Folder = ?2;
+	`,
+
+	// Background fetch
+	"FeedFetchError": `
+		select coalesce((select Error from FeedStatus where Feed = ?1), "");
+	`,
+	"FeedFetchOK": `
+		insert into FeedStatus (Feed, Fetched, Succeeded, Error, Failures) values (?1, ?2, ?2, "", 0)
+		on conflict (Feed) do update set Fetched = ?2, Succeeded = ?2, Error = "", Failures = 0;
+	`,
+	"FeedFetchFailed": `
+		insert into FeedStatus (Feed, Fetched, Succeeded, Error, Failures) values (?1, ?2, 0, ?3, 1)
+		on conflict (Feed) do update set Fetched = ?2, Error = ?3, Failures = Failures + 1;
+	`,
+}
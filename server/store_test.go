@@ -0,0 +1,563 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "fmt"
+import "sort"
+import "reflect"
+import "testing"
+
+// TestStore runs the store through everything the rest of the server relies on, so both backends are held to the same
+// behavior. Each step builds on the ones before it.
+func TestStore(t *testing.T) {
+	testDB(t, func(t *testing.T) {
+		for _, step := range []struct {
+			name string
+			f    func(s Store) error
+		}{
+			{"users", checkStoreUsers},
+			{"api keys", checkStoreApiKeys},
+			{"feeds", checkStoreFeeds},
+			{"subscriptions", checkStoreSubscriptions},
+			{"articles", checkStoreArticles},
+			{"read state", checkStoreRead},
+			{"paging", checkStorePaging},
+			{"unsubscribe", checkStoreUnsubscribe},
+		} {
+			err := step.f(Data)
+			if err != nil {
+				t.Fatalf("%v: %v", step.name, err)
+			}
+		}
+	})
+}
+
+// checkEq is for comparing results. Errors are passed straight through.
+func checkEq(what string, got, want interface{}, err error) error {
+	if err != nil {
+		return fmt.Errorf("%v: %v", what, err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		return fmt.Errorf("%v: got %#v, expected %#v", what, got, want)
+	}
+	return nil
+}
+
+// checkAll returns the first error, so a step can be a list of checks.
+func checkAll(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkNotFound(what string, err error) error {
+	if err != ErrNotFound {
+		return fmt.Errorf("%v: expected ErrNotFound, got %v", what, err)
+	}
+	return nil
+}
+
+// checkFeed gets the details of a feed, or empty details along with the error so checkEq can return it.
+func checkFeed(s Store, user, feed string) (*Feed, error) {
+	f, err := s.FeedDetails(user, feed)
+	if err != nil {
+		return &Feed{}, err
+	}
+	return f, nil
+}
+
+func checkUnreadIDs(list []*UnreadArticle) []string {
+	ids := []string{}
+	for _, a := range list {
+		ids = append(ids, a.ID)
+	}
+	return ids
+}
+
+func checkStoreUsers(s Store) error {
+	err := checkAll(
+		s.UserAdd("check-u1", "one@example.com", "pass1"),
+		s.UserAdd("check-u2", "two@example.com", "pass2"),
+		s.UserAdd("check-u3", "three@example.com", "pass3"),
+	)
+	if err != nil {
+		return err
+	}
+
+	exists, err := s.UserEmailExists("one@example.com")
+	if err := checkEq("existing email", exists, true, err); err != nil {
+		return err
+	}
+	exists, err = s.UserEmailExists("nobody@example.com")
+	if err := checkEq("missing email", exists, false, err); err != nil {
+		return err
+	}
+
+	id, pass, canlogin, err := s.UserLogin("one@example.com")
+	got := []interface{}{id, pass, canlogin}
+	if err := checkEq("new user login", got, []interface{}{"check-u1", "pass1", false}, err); err != nil {
+		return err
+	}
+	_, _, _, err = s.UserLogin("nobody@example.com")
+	if err := checkNotFound("missing user login", err); err != nil {
+		return err
+	}
+
+	err = s.UserConfirm("check-u1")
+	_, _, canlogin, err2 := s.UserLogin("one@example.com")
+	if err := checkEq("confirmed user login", canlogin, true, checkAll(err, err2)); err != nil {
+		return err
+	}
+
+	err = s.UserSetPassword("check-u1", "pass4")
+	pass, err2 = s.UserPassword("check-u1")
+	if err := checkEq("new password", pass, "pass4", checkAll(err, err2)); err != nil {
+		return err
+	}
+
+	err = s.UserSetEmail("check-u1", "uno@example.com")
+	email, err2 := s.UserEmail("check-u1")
+	if err := checkEq("new email", email, "uno@example.com", checkAll(err, err2)); err != nil {
+		return err
+	}
+	_, _, canlogin, err = s.UserLogin("uno@example.com")
+	if err := checkEq("new email login", canlogin, false, err); err != nil {
+		return err
+	}
+
+	// Only unconfirmed users can be deleted.
+	err = checkAll(
+		s.UserConfirm("check-u1"),
+		s.UserConfirm("check-u2"),
+		s.UserDeleteUnconfirmed("check-u1"),
+		s.UserDeleteUnconfirmed("check-u3"),
+	)
+	if err != nil {
+		return err
+	}
+	email, err = s.UserEmail("check-u1")
+	if err := checkEq("confirmed user after delete", email, "uno@example.com", err); err != nil {
+		return err
+	}
+	_, err = s.UserEmail("check-u3")
+	return checkNotFound("deleted user", err)
+}
+
+func checkStoreApiKeys(s Store) error {
+	err := s.ApiKeyAdd("check-k1", "check-u1", "fever", 1)
+	user, err2 := s.ApiKeyUser("check-k1", "fever")
+	if err := checkEq("new key", user, "check-u1", checkAll(err, err2)); err != nil {
+		return err
+	}
+	_, err = s.ApiKeyUser("check-k1", "greader")
+	if err := checkNotFound("key of another kind", err); err != nil {
+		return err
+	}
+
+	err = s.ApiKeyUpdate("check-u1", "fever", "check-k2")
+	user, err2 = s.ApiKeyUser("check-k2", "fever")
+	if err := checkEq("updated key", user, "check-u1", checkAll(err, err2)); err != nil {
+		return err
+	}
+	_, err = s.ApiKeyUser("check-k1", "fever")
+	if err := checkNotFound("replaced key", err); err != nil {
+		return err
+	}
+
+	err = s.ApiKeyDelete("check-u1", "fever")
+	if err != nil {
+		return err
+	}
+	_, err = s.ApiKeyUser("check-k2", "fever")
+	return checkNotFound("deleted key", err)
+}
+
+func checkStoreFeeds(s Store) error {
+	feed, err := s.FeedByURL("https://example.com/one")
+	if err := checkEq("missing feed", feed, "", err); err != nil {
+		return err
+	}
+
+	feed, added, subscribed, err := s.Subscribe("check-u1", "https://example.com/one", "check-f1", "One")
+	err = checkEq("new feed", []interface{}{feed, added, subscribed}, []interface{}{"check-f1", true, false}, err)
+	if err != nil {
+		return err
+	}
+	_, _, _, err = s.Subscribe("check-u1", "https://example.com/two", "check-f2", "Two")
+	if err != nil {
+		return err
+	}
+	feed, err = s.FeedByURL("https://example.com/one")
+	if err := checkEq("feed by URL", feed, "check-f1", err); err != nil {
+		return err
+	}
+	feeds, err := s.FeedURLs()
+	sort.Slice(feeds, func(i, j int) bool { return feeds[i][1] < feeds[j][1] })
+	err = checkEq("feed URLs", feeds, [][2]string{
+		{"https://example.com/one", "check-f1"},
+		{"https://example.com/two", "check-f2"},
+	}, err)
+	if err != nil {
+		return err
+	}
+
+	title, err := s.FeedTitleByURL("https://example.com/one")
+	if err := checkEq("missing title", title, "", err); err != nil {
+		return err
+	}
+	err = checkAll(
+		s.FeedSetInfo("check-f1", "Title", "https://example.com/", "Feed one", "", "en"),
+		s.FeedSetInfo("check-f1", "Feed One", "https://example.com/", "Feed one", "", "en"),
+	)
+	title, err2 := s.FeedTitleByURL("https://example.com/one")
+	if err := checkEq("title", title, "Feed One", checkAll(err, err2)); err != nil {
+		return err
+	}
+
+	last, err := s.FeedFetchError("check-f1")
+	if err := checkEq("error before fetching", last, "", err); err != nil {
+		return err
+	}
+	err = s.FeedFetchFailed("check-f1", 10, "Oops")
+	last, err2 = s.FeedFetchError("check-f1")
+	if err := checkEq("error after failing", last, "Oops", checkAll(err, err2)); err != nil {
+		return err
+	}
+	err = s.FeedFetchOK("check-f1", 20)
+	last, err2 = s.FeedFetchError("check-f1")
+	return checkEq("error after succeeding", last, "", checkAll(err, err2))
+}
+
+func checkStoreSubscriptions(s Store) error {
+	ok, err := s.Subscribed("check-u2", "check-f1")
+	if err := checkEq("not subscribed", ok, false, err); err != nil {
+		return err
+	}
+
+	feed, added, subscribed, err := s.Subscribe("check-u2", "https://example.com/one", "check-f3", "Uno")
+	err = checkEq("existing feed", []interface{}{feed, added, subscribed}, []interface{}{"check-f1", false, false}, err)
+	if err != nil {
+		return err
+	}
+	feed, added, subscribed, err = s.Subscribe("check-u1", "https://example.com/one", "check-f4", "Again")
+	err = checkEq("subscribing twice", []interface{}{feed, added, subscribed}, []interface{}{"check-f1", false, true}, err)
+	if err != nil {
+		return err
+	}
+	ok, err = s.Subscribed("check-u1", "check-f1")
+	if err := checkEq("subscribed", ok, true, err); err != nil {
+		return err
+	}
+	ok, err = s.HasSubscribers("check-f2")
+	if err := checkEq("has subscribers", ok, true, err); err != nil {
+		return err
+	}
+	users, err := s.Subscribers("check-f1")
+	sort.Strings(users)
+	if err := checkEq("subscribers", users, []string{"check-u1", "check-u2"}, err); err != nil {
+		return err
+	}
+
+	feeds, err := s.FeedList("check-u1")
+	if err := checkEq("feed list length", len(feeds), 2, err); err != nil {
+		return err
+	}
+	f, err := s.FeedDetails("check-u1", "check-f1")
+	if err != nil {
+		return err
+	}
+	got := []interface{}{f.Name, f.URL, f.Title, f.Paused, f.Folder, f.Fetched.Unix(), f.Error}
+	want := []interface{}{"One", "https://example.com/one", "Feed One", false, "", int64(20), ""}
+	if err := checkEq("feed details", got, want, nil); err != nil {
+		return err
+	}
+	_, err = s.FeedDetails("check-u2", "check-f2")
+	if err := checkNotFound("details of unsubscribed feed", err); err != nil {
+		return err
+	}
+
+	err = checkAll(
+		s.SetFolder("check-u1", "check-f1", "News"),
+		s.SetFolder("check-u1", "check-f1", "Other"),
+	)
+	feedIDs, err2 := s.FolderFeeds("check-u1", "Other")
+	if err := checkEq("folder feeds", feedIDs, []string{"check-f1"}, checkAll(err, err2)); err != nil {
+		return err
+	}
+	feedIDs, err = s.FolderFeeds("check-u1", "News")
+	if err := checkEq("old folder feeds", feedIDs, []string{}, err); err != nil {
+		return err
+	}
+	err = s.SetFolder("check-u1", "check-f1", "")
+	f, err2 = checkFeed(s, "check-u1", "check-f1")
+	if err := checkEq("cleared folder", f.Folder, "", checkAll(err, err2)); err != nil {
+		return err
+	}
+
+	err = checkAll(
+		s.Pause("check-u1", "check-f1"),
+		s.Pause("check-u1", "check-f1"),
+	)
+	f, err2 = checkFeed(s, "check-u1", "check-f1")
+	if err := checkEq("paused", f.Paused, true, checkAll(err, err2)); err != nil {
+		return err
+	}
+	err = s.Unpause("check-u1", "check-f1")
+	f, err2 = checkFeed(s, "check-u1", "check-f1")
+	return checkEq("unpaused", f.Paused, false, checkAll(err, err2))
+}
+
+func checkStoreArticles(s Store) error {
+	article, err := s.ArticleByURL("https://example.com/one/1")
+	if err := checkEq("missing article", article, "", err); err != nil {
+		return err
+	}
+
+	for i, published := range []int64{100, 200, 300, 400} {
+		err := s.ArticleAdd(fmt.Sprintf("check-a%v", i+1), "check-f1", fmt.Sprintf("Article %v", i+1),
+			fmt.Sprintf("https://example.com/one/%v", i+1), published)
+		if err != nil {
+			return err
+		}
+	}
+	err = s.ArticleAdd("check-b1", "check-f2", "Article B", "https://example.com/two/1", 150)
+	if err != nil {
+		return err
+	}
+	article, err = s.ArticleByURL("https://example.com/one/1")
+	if err := checkEq("new article", article, "check-a1", err); err != nil {
+		return err
+	}
+
+	seen, err := s.ArticlePrunedSeen("https://example.com/one/1", 500)
+	if err := checkEq("unpruned article", seen, false, err); err != nil {
+		return err
+	}
+	err = s.PrunedTrim("check-f1", 500)
+	if err != nil {
+		return err
+	}
+
+	unread, err := s.Unread("check-u1", "", NewPageParams(false, 10))
+	ids := []string{"check-a1", "check-b1", "check-a2", "check-a3", "check-a4"}
+	if err := checkEq("unread", checkUnreadIDs(unread), ids, err); err != nil {
+		return err
+	}
+	a := unread[0]
+	got := []interface{}{a.Feed, a.Title, a.URL, a.FeedName, a.Published.Unix()}
+	want := []interface{}{"check-f1", "Article 1", "https://example.com/one/1", "One", int64(100)}
+	if err := checkEq("unread article", got, want, nil); err != nil {
+		return err
+	}
+
+	err = s.SetFolder("check-u1", "check-f2", "News")
+	unread, err2 := s.Unread("check-u1", "News", NewPageParams(false, 10))
+	if err := checkEq("unread in folder", checkUnreadIDs(unread), []string{"check-b1"}, checkAll(err, err2)); err != nil {
+		return err
+	}
+
+	err = s.Pause("check-u1", "check-f1")
+	unread, err2 = s.Unread("check-u1", "", NewPageParams(false, 10))
+	err = checkEq("unread while paused", checkUnreadIDs(unread), []string{"check-b1"}, checkAll(err, err2))
+	if err != nil {
+		return err
+	}
+	_, err = s.UnreadArticle("check-u1", "check-a1")
+	if err := checkNotFound("unread article while paused", err); err != nil {
+		return err
+	}
+	err = s.Unpause("check-u1", "check-f1")
+	if err != nil {
+		return err
+	}
+
+	a, err = s.UnreadArticle("check-u2", "check-a1")
+	if err != nil {
+		return err
+	}
+	if err := checkEq("unread article name", a.FeedName, "Uno", nil); err != nil {
+		return err
+	}
+	unread, err = s.UnreadFeedArticles("check-u1", "check-f1", 2)
+	if err := checkEq("unread feed articles", checkUnreadIDs(unread), []string{"check-a1", "check-a2"}, err); err != nil {
+		return err
+	}
+
+	err = checkAll(
+		s.Star("check-u1", "check-a2"),
+		s.Star("check-u1", "check-a2"),
+		s.Star("check-u1", "check-a3"),
+		s.Unstar("check-u1", "check-a3"),
+	)
+	articles, err2 := s.FeedArticles("check-u1", "check-f1", NewPageParams(false, 10))
+	if err := checkAll(err, err2); err != nil {
+		return err
+	}
+	starred := []bool{}
+	for _, a := range articles {
+		starred = append(starred, a.Starred)
+	}
+	return checkEq("starred", starred, []bool{false, true, false, false}, nil)
+}
+
+// checkStoreRead checks the watermark and the exceptions on either side of it.
+func checkStoreRead(s Store) error {
+	err := s.MarkRead("check-u1", "check-x")
+	if err := checkNotFound("marking missing article", err); err != nil {
+		return err
+	}
+
+	// Reading out of order is an exception, the mark can't move past the unread article before it.
+	err = s.MarkRead("check-u1", "check-a2")
+	mark, err2 := s.ReadMark("check-u1", "check-f1")
+	if err := checkEq("mark with a gap", mark, int64(0), checkAll(err, err2)); err != nil {
+		return err
+	}
+
+	err = s.MarkRead("check-u1", "check-a1")
+	mark, err2 = s.ReadMark("check-u1", "check-f1")
+	if err := checkEq("mark after the gap", mark > 0, true, checkAll(err, err2)); err != nil {
+		return err
+	}
+	unread, err := s.Unread("check-u1", "", NewPageParams(false, 10))
+	err = checkEq("unread after marking", checkUnreadIDs(unread), []string{"check-b1", "check-a3", "check-a4"}, err)
+	if err != nil {
+		return err
+	}
+
+	// The mark dropped the exceptions it passed, so this is the only one.
+	err = s.MarkUnread("check-u1", "check-a1")
+	articles, err2 := s.FeedArticles("check-u1", "check-f1", NewPageParams(false, 10))
+	if err := checkAll(err, err2); err != nil {
+		return err
+	}
+	read := []bool{}
+	for _, a := range articles {
+		read = append(read, a.Read)
+	}
+	if err := checkEq("read flags", read, []bool{false, true, false, false}, nil); err != nil {
+		return err
+	}
+	err = s.MarkRead("check-u1", "check-a1")
+	_, err2 = s.UnreadArticle("check-u1", "check-a1")
+	if err := checkNotFound("cleared exception", checkAll(err, err2)); err != nil {
+		return err
+	}
+
+	err = checkAll(
+		s.MarkUnread("check-u1", "check-a2"),
+		s.FeedMarkRead("check-u1", "check-f1", 350),
+	)
+	unread, err2 = s.Unread("check-u1", "", NewPageParams(false, 10))
+	err = checkEq("unread after marking the feed", checkUnreadIDs(unread), []string{"check-b1", "check-a4"},
+		checkAll(err, err2))
+	if err != nil {
+		return err
+	}
+
+	unread, err = s.Unread("check-u2", "", NewPageParams(false, 10))
+	return checkEq("other user unread", len(unread), 4, err)
+}
+
+func checkStorePaging(s Store) error {
+	for _, newest := range []bool{false, true} {
+		want := []string{"check-a1", "check-a2", "check-a3", "check-a4"}
+		if newest {
+			want = []string{"check-a4", "check-a3", "check-a2", "check-a1"}
+		}
+
+		p := NewPageParams(newest, 2)
+		unread, err := s.Unread("check-u2", "", p)
+		if err := checkEq("first unread page", checkUnreadIDs(unread), want[:3], err); err != nil {
+			return err
+		}
+		p.Published, p.ID = unread[1].Published.Unix(), unread[1].ID
+		unread, err = s.Unread("check-u2", "", p)
+		if err := checkEq("second unread page", checkUnreadIDs(unread), want[2:], err); err != nil {
+			return err
+		}
+
+		p.Reset()
+		articles, err := s.FeedArticles("check-u2", "check-f1", p)
+		if err := checkEq("first feed page", len(articles), 3, err); err != nil {
+			return err
+		}
+		p.Published, p.ID = articles[1].Published.Unix(), articles[1].ID
+		articles, err = s.FeedArticles("check-u2", "check-f1", p)
+		if err := checkEq("second feed page", len(articles), 2, err); err != nil {
+			return err
+		}
+		if err := checkEq("second feed page", articles[0].ID, want[2], nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkStoreUnsubscribe(s Store) error {
+	err := checkAll(
+		s.Pause("check-u1", "check-f2"),
+		s.Star("check-u1", "check-b1"),
+		s.Unsubscribe("check-u1", "check-f2"),
+	)
+	ok, err2 := s.Subscribed("check-u1", "check-f2")
+	if err := checkEq("unsubscribed", ok, false, checkAll(err, err2)); err != nil {
+		return err
+	}
+	ok, err = s.HasSubscribers("check-f2")
+	if err := checkEq("no subscribers", ok, false, err); err != nil {
+		return err
+	}
+	feeds, err := s.FolderFeeds("check-u1", "News")
+	if err := checkEq("folder after unsubscribing", feeds, []string{}, err); err != nil {
+		return err
+	}
+
+	// Nobody else was subscribed, so the feed is gone.
+	feed, err := s.FeedByURL("https://example.com/two")
+	if err := checkEq("deleted feed", feed, "", err); err != nil {
+		return err
+	}
+	article, err := s.ArticleByURL("https://example.com/two/1")
+	if err := checkEq("articles of deleted feed", article, "", err); err != nil {
+		return err
+	}
+
+	// Subscribing again starts from scratch.
+	feed, added, _, err := s.Subscribe("check-u1", "https://example.com/two", "check-f5", "Two")
+	if err := checkEq("resubscribing", []interface{}{feed, added}, []interface{}{"check-f5", true}, err); err != nil {
+		return err
+	}
+	f, err := checkFeed(s, "check-u1", "check-f5")
+	if err := checkEq("paused after resubscribing", f.Paused, false, err); err != nil {
+		return err
+	}
+
+	// The other user is still subscribed to this one.
+	err = s.Unsubscribe("check-u1", "check-f1")
+	feed, err2 = s.FeedByURL("https://example.com/one")
+	return checkEq("feed with another subscriber", feed, "check-f1", checkAll(err, err2))
+}
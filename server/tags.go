@@ -0,0 +1,166 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "time"
+import "strings"
+import "net/http"
+import "unicode/utf8"
+
+// Tags label individual articles, unlike folders which hold feeds. They only exist as long as some article has them.
+
+const MaxTagLength = 64
+
+// Most tag edits will be a handful of articles, but selecting a whole page and tagging it should work.
+const MaxTagArticles = 500
+
+// TagClean trims a tag and reports if what is left is usable.
+func TagClean(tag string) (string, bool) {
+	tag = strings.TrimSpace(tag)
+	return tag, tag != "" && utf8.RuneCountInString(tag) <= MaxTagLength
+}
+
+// /api/tag/add, /api/tag/remove
+// =====================================================================================================================
+
+type TagEditData struct {
+	Tag      string
+	Articles []string
+}
+
+// TagEdit adds or removes a tag on a set of articles. Articles the user can't see are skipped.
+func TagEdit(l *SessionLogger, user string, data *TagEditData, add bool) int {
+	tag, ok := TagClean(data.Tag)
+	if !ok {
+		l.W.Printf("Invalid tag: %q\n", data.Tag)
+		return http.StatusBadRequest
+	}
+	if len(data.Articles) == 0 || len(data.Articles) > MaxTagArticles {
+		l.W.Printf("Invalid article count for tag edit: %v\n", len(data.Articles))
+		return http.StatusBadRequest
+	}
+
+	q := "ArticleUntag"
+	if add {
+		q = "ArticleTag"
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		l.E.Printf("Failed starting tag transaction, error: %v\n", err)
+		return http.StatusInternalServerError
+	}
+	stmt := tx.Stmt(Queries[q].Preped)
+	for _, article := range data.Articles {
+		_, err := stmt.Exec(user, article, tag)
+		if err != nil {
+			l.E.Printf("Failed tagging article %v as user %v, error: %v\n", article, user, err)
+			tx.Rollback()
+			return http.StatusInternalServerError
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		l.E.Printf("Failed committing tag transaction, error: %v\n", err)
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
+
+// /api/tag/list
+// =====================================================================================================================
+
+type TagCount struct {
+	Tag   string
+	Count int
+}
+
+func TagList(l *SessionLogger, user string) []*TagCount {
+	rows, err := Queries["TagCounts"].Preped.Query(user)
+	if err != nil {
+		l.E.Printf("Tag list failed for user %v, error: %v\n", user, err)
+		return nil
+	}
+	defer rows.Close()
+
+	tags := []*TagCount{}
+	for rows.Next() {
+		t := &TagCount{}
+		err := rows.Scan(&t.Tag, &t.Count)
+		if err != nil {
+			l.E.Printf("Tag list failed for user %v, error: %v\n", user, err)
+			return nil
+		}
+		tags = append(tags, t)
+	}
+	return tags
+}
+
+// /api/tag/articles
+// =====================================================================================================================
+
+type TaggedArticle struct {
+	ID        string
+	Title     string
+	URL       string
+	FeedName  string
+	Published time.Time
+	Read      bool
+	Starred   bool
+}
+
+type TaggedPage struct {
+	Articles []*TaggedArticle
+	Next     string // Cursor for the next page, empty if this is the last one.
+}
+
+func TagArticles(l *SessionLogger, user, tag string, p *PageParams) *TaggedPage {
+	rows, err := Queries["TagArticles"+p.Query()].Preped.Query(user, tag, p.Published, p.ID, p.Limit+1)
+	if err != nil {
+		l.E.Printf("Tagged article list failed for tag %q, user %v. Error: %v\n", tag, user, err)
+		return nil
+	}
+	defer rows.Close()
+
+	page := &TaggedPage{Articles: []*TaggedArticle{}}
+	for rows.Next() {
+		a := &TaggedArticle{}
+		var stamp int64
+		err := rows.Scan(&a.ID, &a.Title, &a.URL, &a.FeedName, &stamp, &a.Read, &a.Starred)
+		if err != nil {
+			l.E.Printf("Tagged article list failed for tag %q, user %v. Error: %v\n", tag, user, err)
+			return nil
+		}
+		a.Published = time.Unix(stamp, 0)
+
+		// We always ask for one more than we need so we know if there is another page.
+		if len(page.Articles) == p.Limit {
+			last := page.Articles[p.Limit-1]
+			page.Next = Cursor(last.Published.Unix(), last.ID)
+			break
+		}
+		page.Articles = append(page.Articles, a)
+	}
+	return page
+}
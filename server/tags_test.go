@@ -0,0 +1,76 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "testing"
+import "net/http"
+
+func TestTags(t *testing.T) {
+	testDB(t, func(t *testing.T) {
+		testUser(t, "u1", "one@example.com")
+		testUser(t, "u2", "two@example.com")
+		feed := testFeed(t, "https://example.com/feed", "u1")
+		ids := testIngest(t, feed,
+			testItem("https://example.com/1", "One", 1),
+			testItem("https://example.com/2", "Two", 2),
+			testItem("https://example.com/3", "Three", 3),
+		)
+
+		testStatus(t, "empty tag", TagEdit(ml, "u1", &TagEditData{Tag: " ", Articles: ids}, true), http.StatusBadRequest)
+		testStatus(t, "no articles", TagEdit(ml, "u1", &TagEditData{Tag: "later"}, true), http.StatusBadRequest)
+		testStatus(t, "add", TagEdit(ml, "u1", &TagEditData{Tag: " later ", Articles: ids}, true), http.StatusOK)
+		testStatus(t, "add again", TagEdit(ml, "u1", &TagEditData{Tag: "later", Articles: ids[:1]}, true), http.StatusOK)
+		testStatus(t, "other tag", TagEdit(ml, "u1", &TagEditData{Tag: "best", Articles: ids[1:2]}, true), http.StatusOK)
+
+		// u2 can't see the feed, so nothing is tagged.
+		testStatus(t, "unsubscribed", TagEdit(ml, "u2", &TagEditData{Tag: "later", Articles: ids}, true), http.StatusOK)
+		if tags := TagList(ml, "u2"); len(tags) != 0 {
+			t.Fatalf("Unsubscribed user got tags: %+v", tags)
+		}
+
+		testStatus(t, "remove", TagEdit(ml, "u1", &TagEditData{Tag: "later", Articles: ids[2:]}, false), http.StatusOK)
+		tags := TagList(ml, "u1")
+		counts := map[string]int{}
+		for _, c := range tags {
+			counts[c.Tag] = c.Count
+		}
+		if len(counts) != 2 || counts["later"] != 2 || counts["best"] != 1 {
+			t.Fatalf("Tag counts: %+v", counts)
+		}
+
+		// Newest first, one per page.
+		p := NewPageParams(true, 1)
+		page := TagArticles(ml, "u1", "later", p)
+		if page == nil || len(page.Articles) != 1 || page.Articles[0].ID != ids[1] || page.Next == "" {
+			t.Fatalf("First page: %+v", page)
+		}
+		p.Published, p.ID = page.Articles[0].Published.Unix(), page.Articles[0].ID
+		page = TagArticles(ml, "u1", "later", p)
+		if page == nil || len(page.Articles) != 1 || page.Articles[0].ID != ids[0] || page.Next != "" {
+			t.Fatalf("Second page: %+v", page)
+		}
+		if page.Articles[0].FeedName != "Feed https://example.com/feed" {
+			t.Fatalf("Feed name: %v", page.Articles[0].FeedName)
+		}
+	})
+}
@@ -0,0 +1,526 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "io"
+import "os"
+import "net"
+import "time"
+import "bytes"
+import "errors"
+import "context"
+import "strconv"
+import "syscall"
+import "net/url"
+import "net/http"
+import "io/ioutil"
+import "crypto/hmac"
+import "crypto/rand"
+import "crypto/sha256"
+import "database/sql"
+import "encoding/hex"
+import "encoding/json"
+
+import "github.com/teris-io/shortid"
+
+// Webhooks get a JSON POST for every new article in the feeds they watch. The body is signed with the hook's secret,
+// the signature is in the X-RSN2-Signature header as "sha256=<hex HMAC of the body>".
+
+const WebhookWorkers = 4
+const WebhookQueueSize = 1000
+
+// How many deliveries are kept in the log for each hook.
+const WebhookLogSize = 100
+
+// How long to wait before each retry, a delivery is given up on after the last one.
+var WebhookRetries = []time.Duration{30 * time.Second, 2 * time.Minute, 10 * time.Minute, 30 * time.Minute}
+
+// Webhooks are added by users, so by default they may only point at public addresses. Set this to let them reach
+// loopback, private, and link-local addresses too (for example a bot running on the same machine).
+var WebhookAllowPrivate = os.Getenv("RSN2_WEBHOOK_ALLOW_PRIVATE") != ""
+
+var errWebhookAddress = errors.New("webhook destination address not allowed")
+
+// Ranges that net.IP has no method for.
+var webhookPrivateNets = []*net.IPNet{
+	webhookCIDR("10.0.0.0/8"),
+	webhookCIDR("172.16.0.0/12"),
+	webhookCIDR("192.168.0.0/16"),
+	webhookCIDR("100.64.0.0/10"),
+	webhookCIDR("0.0.0.0/8"),
+	webhookCIDR("fc00::/7"),
+}
+
+func webhookCIDR(raw string) *net.IPNet {
+	_, n, err := net.ParseCIDR(raw)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// webhookAddressAllowed returns false for any address that isn't on the public internet, unless those are allowed.
+func webhookAddressAllowed(ip net.IP) bool {
+	if WebhookAllowPrivate {
+		return true
+	}
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range webhookPrivateNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// The address is checked again when connecting, after DNS, so a host can't be pointed somewhere else after the hook
+// is added. This also covers redirects. There is no proxy support, as the proxy would be the address checked.
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(host)
+				if ip == nil || !webhookAddressAllowed(ip) {
+					return errWebhookAddress
+				}
+				return nil
+			},
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	},
+}
+
+// webhookCheckHost makes sure every address the host resolves to is allowed.
+func webhookCheckHost(host string) error {
+	ips, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if !webhookAddressAllowed(ip.IP) {
+			return errWebhookAddress
+		}
+	}
+	return nil
+}
+
+// webhookError turns the result of a delivery into something safe to show the user. The real error could say things
+// about the network the server is on, so that only goes in the server log.
+func webhookError(status int, err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case status != 0:
+		return "Unexpected status."
+	default:
+		return "Delivery failed."
+	}
+}
+
+var webhookQueue = make(chan *webhookJob, WebhookQueueSize)
+
+var webhookIDService <-chan string
+
+func init() {
+	c := make(chan string)
+	webhookIDService = c
+	go func() {
+		idsource := shortid.MustNew(8, shortid.DefaultABC, uint64(time.Now().UnixNano()))
+
+		for {
+			c <- idsource.MustGenerate()
+		}
+	}()
+}
+
+type Webhook struct {
+	ID      string
+	Feed    string // Empty for every feed.
+	URL     string
+	Secret  string
+	Created int64
+}
+
+type WebhookPayload struct {
+	Event    string // "article" or "test"
+	Delivery int64
+	Time     int64
+	Feed     *WebhookFeed
+	Article  *WebhookArticle
+}
+
+type WebhookFeed struct {
+	ID   string
+	Name string
+	URL  string
+}
+
+type WebhookArticle struct {
+	ID        string
+	Title     string
+	URL       string
+	Published int64
+}
+
+type WebhookDelivery struct {
+	ID       int64
+	Event    string
+	Article  string
+	Attempts int
+	Status   int // HTTP status of the last attempt, 0 if there was no response.
+	Error    string
+	Time     int64
+}
+
+type webhookJob struct {
+	hook     string
+	url      string
+	secret   string
+	event    string
+	delivery int64
+	body     []byte
+	attempts int
+}
+
+// Delivery
+// =====================================================================================================================
+
+// WebhookJob runs the delivery workers.
+func WebhookJob() {
+	l := newSessionLogger("webhooks")
+	l.I.Println("Starting webhook workers.")
+
+	for i := 0; i < WebhookWorkers; i++ {
+		go func() {
+			for job := range webhookQueue {
+				webhookDeliver(l, job)
+			}
+		}()
+	}
+}
+
+// WebhookArticleAdded queues a delivery to every hook watching the feed.
+func WebhookArticleAdded(l *SessionLogger, feed, article, title, link string, published time.Time) {
+	rows, err := Queries["WebhooksForFeed"].Preped.Query(feed)
+	if err != nil {
+		l.E.Printf("Cannot list webhooks for feed %v, error: %v\n", feed, err)
+		return
+	}
+
+	jobs := []*webhookJob{}
+	payloads := []*WebhookPayload{}
+	for rows.Next() {
+		job := &webhookJob{event: "article"}
+		p := &WebhookPayload{
+			Event:   "article",
+			Feed:    &WebhookFeed{ID: feed},
+			Article: &WebhookArticle{ID: article, Title: title, URL: link, Published: published.Unix()},
+		}
+		err := rows.Scan(&job.hook, &job.url, &job.secret, &p.Feed.Name, &p.Feed.URL)
+		if err != nil {
+			l.E.Printf("Cannot list webhooks for feed %v, error: %v\n", feed, err)
+			rows.Close()
+			return
+		}
+		jobs = append(jobs, job)
+		payloads = append(payloads, p)
+	}
+	rows.Close()
+
+	for i, job := range jobs {
+		if !webhookPrepare(l, job, article, payloads[i]) {
+			continue
+		}
+
+		select {
+		case webhookQueue <- job:
+		default:
+			l.W.Printf("Webhook queue full, dropping delivery %v.\n", job.delivery)
+			webhookLog(l, job, 0, "Delivery queue full.")
+		}
+	}
+}
+
+// webhookPrepare logs the new delivery and fills in the body.
+func webhookPrepare(l *SessionLogger, job *webhookJob, article string, p *WebhookPayload) bool {
+	var err error
+	job.delivery, err = Queries["WebhookDeliveryAdd"].InsertID(job.hook, job.event, article, time.Now().Unix())
+	if err != nil {
+		l.E.Printf("Cannot log delivery for webhook %v, error: %v\n", job.hook, err)
+		return false
+	}
+
+	_, err = Queries["WebhookDeliveryTrim"].Preped.Exec(job.hook, WebhookLogSize)
+	if err != nil {
+		l.E.Printf("Cannot trim delivery log for webhook %v, error: %v\n", job.hook, err)
+	}
+
+	p.Delivery = job.delivery
+	p.Time = time.Now().Unix()
+	job.body, err = json.Marshal(p)
+	if err != nil {
+		l.E.Printf("Error encoding webhook payload. Error: %v\n", err)
+		return false
+	}
+	return true
+}
+
+// webhookSend makes one attempt at a delivery.
+func webhookSend(job *webhookJob) (int, error) {
+	mac := hmac.New(sha256.New, []byte(job.secret))
+	mac.Write(job.body)
+
+	req, err := http.NewRequest(http.MethodPost, job.url, bytes.NewReader(job.body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "RSN2-Webhook")
+	req.Header.Set("X-RSN2-Event", job.event)
+	req.Header.Set("X-RSN2-Delivery", strconv.FormatInt(job.delivery, 10))
+	req.Header.Set("X-RSN2-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, errors.New("unexpected status: " + resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// webhookDeliver tries a delivery, scheduling a retry if it fails.
+func webhookDeliver(l *SessionLogger, job *webhookJob) {
+	job.attempts++
+	status, err := webhookSend(job)
+	if err == nil {
+		webhookLog(l, job, status, "")
+		return
+	}
+	l.W.Printf("Delivery %v to webhook %v failed, error: %v\n", job.delivery, job.hook, err)
+	webhookLog(l, job, status, webhookError(status, err))
+
+	if job.attempts > len(WebhookRetries) {
+		l.W.Printf("Giving up on delivery %v to webhook %v, error: %v\n", job.delivery, job.hook, err)
+		return
+	}
+	time.AfterFunc(WebhookRetries[job.attempts-1], func() {
+		select {
+		case webhookQueue <- job:
+		default:
+			l.W.Printf("Webhook queue full, dropping retry of delivery %v.\n", job.delivery)
+		}
+	})
+}
+
+func webhookLog(l *SessionLogger, job *webhookJob, status int, msg string) {
+	_, err := Queries["WebhookDeliveryUpdate"].Preped.Exec(job.delivery, job.attempts, status, msg, time.Now().Unix())
+	if err != nil {
+		l.E.Printf("Cannot log delivery %v for webhook %v, error: %v\n", job.delivery, job.hook, err)
+	}
+}
+
+// /api/webhook/list
+// =====================================================================================================================
+
+func WebhookList(l *SessionLogger, user string) []*Webhook {
+	rows, err := Queries["WebhookList"].Preped.Query(user)
+	if err != nil {
+		l.E.Printf("Webhook list failed for user %v, error: %v\n", user, err)
+		return nil
+	}
+	defer rows.Close()
+
+	hooks := []*Webhook{}
+	for rows.Next() {
+		h := &Webhook{}
+		err := rows.Scan(&h.ID, &h.Feed, &h.URL, &h.Secret, &h.Created)
+		if err != nil {
+			l.E.Printf("Webhook list failed for user %v, error: %v\n", user, err)
+			return nil
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks
+}
+
+func webhookGet(l *SessionLogger, user, hook string) (*Webhook, int) {
+	h := &Webhook{}
+	err := Queries["WebhookGet"].Preped.QueryRow(user, hook).Scan(&h.ID, &h.Feed, &h.URL, &h.Secret, &h.Created)
+	if err == sql.ErrNoRows {
+		l.W.Printf("Webhook %v not found for user %v.\n", hook, user)
+		return nil, http.StatusBadRequest
+	}
+	if err != nil {
+		l.E.Printf("Failed loading webhook %v for user %v, error: %v\n", hook, user, err)
+		return nil, http.StatusInternalServerError
+	}
+	return h, http.StatusOK
+}
+
+// /api/webhook/add
+// =====================================================================================================================
+
+type WebhookAddData struct {
+	URL  string
+	Feed string // Empty for every feed.
+}
+
+func WebhookAdd(l *SessionLogger, user string, data *WebhookAddData) (*Webhook, int) {
+	u, err := url.ParseRequestURI(data.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		l.W.Printf("Malformed webhook URL: %v\n", data.URL)
+		return nil, http.StatusBadRequest
+	}
+
+	err = webhookCheckHost(u.Hostname())
+	if err != nil {
+		l.W.Printf("Webhook URL %v not allowed, error: %v\n", data.URL, err)
+		return nil, http.StatusBadRequest
+	}
+
+	if data.Feed != "" {
+		ok, err := Data.Subscribed(user, data.Feed)
+		if err != nil {
+			l.E.Printf("DB existence check failed for subscribed feed %v by user %v, error: %v\n", data.Feed, user, err)
+			return nil, http.StatusInternalServerError
+		}
+		if !ok {
+			l.W.Printf("Feed %v not subscribed by user %v.\n", data.Feed, user)
+			return nil, http.StatusBadRequest
+		}
+	}
+
+	secret := make([]byte, 32)
+	_, err = rand.Read(secret)
+	if err != nil {
+		l.E.Printf("Cannot generate webhook secret, error: %v\n", err)
+		return nil, http.StatusInternalServerError
+	}
+
+	h := &Webhook{
+		ID:      <-webhookIDService,
+		Feed:    data.Feed,
+		URL:     data.URL,
+		Secret:  hex.EncodeToString(secret),
+		Created: time.Now().Unix(),
+	}
+	_, err = Queries["WebhookAdd"].Preped.Exec(h.ID, user, h.Feed, h.URL, h.Secret, h.Created)
+	if err != nil {
+		l.E.Printf("Cannot add webhook for user %v, error: %v\n", user, err)
+		return nil, http.StatusInternalServerError
+	}
+	return h, http.StatusOK
+}
+
+// /api/webhook/delete
+// =====================================================================================================================
+
+func WebhookDelete(l *SessionLogger, user, hook string) int {
+	for _, q := range []string{"WebhookDelete1", "WebhookDelete2"} {
+		_, err := Queries[q].Preped.Exec(user, hook)
+		if err != nil {
+			l.E.Printf("Failed deleting webhook %v for user %v, error: %v\n", hook, user, err)
+			return http.StatusInternalServerError
+		}
+	}
+	return http.StatusOK
+}
+
+// /api/webhook/deliveries
+// =====================================================================================================================
+
+func WebhookDeliveries(l *SessionLogger, user, hook string) ([]*WebhookDelivery, int) {
+	if h, status := webhookGet(l, user, hook); h == nil {
+		return nil, status
+	}
+
+	rows, err := Queries["WebhookDeliveries"].Preped.Query(hook)
+	if err != nil {
+		l.E.Printf("Delivery list failed for webhook %v, error: %v\n", hook, err)
+		return nil, http.StatusInternalServerError
+	}
+	defer rows.Close()
+
+	deliveries := []*WebhookDelivery{}
+	for rows.Next() {
+		d := &WebhookDelivery{}
+		err := rows.Scan(&d.ID, &d.Event, &d.Article, &d.Attempts, &d.Status, &d.Error, &d.Time)
+		if err != nil {
+			l.E.Printf("Delivery list failed for webhook %v, error: %v\n", hook, err)
+			return nil, http.StatusInternalServerError
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, http.StatusOK
+}
+
+// /api/webhook/test
+// =====================================================================================================================
+
+// WebhookTest sends a test delivery right away and reports how it went. Test deliveries are not retried.
+func WebhookTest(l *SessionLogger, user, hook string) (*WebhookDelivery, int) {
+	h, status := webhookGet(l, user, hook)
+	if h == nil {
+		return nil, status
+	}
+
+	job := &webhookJob{hook: h.ID, url: h.URL, secret: h.Secret, event: "test"}
+	p := &WebhookPayload{
+		Event: "test",
+		Feed:  &WebhookFeed{},
+		Article: &WebhookArticle{
+			Title:     "RSN2 webhook test",
+			Published: time.Now().Unix(),
+		},
+	}
+	if !webhookPrepare(l, job, "", p) {
+		return nil, http.StatusInternalServerError
+	}
+
+	job.attempts++
+	status, err := webhookSend(job)
+	d := &WebhookDelivery{ID: job.delivery, Event: job.event, Attempts: job.attempts, Status: status, Time: time.Now().Unix()}
+	if err != nil {
+		l.W.Printf("Test delivery %v to webhook %v failed, error: %v\n", job.delivery, job.hook, err)
+		d.Error = webhookError(status, err)
+	}
+	webhookLog(l, job, d.Status, d.Error)
+	return d, http.StatusOK
+}
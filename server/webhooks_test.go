@@ -0,0 +1,118 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "testing"
+import "net/http"
+import "io/ioutil"
+import "sync/atomic"
+import "crypto/hmac"
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/json"
+import "net/http/httptest"
+
+func TestWebhooks(t *testing.T) {
+	type delivery struct {
+		signature string
+		body      []byte
+	}
+	got := make(chan *delivery, 10)
+	status := int32(http.StatusOK)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		got <- &delivery{signature: r.Header.Get("X-RSN2-Signature"), body: body}
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer hook.Close()
+
+	defer func(allow bool) { WebhookAllowPrivate = allow }(WebhookAllowPrivate)
+
+	testDB(t, func(t *testing.T) {
+		testUser(t, "u1", "one@example.com")
+		testUser(t, "u2", "two@example.com")
+		feed := testFeed(t, "https://example.com/feed", "u1")
+
+		// The test server is on loopback, which is only allowed if the operator says so.
+		WebhookAllowPrivate = false
+		_, code := WebhookAdd(ml, "u1", &WebhookAddData{URL: hook.URL})
+		testStatus(t, "private address", code, http.StatusBadRequest)
+		WebhookAllowPrivate = true
+
+		_, code = WebhookAdd(ml, "u1", &WebhookAddData{URL: "ftp://example.com/"})
+		testStatus(t, "not HTTP", code, http.StatusBadRequest)
+		_, code = WebhookAdd(ml, "u2", &WebhookAddData{URL: hook.URL, Feed: feed})
+		testStatus(t, "unsubscribed feed", code, http.StatusBadRequest)
+		h, code := WebhookAdd(ml, "u1", &WebhookAddData{URL: hook.URL, Feed: feed})
+		testStatus(t, "add", code, http.StatusOK)
+
+		// New articles queue a delivery, which the workers would normally pick up.
+		ids := testIngest(t, feed, testItem("https://example.com/1", "One", 1))
+		select {
+		case job := <-webhookQueue:
+			webhookDeliver(ml, job)
+		default:
+			t.Fatal("No delivery was queued for the new article")
+		}
+		d := <-got
+		mac := hmac.New(sha256.New, []byte(h.Secret))
+		mac.Write(d.body)
+		if d.signature != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Fatalf("Bad signature %v", d.signature)
+		}
+		p := &WebhookPayload{}
+		err := json.Unmarshal(d.body, p)
+		if err != nil || p.Event != "article" || p.Article.ID != ids[0] || p.Feed.ID != feed {
+			t.Fatalf("Payload %s, error: %v", d.body, err)
+		}
+
+		test, code := WebhookTest(ml, "u1", h.ID)
+		testStatus(t, "test", code, http.StatusOK)
+		<-got
+		if test.Status != http.StatusOK || test.Error != "" {
+			t.Fatalf("Test delivery: %+v", test)
+		}
+
+		// Failures are reported without the details.
+		atomic.StoreInt32(&status, http.StatusInternalServerError)
+		test, _ = WebhookTest(ml, "u1", h.ID)
+		<-got
+		atomic.StoreInt32(&status, http.StatusOK)
+		if test.Status != http.StatusInternalServerError || test.Error != "Unexpected status." {
+			t.Fatalf("Failed test delivery: %+v", test)
+		}
+
+		deliveries, code := WebhookDeliveries(ml, "u1", h.ID)
+		testStatus(t, "deliveries", code, http.StatusOK)
+		if len(deliveries) != 3 || deliveries[2].Article != ids[0] || deliveries[2].Status != http.StatusOK {
+			t.Fatalf("Deliveries: %+v", deliveries)
+		}
+		_, code = WebhookDeliveries(ml, "u2", h.ID)
+		testStatus(t, "other user's deliveries", code, http.StatusBadRequest)
+
+		testStatus(t, "delete", WebhookDelete(ml, "u1", h.ID), http.StatusOK)
+		if hooks := WebhookList(ml, "u1"); len(hooks) != 0 {
+			t.Fatalf("Hooks left after deleting: %+v", hooks)
+		}
+	})
+}
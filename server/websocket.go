@@ -22,74 +22,537 @@ misrepresented as being the original software.
 
 package main
 
+import "sort"
 import "sync"
+import "time"
+import "strings"
 import "net/http"
+import "encoding/json"
 
 import "github.com/gorilla/websocket"
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+	CheckOrigin:     CheckOrigin,
+}
+
+// Version of the websocket protocol, sent with every message. Clients that don't know it should reload.
+const ProtocolVersion = 2
+
+// The most articles sent in one event, for things like unpausing a feed. Clients fetch anything past this from
+// /api/article/list like any other page.
+const MaxEventArticles = 500
+
+// How long events are kept for clients that reconnect, and the most kept for any one user. A client that missed more
+// than this gets a new hello instead.
+const EventLogWindow = 15 * time.Minute
+const EventLogSize = 1000
+
+// Event is the envelope for everything sent over the websocket. The client gets a hello with the first page of unread
+// articles when it connects, after that it only gets changes:
+//
+//	hello             *UnreadPage
+//	article.added     *ArticlesEvent, new unread articles.
+//	article.unread    *ArticlesEvent, articles that were marked unread.
+//	article.read      *ArticleIDsEvent
+//	article.starred   *ArticleIDsEvent
+//	article.unstarred *ArticleIDsEvent
+//	feed.read         *FeedReadEvent, everything in the feed published before the given time is read.
+//	feed.paused       *FeedEvent, drop everything from the feed.
+//	feed.unpaused     *FeedEvent, its unread articles follow in an article.added.
+//	feed.removed      *FeedEvent, the user unsubscribed from the feed.
+//	feed.error        *FeedErrorEvent, a feed started failing or (if Error is empty) recovered.
+//	feed.moved        *FeedFolderEvent, the feed was filed under a different folder.
+//	reply             *CommandReply, the result of a command sent by this connection.
+//
+// Seq increases with every event sent to a user. A client that reconnects with ?since=<last Seq it saw> gets only the
+// events it missed, or a hello if they are no longer available. The hello has the Seq of the last event it includes.
+// Replies are only for the connection that sent the command, they have no Seq.
+type Event struct {
+	Version int
+	Seq     int64
+	Type    string
+	Data    interface{}
+
+	sent time.Time
+}
+
+type ArticlesEvent struct {
+	Articles []*UnreadArticle
+}
+
+type ArticleIDsEvent struct {
+	Articles []string
+}
+
+type FeedEvent struct {
+	Feed string
+}
+
+type FeedReadEvent struct {
+	Feed   string
+	Before int64
+}
+
+type FeedErrorEvent struct {
+	Feed  string
+	Error string
 }
 
+type FeedFolderEvent struct {
+	Feed   string
+	Folder string
+}
+
+// Command is something the client wants done, so it doesn't need a separate HTTP request:
+//
+//	article.read    Article
+//	article.unread  Article
+//	article.star    Article
+//	article.unstar  Article
+//	view            Folder, only send articles from feeds in this folder, or from every feed if empty. A new hello
+//	                follows.
+//
+// Every command gets a reply with the HTTP status the equivalent API call would have returned.
+type Command struct {
+	ID      string // Anything the client likes, it is sent back with the reply.
+	Type    string
+	Article string
+	Folder  string
+}
+
+type CommandReply struct {
+	ID     string
+	Status int
+}
+
+func NewEvent(typ string, data interface{}) *Event {
+	return &Event{Version: ProtocolVersion, Type: typ, Data: data}
+}
+
+// Each connection has its own queue, so one slow connection can't hold up anything else. When a queue fills up the
+// events in it are dropped and the connection gets a new hello instead. If it fills up again before that hello is even
+// written the connection is closed, the client will reconnect when it can keep up.
+const ConnQueueSize = 64
+
+// The longest a single write may take before the connection is considered dead.
+const ConnWriteTimeout = 10 * time.Second
+
+// Clients must answer a ping within ConnPongWait. Browsers do this on their own.
+const ConnPongWait = 60 * time.Second
+const ConnPingPeriod = 50 * time.Second
+
+// Commands are tiny, anything bigger than this is not a command.
+const ConnReadLimit = 4096
+
 type client struct {
 	sync.RWMutex
 
-	conns map[*websocket.Conn]chan []*UnreadArticle
+	conns map[*clientConn]bool
+	left  time.Time // When the last connection closed.
 
-	messages chan []*UnreadArticle // For sending pre-marshaled JSON
+	seq int64
+	log []*Event // Oldest first.
 }
 
-func (c *client) newBabysitter(l *SessionLogger, conn *websocket.Conn, user string) {
-	incoming := make(chan []*UnreadArticle)
+func newClient() *client {
+	// Starting from the clock means a Seq from before a restart is always behind, so those clients get a hello.
+	return &client{
+		conns: make(map[*clientConn]bool),
+		seq:   time.Now().UnixNano() / int64(time.Millisecond),
+	}
+}
+
+// eventConn is where a clientConn sends events, a websocket or an event stream.
+type eventConn interface {
+	WriteEvent(e *Event) error
+	Ping() error
+
+	// Close may be called while a write is in progress, and should make it fail.
+	Close() error
+}
+
+// clientConn is the send queue for one connection.
+type clientConn struct {
+	sync.Mutex
+
+	conn eventConn
+	ping time.Duration
+	wake chan struct{}
+
+	pending []*Event
+	resync  bool // Send a hello before anything in pending.
+	closed  bool
+
+	// The folder view, if any.
+	folder string
+	feeds  map[string]bool
+}
+
+func newClientConn(conn eventConn, ping time.Duration, folder string, feeds []string) *clientConn {
+	return &clientConn{
+		conn:   conn,
+		ping:   ping,
+		wake:   make(chan struct{}, 1),
+		folder: folder,
+		feeds:  viewFeeds(folder, feeds),
+	}
+}
+
+func viewFeeds(folder string, feeds []string) map[string]bool {
+	if folder == "" {
+		return nil
+	}
+	view := map[string]bool{}
+	for _, feed := range feeds {
+		view[feed] = true
+	}
+	return view
+}
+
+func (cc *clientConn) signal() {
+	select {
+	case cc.wake <- struct{}{}:
+	default:
+	}
+}
+
+// push queues an event, returning false if the connection should be evicted.
+func (cc *clientConn) push(e *Event) bool {
+	cc.Lock()
+	defer cc.Unlock()
+
+	if cc.closed {
+		return true
+	}
+	if len(cc.pending) >= ConnQueueSize {
+		if cc.resync {
+			cc.closed = true
+			cc.signal()
+			return false
+		}
+
+		// Any number of dropped events are covered by one hello.
+		cc.pending = nil
+		cc.resync = true
+	} else {
+		cc.pending = append(cc.pending, e)
+	}
+	cc.signal()
+	return true
+}
+
+func (cc *clientConn) take() ([]*Event, bool, string, bool) {
+	cc.Lock()
+	defer cc.Unlock()
+
+	pending, resync := cc.pending, cc.resync
+	cc.pending, cc.resync = nil, false
+	return pending, resync, cc.folder, cc.closed
+}
+
+// close tells the babysitter to stop.
+func (cc *clientConn) close() {
+	cc.Lock()
+	defer cc.Unlock()
+
+	cc.closed = true
+	cc.signal()
+}
+
+// setView switches the connection to a folder view. feeds must be the feeds in the folder.
+func (cc *clientConn) setView(folder string, feeds []string) {
+	cc.Lock()
+	defer cc.Unlock()
+
+	cc.folder, cc.feeds = folder, viewFeeds(folder, feeds)
+	cc.resync = true
+	cc.signal()
+}
+
+// filter returns what of an event belongs in the connection's view, or nil if none of it does.
+func (cc *clientConn) filter(e *Event) *Event {
+	cc.Lock()
+	defer cc.Unlock()
+
+	if cc.folder == "" {
+		return e
+	}
+
+	switch data := e.Data.(type) {
+	case *ArticlesEvent:
+		articles := []*UnreadArticle{}
+		for _, a := range data.Articles {
+			if cc.feeds[a.Feed] {
+				articles = append(articles, a)
+			}
+		}
+		if len(articles) == 0 {
+			return nil
+		}
+		filtered := *e
+		filtered.Data = &ArticlesEvent{Articles: articles}
+		return &filtered
+	case *FeedFolderEvent:
+		// The view is now missing articles or has extra ones, easiest to start over.
+		in := data.Folder == cc.folder
+		if cc.feeds[data.Feed] != in {
+			cc.feeds[data.Feed] = in
+			cc.resync = true
+			cc.signal()
+		}
+	}
+	return e
+}
+
+type wsConn struct {
+	*websocket.Conn
+}
+
+func (conn wsConn) WriteEvent(e *Event) error {
+	conn.SetWriteDeadline(time.Now().Add(ConnWriteTimeout))
+	return conn.WriteJSON(e)
+}
+
+func (conn wsConn) Ping() error {
+	return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(ConnWriteTimeout))
+}
+
+// missed returns the events after since, or false if some of them are gone. Must be called with the lock held.
+func (c *client) missed(since int64) ([]*Event, bool) {
+	if since < 0 || since > c.seq {
+		return nil, false
+	}
+	if since == c.seq {
+		return nil, true
+	}
+	if len(c.log) == 0 || c.log[0].Seq > since+1 {
+		return nil, false
+	}
+
+	i := sort.Search(len(c.log), func(i int) bool { return c.log[i].Seq > since })
+	if len(c.log)-i > ConnQueueSize {
+		return nil, false
+	}
+	return append([]*Event(nil), c.log[i:]...), true
+}
+
+// Seq returns the Seq of the last event sent.
+func (c *client) Seq() int64 {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.seq
+}
+
+// add registers a connection, queueing whatever it needs to catch up. Connections are registered before getting the
+// snapshot, so nothing that happens in between is missed.
+func (c *client) add(l *SessionLogger, cc *clientConn, since int64) {
+	c.Lock()
+	defer c.Unlock()
+
+	missed, ok := c.missed(since)
+	if ok {
+		cc.pending = missed
+	} else {
+		if since != 0 {
+			l.I.Printf("Events since %v are gone, sending hello.\n", since)
+		}
+		cc.resync = true
+	}
+	c.conns[cc] = true
+	cc.signal()
+}
+
+// newBabysitter writes everything queued for a connection until it is closed.
+func (c *client) newBabysitter(l *SessionLogger, cc *clientConn, user string, since int64) {
 	l.I.Println("Creating new conn baby sitter.")
+	defer l.I.Println("Conn baby sitter going away.")
 
-	// Send "hello" packet
-	unread := GetUnread(l, user)
-	if unread != nil {
-		err := conn.WriteJSON(unread)
-		if err != nil {
-			l.W.Println("Closed connection when trying to send hello packet: ", err)
-			conn.Close()
+	ping := time.NewTicker(cc.ping)
+	defer ping.Stop()
+
+	last := since
+	for {
+		select {
+		case <-ping.C:
+			err := cc.conn.Ping()
+			if err != nil {
+				l.W.Println("Closed connection when trying to send ping: ", err)
+				return
+			}
+			continue
+		case <-cc.wake:
+		}
+
+		pending, resync, folder, closed := cc.take()
+		if closed {
 			return
 		}
+
+		if resync {
+			// Send "hello" packet, this is the only time the client gets a full list. It is only the first page,
+			// clients fetch the rest from /api/article/list as needed.
+			seq := c.Seq()
+			unread := GetUnread(l, user, folder, NewPageParams(false, DefaultPageSize))
+			if unread == nil {
+				return
+			}
+			hello := NewEvent("hello", unread)
+			hello.Seq = seq
+
+			err := cc.conn.WriteEvent(hello)
+			if err != nil {
+				l.W.Println("Closed connection when trying to send hello packet: ", err)
+				return
+			}
+			last = seq
+		}
+
+		// Anything already covered by the hello can be skipped.
+		for _, e := range pending {
+			e = cc.filter(e)
+			if e == nil || e.Seq != 0 && e.Seq <= last {
+				continue
+			}
+
+			err := cc.conn.WriteEvent(e)
+			if err != nil {
+				l.W.Println("Closed connection when trying to send update packet: ", err)
+				return
+			}
+			if e.Seq != 0 {
+				last = e.Seq
+			}
+		}
 	}
+}
 
-	c.Lock()
-	c.conns[conn] = incoming
-	c.Unlock()
+// readCommands runs commands from a connection until it is closed. Reading is also how close frames, pongs, and dead
+// connections are noticed.
+func (c *client) readCommands(l *SessionLogger, cc *clientConn, conn *websocket.Conn, user string) {
+	defer cc.close()
+
+	conn.SetReadLimit(ConnReadLimit)
+	conn.SetReadDeadline(time.Now().Add(ConnPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(ConnPongWait))
+	})
 
 	for {
-		msg := <-incoming
-		err := conn.WriteJSON(msg)
+		_, msg, err := conn.ReadMessage()
 		if err != nil {
-			l.W.Println("Closed connection when trying to send update packet: ", err)
-			conn.Close()
-			c.Lock()
-			delete(c.conns, conn)
-			c.Unlock()
-			break
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				l.W.Println("Websocket connection lost: ", err)
+			}
+			return
+		}
+
+		cmd := &Command{}
+		status := http.StatusBadRequest
+		err = json.Unmarshal(msg, cmd)
+		if err != nil {
+			l.W.Printf("Invalid websocket command. Error: %v\n", err)
+		} else {
+			status = c.command(l, cc, user, cmd)
+		}
+
+		if !cc.push(NewEvent("reply", &CommandReply{ID: cmd.ID, Status: status})) {
+			l.W.Println("Websocket connection is not keeping up, closing it.")
+			return
 		}
 	}
-	l.I.Println("Conn baby sitter going away.")
 }
 
-func (c *client) Broadcast(unread []*UnreadArticle) {
-	c.RLock()
-	defer c.RUnlock()
+func (c *client) command(l *SessionLogger, cc *clientConn, user string, cmd *Command) int {
+	if strings.HasPrefix(cmd.Type, "article.") && cmd.Article == "" {
+		l.W.Printf("Missing article ID.\n")
+		return http.StatusBadRequest
+	}
 
-	for _, comm := range c.conns {
-		comm <- unread
+	switch cmd.Type {
+	case "article.read":
+		return ArticleMarkRead(l, user, cmd.Article)
+	case "article.unread":
+		return ArticleMarkUnread(l, user, cmd.Article)
+	case "article.star":
+		return ArticleStar(l, user, cmd.Article)
+	case "article.unstar":
+		return ArticleUnstar(l, user, cmd.Article)
+	case "view":
+		var feeds []string
+		if cmd.Folder != "" {
+			feeds = FolderFeeds(l, user, cmd.Folder)
+			if feeds == nil {
+				return http.StatusInternalServerError
+			}
+		}
+		cc.setView(cmd.Folder, feeds)
+		return http.StatusOK
+	default:
+		l.W.Printf("Unknown websocket command: %v\n", cmd.Type)
+		return http.StatusBadRequest
 	}
 }
 
-var Feeds = &dispatcher{
+// Broadcast numbers an event, logs it, and queues it for every connection. Nothing here waits on a connection.
+func (c *client) Broadcast(l *SessionLogger, e *Event) {
+	c.Lock()
+	c.seq++
+	e.Seq = c.seq
+	e.sent = time.Now()
+
+	c.log = append(c.log, e)
+	drop := 0
+	for drop < len(c.log) && (len(c.log)-drop > EventLogSize || e.sent.Sub(c.log[drop].sent) > EventLogWindow) {
+		drop++
+	}
+	if drop > 0 {
+		c.log = append([]*Event(nil), c.log[drop:]...)
+	}
+
+	evict := []*clientConn{}
+	for cc := range c.conns {
+		if !cc.push(e) {
+			evict = append(evict, cc)
+		}
+	}
+	c.Unlock()
+
+	// The babysitter may be stuck in a write, closing the connection gets it out.
+	for _, cc := range evict {
+		l.W.Println("Websocket connection is not keeping up, closing it.")
+		cc.conn.Close()
+	}
+}
+
+// Dispatcher gets events to users' connections. The in-process dispatcher only reaches connections to this process,
+// see broker.go for one that reaches every process.
+type Dispatcher interface {
+	Upgrade(l *SessionLogger, w http.ResponseWriter, r *http.Request, user string, since int64, folder string)
+	Stream(l *SessionLogger, w http.ResponseWriter, r *http.Request, user string, since int64, folder string)
+
+	// Connected reports if a user might have a connection open or be about to resume one, so events that are
+	// expensive to build can be skipped if not.
+	Connected(user string) bool
+
+	Send(l *SessionLogger, user, typ string, data interface{})
+}
+
+// Feeds is how everything sends events.
+var Feeds = &eventSender{Dispatcher: localEvents}
+
+var localEvents = &dispatcher{
 	clients: map[string]*client{},
 }
 
+// eventSender has the helpers for sending common events, on top of whatever dispatcher is in use.
+type eventSender struct {
+	Dispatcher
+}
+
+// A user's client is kept for EventLogWindow after their last connection closes, so they can still resume.
 type dispatcher struct {
 	sync.RWMutex
 
@@ -97,65 +560,159 @@ type dispatcher struct {
 	clients map[string]*client
 }
 
-func (d *dispatcher) Upgrade(l *SessionLogger, w http.ResponseWriter, r *http.Request, user string) {
+// Upgrade turns a request into a websocket connection for the user. since is the Seq of the last event the client has
+// seen, or 0 if it has seen nothing. If folder is not empty the connection starts in that folder's view.
+func (d *dispatcher) Upgrade(l *SessionLogger, w http.ResponseWriter, r *http.Request, user string, since int64, folder string) {
+	var feeds []string
+	if folder != "" {
+		feeds = FolderFeeds(l, user, folder)
+		if feeds == nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		l.E.Printf("Error upgrading websocket, error: %v\n", err)
 		return
 	}
+	cc := newClientConn(wsConn{conn}, ConnPingPeriod, folder, feeds)
+
+	c := d.add(l, cc, user, since)
+	go c.readCommands(l, cc, conn, user)
+	c.newBabysitter(l, cc, user, since)
 
-	// Get or create client for ID
+	conn.Close()
+	d.drop(c, cc)
+}
+
+// add registers a connection with the user's client, creating it if needed. The connection is added before letting go
+// of the dispatcher, so the client can't be cleaned up in between.
+func (d *dispatcher) add(l *SessionLogger, cc *clientConn, user string, since int64) *client {
 	d.Lock()
+	defer d.Unlock()
+
 	c, ok := d.clients[user]
 	if !ok {
-		c = &client{
-			conns:    make(map[*websocket.Conn]chan []*UnreadArticle),
-			messages: make(chan []*UnreadArticle),
-		}
+		c = newClient()
 		d.clients[user] = c
 	}
-	d.Unlock()
+	c.add(l, cc, since)
+	return c
+}
+
+// drop removes a closed connection. The client is kept so the user can resume, see sweep.
+func (d *dispatcher) drop(c *client, cc *clientConn) {
+	d.Lock()
+	defer d.Unlock()
+
+	c.Lock()
+	defer c.Unlock()
 
-	c.newBabysitter(l, conn, user)
+	delete(c.conns, cc)
+	if len(c.conns) == 0 {
+		c.left = time.Now()
+	}
 }
 
-// The feed updater keeps track of what users have new content, this then sends payloads to those users.
-func (d *dispatcher) BroadcastLatest(l *SessionLogger, updated map[string]bool) {
-	d.RLock()
-	defer d.RUnlock()
+// sweep removes any clients that have had no connections for too long to resume.
+func (d *dispatcher) sweep() {
+	d.Lock()
+	defer d.Unlock()
 
-	l.I.Printf("Update broadcast initiated.\n")
 	for user, c := range d.clients {
-		if !updated[user] {
-			l.I.Printf("No updates for user %v.\n", user)
-			continue
-		}
-		l.I.Printf("Broadcasting updates to user %v.\n", user)
-
-		unread := GetUnread(l, user)
-		if unread == nil {
-			continue
+		if c.idle() {
+			delete(d.clients, user)
 		}
+	}
+}
 
-		c.Broadcast(unread)
+// EventSweepJob clears out the clients of users that left and didn't come back.
+func EventSweepJob() {
+	for {
+		time.Sleep(EventLogWindow)
+		localEvents.sweep()
 	}
 }
 
-func (d *dispatcher) BroadcastTo(l *SessionLogger, user string) {
+// idle returns true if the client has had no connections for longer than EventLogWindow.
+func (c *client) idle() bool {
+	c.RLock()
+	defer c.RUnlock()
+
+	return len(c.conns) == 0 && time.Since(c.left) > EventLogWindow
+}
+
+// Connected reports if a user has a websocket or event stream open to this process, or closed one recently enough to
+// resume. Events have to be built for the latter too, or resuming would miss them.
+func (d *dispatcher) Connected(user string) bool {
 	d.RLock()
 	defer d.RUnlock()
 
 	c, ok := d.clients[user]
+	return ok && !c.idle()
+}
+
+// Send sends an event to every connection a user has open to this process. If the user has none it is only logged,
+// for when they resume.
+func (d *dispatcher) Send(l *SessionLogger, user, typ string, data interface{}) {
+	d.Lock()
+	c, ok := d.clients[user]
+	if ok && c.idle() {
+		delete(d.clients, user)
+		ok = false
+	}
+	d.Unlock()
 	if !ok {
 		return
 	}
 
-	l.I.Printf("Broadcasting special update to user %v.\n", user)
+	l.I.Printf("Sending %v to user %v.\n", typ, user)
+	c.Broadcast(l, NewEvent(typ, data))
+}
+
+// SendArticles sends an event with the given articles, as long as they are still unread.
+func (d *eventSender) SendArticles(l *SessionLogger, user, typ string, articles []string) {
+	if len(articles) == 0 || !d.Connected(user) {
+		return
+	}
+
+	unread := UnreadArticles(l, user, articles)
+	if len(unread) == 0 {
+		return
+	}
+	d.Send(l, user, typ, &ArticlesEvent{Articles: unread})
+}
+
+// SendFeedArticles sends the unread articles in a feed as an article.added.
+func (d *eventSender) SendFeedArticles(l *SessionLogger, user, feed string) {
+	if !d.Connected(user) {
+		return
+	}
 
-	unread := GetUnread(l, user)
-	if unread == nil {
+	unread := UnreadFeedArticles(l, user, feed, MaxEventArticles)
+	if len(unread) == 0 {
 		return
 	}
+	d.Send(l, user, "article.added", &ArticlesEvent{Articles: unread})
+}
+
+// SendFeed sends an event to every user subscribed to a feed.
+func (d *eventSender) SendFeed(l *SessionLogger, feed, typ string, data interface{}) {
+	users := FeedListSubs(l, feed)
+	for _, user := range users {
+		d.Send(l, user, typ, data)
+	}
+}
 
-	c.Broadcast(unread)
+// The feed updater keeps track of what articles are new for each user, this then sends them out.
+func (d *eventSender) SendAdded(l *SessionLogger, added map[string][]string) {
+	l.I.Printf("Update broadcast initiated.\n")
+	for user, articles := range added {
+		if len(articles) > MaxEventArticles {
+			articles = articles[len(articles)-MaxEventArticles:]
+		}
+		d.SendArticles(l, user, "article.added", articles)
+	}
 }
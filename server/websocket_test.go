@@ -0,0 +1,266 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "time"
+import "strings"
+import "testing"
+import "strconv"
+import "net/http"
+import "encoding/json"
+import "net/http/httptest"
+
+import "github.com/gorilla/websocket"
+
+type testEvent struct {
+	Version int
+	Seq     int64
+	Type    string
+	Data    json.RawMessage
+}
+
+// testEvents serves websockets for u1 from a dispatcher of its own, so nothing else sending events gets in the way.
+func testEvents(t *testing.T) (*dispatcher, func(since int64) *websocket.Conn) {
+	d := &dispatcher{clients: map[string]*client{}}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		since, _ := strconv.ParseInt(r.FormValue("since"), 10, 64)
+		d.Upgrade(ml, w, r, "u1", since, "")
+	}))
+	t.Cleanup(s.Close)
+
+	return d, func(since int64) *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/?since="+strconv.FormatInt(since, 10), nil)
+		if err != nil {
+			t.Fatalf("Websocket connection failed, error: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+}
+
+func testReadEvent(t *testing.T, conn *websocket.Conn, typ string) *testEvent {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	e := &testEvent{}
+	err := conn.ReadJSON(e)
+	if err != nil {
+		t.Fatalf("Reading event failed, error: %v", err)
+	}
+	if e.Type != typ || e.Version != ProtocolVersion {
+		t.Fatalf("Got %v event version %v, expected %v version %v", e.Type, e.Version, typ, ProtocolVersion)
+	}
+	return e
+}
+
+func TestEventResume(t *testing.T) {
+	testDB(t, func(t *testing.T) {
+		testUser(t, "u1", "one@example.com")
+		d, dial := testEvents(t)
+
+		conn := dial(0)
+		hello := testReadEvent(t, conn, "hello")
+
+		d.Send(ml, "u1", "article.read", &ArticleIDsEvent{Articles: []string{"a1"}})
+		d.Send(ml, "u1", "article.read", &ArticleIDsEvent{Articles: []string{"a2"}})
+		first := testReadEvent(t, conn, "article.read")
+		second := testReadEvent(t, conn, "article.read")
+		if first.Seq != hello.Seq+1 || second.Seq != hello.Seq+2 {
+			t.Fatalf("Got events %v and %v after hello %v", first.Seq, second.Seq, hello.Seq)
+		}
+		conn.Close()
+
+		testEventsLeft(t, d, "u1")
+
+		// Sent while nobody is listening, it still has to be there when the client comes back. That includes events
+		// that are only built for users that are connected.
+		d.Send(ml, "u1", "article.starred", &ArticleIDsEvent{Articles: []string{"a3"}})
+		feed := testFeed(t, "https://example.com/feed", "u1")
+		ids := testIngest(t, feed, testItem("https://example.com/1", "One", 1))
+		(&eventSender{Dispatcher: d}).SendArticles(ml, "u1", "article.added", ids)
+
+		conn = dial(first.Seq)
+		if e := testReadEvent(t, conn, "article.read"); e.Seq != second.Seq || string(e.Data) != `{"Articles":["a2"]}` {
+			t.Fatalf("Got event %v %s on resume, expected %v", e.Seq, e.Data, second.Seq)
+		}
+		if e := testReadEvent(t, conn, "article.starred"); e.Seq != second.Seq+1 {
+			t.Fatalf("Got event %v on resume, expected %v", e.Seq, second.Seq+1)
+		}
+		if e := testReadEvent(t, conn, "article.added"); e.Seq != second.Seq+2 || !strings.Contains(string(e.Data), ids[0]) {
+			t.Fatalf("Got event %v %s on resume, expected %v with %v", e.Seq, e.Data, second.Seq+2, ids[0])
+		}
+		conn.Close()
+
+		// Anything the server doesn't have gets a hello, whether it is too old or from the future.
+		for _, since := range []int64{1, hello.Seq + 100} {
+			conn = dial(since)
+			if e := testReadEvent(t, conn, "hello"); e.Seq != second.Seq+2 {
+				t.Fatalf("Got hello with Seq %v for since %v, expected %v", e.Seq, since, second.Seq+2)
+			}
+			conn.Close()
+		}
+
+		// Once it is too late to resume there is nobody to build events for.
+		testEventsLeft(t, d, "u1")
+		c := d.clients["u1"]
+		c.Lock()
+		c.left = time.Now().Add(-EventLogWindow - time.Minute)
+		c.Unlock()
+		if d.Connected("u1") {
+			t.Fatalf("User is connected after the resume window passed")
+		}
+	})
+}
+
+// testEventsLeft waits for the dispatcher to notice the user closed every connection.
+func testEventsLeft(t *testing.T, d *dispatcher, user string) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		d.RLock()
+		c := d.clients[user]
+		d.RUnlock()
+		c.RLock()
+		left := len(c.conns) == 0
+		c.RUnlock()
+		if left {
+			if !d.Connected(user) {
+				t.Fatalf("User is not connected right after leaving")
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Connections are still open")
+}
+
+func TestEventLog(t *testing.T) {
+	c := newClient()
+	start := c.seq
+	for i := 0; i < EventLogSize+5; i++ {
+		c.Broadcast(ml, NewEvent("article.read", &ArticleIDsEvent{}))
+	}
+	if len(c.log) != EventLogSize || c.log[0].Seq != start+6 {
+		t.Fatalf("Log has %v events starting at %v, expected %v starting at %v", len(c.log), c.log[0].Seq, EventLogSize, start+6)
+	}
+
+	// Clients too far behind to catch up from their queue get a hello, even if the log still has what they missed.
+	missed, ok := c.missed(c.seq - ConnQueueSize)
+	if !ok || len(missed) != ConnQueueSize || missed[0].Seq != c.seq-ConnQueueSize+1 {
+		t.Fatalf("Got %v missed events (%v), expected %v", len(missed), ok, ConnQueueSize)
+	}
+	if _, ok := c.missed(c.seq - ConnQueueSize - 1); ok {
+		t.Fatalf("Resumed with more events than fit in the queue")
+	}
+
+	// Old events go too, however few there are.
+	old := time.Now().Add(-EventLogWindow - time.Minute)
+	for _, e := range c.log {
+		e.sent = old
+	}
+	c.Broadcast(ml, NewEvent("article.read", &ArticleIDsEvent{}))
+	if len(c.log) != 1 {
+		t.Fatalf("Log has %v events after the window passed, expected 1", len(c.log))
+	}
+}
+
+func TestConnQueue(t *testing.T) {
+	fill := func(cc *clientConn) {
+		for i := 0; i < ConnQueueSize; i++ {
+			if !cc.push(NewEvent("article.read", &ArticleIDsEvent{})) {
+				t.Fatalf("Connection evicted after %v events", i)
+			}
+		}
+	}
+
+	// Overflowing throws the queue away for a hello.
+	cc := newClientConn(nil, ConnPingPeriod, "", nil)
+	fill(cc)
+	if !cc.push(NewEvent("article.read", &ArticleIDsEvent{})) {
+		t.Fatalf("Connection evicted on the first overflow")
+	}
+	pending, resync, _, evicted := cc.take()
+	if len(pending) != 0 || !resync || evicted {
+		t.Fatalf("Got %v pending, resync %v, evicted %v after overflowing", len(pending), resync, evicted)
+	}
+
+	// Overflowing again before that hello is sent means the connection isn't keeping up at all.
+	fill(cc)
+	cc.push(NewEvent("article.read", &ArticleIDsEvent{}))
+	fill(cc)
+	if cc.push(NewEvent("article.read", &ArticleIDsEvent{})) {
+		t.Fatalf("Connection not evicted after overflowing while waiting on a hello")
+	}
+	if _, _, _, evicted := cc.take(); !evicted {
+		t.Fatalf("Connection not marked as evicted")
+	}
+}
+
+func TestEventCommands(t *testing.T) {
+	testDB(t, func(t *testing.T) {
+		testUser(t, "u1", "one@example.com")
+		feed := testFeed(t, "https://example.com/feed", "u1")
+		ids := testIngest(t, feed, testItem("https://example.com/1", "One", 1), testItem("https://example.com/2", "Two", 2))
+		_, dial := testEvents(t)
+
+		conn := dial(0)
+		testReadEvent(t, conn, "hello")
+
+		send := func(cmd *Command) {
+			t.Helper()
+			err := conn.WriteJSON(cmd)
+			if err != nil {
+				t.Fatalf("Sending command failed, error: %v", err)
+			}
+		}
+		reply := func(cmd *Command, status int) {
+			t.Helper()
+			r := &CommandReply{}
+			err := json.Unmarshal(testReadEvent(t, conn, "reply").Data, r)
+			if err != nil || r.ID != cmd.ID || r.Status != status {
+				t.Fatalf("Got reply %+v for %v, expected status %v", r, cmd.Type, status)
+			}
+		}
+		command := func(cmd *Command, status int) {
+			t.Helper()
+			send(cmd)
+			reply(cmd, status)
+		}
+
+		command(&Command{ID: "1", Type: "article.read", Article: ids[0]}, http.StatusOK)
+		command(&Command{ID: "2", Type: "article.star", Article: ids[1]}, http.StatusOK)
+		command(&Command{ID: "3", Type: "article.read"}, http.StatusBadRequest)
+		command(&Command{ID: "4", Type: "nonsense"}, http.StatusBadRequest)
+		if unread := testUnread(t, "u1"); len(unread) != 1 || unread[0].ID != ids[1] {
+			t.Fatalf("Got %v unread articles after commands, expected only the second", len(unread))
+		}
+
+		// Changing the view starts over with a hello for it.
+		view := &Command{ID: "5", Type: "view", Folder: "Nothing here"}
+		send(view)
+		hello := &UnreadPage{}
+		err := json.Unmarshal(testReadEvent(t, conn, "hello").Data, hello)
+		if err != nil || len(hello.Articles) != 0 {
+			t.Fatalf("Got %v articles in an empty folder, error: %v", len(hello.Articles), err)
+		}
+		reply(view, http.StatusOK)
+	})
+}
@@ -0,0 +1,473 @@
+/*
+Copyright 2020-2021 by Milo Christiansen
+
+This software is provided 'as-is', without any express or implied warranty. In
+no event will the authors be held liable for any damages arising from the use of
+this software.
+
+Permission is granted to anyone to use this software for any purpose, including
+commercial applications, and to alter it and redistribute it freely, subject to
+the following restrictions:
+
+1. The origin of this software must not be misrepresented; you must not claim
+that you wrote the original software. If you use this software in a product, an
+acknowledgment in the product documentation would be appreciated but is not
+required.
+
+2. Altered source versions must be plainly marked as such, and must not be
+misrepresented as being the original software.
+
+3. This notice may not be removed or altered from any source distribution.
+*/
+
+package main
+
+import "io"
+import "hash"
+import "time"
+import "bytes"
+import "strconv"
+import "strings"
+import "net/url"
+import "net/http"
+import "io/ioutil"
+import "crypto/hmac"
+import "crypto/rand"
+import "crypto/sha1"
+import "crypto/sha256"
+import "crypto/sha512"
+import "database/sql"
+import "encoding/hex"
+import "encoding/xml"
+import "encoding/json"
+
+// WebSub (https://www.w3.org/TR/websub/) lets the hub for a feed push new items to us as soon as they are published.
+// Subscriptions are made the first time the background process sees a hub advertised in a feed, and pushed content goes
+// through FeedIngest just like polled content. The hub needs to reach us, so this only happens when RSN2_DOMAIN is set.
+
+// What we ask the hub for, it is free to pick something else.
+const WebSubLease = 10 * 24 * time.Hour
+
+// Leases are renewed once they have less than this left.
+const WebSubRenew = 24 * time.Hour
+
+// How long to wait on a request before trying it again. This is also how long a refusal from the hub sticks.
+const WebSubRetry = time.Hour
+
+// Push feeds are still polled this often, in case the hub misses something.
+const WebSubPoll = 6 * time.Hour
+
+var webSubClient = &http.Client{Timeout: 15 * time.Second}
+
+type webSub struct {
+	Feed      string
+	Hub       string
+	Topic     string
+	Token     string
+	Secret    string
+	State     string
+	Expires   int64
+	Requested int64
+}
+
+func webSubScan(row *sql.Row) (*webSub, error) {
+	s := &webSub{}
+	err := row.Scan(&s.Feed, &s.Hub, &s.Topic, &s.Token, &s.Secret, &s.State, &s.Expires, &s.Requested)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func webSubSave(l *SessionLogger, s *webSub) bool {
+	_, err := Queries["WebSubSet"].Preped.Exec(s.Feed, s.Hub, s.Topic, s.Token, s.Secret, s.State, s.Expires, s.Requested)
+	if err != nil {
+		l.E.Printf("Cannot save WebSub state for feed %v, error: %v\n", s.Feed, err)
+		return false
+	}
+	return true
+}
+
+func webSubCallback(s *webSub) string {
+	return Domain + "/websub/" + s.Token
+}
+
+// WebSubPollSkip returns the feeds with a working push subscription that have been polled recently enough.
+func WebSubPollSkip(l *SessionLogger) map[string]bool {
+	skip := map[string]bool{}
+
+	now := time.Now()
+	rows, err := Queries["WebSubPollSkip"].Preped.Query(now.Unix(), now.Add(-WebSubPoll).Unix())
+	if err != nil {
+		l.E.Printf("Cannot list push feeds, error: %v\n", err)
+		return skip
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		feed := ""
+		err := rows.Scan(&feed)
+		if err != nil {
+			l.E.Printf("Cannot list push feeds, error: %v\n", err)
+			return skip
+		}
+		skip[feed] = true
+	}
+	return skip
+}
+
+// WebSubCheck looks at a freshly fetched feed and subscribes, renews, or unsubscribes as needed.
+func WebSubCheck(l *SessionLogger, feed, feedurl string, res *FetchResult) {
+	if Domain == "" {
+		return
+	}
+
+	hub, topic := webSubDiscover(res)
+	if topic == "" {
+		topic = feedurl
+	}
+
+	s, err := webSubScan(Queries["WebSubGet"].Preped.QueryRow(feed))
+	if err != nil {
+		l.E.Printf("Cannot read WebSub state for feed %v, error: %v\n", feed, err)
+		return
+	}
+
+	now := time.Now()
+	stale := s != nil && now.Sub(time.Unix(s.Requested, 0)) > WebSubRetry
+
+	if hub == "" {
+		// The feed stopped advertising a hub, so stop using it. If the hub never confirms we give up on it.
+		switch {
+		case s == nil:
+		case s.State == "active":
+			s.State, s.Requested = "unsubscribing", now.Unix()
+			if webSubSave(l, s) {
+				go webSubRequest(l, s, "unsubscribe")
+			}
+		case s.State != "unsubscribing" || stale:
+			_, err := Queries["WebSubDelete"].Preped.Exec(feed)
+			if err != nil {
+				l.E.Printf("Cannot delete WebSub state for feed %v, error: %v\n", feed, err)
+			}
+		}
+		return
+	}
+
+	switch {
+	case s == nil || s.Hub != hub || s.Topic != topic:
+		// New subscription, or the feed moved to a different hub. Either way anything the old hub sends will be for a
+		// token we don't know any more.
+		s = &webSub{Feed: feed, Hub: hub, Topic: topic, State: "pending"}
+		s.Token, s.Secret = webSubToken(), webSubToken()
+		if s.Token == "" || s.Secret == "" {
+			l.E.Printf("Cannot generate WebSub secrets for feed %v.\n", feed)
+			return
+		}
+	case !stale:
+		return
+	case s.State == "active" && time.Unix(s.Expires, 0).Sub(now) < WebSubRenew:
+		// Renewal, keeps the same token and secret so nothing in flight gets lost.
+	case s.State != "active":
+		// Never verified, refused, or stuck unsubscribing while the feed still has a hub. Try again.
+		s.State = "pending"
+	default:
+		return
+	}
+
+	s.Requested = now.Unix()
+	if webSubSave(l, s) {
+		go webSubRequest(l, s, "subscribe")
+	}
+}
+
+func webSubToken() string {
+	b := make([]byte, 20)
+	_, err := rand.Read(b)
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// webSubRequest asks the hub to (un)subscribe us. The hub confirms by calling the callback, so all we do with the answer
+// is log it.
+func webSubRequest(l *SessionLogger, s *webSub, mode string) {
+	form := url.Values{
+		"hub.mode":     {mode},
+		"hub.topic":    {s.Topic},
+		"hub.callback": {webSubCallback(s)},
+	}
+	if mode == "subscribe" {
+		form.Set("hub.secret", s.Secret)
+		form.Set("hub.lease_seconds", strconv.Itoa(int(WebSubLease/time.Second)))
+	}
+
+	resp, err := webSubClient.PostForm(s.Hub, form)
+	if err != nil {
+		l.W.Printf("WebSub %v request for feed %v to %v failed, error: %v\n", mode, s.Feed, s.Hub, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		l.W.Printf("WebSub %v request for feed %v to %v refused: %v %s\n", mode, s.Feed, s.Hub, resp.Status, msg)
+		return
+	}
+	l.I.Printf("WebSub %v request for feed %v sent to %v.\n", mode, s.Feed, s.Hub)
+}
+
+// webSubDiscover finds the hub and topic URLs for a feed. Link headers take priority over the document.
+func webSubDiscover(res *FetchResult) (hub, self string) {
+	resolve := func(link string) string {
+		u, err := res.URL.Parse(strings.TrimSpace(link))
+		if err != nil {
+			return ""
+		}
+		return u.String()
+	}
+
+	for _, header := range res.Header["Link"] {
+		for _, link := range strings.Split(header, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, param := range parts[1:] {
+				kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+				if len(kv) != 2 || strings.ToLower(kv[0]) != "rel" {
+					continue
+				}
+				for _, rel := range strings.Fields(strings.ToLower(strings.Trim(kv[1], `"`))) {
+					if rel == "hub" && hub == "" {
+						hub = resolve(target[1 : len(target)-1])
+					}
+					if rel == "self" && self == "" {
+						self = resolve(target[1 : len(target)-1])
+					}
+				}
+			}
+		}
+	}
+	if hub != "" {
+		return hub, self
+	}
+
+	body := bytes.TrimLeft(res.Body, " \t\r\n")
+	if len(body) > 0 && body[0] == '{' {
+		jf := &jsonFeed{}
+		if json.Unmarshal(body, jf) != nil {
+			return "", ""
+		}
+		for _, h := range jf.Hubs {
+			if strings.EqualFold(h.Type, "WebSub") && h.URL != "" {
+				return resolve(h.URL), resolve(jf.FeedURL)
+			}
+		}
+		return "", ""
+	}
+
+	// Only the feed level links matter, so stop at the first item.
+	d := xml.NewDecoder(bytes.NewReader(body))
+	d.Strict = false
+	for {
+		t, err := d.RawToken()
+		if err != nil {
+			break
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		name := strings.ToLower(se.Name.Local)
+		if name == "item" || name == "entry" {
+			break
+		}
+		if name != "link" {
+			continue
+		}
+
+		rel, href := "", ""
+		for _, a := range se.Attr {
+			switch strings.ToLower(a.Name.Local) {
+			case "rel":
+				rel = strings.ToLower(a.Value)
+			case "href":
+				href = a.Value
+			}
+		}
+		if href == "" {
+			continue
+		}
+		for _, r := range strings.Fields(rel) {
+			if r == "hub" && hub == "" {
+				hub = resolve(href)
+			}
+			if r == "self" && self == "" {
+				self = resolve(href)
+			}
+		}
+	}
+	if hub == "" {
+		return "", ""
+	}
+	return hub, self
+}
+
+// /websub/
+// =====================================================================================================================
+
+func WebSubHandler(w http.ResponseWriter, r *http.Request) {
+	l := newSessionLogger("/websub/")
+
+	token := strings.TrimPrefix(r.URL.Path, "/websub/")
+	s, err := webSubScan(Queries["WebSubByToken"].Preped.QueryRow(token))
+	if err != nil {
+		l.E.Printf("Cannot read WebSub state, error: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if s == nil {
+		l.W.Printf("WebSub callback for unknown token.\n")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		webSubVerify(l, w, r, s)
+	case "POST":
+		webSubDeliver(l, w, r, s)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// webSubVerify answers the hub's intent verification, and its notice if it refused us.
+func webSubVerify(l *SessionLogger, w http.ResponseWriter, r *http.Request, s *webSub) {
+	mode := r.FormValue("hub.mode")
+	if mode != "denied" && r.FormValue("hub.topic") != s.Topic {
+		l.W.Printf("WebSub %v verification for feed %v has the wrong topic.\n", mode, s.Feed)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch mode {
+	case "subscribe":
+		if s.State == "unsubscribing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		lease, err := strconv.ParseInt(r.FormValue("hub.lease_seconds"), 10, 64)
+		if err != nil || lease <= 0 {
+			lease = int64(WebSubLease / time.Second)
+		}
+		s.State, s.Expires = "active", time.Now().Unix()+lease
+		if !webSubSave(l, s) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		l.I.Printf("WebSub subscription for feed %v active for %v seconds.\n", s.Feed, lease)
+	case "unsubscribe":
+		if s.State != "unsubscribing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, err := Queries["WebSubDelete"].Preped.Exec(s.Feed)
+		if err != nil {
+			l.E.Printf("Cannot delete WebSub state for feed %v, error: %v\n", s.Feed, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		l.I.Printf("WebSub subscription for feed %v removed.\n", s.Feed)
+	case "denied":
+		l.W.Printf("WebSub hub refused feed %v: %v\n", s.Feed, r.FormValue("hub.reason"))
+		s.State = "denied"
+		webSubSave(l, s)
+		w.WriteHeader(http.StatusOK)
+		return
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Write([]byte(r.FormValue("hub.challenge")))
+}
+
+// webSubDeliver takes new content from the hub. Anything we can't verify is acknowledged and then dropped, as the spec
+// asks, so the hub doesn't keep retrying it.
+func webSubDeliver(l *SessionLogger, w http.ResponseWriter, r *http.Request, s *webSub) {
+	r.Body = http.MaxBytesReader(w, r.Body, MaxFeedBytes)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		l.W.Printf("Error reading WebSub content for feed %v, error: %v\n", s.Feed, err)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if s.State != "active" {
+		l.W.Printf("WebSub content for feed %v without an active subscription.\n", s.Feed)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if !webSubSigned(r.Header.Get("X-Hub-Signature"), s.Secret, body) {
+		l.W.Printf("WebSub content for feed %v has a bad signature.\n", s.Feed)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	res, err := FetchPrepare(body, r.Header, r.URL, MaxFeedBytes)
+	if err != nil {
+		l.W.Printf("Error decoding WebSub content for feed %v, error: %v\n", s.Feed, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f, err := FeedParse(res)
+	if err != nil {
+		l.W.Printf("Error parsing WebSub content for feed %v, error: %v\n", s.Feed, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	updated := map[string][]string{}
+	FeedIngest(l, s.Feed, f, time.Now().Unix(), updated)
+	if len(updated) > 0 {
+		Feeds.SendAdded(l, updated)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// webSubSigned checks an X-Hub-Signature header, which is "method=hexdigest".
+func webSubSigned(header, secret string, body []byte) bool {
+	parts := strings.SplitN(header, "=", 2)
+	if len(parts) != 2 {
+		return false
+	}
+
+	var h func() hash.Hash
+	switch strings.ToLower(parts[0]) {
+	case "sha1":
+		h = sha1.New
+	case "sha256":
+		h = sha256.New
+	case "sha384":
+		h = sha512.New384
+	case "sha512":
+		h = sha512.New
+	default:
+		return false
+	}
+
+	sig, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(h, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), sig)
+}